@@ -0,0 +1,26 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package bprovider
+
+//Providers that keep blocks in numbered files address them by packing the
+//index of the file above the offset of the block in it. The offset has the
+//low ADDRESSOFFSETBITS bits and the file index the rest
+const ADDRESSOFFSETBITS = 50
+
+//The bits of an address holding the offset
+const ADDRESSOFFSETMASK = 1<<ADDRESSOFFSETBITS - 1
+
+//Returns the address of the block at the given offset in the given file. The
+//offset must be below 1<<ADDRESSOFFSETBITS
+func EncodeAddress(fidx int, offset int64) uint64 {
+	return uint64(fidx)<<ADDRESSOFFSETBITS | uint64(offset)
+}
+
+//Returns the file index and offset packed into an address by EncodeAddress
+func DecodeAddress(addr uint64) (fidx int, offset int64) {
+	return int(addr >> ADDRESSOFFSETBITS), int64(addr & ADDRESSOFFSETMASK)
+}
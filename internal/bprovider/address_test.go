@@ -0,0 +1,53 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package bprovider
+
+import "testing"
+
+func TestAddressRoundTrip(t *testing.T) {
+	maxoff := int64(ADDRESSOFFSETMASK)
+	maxfidx := 1<<(64-ADDRESSOFFSETBITS) - 1
+	fidxs := []int{0, 1, 2, 0xFF, 1<<(64-ADDRESSOFFSETBITS-1) - 1, 1 << (64 - ADDRESSOFFSETBITS - 1), maxfidx - 1, maxfidx}
+	offs := []int64{0, 1, 8, 1<<32 - 1, 1 << 32, maxoff >> 1, maxoff/2 + 1, maxoff - 1, maxoff}
+	for _, fidx := range fidxs {
+		for _, off := range offs {
+			addr := EncodeAddress(fidx, off)
+			gfidx, goff := DecodeAddress(addr)
+			if gfidx != fidx || goff != off {
+				t.Fatalf("%d/%x encoded as %x decoded as %d/%x", fidx, off, addr, gfidx, goff)
+			}
+		}
+	}
+}
+
+func TestAddressBoundaryBits(t *testing.T) {
+	//Every bit of the offset stays in the offset, and every bit of the
+	//file index in the file index
+	for bit := uint(0); bit < 64; bit++ {
+		addr := uint64(1) << bit
+		fidx, off := DecodeAddress(addr)
+		if bit < ADDRESSOFFSETBITS {
+			if fidx != 0 || off != int64(addr) {
+				t.Fatalf("bit %d decoded as file %d offset %x", bit, fidx, off)
+			}
+		} else if off != 0 || fidx != 1<<(bit-ADDRESSOFFSETBITS) {
+			t.Fatalf("bit %d decoded as file %d offset %x", bit, fidx, off)
+		}
+		if EncodeAddress(fidx, off) != addr {
+			t.Fatalf("bit %d did not encode back to itself", bit)
+		}
+	}
+	if EncodeAddress(1, 0) != EncodeAddress(0, ADDRESSOFFSETMASK)+1 {
+		t.Fatalf("the first address of a file does not follow the last of the previous one")
+	}
+	if fidx, off := DecodeAddress(ADDRESSOFFSETMASK); fidx != 0 || off != ADDRESSOFFSETMASK {
+		t.Fatalf("the last offset of file zero decoded as file %d offset %x", fidx, off)
+	}
+	if fidx, off := DecodeAddress(^uint64(0)); fidx != 1<<(64-ADDRESSOFFSETBITS)-1 || off != ADDRESSOFFSETMASK {
+		t.Fatalf("the highest address decoded as file %d offset %x", fidx, off)
+	}
+}
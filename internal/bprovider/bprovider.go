@@ -25,6 +25,7 @@ package bprovider
 import (
 	"context"
 	"errors"
+	"fmt"
 
 	"github.com/BTrDB/btrdb-server/internal/configprovider"
 	"github.com/BTrDB/btrdb-server/internal/rez"
@@ -34,6 +35,43 @@ var ErrNoSpace = errors.New("No more space")
 var ErrInvalidArgument = errors.New("Invalid argument")
 var ErrExists = errors.New("File exists")
 var ErrAnnotationTooBig = errors.New("Annotation too big")
+var ErrCorrupt = errors.New("Corrupt block")
+
+//Returned by reads of a block that was never completely written, such as one
+//torn by a crash, where the format can tell (see FormatSentinel)
+var ErrIncompleteBlock = errors.New("Incomplete block")
+
+//Address zero never refers to a block, it is used to mean "no block"
+var ErrNoBlock = errors.New("No block at address zero")
+
+//Returned by writes to a provider that is not accepting them, such as a standby
+var ErrReadOnly = errors.New("Read only")
+
+//Returned when starting a provider on storage where no database was created
+var ErrDatabaseNotInitialized = errors.New("Database not initialized")
+
+//Returned by reads of superblocks of versions above the stream's current
+//version, which a rollback has made invalid
+var ErrVersionRolledBack = errors.New("Version rolled back")
+
+//Returned by reads into a buffer too small for the block. Need is the size
+//the buffer must be
+type ErrBufferTooSmall struct {
+	Need int
+}
+
+func (e ErrBufferTooSmall) Error() string {
+	return fmt.Sprintf("Buffer too small, need %d bytes", e.Need)
+}
+
+//The catalog entry for a stream, for providers that keep their own stream
+//metadata
+type Stream struct {
+	UUID       []byte
+	Collection string
+	Tags       map[string]string
+	Annotation []byte
+}
 
 const SpecialVersionCreated = 9
 const SpecialVersionFirst = 10
@@ -44,8 +82,8 @@ type Segment interface {
 	BaseAddress() uint64
 
 	//Unlocks the segment for the StorageProvider to give to other consumers
-	//Implies a flush
-	Unlock()
+	//Implies a flush. Returns an error if any of the writes failed
+	Unlock() error
 
 	//Writes a slice to the segment, returns immediately
 	//Returns nil if op is OK, otherwise ErrNoSpace or ErrInvalidArgument
@@ -54,7 +92,8 @@ type Segment interface {
 	Write(uuid []byte, address uint64, data []byte) (uint64, error)
 
 	//Block until all writes are complete. Note this does not imply a flush of the underlying files.
-	Flush()
+	//The segment remains usable afterwards. Returns an error if any of the writes failed
+	Flush() error
 }
 
 type StorageProvider interface {
@@ -0,0 +1,566 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package bprovidertest is a conformance suite for storage providers, so
+//that every backend is checked against the same expectations.
+//
+//The mandatory cases cover what bstore relies on: writing blocks through
+//locked segments, flushing them and reading them back, the addresses
+//segments hand out, superblocks and stream versions. A backend must pass all
+//of them. The rest are optional, so that a partial backend can opt in as it
+//grows:
+//
+//  - The Obliterate and BackgroundCleanup cases only run if they are named
+//    when the suite is run, so running it with -v lists what a backend has
+//    not opted in to yet
+//  - The stream catalog cases only run if the provider implements Catalog
+//
+//A panic in the provider always fails the case, naming the method.
+package bprovidertest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//The stream catalog, which providers that keep their own stream metadata
+//implement
+type Catalog interface {
+	CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE
+	GetStreamInfo(uuid []byte) (bprovider.Stream, uint64)
+	ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE)
+	ListCollections(prefix string, startingFrom string, number int64) ([]string, bte.BTE)
+}
+
+//The methods the suite exercises, in the shape of the file provider's. The
+//adapter presents a StorageProvider this way
+type provider interface {
+	LockSegment(uuid []byte) bprovider.Segment
+	Read(uuid []byte, address uint64, buffer []byte) ([]byte, error)
+	ReadSuperBlock(uuid []byte, version uint64, buffer []byte) ([]byte, error)
+	WriteSuperBlock(uuid []byte, version uint64, buffer []byte)
+	SetStreamVersion(uuid []byte, version uint64)
+	GetStreamVersion(uuid []byte) uint64
+	Catalog
+}
+
+const (
+	mandatory = iota
+	//Only run if the backend opts in to it by name
+	optional
+	//Only run for providers implementing Catalog
+	catalog
+)
+
+var cases = []struct {
+	name string
+	kind int
+	run  func(t *testing.T, p provider)
+}{
+	{"WriteRead", mandatory, testWriteRead},
+	{"AddressOrder", mandatory, testAddressOrder},
+	{"AddressZero", mandatory, testAddressZero},
+	{"BadAddress", mandatory, testBadAddress},
+	{"SmallBuffer", mandatory, testSmallBuffer},
+	{"ConcurrentSegments", mandatory, testConcurrentSegments},
+	{"SuperBlocks", mandatory, testSuperBlocks},
+	{"StreamVersions", mandatory, testStreamVersions},
+	{"Flush", mandatory, testFlush},
+	{"Obliterate", optional, testObliterate},
+	{"BackgroundCleanup", optional, testBackgroundCleanup},
+	{"Streams", catalog, testStreams},
+	{"ListCollections", catalog, testListCollections},
+}
+
+//Run each case of the suite as a subtest against a fresh provider from
+//factory, which must be ready to use (created and initialized). Of the
+//optional cases, only those named in optin are run. A panic in a method of
+//the provider fails the case, naming the method
+func RunConformance(t *testing.T, factory func() bprovider.StorageProvider, optin ...string) {
+	opted := make(map[string]bool)
+	for _, name := range optin {
+		opted[name] = true
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			if c.kind == optional && !opted[c.name] {
+				t.Skip("provider has not opted in to this case")
+			}
+			sp := factory()
+			cat, ok := sp.(Catalog)
+			if c.kind == catalog && !ok {
+				t.Skip("provider does not implement Catalog")
+			}
+			p := &adapter{sp: sp, cat: cat}
+			runCase(t, func() { c.run(t, p) }, func() string { return p.calling })
+		})
+	}
+}
+
+//Call fn, turning a panic into a failure. calling gives the method that was
+//running, if known
+func runCase(t *testing.T, fn func(), calling func() string) {
+	panicked := true
+	var r interface{}
+	func() {
+		defer func() { r = recover() }()
+		fn()
+		panicked = false
+	}()
+	if !panicked {
+		return
+	}
+	msg := fmt.Sprintf("panics: %v", r)
+	if name := calling(); name != "" {
+		msg = name + " " + msg
+	}
+	t.Fatal(msg)
+}
+
+//Presents a StorageProvider as a provider, recording which of its methods
+//is being called
+type adapter struct {
+	sp      bprovider.StorageProvider
+	cat     Catalog
+	calling string
+}
+
+type adapterSegment struct {
+	bprovider.Segment
+	a *adapter
+}
+
+//Record that the named method is running. The returned function, deferred
+//by the method, clears it again unless the method panicked
+func (a *adapter) call(name string) func() {
+	a.calling = name
+	return func() {
+		if r := recover(); r != nil {
+			panic(r)
+		}
+		a.calling = ""
+	}
+}
+
+func (a *adapter) LockSegment(uuid []byte) bprovider.Segment {
+	defer a.call("LockCoreSegment")()
+	return &adapterSegment{a.sp.LockCoreSegment(uuid), a}
+}
+
+func (s *adapterSegment) BaseAddress() uint64 {
+	defer s.a.call("Segment.BaseAddress")()
+	return s.Segment.BaseAddress()
+}
+
+func (s *adapterSegment) Write(uuid []byte, address uint64, data []byte) (uint64, error) {
+	defer s.a.call("Segment.Write")()
+	return s.Segment.Write(uuid, address, data)
+}
+
+func (s *adapterSegment) Flush() error {
+	defer s.a.call("Segment.Flush")()
+	return s.Segment.Flush()
+}
+
+func (s *adapterSegment) Unlock() error {
+	defer s.a.call("Segment.Unlock")()
+	return s.Segment.Unlock()
+}
+
+func (a *adapter) Read(uuid []byte, address uint64, buffer []byte) ([]byte, error) {
+	defer a.call("Read")()
+	return a.sp.Read(context.Background(), uuid, address, buffer)
+}
+
+func (a *adapter) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) ([]byte, error) {
+	defer a.call("ReadSuperBlock")()
+	return a.sp.ReadSuperBlock(context.Background(), uuid, version, buffer)
+}
+
+func (a *adapter) WriteSuperBlock(uuid []byte, version uint64, buffer []byte) {
+	defer a.call("WriteSuperBlock")()
+	a.sp.WriteSuperBlock(uuid, version, buffer)
+}
+
+func (a *adapter) SetStreamVersion(uuid []byte, version uint64) {
+	defer a.call("SetStreamVersion")()
+	a.sp.SetStreamVersion(uuid, version)
+}
+
+func (a *adapter) GetStreamVersion(uuid []byte) uint64 {
+	defer a.call("GetStreamVersion")()
+	v, err := a.sp.GetStreamVersion(context.Background(), uuid)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+func (a *adapter) ObliterateStreamMetadata(uuid []byte) {
+	defer a.call("ObliterateStreamMetadata")()
+	a.sp.ObliterateStreamMetadata(uuid)
+}
+
+func (a *adapter) BackgroundCleanup(uuids [][]byte) error {
+	defer a.call("BackgroundCleanup")()
+	return a.sp.BackgroundCleanup(uuids)
+}
+
+func (a *adapter) CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE {
+	defer a.call("CreateStream")()
+	return a.cat.CreateStream(uuid, collection, tags, annotation)
+}
+
+func (a *adapter) GetStreamInfo(uuid []byte) (bprovider.Stream, uint64) {
+	defer a.call("GetStreamInfo")()
+	return a.cat.GetStreamInfo(uuid)
+}
+
+func (a *adapter) ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
+	defer a.call("ListStreams")()
+	return a.cat.ListStreams(collection, partial, tags)
+}
+
+func (a *adapter) ListCollections(prefix string, startingFrom string, number int64) ([]string, bte.BTE) {
+	defer a.call("ListCollections")()
+	return a.cat.ListCollections(prefix, startingFrom, number)
+}
+
+func mkUUID(n byte) []byte {
+	return []byte{n, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+}
+
+func mkData(rnd *rand.Rand, n int) []byte {
+	rv := make([]byte, n)
+	rnd.Read(rv)
+	return rv
+}
+
+//Write the blocks through one segment, returning their addresses
+func writeBlocks(t *testing.T, p provider, uuid []byte, blocks [][]byte) []uint64 {
+	seg := p.LockSegment(uuid)
+	addr := seg.BaseAddress()
+	if addr == 0 {
+		t.Fatalf("segment has base address zero")
+	}
+	rv := make([]uint64, len(blocks))
+	for i, b := range blocks {
+		rv[i] = addr
+		next, err := seg.Write(uuid, addr, b)
+		if err != nil {
+			t.Fatalf("write of block %d: %v", i, err)
+		}
+		if next <= addr {
+			t.Fatalf("write of block %d: next address %x not after %x", i, next, addr)
+		}
+		addr = next
+	}
+	//Unlock implies a flush
+	if err := seg.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	return rv
+}
+
+func testWriteRead(t *testing.T, p provider) {
+	rnd := rand.New(rand.NewSource(1))
+	uuid := mkUUID(1)
+	blocks := [][]byte{mkData(rnd, 1), mkData(rnd, 100), mkData(rnd, 4000), mkData(rnd, 30000)}
+	addrs := writeBlocks(t, p, uuid, blocks)
+	for i, addr := range addrs {
+		rv, err := p.Read(uuid, addr, make([]byte, 40000))
+		if err != nil {
+			t.Fatalf("read of block %d at %x: %v", i, addr, err)
+		}
+		if !bytes.Equal(rv, blocks[i]) {
+			t.Fatalf("block %d read back differently", i)
+		}
+	}
+	//A second segment gets its own addresses
+	more := writeBlocks(t, p, uuid, [][]byte{blocks[0]})
+	for _, addr := range addrs {
+		if addr == more[0] {
+			t.Fatalf("address %x handed out twice", addr)
+		}
+	}
+}
+
+func testAddressZero(t *testing.T, p provider) {
+	if _, err := p.Read(mkUUID(1), 0, make([]byte, 100)); err != bprovider.ErrNoBlock {
+		t.Fatalf("read of address zero gave %v, expected ErrNoBlock", err)
+	}
+}
+
+func testBadAddress(t *testing.T, p provider) {
+	//No provider has this many files
+	if _, err := p.Read(mkUUID(1), 0x3FFF<<50|8, make([]byte, 100)); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("read of a missing file gave %v, expected ErrInvalidArgument", err)
+	}
+}
+
+func testSmallBuffer(t *testing.T, p provider) {
+	rnd := rand.New(rand.NewSource(2))
+	uuid := mkUUID(1)
+	data := mkData(rnd, 1000)
+	addrs := writeBlocks(t, p, uuid, [][]byte{data})
+	_, err := p.Read(uuid, addrs[0], make([]byte, 100))
+	tooSmall, ok := err.(bprovider.ErrBufferTooSmall)
+	if !ok {
+		t.Fatalf("read into a small buffer gave %v, expected ErrBufferTooSmall", err)
+	}
+	rv, err := p.Read(uuid, addrs[0], make([]byte, tooSmall.Need))
+	if err != nil {
+		t.Fatalf("read into a buffer of %d bytes: %v", tooSmall.Need, err)
+	}
+	if !bytes.Equal(rv, data) {
+		t.Fatalf("block read back differently")
+	}
+}
+
+func testConcurrentSegments(t *testing.T, p provider) {
+	a := p.LockSegment(mkUUID(1))
+	b := p.LockSegment(mkUUID(2))
+	if a.BaseAddress()>>50 == b.BaseAddress()>>50 {
+		t.Fatalf("two locked segments share file %d", a.BaseAddress()>>50)
+	}
+	na, err := a.Write(mkUUID(1), a.BaseAddress(), []byte("first"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := b.Write(mkUUID(2), b.BaseAddress(), []byte("second")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := a.Write(mkUUID(1), na, []byte("third")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := a.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	if err := b.Unlock(); err != nil {
+		t.Fatalf("unlock: %v", err)
+	}
+	for addr, want := range map[uint64]string{a.BaseAddress(): "first", b.BaseAddress(): "second", na: "third"} {
+		rv, err := p.Read(nil, addr, make([]byte, 100))
+		if err != nil || string(rv) != want {
+			t.Fatalf("read at %x gave %q, %v, expected %q", addr, rv, err, want)
+		}
+	}
+}
+
+func testSuperBlocks(t *testing.T, p provider) {
+	uuid := mkUUID(1)
+	buf := make([]byte, 100)
+	if rv, err := p.ReadSuperBlock(uuid, 10, buf); rv != nil || err != nil {
+		t.Fatalf("read of a missing superblock gave %v, %v, expected nil", rv, err)
+	}
+	p.WriteSuperBlock(uuid, 10, []byte("version ten"))
+	p.WriteSuperBlock(uuid, 11, []byte("version eleven"))
+	p.WriteSuperBlock(mkUUID(2), 10, []byte("other stream"))
+	for ver, want := range map[uint64]string{10: "version ten", 11: "version eleven"} {
+		rv, err := p.ReadSuperBlock(uuid, ver, buf)
+		if err != nil || string(rv) != want {
+			t.Fatalf("read of version %d gave %q, %v, expected %q", ver, rv, err, want)
+		}
+	}
+	if _, err := p.ReadSuperBlock(uuid, 11, make([]byte, 4)); err != (bprovider.ErrBufferTooSmall{Need: 14}) {
+		t.Fatalf("read into a small buffer gave %v, expected ErrBufferTooSmall", err)
+	}
+	//Superblocks may be rewritten, e.g. after a rollback
+	p.WriteSuperBlock(uuid, 11, []byte("again"))
+	if rv, err := p.ReadSuperBlock(uuid, 11, buf); err != nil || string(rv) != "again" {
+		t.Fatalf("read of rewritten version gave %q, %v", rv, err)
+	}
+}
+
+func testStreamVersions(t *testing.T, p provider) {
+	uuid := mkUUID(1)
+	if v := p.GetStreamVersion(uuid); v != 0 {
+		t.Fatalf("version of a new stream is %d, expected 0", v)
+	}
+	p.SetStreamVersion(uuid, 12)
+	p.SetStreamVersion(mkUUID(2), 20)
+	if v := p.GetStreamVersion(uuid); v != 12 {
+		t.Fatalf("version is %d, expected 12", v)
+	}
+	//Rollback
+	p.SetStreamVersion(uuid, 11)
+	if v := p.GetStreamVersion(uuid); v != 11 {
+		t.Fatalf("version after rollback is %d, expected 11", v)
+	}
+	if v := p.GetStreamVersion(mkUUID(2)); v != 20 {
+		t.Fatalf("version of other stream is %d, expected 20", v)
+	}
+}
+
+func testAddressOrder(t *testing.T, p provider) {
+	rnd := rand.New(rand.NewSource(3))
+	seen := make(map[uint64]bool)
+	var blocks [][]byte
+	var addrs []uint64
+	for s := 0; s < 5; s++ {
+		var segblocks [][]byte
+		for i := 0; i < 20; i++ {
+			segblocks = append(segblocks, mkData(rnd, 1+rnd.Intn(5000)))
+		}
+		//writeBlocks checks that the addresses increase within the segment
+		for i, addr := range writeBlocks(t, p, mkUUID(byte(s)), segblocks) {
+			if seen[addr] {
+				t.Fatalf("address %x handed out twice", addr)
+			}
+			seen[addr] = true
+			addrs = append(addrs, addr)
+			blocks = append(blocks, segblocks[i])
+		}
+	}
+	for i, addr := range addrs {
+		rv, err := p.Read(nil, addr, make([]byte, 6000))
+		if err != nil || !bytes.Equal(rv, blocks[i]) {
+			t.Fatalf("block at %x did not read back: %v", addr, err)
+		}
+	}
+}
+
+func testFlush(t *testing.T, p provider) {
+	uuid := mkUUID(1)
+	seg := p.LockSegment(uuid)
+	next, err := seg.Write(uuid, seg.BaseAddress(), []byte("flushed"))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := seg.Flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	if rv, err := p.Read(uuid, seg.BaseAddress(), make([]byte, 100)); err != nil || string(rv) != "flushed" {
+		t.Fatalf("read after flush gave %q, %v", rv, err)
+	}
+	//The segment is still usable after a flush
+	if _, err := seg.Write(uuid, next, []byte("after")); err != nil {
+		t.Fatalf("write after flush: %v", err)
+	}
+	if err := seg.Flush(); err != nil {
+		t.Fatalf("second flush: %v", err)
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatalf("unlock after flush: %v", err)
+	}
+	if rv, err := p.Read(uuid, next, make([]byte, 100)); err != nil || string(rv) != "after" {
+		t.Fatalf("read of the block written after flush gave %q, %v", rv, err)
+	}
+}
+
+func testObliterate(t *testing.T, p provider) {
+	o, ok := p.(interface {
+		ObliterateStreamMetadata(uuid []byte)
+	})
+	if !ok {
+		t.Skip("provider does not implement ObliterateStreamMetadata")
+	}
+	p.SetStreamVersion(mkUUID(1), 12)
+	p.SetStreamVersion(mkUUID(2), 20)
+	o.ObliterateStreamMetadata(mkUUID(1))
+	if v := p.GetStreamVersion(mkUUID(1)); v != 0 {
+		t.Fatalf("version after obliterating is %d, expected 0", v)
+	}
+	if v := p.GetStreamVersion(mkUUID(2)); v != 20 {
+		t.Fatalf("version of other stream is %d, expected 20", v)
+	}
+}
+
+func testBackgroundCleanup(t *testing.T, p provider) {
+	c, ok := p.(interface {
+		BackgroundCleanup(uuids [][]byte) error
+	})
+	if !ok {
+		t.Skip("provider does not implement BackgroundCleanup")
+	}
+	writeBlocks(t, p, mkUUID(1), [][]byte{[]byte("data")})
+	if err := c.BackgroundCleanup([][]byte{mkUUID(2)}); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+}
+
+func testStreams(t *testing.T, p provider) {
+	tags := map[string]string{"name": "a", "unit": "volts"}
+	if err := p.CreateStream(mkUUID(1), "sensors/a", tags, []byte("ann")); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := p.CreateStream(mkUUID(1), "sensors/b", nil, nil); err == nil || err.Code() != bte.StreamExists {
+		t.Fatalf("second create gave %v, expected StreamExists", err)
+	}
+	if err := p.CreateStream(mkUUID(2), "sensors/a", map[string]string{"name": "b", "unit": "volts"}, nil); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := p.CreateStream(mkUUID(3), "sensors/a", map[string]string{"name": "b", "unit": "volts", "x": "y"}, nil); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	s, _ := p.GetStreamInfo(mkUUID(1))
+	if !bytes.Equal(s.UUID, mkUUID(1)) || s.Collection != "sensors/a" || !reflect.DeepEqual(s.Tags, tags) || string(s.Annotation) != "ann" {
+		t.Fatalf("stream info is %+v", s)
+	}
+	if s, _ := p.GetStreamInfo(mkUUID(9)); s.UUID != nil {
+		t.Fatalf("info of a missing stream is %+v", s)
+	}
+	count := func(collection string, partial bool, tags map[string]string) int {
+		rv, err := p.ListStreams(collection, partial, tags)
+		if err != nil {
+			t.Fatalf("list streams: %v", err)
+		}
+		return len(rv)
+	}
+	if n := count("sensors/a", true, nil); n != 3 {
+		t.Fatalf("listed %d streams, expected 3", n)
+	}
+	if n := count("sensors/a", true, map[string]string{"name": "b"}); n != 2 {
+		t.Fatalf("listed %d streams, expected 2", n)
+	}
+	if n := count("sensors/a", false, map[string]string{"name": "b", "unit": "volts"}); n != 1 {
+		t.Fatalf("listed %d streams with exact tags, expected 1", n)
+	}
+	if n := count("sensors/b", true, nil); n != 0 {
+		t.Fatalf("listed %d streams of an empty collection", n)
+	}
+	if _, err := p.ListStreams("sensors/a", false, map[string]string{"unit": "volts"}); err != nil {
+		t.Fatalf("exact listing with no full match gave %v", err)
+	}
+}
+
+func testListCollections(t *testing.T, p provider) {
+	for i, c := range []string{"b/2", "a/1", "b/1", "b/1", "c"} {
+		if err := p.CreateStream(mkUUID(byte(i)), c, map[string]string{"i": string(rune('0' + i))}, nil); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		prefix, from string
+		number       int64
+		want         []string
+	}{
+		{"", "", 0, []string{"a/1", "b/1", "b/2", "c"}},
+		{"b/", "", 0, []string{"b/1", "b/2"}},
+		{"", "b/1", 0, []string{"b/1", "b/2", "c"}},
+		{"", "", 2, []string{"a/1", "b/1"}},
+		{"b/", "a", 1, []string{"b/1"}},
+		{"d", "", 0, []string{}},
+	} {
+		rv, err := p.ListCollections(tc.prefix, tc.from, tc.number)
+		if err != nil {
+			t.Fatalf("list collections: %v", err)
+		}
+		if len(rv) != 0 || len(tc.want) != 0 {
+			if !reflect.DeepEqual(rv, tc.want) {
+				t.Fatalf("collections with prefix %q from %q, %d: got %v, expected %v", tc.prefix, tc.from, tc.number, rv, tc.want)
+			}
+		}
+	}
+}
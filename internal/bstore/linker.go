@@ -125,8 +125,12 @@ func LinkAndStore(uuid []byte, bs *BlockStore, bp bprovider.StorageProvider, vbl
 		cptr = nptr
 	}
 	te := time.Now()
-	vseg.Unlock()
-	cseg.Unlock()
+	if err := vseg.Unlock(); err != nil {
+		log.Panicf("Got error on segment unlock: %v", err)
+	}
+	if err := cseg.Unlock(); err != nil {
+		log.Panicf("Got error on segment unlock: %v", err)
+	}
 	//Return buffers to pool
 	for _, v := range loaned_sercbufs {
 		ser_buf_pool.Put(v)
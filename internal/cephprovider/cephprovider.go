@@ -202,7 +202,7 @@ func (seg *CephSegment) BaseAddress() uint64 {
 
 //Unlocks the segment for the StorageProvider to give to other consumers
 //Implies a flush
-func (seg *CephSegment) Unlock() {
+func (seg *CephSegment) Unlock() error {
 	seg.flushWrite()
 	seg.rez.Release()
 	if seg.ishot {
@@ -221,6 +221,7 @@ func (seg *CephSegment) Unlock() {
 			seg.sp.cold_segcachelock.Unlock()
 		}
 	}
+	return nil
 }
 
 func (seg *CephSegment) flushWrite() {
@@ -286,8 +287,9 @@ func (seg *CephSegment) Write(uuid []byte, address uint64, data []byte) (uint64,
 }
 
 //Block until all writes are complete. Note this does not imply a flush of the underlying files.
-func (seg *CephSegment) Flush() {
+func (seg *CephSegment) Flush() error {
 	//Not sure we need to do stuff here, we can do it in unlock
+	return nil
 }
 
 //Must be called with the cache lock held
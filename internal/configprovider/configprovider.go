@@ -6,7 +6,11 @@
 
 package configprovider
 
-import etcd "github.com/coreos/etcd/clientv3"
+import (
+	"os"
+
+	etcd "github.com/coreos/etcd/clientv3"
+)
 
 type Configuration interface {
 	ClusterEnabled() bool
@@ -14,6 +18,16 @@ type Configuration interface {
 	ClusterEtcdEndpoints() []string
 	StorageCephConf() string
 	StorageFilepath() string
+	StorageFilepaths() []string
+	StorageFileCount() int
+	StorageSyncOnFlush() bool
+	StorageReadCacheBytes() int
+	StorageCompression() string
+	StorageFirstReadBytes() int
+	StorageUseMmap() bool
+	StorageWriteQueueDepth() int
+	StorageVerifyWrites() bool
+	StorageFileMode() os.FileMode
 	StorageCephDataPool() string
 	StorageCephHotPool() string
 	StorageCephJournalPool() string
@@ -231,6 +231,36 @@ func (c *etcdconfig) StorageCephConf() string {
 func (c *etcdconfig) StorageFilepath() string {
 	panic("why on earth would you call this?")
 }
+func (c *etcdconfig) StorageFilepaths() []string {
+	return c.fileconfig.StorageFilepaths()
+}
+func (c *etcdconfig) StorageFileCount() int {
+	return c.fileconfig.StorageFileCount()
+}
+func (c *etcdconfig) StorageSyncOnFlush() bool {
+	return c.fileconfig.StorageSyncOnFlush()
+}
+func (c *etcdconfig) StorageReadCacheBytes() int {
+	return c.fileconfig.StorageReadCacheBytes()
+}
+func (c *etcdconfig) StorageCompression() string {
+	return c.fileconfig.StorageCompression()
+}
+func (c *etcdconfig) StorageFirstReadBytes() int {
+	return c.fileconfig.StorageFirstReadBytes()
+}
+func (c *etcdconfig) StorageUseMmap() bool {
+	return c.fileconfig.StorageUseMmap()
+}
+func (c *etcdconfig) StorageWriteQueueDepth() int {
+	return c.fileconfig.StorageWriteQueueDepth()
+}
+func (c *etcdconfig) StorageVerifyWrites() bool {
+	return c.fileconfig.StorageVerifyWrites()
+}
+func (c *etcdconfig) StorageFileMode() os.FileMode {
+	return c.fileconfig.StorageFileMode()
+}
 func (c *etcdconfig) StorageCephDataPool() string {
 	return c.stringGlobalKey("cephDataPool")
 }
@@ -7,6 +7,9 @@
 package configprovider
 
 import (
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
 
 	gcfg "gopkg.in/gcfg.v1"
@@ -30,6 +33,16 @@ type FileConfig struct {
 	}
 	Storage struct {
 		Filepath        string
+		Filepaths       []string
+		FileCount       int
+		SyncOnFlush     bool
+		ReadCacheBytes  int
+		Compression     string
+		FirstReadBytes  int
+		UseMmap         bool
+		WriteQueueDepth int
+		VerifyWrites    bool
+		FileMode        string
 		CephDataPool    string
 		CephHotPool     string
 		CephJournalPool string
@@ -56,6 +69,12 @@ func LoadFileConfig(path string) (Configuration, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cfg.Storage.FileMode != "" {
+		mode, err := strconv.ParseUint(cfg.Storage.FileMode, 8, 32)
+		if err != nil || os.FileMode(mode)&^os.ModePerm != 0 {
+			return nil, fmt.Errorf("invalid storage filemode %q, expected octal permissions like 0600", cfg.Storage.FileMode)
+		}
+	}
 	return cfg, nil
 }
 
@@ -74,6 +93,44 @@ func (c *FileConfig) StorageCephConf() string {
 func (c *FileConfig) StorageFilepath() string {
 	return c.Storage.Filepath
 }
+func (c *FileConfig) StorageFilepaths() []string {
+	rv := []string{}
+	for _, x := range c.Storage.Filepaths {
+		if x != "" {
+			rv = append(rv, x)
+		}
+	}
+	return rv
+}
+func (c *FileConfig) StorageFileCount() int {
+	return c.Storage.FileCount
+}
+func (c *FileConfig) StorageSyncOnFlush() bool {
+	return c.Storage.SyncOnFlush
+}
+func (c *FileConfig) StorageReadCacheBytes() int {
+	return c.Storage.ReadCacheBytes
+}
+func (c *FileConfig) StorageCompression() string {
+	return c.Storage.Compression
+}
+func (c *FileConfig) StorageFirstReadBytes() int {
+	return c.Storage.FirstReadBytes
+}
+func (c *FileConfig) StorageUseMmap() bool {
+	return c.Storage.UseMmap
+}
+func (c *FileConfig) StorageWriteQueueDepth() int {
+	return c.Storage.WriteQueueDepth
+}
+func (c *FileConfig) StorageVerifyWrites() bool {
+	return c.Storage.VerifyWrites
+}
+func (c *FileConfig) StorageFileMode() os.FileMode {
+	//Checked by LoadFileConfig
+	mode, _ := strconv.ParseUint(c.Storage.FileMode, 8, 32)
+	return os.FileMode(mode)
+}
 func (c *FileConfig) StorageCephDataPool() string {
 	return c.Storage.CephDataPool
 }
@@ -0,0 +1,57 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/bte"
+)
+
+//What happens when an internal integrity check fails
+type AssertMode int32
+
+const (
+	//Panic, the default. Best for tests
+	AssertPanic AssertMode = iota
+	//Return an InvariantFailure error to the caller
+	AssertError
+	//Log the failure and carry on
+	AssertLog
+	//Don't check at all
+	AssertOff
+)
+
+var assertMode = int32(AssertPanic)
+
+//Set the global assertion mode for all providers
+func SetAssertMode(m AssertMode) {
+	atomic.StoreInt32(&assertMode, int32(m))
+}
+
+//Check an invariant, reacting according to the assertion mode if it does not
+//hold. Failures are reported to the provider's Logger. The returned error is
+//only ever non-nil in AssertError mode
+func (sp *FileStorageProvider) invariant(cond bool, format string, args ...interface{}) bte.BTE {
+	mode := AssertMode(atomic.LoadInt32(&assertMode))
+	if cond || mode == AssertOff {
+		return nil
+	}
+	msg := fmt.Sprintf(format, args...)
+	switch mode {
+	case AssertPanic:
+		sp.fatal("Invariant failed", "reason", msg)
+	case AssertError:
+		return bte.Err(bte.InvariantFailure, msg)
+	case AssertLog:
+		sp.logger().Error("Invariant failed", "reason", msg)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/pborman/uuid"
+)
+
+func TestAssertModes(t *testing.T) {
+	defer SetAssertMode(AssertPanic)
+	lg := &capturingLogger{}
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.Logger = lg
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	defer seg.Unlock()
+	bad := seg.BaseAddress() + 1
+
+	SetAssertMode(AssertPanic)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected a panic in panic mode")
+			}
+		}()
+		seg.Write(id, bad, mkData(10, 0))
+	}()
+
+	SetAssertMode(AssertError)
+	_, err := seg.Write(id, bad, mkData(10, 0))
+	if err == nil || err.(bte.BTE).Code() != bte.InvariantFailure {
+		t.Fatalf("expected an invariant failure in error mode, got %v", err)
+	}
+
+	//Log and off mode both let the write go ahead. Panic mode logged its
+	//failure too, so only what log mode reports is kept
+	lg.events = nil
+	for _, m := range []AssertMode{AssertLog, AssertOff} {
+		SetAssertMode(m)
+		_, err = seg.Write(id, bad, mkData(10, 0))
+		if err != nil {
+			t.Fatalf("unexpected error in mode %d: %v", m, err)
+		}
+		bad++
+	}
+	//The failure in log mode went to the provider's Logger
+	ev, ok := lg.find("Invariant failed")
+	if !ok || ev.level != "error" {
+		t.Fatalf("expected an error event for the failed invariant, got %v", lg.events)
+	}
+}
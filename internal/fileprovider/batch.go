@@ -0,0 +1,153 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//Each Write is a send on the segment's queue, and each block is at least one
+//write to the file. WriteBatch queues many blocks with one send, and the
+//writer writes the ones that are next to each other in the file with one
+//call. Padding and checkpoints still go on the queue by themselves, so a
+//batch is sent ahead of them to keep the queue in order
+
+//The most blocks written in one call. Each is up to three buffers, which
+//keeps a call under the usual IOV_MAX of 1024
+const MAXBATCHRUN = 256
+
+//The most bytes written in one call, unless a single block is bigger
+const MAXBATCHBYTES = 4 << 20
+
+//A block for WriteBatch
+type WriteItem struct {
+	Data []byte
+	//If not nil, called once the block is written, as with WriteNotify
+	Complete func(address uint64)
+}
+
+//Like Write, for several blocks of the stream written one after the other
+//starting at the given address. Returns the address of each block and the
+//address for the next write. If one of them fails, the blocks before it are
+//still written, and their addresses are returned along with the error
+func (seg *FileProviderSegment) WriteBatch(uuid []byte, address uint64, items []WriteItem) ([]uint64, uint64, error) {
+	addrs := make([]uint64, 0, len(items))
+	seg.batching = true
+	defer func() {
+		seg.batching = false
+		seg.flushBatch()
+	}()
+	for _, it := range items {
+		next, err := seg.write(writeparams{UUID: uuid, Address: address, Data: seg.sp.preWrite(it.Data), Complete: it.Complete})
+		if err != nil {
+			return addrs, address, err
+		}
+		addrs = append(addrs, address)
+		address = next
+	}
+	return addrs, address, nil
+}
+
+//Queue the blocks gathered by WriteBatch so far
+func (seg *FileProviderSegment) flushBatch() {
+	if len(seg.batch) == 0 {
+		return
+	}
+	seg.wchan <- writeparams{Batch: seg.batch}
+	seg.batch = nil
+}
+
+//Called by a writer for a batch from the queue
+func (seg *FileProviderSegment) writeBatch(batch []writeparams) {
+	//A batch never holds a checkpoint, so its blocks all follow the same ones
+	if !seg.stopped() {
+		seg.waitBarrier(batch[0].Barrier)
+	}
+	for len(batch) > 0 {
+		run := batch[:seg.sp.adjacent(batch)]
+		batch = batch[len(run):]
+		if !seg.stopped() {
+			start := time.Now()
+			last := &run[len(run)-1]
+			_, off := bprovider.DecodeAddress(last.Address)
+			seg.sp.preallocate(seg.fidx, off+seg.sp.recordLen(last))
+			err := seg.writeRun(run)
+			atomic.AddInt64(&seg.sp.io.writeTime, int64(time.Since(start)))
+			for i := 0; err == nil && i < len(run); i++ {
+				err = seg.verifyWrite(&run[i])
+			}
+			if err != nil {
+				seg.fail(err)
+			} else {
+				for i := range run {
+					seg.written(&run[i])
+				}
+			}
+		}
+		for _, args := range run {
+			seg.complete(args)
+		}
+	}
+}
+
+//How many blocks from the start of the batch follow each other in the file
+//and can be written with one call
+func (sp *FileStorageProvider) adjacent(batch []writeparams) int {
+	_, end := bprovider.DecodeAddress(batch[0].Address)
+	end += sp.recordLen(&batch[0])
+	bytes := sp.recordLen(&batch[0])
+	n := 1
+	for ; n < len(batch) && n < MAXBATCHRUN; n++ {
+		rlen := sp.recordLen(&batch[n])
+		if _, off := bprovider.DecodeAddress(batch[n].Address); off != end || bytes+rlen > MAXBATCHBYTES {
+			break
+		}
+		end += rlen
+		bytes += rlen
+	}
+	return n
+}
+
+//Write blocks that follow each other in the file with one call. Sentinels
+//must follow the rest of their record, so with them each block is written
+//on its own
+func (seg *FileProviderSegment) writeRun(run []writeparams) error {
+	if len(run) == 1 || seg.sp.format&FormatSentinel != 0 {
+		for i := range run {
+			if err := seg.writeBlock(&run[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	_, off := bprovider.DecodeAddress(run[0].Address)
+	err := seg.sp.retryIO(func() error {
+		var bufs [][]byte
+		for i := range run {
+			bufs = append(bufs, seg.sp.recordBufs(&run[i])...)
+		}
+		if vw, ok := seg.w.(vectorWriter); ok {
+			_, err := vw.WriteVecAt(bufs, off)
+			return err
+		}
+		var b []byte
+		for _, part := range bufs {
+			b = append(b, part...)
+		}
+		_, err := seg.w.WriteAt(b, off)
+		return err
+	})
+	if err != nil {
+		atomic.AddUint64(&seg.sp.errs.write[seg.fidx], 1)
+	}
+	return err
+}
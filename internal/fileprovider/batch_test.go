@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+//Batched writes must leave the file exactly as the same writes one by one,
+//with blocks next to each other written in one call
+func TestWriteBatch(t *testing.T) {
+	var items []WriteItem
+	for i := 0; i < 300; i++ {
+		items = append(items, WriteItem{Data: mkData(10+(i%7)*300, byte(i))})
+	}
+	type result struct {
+		addrs []uint64
+		next  uint64
+		data  []byte
+	}
+	run := func(batched bool) result {
+		rec := &recordingSegfile{}
+		sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+			sp.wrapSegfile = func(f segfile) segfile {
+				rec.segfile = f
+				return rec
+			}
+		})
+		defer os.RemoveAll(cfg.dir)
+		id := uuid.NewRandom()
+		seg := sp.LockSegment(id).(*FileProviderSegment)
+		var rv result
+		addr := seg.BaseAddress()
+		if batched {
+			var completed int32
+			batch := make([]WriteItem, len(items))
+			for i := range items {
+				batch[i] = WriteItem{Data: items[i].Data, Complete: func(uint64) { atomic.AddInt32(&completed, 1) }}
+			}
+			var err error
+			rv.addrs, rv.next, err = seg.WriteBatch(id, addr, batch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := seg.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if completed != int32(len(items)) {
+				t.Fatalf("expected %d blocks to complete, got %d", len(items), completed)
+			}
+			//300 blocks of up to 1.8KB are two runs of at most MAXBATCHRUN
+			if len(rec.events) != 2 {
+				t.Fatalf("expected the batch to be written in 2 calls, got %d", len(rec.events))
+			}
+		} else {
+			for _, it := range items {
+				rv.addrs = append(rv.addrs, addr)
+				var err error
+				addr, err = seg.Write(id, addr, it.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			rv.next = addr
+			if err := seg.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, a := range rv.addrs {
+			d, err := sp.Read(id, a, make([]byte, MAXBLOCKSIZE))
+			if err != nil || !bytes.Equal(d, items[i].Data) {
+				t.Fatalf("block %d did not read back: %v", i, err)
+			}
+		}
+		var err error
+		rv.data, err = ioutil.ReadFile(blockPath(sp.dbroots, seg.fidx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rv
+	}
+	single := run(false)
+	batched := run(true)
+	if batched.next != single.next || len(batched.addrs) != len(single.addrs) {
+		t.Fatalf("expected the batch to end at %x, got %x", single.next, batched.next)
+	}
+	for i := range single.addrs {
+		if batched.addrs[i] != single.addrs[i] {
+			t.Fatalf("block %d at %x, expected %x", i, batched.addrs[i], single.addrs[i])
+		}
+	}
+	if !bytes.Equal(batched.data, single.data) {
+		t.Fatalf("batched writes left a different file")
+	}
+}
+
+//Writes 64 small blocks per segment, one by one or in a batch
+func benchmarkWrites(b *testing.B, batched bool) {
+	sp, cfg := mkProvider(b, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	data := mkData(200, 1)
+	items := make([]WriteItem, 64)
+	for i := range items {
+		items[i] = WriteItem{Data: data}
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += len(items) {
+		seg := sp.LockSegment(id).(*FileProviderSegment)
+		addr := seg.BaseAddress()
+		if batched {
+			if _, _, err := seg.WriteBatch(id, addr, items); err != nil {
+				b.Fatal(err)
+			}
+		} else {
+			for _, it := range items {
+				var err error
+				if addr, err = seg.Write(id, addr, it.Data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+		if err := seg.Unlock(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrites(b, false)
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWrites(b, true)
+}
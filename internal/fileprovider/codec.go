@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+//Block compression. In a database with FormatCodec, the stored data of each
+//block starts with the id of the codec it was compressed with. Blocks are
+//compressed with the codec of StorageCompression in the configuration, but
+//since each block says how it was stored, the codec can be changed between
+//runs and blocks written with any codec (or none) can still be read
+const (
+	CodecNone byte = iota
+	CodecSnappy
+	CodecZstd
+)
+
+//Indexed by codec id
+var codecNames = []string{"none", "snappy", "zstd"}
+
+var zstdOnce sync.Once
+var zstdEnc *zstd.Encoder
+var zstdDec *zstd.Decoder
+var zstdErr error
+
+//Create the encoder and decoder, which are safe for concurrent EncodeAll and
+//DecodeAll. Initialize does this for any database with FormatCodec, so
+//compress and decompress can use them
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEnc, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			zstdErr = fmt.Errorf("could not create zstd encoder: %v", zstdErr)
+			return
+		}
+		zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAXWIDEDATA))
+		if zstdErr != nil {
+			zstdErr = fmt.Errorf("could not create zstd decoder: %v", zstdErr)
+		}
+	})
+	return zstdErr
+}
+
+//Returns the id of the named codec. The empty name is CodecNone
+func codecByName(name string) (byte, error) {
+	if name == "" {
+		return CodecNone, nil
+	}
+	for id, n := range codecNames {
+		if n == name {
+			return byte(id), nil
+		}
+	}
+	return 0, bprovider.ErrInvalidArgument
+}
+
+//Returns the data to store for a block: the codec id followed by the data,
+//compressed unless that would not make it smaller
+func (sp *FileStorageProvider) compress(data []byte) []byte {
+	var rv []byte
+	switch sp.codec {
+	case CodecSnappy:
+		rv = make([]byte, 1+snappy.MaxEncodedLen(len(data)))
+		rv = rv[:1+len(snappy.Encode(rv[1:], data))]
+	case CodecZstd:
+		rv = zstdEnc.EncodeAll(data, make([]byte, 1, 1+len(data)))
+	}
+	if rv == nil || len(rv) > len(data) {
+		rv = make([]byte, 1+len(data))
+		copy(rv[1:], data)
+		rv[0] = CodecNone
+		return rv
+	}
+	rv[0] = sp.codec
+	return rv
+}
+
+//Undo compress. Returns ErrCorrupt if the codec is unknown or the data does
+//not decompress
+func decompress(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, bprovider.ErrCorrupt
+	}
+	data := stored[1:]
+	switch stored[0] {
+	case CodecNone:
+		return data, nil
+	case CodecSnappy:
+		n, err := snappy.DecodedLen(data)
+		if err != nil || n > MAXWIDEDATA {
+			return nil, bprovider.ErrCorrupt
+		}
+		rv, err := snappy.Decode(make([]byte, n), data)
+		if err != nil {
+			return nil, bprovider.ErrCorrupt
+		}
+		return rv, nil
+	case CodecZstd:
+		rv, err := zstdDec.DecodeAll(data, nil)
+		if err != nil {
+			return nil, bprovider.ErrCorrupt
+		}
+		return rv, nil
+	}
+	return nil, bprovider.ErrCorrupt
+}
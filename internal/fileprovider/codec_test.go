@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+func TestCompression(t *testing.T) {
+	compressible := bytes.Repeat([]byte("0123456789abcdef"), 500)
+	incompressible := make([]byte, len(compressible))
+	rand.New(rand.NewSource(1)).Read(incompressible)
+	for _, codec := range []string{"snappy", "zstd"} {
+		dir, err := ioutil.TempDir("", "fileprovider")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cfg := &testConfig{dir: dir, files: 2, compression: codec}
+		if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+			t.Fatal(err)
+		}
+		sp := &FileStorageProvider{}
+		if err := sp.Initialize(cfg); err != nil {
+			t.Fatal(err)
+		}
+		seg := sp.LockSegment(nil)
+		addrs := []uint64{seg.BaseAddress()}
+		for _, d := range [][]byte{compressible, incompressible} {
+			next, err := seg.Write(nil, addrs[len(addrs)-1], d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs = append(addrs, next)
+		}
+		if err := seg.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		//The difference between addresses is the size on disk
+		if size := addrs[1] - addrs[0]; size > uint64(len(compressible)/4) {
+			t.Fatalf("%s: compressible block of %d bytes takes %d", codec, len(compressible), size)
+		}
+		if size := addrs[2] - addrs[1]; size > uint64(len(incompressible))+uint64(sp.blockOverhead())+1 {
+			t.Fatalf("%s: incompressible block of %d bytes takes %d", codec, len(incompressible), size)
+		}
+		var codecs []byte
+		sp.IterateFile(int(addrs[0]>>50), func(rec *FileRecord) bool {
+			codecs = append(codecs, rec.Data[0])
+			return true
+		})
+		if !bytes.Equal(codecs, []byte{sp.codec, CodecNone}) {
+			t.Fatalf("%s: blocks stored with codecs %v", codec, codecs)
+		}
+		check := func(sp *FileStorageProvider) {
+			for i, d := range [][]byte{compressible, incompressible} {
+				rv, err := sp.Read(nil, addrs[i], make([]byte, len(d)+100))
+				if err != nil || !bytes.Equal(rv, d) {
+					t.Fatalf("%s: block %d did not read back: %v", codec, i, err)
+				}
+			}
+		}
+		check(sp)
+		//Blocks say how they were stored, so changing the codec does not
+		//affect them
+		sp.Close()
+		cfg.compression = "none"
+		sp = &FileStorageProvider{}
+		if err := sp.Initialize(cfg); err != nil {
+			t.Fatal(err)
+		}
+		defer sp.Close()
+		check(sp)
+	}
+	//A database created without compression can't have it turned on
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.compression = "snappy"
+	if err := (&FileStorageProvider{}).Initialize(cfg); !errors.Is(err, bprovider.ErrInvalidArgument) {
+		t.Fatalf("expected Initialize to refuse compression, got %v", err)
+	}
+}
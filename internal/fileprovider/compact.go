@@ -0,0 +1,302 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//A Relocation moves live blocks to new addresses. While any relocation is
+//active, Read consults a forwarding table before the normal path, so a block
+//being moved is served from its old location until the copy is on disk and
+//from its new location afterwards, never from something in between.
+type Relocation struct {
+	sp    *FileStorageProvider
+	remap map[uint64]uint64
+	ended bool
+}
+
+type forwardtable struct {
+	mu  sync.RWMutex
+	fwd map[uint64]uint64
+	//The number of active relocations. Read skips the table when zero
+	active int32
+}
+
+//Begin a relocation. The caller must call End once it has finished using
+//the remapped addresses
+func (sp *FileStorageProvider) BeginRelocation() *Relocation {
+	sp.fwd.mu.Lock()
+	if sp.fwd.fwd == nil {
+		sp.fwd.fwd = make(map[uint64]uint64)
+	}
+	atomic.AddInt32(&sp.fwd.active, 1)
+	sp.fwd.mu.Unlock()
+	return &Relocation{sp: sp, remap: make(map[uint64]uint64)}
+}
+
+//Copy the given blocks, which all belong to uuid, to a new segment. Once the
+//copies are on disk, reads of the old addresses are forwarded to them. This
+//waits for its share of CompactConcurrency and CompactBytesPerSec
+func (r *Relocation) Move(uuid []byte, addresses []uint64) error {
+	if r.ended {
+		r.sp.fatal("Move called on ended relocation")
+	}
+	if r.sp.compactSlots != nil {
+		r.sp.compactSlots <- struct{}{}
+		defer func() { <-r.sp.compactSlots }()
+	}
+	buf := make([]byte, r.sp.maxBlockSize())
+	seg := r.sp.LockSegment(uuid)
+	addr := seg.BaseAddress()
+	moved := make(map[uint64]uint64, len(addresses))
+	for _, old := range addresses {
+		r.sp.bgpause.wait()
+		//The writer holds on to data until it is written, so it can't share buf
+		data, err := r.sp.Read(uuid, old, buf)
+		if err != nil {
+			seg.Unlock()
+			return err
+		}
+		data = append([]byte(nil), data...)
+		//Once for the read and once for the write
+		r.sp.compactBudget.take(2 * int64(len(data)))
+		moved[old] = addr
+		addr, err = seg.Write(uuid, addr, data)
+		if err != nil {
+			seg.Unlock()
+			return err
+		}
+	}
+	//Unlock implies a flush, so the new copies are complete after this
+	seg.Unlock()
+	r.sp.fwd.mu.Lock()
+	for old, nw := range moved {
+		r.sp.fwd.fwd[old] = nw
+		r.remap[old] = nw
+	}
+	r.sp.fwd.mu.Unlock()
+	olds := make([]uint64, 0, len(moved))
+	for old := range moved {
+		olds = append(olds, old)
+	}
+	r.sp.live.release(uuid, olds)
+	return nil
+}
+
+//Returns the mapping from old to new addresses for every block moved so far
+func (r *Relocation) Remap() map[uint64]uint64 {
+	return r.remap
+}
+
+//End the relocation, dropping its forwarding entries. After this the old
+//addresses may no longer be read.
+func (r *Relocation) End() {
+	if r.ended {
+		return
+	}
+	r.ended = true
+	r.sp.fwd.mu.Lock()
+	for old := range r.remap {
+		delete(r.sp.fwd.fwd, old)
+	}
+	atomic.AddInt32(&r.sp.fwd.active, -1)
+	r.sp.fwd.mu.Unlock()
+}
+
+//Returns the address a block should currently be read from
+func (sp *FileStorageProvider) forward(address uint64) uint64 {
+	if atomic.LoadInt32(&sp.fwd.active) == 0 {
+		return address
+	}
+	sp.fwd.mu.RLock()
+	nw, ok := sp.fwd.fwd[address]
+	sp.fwd.mu.RUnlock()
+	if ok {
+		return nw
+	}
+	return address
+}
+
+//The new address of each block moved by a compaction
+type RemapTable map[uint64]uint64
+
+type detachreq struct {
+	fidx int
+	done chan struct{}
+}
+
+//Take the given file out of the pool, waiting until no segment has it locked
+func (sp *FileStorageProvider) detachFile(fidx int) {
+	if sp.pooled() {
+		sp.favailmu.Lock()
+		for !sp.favail[fidx] {
+			sp.favailcond.Wait()
+		}
+		sp.favail[fidx] = false
+		sp.favailmu.Unlock()
+		return
+	}
+	done := make(chan struct{})
+	sp.detachch[fidx%len(sp.detachch)] <- detachreq{fidx, done}
+	<-done
+}
+
+//Return a file taken by detachFile to the pool
+func (sp *FileStorageProvider) reattachFile(fidx int) {
+	sp.retfidx[fidx%len(sp.retfidx)] <- fidx
+}
+
+//Compact a single file, keeping only the blocks whose addresses are in live
+//(which must include every live block in the file). The file is taken out of
+//the pool while the live blocks are copied, in order, to a new file that then
+//replaces it. Returns the new address of each live block. Once this returns
+//the old addresses in the file are no longer valid, so nothing may read them
+//while it runs. Not supported with FormatSpan, as moving the tail of a
+//spanning block would invalidate the head that refers to it
+func (sp *FileStorageProvider) CompactFile(fidx int, live map[uint64]bool) (RemapTable, error) {
+	if fidx < 0 || fidx >= sp.numfiles || sp.format&FormatSpan != 0 {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	if sp.ReadOnly {
+		return nil, bprovider.ErrReadOnly
+	}
+	//The migrated ranges of a file are only good for the file as it is
+	if sp.tier != nil && sp.tier.migratedEnd(fidx) != 0 {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	sp.detachFile(fidx)
+	defer sp.reattachFile(fidx)
+	fname := sp.dbf[fidx].Name()
+	tmp, err := os.OpenFile(fname+".compact", os.O_RDWR|os.O_CREATE|os.O_TRUNC, sp.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	defer tmp.Close()
+	//The file tag and format header are kept as they are
+	hdr := make([]byte, sp.datastart)
+	sp.dbrf_mtx[fidx].RLock()
+	_, err = sp.dbrf[fidx].ReadAt(hdr, 0)
+	sp.dbrf_mtx[fidx].RUnlock()
+	if err == nil {
+		_, err = tmp.WriteAt(hdr, 0)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	remap := make(RemapTable)
+	off := sp.datastart
+	var werr error
+	err = sp.IterateFile(fidx, func(rec *FileRecord) bool {
+		if !live[rec.Address] {
+			return true
+		}
+		sp.bgpause.wait()
+		wp := writeparams{Data: rec.Data, CRC: rec.CRC, HasCRC: true, Timestamp: rec.Timestamp}
+		raw := bytes.Join(sp.recordBufs(&wp), nil)
+		if _, werr = tmp.WriteAt(raw, off); werr != nil {
+			return false
+		}
+		remap[rec.Address] = bprovider.EncodeAddress(fidx, off)
+		off += int64(len(raw))
+		return true
+	})
+	if err == nil {
+		err = werr
+	}
+	if err == nil {
+		for addr := range live {
+			afidx, _ := bprovider.DecodeAddress(addr)
+			if _, ok := remap[addr]; !ok && afidx == fidx {
+				err = bprovider.ErrInvalidArgument
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = datasync(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	sp.dbrf_mtx[fidx].Lock()
+	defer sp.dbrf_mtx[fidx].Unlock()
+	if err := os.Rename(tmp.Name(), fname); err != nil {
+		atomic.AddUint64(&sp.errs.write[fidx], 1)
+		sp.fatal("Could not replace compacted file", "file", fidx, "err", err)
+	}
+	f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+	if err == nil {
+		_, err = f.Seek(0, os.SEEK_END)
+	}
+	if err != nil {
+		sp.fatal("Problem with blockstore DB", "err", err)
+	}
+	rf, err := os.OpenFile(fname, os.O_RDONLY, 0666)
+	if err != nil {
+		sp.fatal("Problem with blockstore DB", "err", err)
+	}
+	sp.unmapFile(fidx)
+	sp.resetPrealloc(fidx)
+	sp.dbf[fidx].Close()
+	sp.dbrf[fidx].Close()
+	sp.dbf[fidx], sp.dbrf[fidx] = f, rf
+	sp.rcache.invalidate(fidx, nil)
+	sp.setCommitted(fidx, off)
+	atomic.StoreInt64(&sp.scrubpos[fidx], 0)
+	sp.live.compacted(fidx, remap)
+	return remap, nil
+}
+
+//Compact every blockstore file, keeping only the blocks whose addresses
+//liveAddresses returns for one of streams. This is how the space of rolled
+//back versions and deleted streams is recovered: streams must hold every
+//stream with blocks in the provider, whether or not it is in this provider's
+//metadata, and liveAddresses should return the addresses reachable from the
+//superblocks of every version that is kept. Returns the new address of each
+//kept block, which the caller must apply to the superblocks that refer to it.
+//Nothing may read the old addresses while this runs. If a file fails to
+//compact, the files before it have been, so the table returned with the error
+//must still be applied. See CompactFile
+func (sp *FileStorageProvider) Compact(streams [][]byte, liveAddresses func(uuid []byte) []uint64) (RemapTable, error) {
+	live := make([]map[uint64]bool, sp.numfiles)
+	for _, id := range streams {
+		for _, addr := range liveAddresses(id) {
+			fidx, _ := bprovider.DecodeAddress(addr)
+			if fidx >= sp.numfiles {
+				return nil, bprovider.ErrInvalidArgument
+			}
+			if live[fidx] == nil {
+				live[fidx] = make(map[uint64]bool)
+			}
+			live[fidx][addr] = true
+		}
+	}
+	rv := make(RemapTable)
+	for fidx := range live {
+		if atomic.LoadInt64(&sp.committed[fidx]) == sp.datastart {
+			continue
+		}
+		remap, err := sp.CompactFile(fidx, live[fidx])
+		if err != nil {
+			return rv, err
+		}
+		for old, nw := range remap {
+			rv[old] = nw
+		}
+	}
+	return rv, nil
+}
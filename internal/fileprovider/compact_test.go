@@ -0,0 +1,378 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestReadDuringRelocation(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	for i := 0; i < 50; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(500, byte(i)))
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	seg.Unlock()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var failed int32
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, MAXBLOCKSIZE)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for i, a := range addrs {
+					data, err := sp.Read(id, a, buf)
+					if err != nil || !bytes.Equal(data, mkData(500, byte(i))) {
+						atomic.StoreInt32(&failed, 1)
+					}
+				}
+			}
+		}()
+	}
+	for round := 0; round < 10; round++ {
+		rel := sp.BeginRelocation()
+		if err := rel.Move(id, addrs); err != nil {
+			t.Fatalf("unexpected move error: %v", err)
+		}
+		remap := rel.Remap()
+		for i, a := range addrs {
+			if remap[a] == a {
+				t.Fatalf("block was not moved")
+			}
+			data, err := sp.Read(id, a, make([]byte, MAXBLOCKSIZE))
+			if err != nil || !bytes.Equal(data, mkData(500, byte(i))) {
+				t.Fatalf("forwarded read returned wrong data")
+			}
+		}
+		rel.End()
+	}
+	close(stop)
+	wg.Wait()
+	if failed != 0 {
+		t.Fatalf("a concurrent read returned wrong data")
+	}
+}
+
+func TestCompactionBudget(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.CompactBytesPerSec = 100 * 1024
+		sp.CompactConcurrency = 1
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	for i := 0; i < 20; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(1000, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg.Unlock()
+	rel := sp.BeginRelocation()
+	defer rel.End()
+	done := make(chan error)
+	then := time.Now()
+	go func() {
+		done <- rel.Move(id, addrs)
+	}()
+	//Foreground reads and writes are not held back by the budget
+	time.Sleep(50 * time.Millisecond)
+	fg := time.Now()
+	if _, err := sp.Read(id, addrs[0], make([]byte, MAXBLOCKSIZE)); err != nil {
+		t.Fatal(err)
+	}
+	fgseg := sp.LockSegment(id)
+	if _, err := fgseg.Write(id, fgseg.BaseAddress(), mkData(1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	fgseg.Unlock()
+	if took := time.Since(fg); took > 100*time.Millisecond {
+		t.Fatalf("foreground operations took %s during compaction", took)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(then)
+	//Each block is read and written, less the first block, which does not wait
+	total := int64(2 * 1000 * (len(addrs) - 1))
+	if min := time.Duration(total * int64(time.Second) / sp.CompactBytesPerSec); elapsed < min {
+		t.Fatalf("compaction took %s, faster than the budget allows (%s)", elapsed, min)
+	}
+	for i, old := range addrs {
+		data, err := sp.Read(id, old, make([]byte, MAXBLOCKSIZE))
+		if err != nil || !bytes.Equal(data, mkData(1000, byte(i))) {
+			t.Fatalf("block %d was not moved intact", i)
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	kept, deleted := uuid.NewRandom(), uuid.NewRandom()
+	for _, id := range [][]byte{kept, deleted} {
+		if err := sp.CreateStream(id, "compact", map[string]string{"name": fmt.Sprintf("%x", id)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Blocks in several files, every other block of one stream rolled back
+	//and all of the other deleted. The blocks of a stream that is not in this
+	//provider's metadata are kept all the same
+	uncatalogued := uuid.NewRandom()
+	live := make(map[uint64][]byte)
+	owner := make(map[uint64][]byte)
+	var livesize, keptsize uint64
+	for i := 0; i < 5; i++ {
+		for _, id := range [][]byte{kept, deleted, uncatalogued} {
+			seg := sp.LockSegment(id)
+			addr := seg.BaseAddress()
+			for j := 0; j < 10; j++ {
+				data := mkData(200+j, byte(i*10+j))
+				next, err := seg.Write(id, addr, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Equal(id, kept) && j%2 == 0 || bytes.Equal(id, uncatalogued) {
+					live[addr] = data
+					owner[addr] = id
+					livesize += next - addr
+					if bytes.Equal(id, kept) {
+						keptsize += next - addr
+					}
+				}
+				addr = next
+			}
+			seg.Unlock()
+		}
+	}
+	before := sp.TotalDiskSize()
+	remap, err := sp.Compact([][]byte{kept, deleted, uncatalogued}, func(id []byte) []uint64 {
+		var rv []uint64
+		for addr := range live {
+			if bytes.Equal(owner[addr], id) {
+				rv = append(rv, addr)
+			}
+		}
+		return rv
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remap) != len(live) {
+		t.Fatalf("expected %d remapped blocks, got %d", len(live), len(remap))
+	}
+	for old, data := range live {
+		got, err := sp.Read(owner[old], remap[old], make([]byte, MAXBLOCKSIZE))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("block at %x did not read back at its new address %x: %v", old, remap[old], err)
+		}
+	}
+	if after := sp.TotalDiskSize(); after != livesize {
+		t.Fatalf("expected only the live blocks to remain, %d bytes before and %d after", before, after)
+	}
+	if size, _ := sp.StreamPhysicalSize(deleted); size != 0 {
+		t.Fatalf("expected the deleted stream to have no live blocks, got %d bytes", size)
+	}
+	if size, _ := sp.StreamPhysicalSize(kept); size != keptsize {
+		t.Fatalf("expected the kept stream to have %d live bytes, got %d", keptsize, size)
+	}
+	//An address past the last file is refused before anything is compacted
+	if _, err := sp.Compact([][]byte{kept}, func(id []byte) []uint64 {
+		return []uint64{uint64(sp.numfiles) << 50}
+	}); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument for an address past the last file, got %v", err)
+	}
+}
+
+func TestCompactFile(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	fidx := int(addr >> 50)
+	live := make(map[uint64]bool)
+	blocks := make(map[uint64][]byte)
+	garbage := []uint64{}
+	var livesize int64
+	for i := 0; i < 60; i++ {
+		data := mkData(300+i, byte(i))
+		next, err := seg.Write(id, addr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			live[addr] = true
+			blocks[addr] = data
+			livesize += int64(next - addr)
+		} else {
+			garbage = append(garbage, addr)
+		}
+		addr = next
+	}
+	seg.Unlock()
+	before := sp.TotalDiskSize()
+	remap, err := sp.CompactFile(fidx, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remap) != len(live) {
+		t.Fatalf("expected %d remapped blocks, got %d", len(live), len(remap))
+	}
+	if got := atomic.LoadInt64(&sp.committed[fidx]) - sp.datastart; got != livesize {
+		t.Fatalf("expected the file to hold %d bytes of live blocks, got %d", livesize, got)
+	}
+	if reclaimed := before - sp.TotalDiskSize(); reclaimed != uint64(int64(addr-seg.BaseAddress())-livesize) {
+		t.Fatalf("expected the garbage to be reclaimed, reclaimed %d bytes", reclaimed)
+	}
+	for old, data := range blocks {
+		got, err := sp.Read(id, remap[old], make([]byte, MAXBLOCKSIZE))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("block at %x was not remapped correctly: %v", old, err)
+		}
+	}
+	//The garbage no longer counts as live, and the file is back in the pool
+	if size, _ := sp.StreamPhysicalSize(id); size != uint64(livesize) {
+		t.Fatalf("expected a live size of %d, got %d", livesize, size)
+	}
+	state := sp.FreePoolState()
+	if _, locked := state.Locked[fidx]; locked {
+		t.Fatalf("compacted file is still locked")
+	}
+	//A live block that isn't in the file is an error, and changes nothing
+	if _, err := sp.CompactFile(fidx, map[uint64]bool{remap[seg.BaseAddress()] + 1: true}); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument for a live address that is not a block, got %v", err)
+	}
+	if got := atomic.LoadInt64(&sp.committed[fidx]) - sp.datastart; got != livesize {
+		t.Fatalf("a failed compaction changed the file")
+	}
+}
+
+func TestPauseCompaction(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	fidx := int(addr >> 50)
+	live := make(map[uint64]bool)
+	for i := 0; i < 20; i++ {
+		live[addr] = true
+		var err error
+		addr, err = seg.Write(id, addr, mkData(300, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg.Unlock()
+	sp.PauseBackground()
+	done := make(chan error, 1)
+	go func() {
+		_, err := sp.CompactFile(fidx, live)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatalf("compaction finished while background I/O was paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	sp.ResumeBackground()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("compaction did not finish once resumed")
+	}
+}
+
+func TestCompactFileWide(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatWide
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	fidx := int(addr >> 50)
+	live := make(map[uint64]bool)
+	blocks := make(map[uint64][]byte)
+	//Blocks above 64KB only fit a four byte length prefix
+	for i := 0; i < 12; i++ {
+		data := mkData(300+i*20000, byte(i))
+		next, err := seg.Write(id, addr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			live[addr] = true
+			blocks[addr] = data
+		}
+		addr = next
+	}
+	seg.Unlock()
+	remap, err := sp.CompactFile(fidx, live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(sp *FileStorageProvider) {
+		for old, data := range blocks {
+			got, err := sp.Read(id, remap[old], make([]byte, sp.maxBlockSize()))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("wide block at %x was not remapped correctly: %v", old, err)
+			}
+		}
+	}
+	check(sp)
+	var n int
+	if err := sp.IterateFile(fidx, func(r *FileRecord) bool {
+		n++
+		return true
+	}); err != nil || n != len(blocks) {
+		t.Fatalf("expected to iterate over %d compacted blocks, got %d: %v", len(blocks), n, err)
+	}
+	sp.Close()
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//What one of the provider's goroutines is doing. Each goroutine keeps its
+//own state word up to date with atomic stores, so that reading them never
+//waits on the goroutine
+const (
+	gsNotRunning int32 = iota
+	//Blocked until there is work, e.g. a file returned
+	gsWaiting
+	//An allocator with a file on offer to LockSegment
+	gsOffering
+	//Between iterations of a periodic task
+	gsSleeping
+	gsRunning
+)
+
+var gsNames = []string{"not running", "waiting", "offering", "sleeping", "running"}
+
+//The background workers that DebugState reports on
+const (
+	bgFreeSpace = iota
+	bgScrubber
+	bgVersionFlusher
+	NUMBGWORKERS
+)
+
+var bgNames = []string{"freespace", "scrubber", "versionflusher"}
+
+type AllocatorState struct {
+	//The channel LockSegment takes files from is unbuffered, so an
+	//allocator in the "offering" state stands in for its length
+	State string
+	//Unlocked files not yet taken back
+	Returned int
+}
+
+type SegmentState struct {
+	File int
+	//Blocks and checkpoints waiting for a writer, out of QueueCap
+	Queued   int
+	QueueCap int
+	Held     time.Duration
+}
+
+//A snapshot of the provider's goroutines and channels, see DebugState
+type DebugState struct {
+	//Writer goroutines of locked segments
+	Writers int
+	//One per allocator. With FilesPerStream or SizeClasses set, there is a
+	//single allocator
+	//which only takes back returned files
+	Allocators []AllocatorState
+	//By worker name
+	Workers          map[string]string
+	BackgroundPaused bool
+	Segments         []SegmentState
+}
+
+//Returns what the provider's goroutines are doing and how full their
+//channels are, for working out why something hangs. None of the goroutines
+//are waited on, so this is safe to call while they are stuck
+func (sp *FileStorageProvider) DebugState() DebugState {
+	rv := DebugState{
+		Writers: int(atomic.LoadInt64(&sp.writers)),
+		Workers: make(map[string]string),
+	}
+	for i := range sp.fidx {
+		rv.Allocators = append(rv.Allocators, AllocatorState{
+			State:    gsNames[atomic.LoadInt32(&sp.allocstate[i])],
+			Returned: len(sp.retfidx[i]),
+		})
+	}
+	for i, name := range bgNames {
+		rv.Workers[name] = gsNames[atomic.LoadInt32(&sp.bgstate[i])]
+	}
+	sp.bgpause.mu.Lock()
+	rv.BackgroundPaused = sp.bgpause.paused
+	sp.bgpause.mu.Unlock()
+	now := time.Now()
+	sp.segsmu.Lock()
+	for seg := range sp.segs {
+		rv.Segments = append(rv.Segments, SegmentState{
+			File:     seg.fidx,
+			Queued:   len(seg.wchan),
+			QueueCap: cap(seg.wchan),
+			Held:     now.Sub(seg.locked),
+		})
+	}
+	sp.segsmu.Unlock()
+	return rv
+}
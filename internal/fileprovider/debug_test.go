@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestDebugState(t *testing.T) {
+	release := make(chan struct{})
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &stalledSegfile{f, release}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	//Each writer takes one block off the queue and stalls writing it
+	queued := make(map[int]int)
+	var segs []bprovider.Segment
+	for _, n := range []int{6, 2} {
+		id := uuid.NewRandom()
+		seg := sp.LockSegment(id)
+		addr := seg.BaseAddress()
+		for i := 0; i < n; i++ {
+			var err error
+			addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		segs = append(segs, seg)
+		queued[int(seg.BaseAddress()>>50)] = n - 1
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ds := sp.DebugState()
+		match := len(ds.Segments) == len(queued)
+		for _, s := range ds.Segments {
+			if q, ok := queued[s.File]; !ok || s.Queued != q {
+				match = false
+			}
+		}
+		if ds.Writers == 2 && match {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 writers and queues %v, got %+v", queued, ds)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ds := sp.DebugState()
+	if len(ds.Allocators) != 1 {
+		t.Fatalf("expected 1 allocator, got %+v", ds.Allocators)
+	}
+	for name, state := range ds.Workers {
+		if state != "not running" {
+			t.Fatalf("expected %s not to be running, got %q", name, state)
+		}
+	}
+	close(release)
+	for _, seg := range segs {
+		seg.Unlock()
+	}
+	ds = sp.DebugState()
+	if ds.Writers != 0 || len(ds.Segments) != 0 {
+		t.Fatalf("expected no writers or segments after unlocking, got %+v", ds)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+//How often free space is checked if FreeSpaceInterval is not set
+const DEFAULT_FREESPACE_INTERVAL = 10 * time.Second
+
+//Returns the bytes available to us on the volume holding path
+var statfs = func(path string) (uint64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), nil
+}
+
+//Refuse writes if a storage volume has less than MinFreeBytes available.
+//That is the volume of the metadata or of any of the blockstore files. This
+//is checked periodically rather than on every write, so it must leave
+//enough headroom for the writes between checks
+func (sp *FileStorageProvider) checkFreeSpace() {
+	free, err := statfs(sp.dbpath)
+	if err != nil {
+		sp.logger().Error("Could not check free space", "err", err)
+		return
+	}
+	path := sp.dbpath
+	for _, root := range sp.dbroots {
+		if root == sp.dbpath {
+			continue
+		}
+		rfree, err := statfs(root)
+		if err != nil {
+			sp.logger().Error("Could not check free space", "err", err)
+			return
+		}
+		if rfree < free {
+			free, path = rfree, root
+		}
+	}
+	var low int32
+	if free < sp.MinFreeBytes {
+		low = 1
+	}
+	if atomic.SwapInt32(&sp.lowspace, low) != low {
+		if low == 1 {
+			sp.logger().Warn("Refusing writes, too little space is free", "free", free, "path", path)
+		} else {
+			sp.logger().Warn("Accepting writes again", "free", free, "path", path)
+		}
+	}
+}
+
+//Check free space periodically, until the provider is closed
+func (sp *FileStorageProvider) freeSpaceWatcher() {
+	defer sp.bgwg.Done()
+	interval := sp.FreeSpaceInterval
+	if interval <= 0 {
+		interval = DEFAULT_FREESPACE_INTERVAL
+	}
+	for {
+		atomic.StoreInt32(&sp.bgstate[bgFreeSpace], gsSleeping)
+		if !sp.sleep(interval) {
+			atomic.StoreInt32(&sp.bgstate[bgFreeSpace], gsNotRunning)
+			return
+		}
+		atomic.StoreInt32(&sp.bgstate[bgFreeSpace], gsRunning)
+		sp.checkFreeSpace()
+	}
+}
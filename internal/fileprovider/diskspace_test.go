@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestRefuseWritesOnLowSpace(t *testing.T) {
+	var free uint64 = 1 << 40
+	realstatfs := statfs
+	statfs = func(path string) (uint64, error) {
+		return atomic.LoadUint64(&free), nil
+	}
+	defer func() { statfs = realstatfs }()
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.MinFreeBytes = 1 << 30
+		sp.FreeSpaceInterval = time.Hour
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	addr := writeOne(t, sp, id, mkData(100, 0))
+
+	atomic.StoreUint64(&free, 1<<20)
+	sp.checkFreeSpace()
+	seg := sp.LockSegment(id)
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 1)); err != bprovider.ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace on low space, got %v", err)
+	}
+	data, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE))
+	if err != nil || !bytes.Equal(data, mkData(100, 0)) {
+		t.Fatalf("reads should continue on low space (%v)", err)
+	}
+
+	atomic.StoreUint64(&free, 1<<40)
+	sp.checkFreeSpace()
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 1)); err != nil {
+		t.Fatalf("expected writes to resume, got %v", err)
+	}
+	seg.Unlock()
+}
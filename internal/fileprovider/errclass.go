@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//Whether an I/O error might go away if the operation is retried. EIO is
+//included, as it is what a brief fault in the disk or its path looks like
+func isTransient(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	if err == syscall.EIO {
+		return true
+	}
+	if t, ok := err.(interface{ Temporary() bool }); ok {
+		return t.Temporary()
+	}
+	return false
+}
+
+//Whether the error is a system call interrupted by a signal, which can be
+//retried right away
+func isInterrupted(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.EINTR
+}
+
+//Call fn until it succeeds, it fails with an error that is not transient, or
+//it has been retried the given number of times, sleeping backoff before the
+//first retry and twice as long before each one after that. An interrupted
+//call is retried without sleeping. Returns the last error and the number of
+//attempts made
+func retryTransient(retries int, backoff time.Duration, fn func() error) (error, int) {
+	attempt := 1
+	for {
+		err := fn()
+		if err == nil || attempt > retries || !isTransient(err) {
+			return err, attempt
+		}
+		if !isInterrupted(err) {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		attempt++
+	}
+}
+
+//Retry a read or write of blocks as IORetries says, counting the retries
+func (sp *FileStorageProvider) retryIO(fn func() error) error {
+	err, attempts := retryTransient(sp.IORetries, sp.IORetryBackoff, fn)
+	atomic.AddUint64(&sp.ioretries, uint64(attempts-1))
+	return err
+}
+
+//ReadAt on the given file, retrying transient errors. Running into the end
+//of the file is not one
+func (sp *FileStorageProvider) readAt(fidx int, b []byte, off int64) (int, error) {
+	var f io.ReaderAt = sp.dbrf[fidx]
+	if sp.tier != nil {
+		f = sp.tier.reader(fidx, f)
+	}
+	if sp.wrapReadfile != nil {
+		f = sp.wrapReadfile(f)
+	}
+	var n int
+	err := sp.retryIO(func() error {
+		var err error
+		n, err = f.ReadAt(b, off)
+		return err
+	})
+	return n, err
+}
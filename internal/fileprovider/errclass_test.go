@@ -0,0 +1,108 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+//Fails the next failures writes, or reads, with err
+type flakySegfile struct {
+	segfile
+	failures *int32
+	err      error
+}
+
+func (f *flakySegfile) WriteAt(b []byte, off int64) (int, error) {
+	if atomic.AddInt32(f.failures, -1) >= 0 {
+		return 0, f.err
+	}
+	return f.segfile.WriteAt(b, off)
+}
+
+type flakyReadfile struct {
+	io.ReaderAt
+	failures *int32
+	err      error
+}
+
+func (f *flakyReadfile) ReadAt(b []byte, off int64) (int, error) {
+	if atomic.AddInt32(f.failures, -1) >= 0 {
+		return 0, f.err
+	}
+	return f.ReaderAt.ReadAt(b, off)
+}
+
+func TestIORetries(t *testing.T) {
+	var wfail, rfail int32
+	eio := &os.PathError{Op: "write", Path: "blockstore", Err: syscall.EIO}
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.IORetries = 3
+		sp.IORetryBackoff = time.Millisecond
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &flakySegfile{f, &wfail, eio}
+		}
+		sp.wrapReadfile = func(f io.ReaderAt) io.ReaderAt {
+			return &flakyReadfile{f, &rfail, syscall.EINTR}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i < 3; i++ {
+		//Each write fails twice before it goes through
+		atomic.StoreInt32(&wfail, 2)
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := seg.(*FileProviderSegment).Checkpoint(); err != nil {
+			t.Fatalf("expected the write to succeed after retries, got %v", err)
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range addrs {
+		atomic.StoreInt32(&rfail, 3)
+		d, err := sp.Read(id, a, make([]byte, 200))
+		if err != nil || !bytes.Equal(d, mkData(100, byte(i))) {
+			t.Fatalf("expected block %d to read back after retries: %v", i, err)
+		}
+	}
+	if st := sp.Stats(); st.IORetries != 3*2+3*3 {
+		t.Fatalf("expected %d retries, got %d", 3*2+3*3, st.IORetries)
+	}
+	//More failures than retries
+	atomic.StoreInt32(&rfail, 4)
+	if _, err := sp.Read(id, addrs[0], make([]byte, 200)); err == nil {
+		t.Fatalf("expected the read to fail once retries are exhausted")
+	}
+	atomic.StoreInt32(&rfail, 0)
+	seg = sp.LockSegment(id)
+	atomic.StoreInt32(&wfail, 4)
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 9)); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Unlock(); err == nil {
+		t.Fatalf("expected the write to fail once retries are exhausted")
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+//Reserve disk space for n bytes of the file from off, leaving its size as it
+//is. See prealloc.go
+var fallocate = func(f *os.File, off int64, n int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, off, n)
+}
+
+//Free the disk space of n bytes of the file from off, which then read as
+//zeros. See tiered.go
+func punchHole(f *os.File, off int64, n int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+}
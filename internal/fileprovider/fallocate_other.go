@@ -0,0 +1,23 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+// +build !linux
+
+package fileprovider
+
+import "os"
+
+//Space is only preallocated on Linux, elsewhere files grow as blocks are
+//written
+var fallocate = func(f *os.File, off int64, n int64) error {
+	return nil
+}
+
+//Likewise migrated ranges stay on the local disk, see tiered.go
+func punchHole(f *os.File, off int64, n int64) error {
+	return nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"container/heap"
+)
+
+//The available files of an allocator, least full first, so that picking one
+//takes O(log n) and no syscalls. A file is keyed by its size (see fileSize)
+//when it was made available. That only changes while a file is locked or
+//detached, except when a standby restores blocks or the file is shared, so
+//the key of the least full file is checked as it is taken and fixed if stale
+type fileheap struct {
+	sp    *FileStorageProvider
+	files []heapfile
+	//The position of each file in files, or -1 if it is not available
+	pos []int
+}
+
+type heapfile struct {
+	fidx int
+	off  int64
+}
+
+func newFileHeap(sp *FileStorageProvider) *fileheap {
+	h := &fileheap{sp: sp, pos: make([]int, sp.numfiles)}
+	for i := range h.pos {
+		h.pos[i] = -1
+	}
+	return h
+}
+
+func (h *fileheap) Len() int { return len(h.files) }
+
+//Ties go to the lower file index, so that selection is deterministic
+func (h *fileheap) Less(i, j int) bool {
+	if h.files[i].off != h.files[j].off {
+		return h.files[i].off < h.files[j].off
+	}
+	return h.files[i].fidx < h.files[j].fidx
+}
+
+func (h *fileheap) Swap(i, j int) {
+	h.files[i], h.files[j] = h.files[j], h.files[i]
+	h.pos[h.files[i].fidx] = i
+	h.pos[h.files[j].fidx] = j
+}
+
+func (h *fileheap) Push(x interface{}) {
+	f := x.(heapfile)
+	h.pos[f.fidx] = len(h.files)
+	h.files = append(h.files, f)
+}
+
+func (h *fileheap) Pop() interface{} {
+	f := h.files[len(h.files)-1]
+	h.files = h.files[:len(h.files)-1]
+	h.pos[f.fidx] = -1
+	return f
+}
+
+//Make the file available
+func (h *fileheap) add(fidx int) {
+	if h.pos[fidx] != -1 {
+		return
+	}
+	heap.Push(h, heapfile{fidx, h.sp.fileSize(fidx)})
+}
+
+//Make the file unavailable
+func (h *fileheap) remove(fidx int) {
+	if h.pos[fidx] == -1 {
+		return
+	}
+	heap.Remove(h, h.pos[fidx])
+}
+
+func (h *fileheap) available(fidx int) bool {
+	return h.pos[fidx] != -1
+}
+
+//Returns the least full available file without taking it, or -1 if there
+//is none
+func (h *fileheap) least() int {
+	for len(h.files) > 0 {
+		top := &h.files[0]
+		off := h.sp.fileSize(top.fidx)
+		if off == top.off {
+			return top.fidx
+		}
+		top.off = off
+		heap.Fix(h, 0)
+	}
+	return -1
+}
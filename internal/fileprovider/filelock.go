@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"context"
+	"sync"
+)
+
+//Guards the read descriptor of a file. Reads use ReadAt, which doesn't move
+//a shared offset and is safe to call concurrently on every platform (pread on
+//unix, a read at an offset on Windows, where the os package serializes them
+//itself), so readers share the lock. It is only held exclusively to close or
+//replace the descriptor, as Close and compaction do. Waiting for it can be
+//given up on, so that a read stuck behind a slow swap can be cancelled, and
+//a writer waiting for it keeps new readers out so it is not starved
+type filelock struct {
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	waiting int
+	//Closed and replaced whenever the lock is released
+	changed chan struct{}
+}
+
+func newFileLocks(n int) []filelock {
+	rv := make([]filelock, n)
+	for i := range rv {
+		rv[i].changed = make(chan struct{})
+	}
+	return rv
+}
+
+//Take the lock exclusively
+func (l *filelock) Lock() {
+	l.mu.Lock()
+	l.waiting++
+	for l.writer || l.readers > 0 {
+		ch := l.changed
+		l.mu.Unlock()
+		<-ch
+		l.mu.Lock()
+	}
+	l.waiting--
+	l.writer = true
+	l.mu.Unlock()
+}
+
+func (l *filelock) Unlock() {
+	l.mu.Lock()
+	l.writer = false
+	l.release()
+	l.mu.Unlock()
+}
+
+//Share the lock with other readers
+func (l *filelock) RLock() {
+	l.rlockCtx(context.Background())
+}
+
+func (l *filelock) RUnlock() {
+	l.mu.Lock()
+	l.readers--
+	if l.readers == 0 {
+		l.release()
+	}
+	l.mu.Unlock()
+}
+
+//RLock, unless the context is done first, in which case ctx.Err() is
+//returned
+func (l *filelock) rlockCtx(ctx context.Context) error {
+	l.mu.Lock()
+	for l.writer || l.waiting > 0 {
+		ch := l.changed
+		l.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		l.mu.Lock()
+	}
+	l.readers++
+	l.mu.Unlock()
+	return nil
+}
+
+//Wake everything waiting for the lock. Must be called with mu held
+func (l *filelock) release() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+//Readers of a file share its lock, and only wait for a swap of the file
+func TestConcurrentReads(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i < 100; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100+i*50, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	//A read does not wait for another reader to finish
+	fidx := addrs[0] >> 50
+	sp.dbrf_mtx[fidx].RLock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := sp.Read(id, addrs[0], make([]byte, MAXBLOCKSIZE))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read waited for another reader")
+	}
+	sp.dbrf_mtx[fidx].RUnlock()
+
+	stop := make(chan struct{})
+	var swaps sync.WaitGroup
+	swaps.Add(1)
+	go func() {
+		defer swaps.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			sp.dbrf_mtx[fidx].Lock()
+			time.Sleep(100 * time.Microsecond)
+			sp.dbrf_mtx[fidx].Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(g)))
+			buf := make([]byte, MAXBLOCKSIZE)
+			for n := 0; n < 200; n++ {
+				i := rnd.Intn(len(addrs))
+				got, err := sp.Read(id, addrs[i], buf)
+				if err != nil || !bytes.Equal(got, mkData(100+i*50, byte(i))) {
+					errs <- fmt.Errorf("block %d did not read back: %v", i, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(stop)
+	swaps.Wait()
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+}
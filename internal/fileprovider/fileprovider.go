@@ -9,15 +9,24 @@
 package fileprovider
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BTrDB/btrdb-server/bte"
 	"github.com/BTrDB/btrdb-server/internal/bprovider"
 	"github.com/BTrDB/btrdb-server/internal/configprovider"
 	"github.com/op/go-logging"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 var log *logging.Logger
@@ -26,54 +35,667 @@ func init() {
 	log = logging.MustGetLogger("log")
 }
 
+//The number of blockstore files if the configuration does not say
 const NUMFILES = 256
 
+//How many writes a segment can queue if the configuration does not say
+const WRITEQUEUEDEPTH = 16
+
+//The most blockstore files there can be. The file index is the bits of an
+//address above the offset, and addresses with a top byte of FF are reserved
+const MAXNUMFILES = 0xFF << (64 - bprovider.ADDRESSOFFSETBITS - 8)
+
 type writeparams struct {
+	UUID    []byte
 	Address uint64
 	Data    []byte
+	//The CRC to store with the block, if HasCRC is set. Otherwise the writer
+	//computes it
+	CRC    uint32
+	HasCRC bool
+	//The time stored with the block, for FormatTimestamp
+	Timestamp int64
+	//If this is not nil, this is a checkpoint rather than a write. The writer
+	//closes the channel once every write queued before it is on disk
+	Done chan struct{}
+	//The position of this in the segment's queue
+	Seq uint64
+	//If not nil, called by the writer once the block is written
+	Complete func(address uint64)
+	//If not zero, this is the head of a spanning block and the rest of the
+	//data is at this address. See span.go
+	Cont uint64
+	//One more than the Seq of the last checkpoint queued before this, for
+	//StrictBarriers
+	Barrier uint64
+	//Set for the tail of a split block, which is not counted as a write of
+	//its own in Stats
+	Tail bool
+	//The range of a shared file the record is in, see shared.go
+	Resv *reservation
+	//Set for padding records, which are not blocks
+	Pad bool
+	//If not nil, this carries the blocks queued by a WriteBatch rather than
+	//being a write itself. See writeBatch
+	Batch []writeparams
+}
+
+//What the segment writers write through. This is the blockstore file, unless
+//a test has interposed on it
+type segfile interface {
+	WriteAt(b []byte, off int64) (int, error)
+	Datasync() error
+}
+
+type osSegfile struct {
+	*os.File
+}
+
+//What blocks are written to the file through
+func (sp *FileStorageProvider) segfile(f *os.File) segfile {
+	if sp.wrapSegfile != nil {
+		return sp.wrapSegfile(osSegfile{f})
+	}
+	return osSegfile{f}
+}
+
+func (f osSegfile) Datasync() error {
+	return datasync(f.File)
+}
+
+//Implemented by segfiles that can write several buffers in one call, see
+//sync_linux.go. Others have each part of a block written separately
+type vectorWriter interface {
+	WriteVecAt(bufs [][]byte, off int64) (int, error)
+}
+
+//What appends to the metadata log are written through
+type metafile interface {
+	WriteAt(b []byte, off int64) (int, error)
+	Sync() error
 }
 
 type FileProviderSegment struct {
 	sp    *FileStorageProvider
 	fidx  int
 	f     *os.File
+	w     segfile
 	base  int64
 	ptr   int64
 	wchan chan writeparams
 	wg    sync.WaitGroup
+	//Writes and bytes queued since the last checkpoint
+	cpwrites int
+	cpbytes  int64
+	//The timestamp of the last block queued
+	lastts int64
+	//The sequence number of the next write queued
+	seq uint64
+	//Writers finish out of order if there are several, this puts them back
+	//in order. See complete
+	seqmu   sync.Mutex
+	nextseq uint64
+	pending map[uint64]writeparams
+	//One more than the Seq of the last checkpoint queued, and of the last one
+	//completed, for StrictBarriers. cpcond is signalled as checkpoints complete
+	barrier uint64
+	cpdone  uint64
+	cpcond  *sync.Cond
+	//Set by Abort, after which writers discard what is left in the queue
+	aborted int32
+	//The first error writing or syncing the file. Once it is set, writers
+	//discard what is left in the queue and Write returns it. Guarded by
+	//seqmu, failed is set with it
+	err    error
+	failed int32
+	//The range of a shared file the segment is writing, and whether the
+	//file had no room for another. See shared.go
+	resv     *reservation
+	resvfull bool
+	//Set during WriteBatch, when blocks are gathered in batch rather than
+	//queued one by one
+	batching bool
+	batch    []writeparams
+	//The blocks queued in this segment, so Abort can release them
+	queued []queuedblock
+	//When each queued item not yet complete was queued, in sequence order.
+	//Zero for checkpoints. Guarded by seqmu
+	enqtimes []int64
+	//When the segment was locked
+	locked time.Time
+	//The block limit of each stream written to, looked up on its first write
+	blocklimits map[[16]byte]int64
+}
+
+type queuedblock struct {
+	uuid    []byte
+	address uint64
 }
 
 type FileStorageProvider struct {
-	fidx     chan int
-	retfidx  chan int
+	//One pair of channels per allocator, see provideFiles
+	fidx     []chan int
+	retfidx  []chan int
+	detachch []chan detachreq
+	//The number of blockstore files, from the configuration
+	numfiles int
 	dbf      []*os.File
 	dbrf     []*os.File
-	dbrf_mtx []sync.Mutex
+	dbrf_mtx []filelock
 	favail   []bool
+	dbpath   string
+	//The directories the blockstore files are in, see blockPath
+	dbroots []string
+	//Guards changes to favail. Also used instead of the fidx channel when
+	//FilesPerStream or SizeClasses is set
+	favailmu   sync.Mutex
+	favailcond *sync.Cond
+	ring       []ringpoint
+	//Nonzero while free space is below MinFreeBytes
+	lowspace int32
+	//Nonzero while writes are refused, see standby.go and ReadOnly
+	readonly int32
+	//If set, Initialize opens the database without writing to it, to query a
+	//snapshot or a database another process writes. Only read descriptors
+	//are opened, an incomplete block at the end of a file is ignored rather
+	//than truncated, and no allocators or background workers are started.
+	//Writes fail with bprovider.ErrReadOnly, and LockSegment returns a
+	//segment holding no file whose writes do
+	ReadOnly bool
+	//If set, Initialize registers the provider's Prometheus metrics here, see
+	//metrics.go
+	Registerer prometheus.Registerer
+	metrics    *metrics
+	//Where the provider reports what it does, see logger.go. If nil, the
+	//package's go-logging logger is used
+	Logger Logger
+	//Set by TieredStorageProvider when it wraps this provider
+	tier remoteTier
+	//If set, segment writers write through what this returns, for tests
+	wrapSegfile func(segfile) segfile
+	//Likewise for reads of the blockstore files, see readAt
+	wrapReadfile func(io.ReaderAt) io.ReaderAt
+	//Likewise for appends to the metadata log, see metafile
+	wrapMetafile func(metafile) metafile
+	metaw        metafile
+	//Where allocate starts looking for a file
+	nextalloc uint32
+	//The format flags of the files, see format.go
+	format uint16
+	//Optional format flags for CreateDatabase. Checksums are always enabled
+	FormatFlags uint16
+	//The codec new blocks are compressed with, from the configuration
+	codec byte
+	//The offset of the first block in each file
+	datastart int64
+	//The end of the last block completely written to each file
+	committed []int64
+	//The end of the last block queued to each file. Nothing can be read
+	//past it
+	frontier []int64
+	//The ranges reserved in each file, if files are shared
+	tails []filetail
+	//How far disk space has been reserved in each file
+	preallocs []preallocstate
+	//How far the scrubber has got in each file
+	scrubpos []int64
+	//Whether Flush syncs the file, from the configuration
+	syncOnFlush bool
+	//The permissions files are created with, from the configuration
+	fileMode os.FileMode
+	//Whether every block is read back after it is written, from the
+	//configuration. See verify.go
+	verifyWrites bool
+	//How many writes a segment can queue before Write blocks, from the
+	//configuration
+	queueDepth int
+
+	//If nonzero, a segment issues a checkpoint by itself after this many
+	//writes, or this many bytes, since its last checkpoint
+	CheckpointWrites int
+	CheckpointBytes  int64
+	//If true, a checkpoint also syncs the file
+	SyncOnCheckpoint bool
+	//If true, superseded annotations remain readable via
+	//GetStreamAnnotationVersion
+	KeepAnnotationHistory bool
+	//If nonzero, a background scrubber verifies every block, sleeping this
+	//long between passes, and reading at most ScrubBytesPerSec (if nonzero)
+	//across ScrubWorkers parallel workers, each taking whole roots of
+	//StorageFilepaths
+	ScrubInterval    time.Duration
+	ScrubBytesPerSec int64
+	ScrubWorkers     int
+	//If nonzero, relocations (see compact.go) together copy at most
+	//CompactBytesPerSec, counting both reads and writes, and at most
+	//CompactConcurrency of them copy at once
+	CompactBytesPerSec int64
+	CompactConcurrency int
+	//If either is nonzero, stream version changes are written to the metadata
+	//log as they happen but only synced once VersionFlushBatch are pending, or
+	//every VersionFlushInterval
+	VersionFlushBatch    int
+	VersionFlushInterval time.Duration
+	//If true, the size of the first read of a block adapts to the sizes of
+	//recently read blocks, up to MaxFirstRead (the largest block size if zero).
+	//See firstread.go
+	AdaptiveFirstRead bool
+	MaxFirstRead      int
+	//If nonzero, writes fail with ErrNoSpace while the storage volume has
+	//less than this many bytes free, checked every FreeSpaceInterval
+	MinFreeBytes      uint64
+	FreeSpaceInterval time.Duration
+	//If nonzero, disk space is reserved for each file this many bytes at a
+	//time, ahead of where blocks are written. See prealloc.go
+	PreallocateBytes int64
+	//The size a file may grow to, at most the 1PB the address can describe.
+	//Files that are full are only handed out by LockSegment once every file
+	//is full. A block that does not fit is split if the format has FormatSpan,
+	//otherwise the write fails with ErrNoSpace
+	MaxFileSize int64
+	//If nonzero, each stream's blocks are confined to this many files,
+	//chosen by consistent hashing of its uuid. See placement.go
+	FilesPerStream int
+	//If set, files are split into size classes by these ascending block
+	//sizes, so that each file holds blocks of similar sizes. Class i holds
+	//blocks smaller than SizeClasses[i], the last class holds the rest.
+	//LockSegmentSized picks a file of the right class. See placement.go
+	SizeClasses []int
+	//The number of goroutines handing out files to LockSegment, each with
+	//its own share of the files. Ignored if FilesPerStream or SizeClasses
+	//is set
+	Allocators int
+	//If more than one, up to this many segments can hold a file at once,
+	//each writing to ranges of ReserveBytes (DEFAULT_RESERVE if zero) that it
+	//reserves in the file. Ignored if FilesPerStream or SizeClasses is set.
+	//See shared.go
+	WritersPerFile int
+	ReserveBytes   int64
+	//The number of goroutines writing the blocks of each segment, and
+	//whether WriteNotify callbacks must fire in the order blocks were written
+	SegmentWriters    int
+	OrderedCompletion bool
+	//If set, no block queued after a checkpoint is written until the
+	//checkpoint (including its sync) is complete, even with several
+	//SegmentWriters
+	StrictBarriers bool
+	//Limits on the size of a stream's annotation (never more than
+	//bprovider.MaxAnnotationSize) and of its tags, keys and values included.
+	//Zero means the default, which for tags is no limit
+	MaxAnnotationSize int
+	MaxTagsSize       int
+	//If set, the data of every block is passed through PreWrite before it is
+	//stored and through PostRead after it is read and checked, so PostRead
+	//must undo PreWrite. The checksum and length stored are those of the
+	//transformed data. WriteChecked and ReadChecked can't be used with hooks
+	PreWrite func(data []byte) []byte
+	PostRead func(data []byte) []byte
+	//How many times an append to the metadata log that fails with a transient
+	//error is retried, waiting MetadataRetryBackoff before the first retry
+	//and twice as long before each one after that
+	MetadataRetries      int
+	MetadataRetryBackoff time.Duration
+	//Likewise for reads and writes of blocks. A read or write interrupted
+	//by a signal is retried right away
+	IORetries      int
+	IORetryBackoff time.Duration
+	//The fraction of blocks written that are read back and compared with
+	//what was written, see verify.go. Mismatches are counted in Stats. Not
+	//used with StorageVerifyWrites, which reads back every block
+	VerifySampleRate float64
+	//If nonzero, writes to a stream with this many live blocks fail with a
+	//ResourceDepleted error. Streams can override this with
+	//SetStreamBlockLimit. Only blocks written since the provider was
+	//initialized are counted, see livesize.go
+	MaxStreamBlocks int64
+	//If nonzero, the most scratch space (see scratch.go) that may be
+	//allocated at once
+	ScratchLimit int64
+	//If set, reads of superblocks of versions above the stream's current
+	//version (which a rollback has made invalid) fail rather than returning
+	//stale data
+	StrictVersionReads bool
+	//If set, called before anything is read by Read, ReadLenient and
+	//ReadChecked. If it returns an error, the read fails with that error
+	BeforeRead func(uuid []byte, address uint64) error
+	//If set, only recent stream metadata is held in memory, with the rest
+	//in index files next to the metadata log. See metaindex.go
+	MetadataOnDisk       bool
+	MetadataMemtableSize int
+	//The size of the chunks IterateFile and ReadRange read, ITERATECHUNK if
+	//zero
+	IterateChunkSize int
+	//If set, a read into a buffer too small for the block allocates a big
+	//enough one and returns the data in that instead of failing with
+	//bprovider.ErrBufferTooSmall
+	GrowSmallBuffers bool
+
+	metamu  sync.RWMutex
+	metaf   *os.File
+	metaend int64
+	meta    map[[16]byte]*streammeta
+	//Streams by collection, and by collection then tag
+	collidx map[string]map[[16]byte]*streammeta
+	tagidx  map[string]map[string]map[[16]byte]*streammeta
+	//Stream versions, and how many changes to them are in the log but not
+	//yet synced
+	versions  map[[16]byte]uint64
+	vunsynced int
+	//Tags merged into streams created in a collection
+	colldefaults map[string]map[string]string
+	//Only used with MetadataOnDisk, in which case the maps above only hold
+	//what has changed since the index was written
+	metaidx *metaindex
+
+	fwd     forwardtable
+	bgpause pausegate
+	//Shared by all relocations, see compact.go
+	compactBudget *ratelimiter
+	compactSlots  chan struct{}
+
+	checkpoints uint64
+	syncs       uint64
+	scrubbed    uint64
+	scrubErrors uint64
+	metawrites  uint64
+	metasyncs   uint64
+	reads       uint64
+	secondreads uint64
+	ioretries   uint64
+	remaps      uint64
+	verified    uint64
+	verifyFails uint64
+	verifyseq   uint64
+	//The size of the first read of a block, from the configuration, and the
+	//sizes of recent blocks for AdaptiveFirstRead
+	firstread  int
+	blocksizes sizesampler
+	//Per file I/O error counts, see stats.go
+	errs errcounters
+	//When a block was last written to each file, in unix nanoseconds. See
+	//FileActivity
+	lastwrite []int64
+	//Reads and writes, see stats.go
+	io iocounters
+	//The blocks of each stream not yet released, see livesize.go
+	live liveindex
+	//The segments currently locked, see stats.go
+	segs   map[*FileProviderSegment]struct{}
+	segsmu sync.Mutex
+	//How long LockSegment waits, see lockstats.go
+	lockstats lockcounters
+	//One per file, see syncgroup.go
+	syncgroups []syncgroup
+	//The superblock log and where each version is in it, see superblock.go
+	sbmu  sync.RWMutex
+	sbf   *os.File
+	sbend int64
+	sbidx map[[16]byte]map[uint64]sbloc
+	//Allocated scratch space, see scratch.go
+	scratch scratchstate
+	//Recently read and written blocks, see readcache.go
+	rcache readcache
+	//Buffers for Read, see readbuf.go
+	readbufs sync.Pool
+	//Whether files are read through mappings, from the configuration, and
+	//the mapping of each file. See mmap.go
+	useMmap bool
+	maps    []filemap
+	//What the goroutines are doing, see debug.go
+	writers    int64
+	allocstate []int32
+	bgstate    [NUMBGWORKERS]int32
+
+	//Closed by Close to stop the allocators and background workers, which
+	//are counted in bgwg. Locked segments are counted in segwg
+	done   chan struct{}
+	closed int32
+	bgwg   sync.WaitGroup
+	segwg  sync.WaitGroup
 }
 
 func (seg *FileProviderSegment) writer() {
-
+	atomic.AddInt64(&seg.sp.writers, 1)
 	for args := range seg.wchan {
-		off := int64(args.Address & ((1 << 50) - 1))
-		lenarr := make([]byte, 2)
-		lenarr[0] = byte(len(args.Data))
-		lenarr[1] = byte(len(args.Data) >> 8)
-		_, err := seg.f.WriteAt(lenarr, off)
-		if err != nil {
-			log.Panic("File writing error %v", err)
+		if args.Batch != nil {
+			seg.writeBatch(args.Batch)
+			continue
 		}
-		_, err = seg.f.WriteAt(args.Data, off+2)
-		if err != nil {
-			log.Panic("File writing error %v", err)
+		if args.Done == nil && !seg.stopped() {
+			seg.waitBarrier(args.Barrier)
+			start := time.Now()
+			_, off := bprovider.DecodeAddress(args.Address)
+			seg.sp.preallocate(seg.fidx, off+seg.sp.recordLen(&args))
+			err := seg.writeBlock(&args)
+			atomic.AddInt64(&seg.sp.io.writeTime, int64(time.Since(start)))
+			if err == nil {
+				err = seg.verifyWrite(&args)
+			}
+			if err != nil {
+				seg.fail(err)
+			} else {
+				seg.written(&args)
+			}
 		}
+		seg.complete(args)
 	}
+	atomic.AddInt64(&seg.sp.writers, -1)
 	seg.wg.Done()
 }
+
+//With StrictBarriers, wait until the checkpoints a write must follow are
+//done
+func (seg *FileProviderSegment) waitBarrier(barrier uint64) {
+	if !seg.sp.StrictBarriers {
+		return
+	}
+	seg.seqmu.Lock()
+	for seg.cpdone < barrier && !seg.stopped() {
+		seg.cpcond.Wait()
+	}
+	seg.seqmu.Unlock()
+}
+
+//Called by a writer once a block is in the file
+func (seg *FileProviderSegment) written(args *writeparams) {
+	atomic.StoreInt64(&seg.sp.lastwrite[seg.fidx], time.Now().UnixNano())
+	if !args.Pad && !seg.sp.verifyWrites && seg.sp.sampleVerify() {
+		seg.verifyBlock(args)
+	}
+	if args.Complete != nil && !seg.sp.OrderedCompletion {
+		args.Complete(args.Address)
+	}
+}
+
+//Called by a writer once it is done with something from the queue. The block
+//is only considered committed (and checkpoints only happen) once everything
+//queued before it is also done, so the file never appears to have holes
+func (seg *FileProviderSegment) complete(args writeparams) {
+	seg.seqmu.Lock()
+	defer seg.seqmu.Unlock()
+	if args.Seq != seg.nextseq {
+		if seg.pending == nil {
+			seg.pending = make(map[uint64]writeparams)
+		}
+		seg.pending[args.Seq] = args
+		return
+	}
+	for {
+		seg.enqtimes = seg.enqtimes[1:]
+		if seg.stopped() {
+			if args.Done != nil {
+				close(args.Done)
+			}
+		} else if args.Done != nil {
+			//Sync without seqmu, so other writers completing in the meantime
+			//don't wait behind it. They only go to pending, since nextseq
+			//does not move past the checkpoint until it is done
+			seg.seqmu.Unlock()
+			err := seg.checkpoint()
+			seg.seqmu.Lock()
+			if err != nil {
+				seg.failLocked(err)
+			}
+			seg.cpdone = args.Seq + 1
+			seg.cpcond.Broadcast()
+			close(args.Done)
+		} else {
+			_, off := bprovider.DecodeAddress(args.Address)
+			if args.Resv != nil {
+				seg.sp.advance(seg.fidx, args.Resv, off+seg.sp.recordLen(&args))
+			} else {
+				atomic.StoreInt64(&seg.sp.committed[seg.fidx], off+seg.sp.recordLen(&args))
+			}
+			if args.Complete != nil && seg.sp.OrderedCompletion {
+				args.Complete(args.Address)
+			}
+		}
+		seg.nextseq++
+		next, ok := seg.pending[seg.nextseq]
+		if !ok {
+			return
+		}
+		delete(seg.pending, seg.nextseq)
+		args = next
+	}
+}
+
+//Record the first error writing the segment, see the err field
+func (seg *FileProviderSegment) fail(err error) {
+	seg.seqmu.Lock()
+	seg.failLocked(err)
+	seg.seqmu.Unlock()
+}
+
+func (seg *FileProviderSegment) failLocked(err error) {
+	if seg.err == nil {
+		seg.sp.logger().Error("Writing file failed, failing the segment", "file", seg.fidx, "err", err)
+		seg.err = err
+		atomic.StoreInt32(&seg.failed, 1)
+		//Writers waiting on a barrier must not wait for a checkpoint that
+		//will not happen
+		seg.cpcond.Broadcast()
+	}
+}
+
+//Returns the first error writing the segment, if any
+func (seg *FileProviderSegment) failure() error {
+	if atomic.LoadInt32(&seg.failed) == 0 {
+		return nil
+	}
+	seg.seqmu.Lock()
+	defer seg.seqmu.Unlock()
+	return seg.err
+}
+
+//Whether writers should discard what is left in the queue
+func (seg *FileProviderSegment) stopped() bool {
+	return atomic.LoadInt32(&seg.aborted) != 0 || atomic.LoadInt32(&seg.failed) != 0
+}
+
+//Write a block to its place in the file
+func (seg *FileProviderSegment) writeBlock(args *writeparams) error {
+	//Writing the same bytes to the same place again is harmless, so a
+	//failed write is simply tried again
+	err := seg.sp.retryIO(func() error {
+		_, off := bprovider.DecodeAddress(args.Address)
+		bufs := seg.sp.recordBufs(args)
+		//The sentinel is written on its own once the rest of the record
+		//is, so a record that has it is complete
+		var sentinel []byte
+		if seg.sp.format&FormatSentinel != 0 {
+			last := bufs[len(bufs)-1]
+			sentinel = last[len(last)-1:]
+			bufs[len(bufs)-1] = last[:len(last)-1]
+		}
+		if vw, ok := seg.w.(vectorWriter); ok {
+			n, err := vw.WriteVecAt(bufs, off)
+			if err != nil {
+				return err
+			}
+			off += int64(n)
+		} else {
+			for _, b := range bufs {
+				if _, err := seg.w.WriteAt(b, off); err != nil {
+					return err
+				}
+				off += int64(len(b))
+			}
+		}
+		if sentinel != nil {
+			_, err := seg.w.WriteAt(sentinel, off)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		atomic.AddUint64(&seg.sp.errs.write[seg.fidx], 1)
+	}
+	return err
+}
+
+//The parts of a block's record, in the order they are in the file
+func (sp *FileStorageProvider) recordBufs(args *writeparams) [][]byte {
+	lenarr := sp.lengthPrefix(len(args.Data))
+	if args.Cont != 0 {
+		lenarr = spanHeader(len(args.Data), args.Cont)
+	}
+	bufs := [][]byte{lenarr, args.Data}
+	if trailer := sp.trailer(args); len(trailer) > 0 {
+		bufs = append(bufs, trailer)
+	}
+	return bufs
+}
+
+//Encode whatever follows the data of a block in this format
+func (sp *FileStorageProvider) trailer(args *writeparams) []byte {
+	rv := make([]byte, 0, sp.blockOverhead()-int64(sp.prefixLen()))
+	if sp.format&FormatTimestamp != 0 {
+		for i := uint(0); i < 64; i += 8 {
+			rv = append(rv, byte(args.Timestamp>>i))
+		}
+	}
+	if sp.format&FormatCRC != 0 {
+		crc := args.CRC
+		if !args.HasCRC {
+			crc = crc32.Checksum(args.Data, crctab)
+		}
+		rv = append(rv, byte(crc), byte(crc>>8), byte(crc>>16), byte(crc>>24))
+	}
+	if sp.format&FormatSentinel != 0 {
+		rv = append(rv, SENTINEL)
+	}
+	return rv
+}
+
+//Called by the writer when it reaches a checkpoint in the queue
+func (seg *FileProviderSegment) checkpoint() error {
+	atomic.AddUint64(&seg.sp.checkpoints, 1)
+	if seg.sp.SyncOnCheckpoint {
+		err := seg.sp.syncgroups[seg.fidx].sync(seg.w.Datasync)
+		if err != nil {
+			atomic.AddUint64(&seg.sp.errs.write[seg.fidx], 1)
+			return err
+		}
+		atomic.AddUint64(&seg.sp.syncs, 1)
+	}
+	return nil
+}
+
 func (seg *FileProviderSegment) init() {
-	seg.wchan = make(chan writeparams, 16)
-	seg.wg.Add(1)
-	go seg.writer()
+	seg.locked = time.Now()
+	seg.wchan = make(chan writeparams, seg.sp.queueDepth)
+	seg.cpcond = sync.NewCond(&seg.seqmu)
+	seg.w = seg.sp.segfile(seg.f)
+	seg.sp.addSegment(seg)
+	n := seg.sp.SegmentWriters
+	if n < 1 {
+		n = 1
+	}
+	seg.wg.Add(n)
+	for i := 0; i < n; i++ {
+		go seg.writer()
+	}
 }
 
 //Returns the address of the first free word in the segment when it was locked
@@ -82,14 +704,105 @@ func (seg *FileProviderSegment) BaseAddress() uint64 {
 	//a) this still leaves 1PB per file
 	//b) The huffman encoding can do 58 bits in 8 bytes, but anything more is 9
 	//c) if we later decide to more than 256 files, we can
-	return (uint64(seg.fidx) << 50) + uint64(seg.base)
+	return bprovider.EncodeAddress(seg.fidx, seg.base)
 }
 
 //Unlocks the segment for the StorageProvider to give to other consumers
-//Implies a flush
-func (seg *FileProviderSegment) Unlock() {
-	seg.Flush()
-	seg.sp.retfidx <- seg.fidx
+//Implies a flush. Returns the first error writing the segment, in which case
+//whatever was written after the last block known to be on disk is discarded
+func (seg *FileProviderSegment) Unlock() error {
+	if seg.resv != nil && !seg.stopped() {
+		seg.releaseReservation()
+	}
+	err := seg.finish()
+	if err != nil {
+		seg.discardFailed()
+	}
+	seg.sp.retfidx[seg.fidx%len(seg.sp.retfidx)] <- seg.fidx
+	return err
+}
+
+//Truncate a failed segment back to the last block known to be on disk, and
+//release the blocks after it. The disk may well refuse, so that is only
+//logged. A shared file is not truncated, as other segments may be writing
+//after it
+func (seg *FileProviderSegment) discardFailed() {
+	end := atomic.LoadInt64(&seg.sp.committed[seg.fidx])
+	if seg.resv == nil {
+		if err := seg.sp.truncateFile(seg.fidx, end); err != nil {
+			seg.sp.logger().Error("Could not truncate failed segment", "file", seg.fidx, "err", err)
+		}
+		atomic.StoreInt64(&seg.sp.frontier[seg.fidx], end)
+	}
+	for _, qb := range seg.queued {
+		if _, off := bprovider.DecodeAddress(qb.address); off >= end {
+			seg.sp.live.release(qb.uuid, []uint64{qb.address})
+			seg.sp.rcache.invalidate(seg.fidx, []uint64{qb.address})
+		}
+	}
+	seg.queued = nil
+}
+
+//Unlocks the segment, discarding everything written to it. Writes still
+//queued are dropped and any that were already written are truncated away, so
+//the file is as it was when the segment was locked. If the file can't be
+//truncated, the blocks are left in it with nothing referring to them, as for
+//a failed segment. The addresses returned by Write must not be used
+//afterwards. On a shared file, what was queued is written anyway and only
+//the blocks are released
+func (seg *FileProviderSegment) Abort() {
+	if seg.resv != nil {
+		if err := seg.Unlock(); err != nil {
+			seg.sp.logger().Error("Could not write aborted segment", "file", seg.fidx, "err", err)
+		}
+		for _, qb := range seg.queued {
+			seg.sp.live.release(qb.uuid, []uint64{qb.address})
+			seg.sp.rcache.invalidate(seg.fidx, []uint64{qb.address})
+		}
+		seg.queued = nil
+		return
+	}
+	atomic.StoreInt32(&seg.aborted, 1)
+	seg.seqmu.Lock()
+	seg.cpcond.Broadcast()
+	seg.seqmu.Unlock()
+	seg.finish()
+	if err := seg.sp.truncateFile(seg.fidx, seg.base); err != nil {
+		atomic.AddUint64(&seg.sp.errs.write[seg.fidx], 1)
+		seg.sp.logger().Error("Could not truncate aborted segment", "file", seg.fidx, "err", err)
+	} else {
+		atomic.StoreInt64(&seg.sp.committed[seg.fidx], seg.base)
+		atomic.StoreInt64(&seg.sp.frontier[seg.fidx], seg.base)
+	}
+	for _, qb := range seg.queued {
+		seg.sp.live.release(qb.uuid, []uint64{qb.address})
+		seg.sp.rcache.invalidate(seg.fidx, []uint64{qb.address})
+	}
+	seg.queued = nil
+	seg.ptr = seg.base
+	seg.sp.retfidx[seg.fidx%len(seg.sp.retfidx)] <- seg.fidx
+}
+
+//Fail if another block would put the stream over its block limit. The limit
+//is looked up once per segment
+func (seg *FileProviderSegment) checkBlockLimit(uuid []byte) error {
+	key := uuidkey(uuid)
+	limit, ok := seg.blocklimits[key]
+	if !ok {
+		var err error
+		limit, err = seg.sp.streamBlockLimit(uuid)
+		if err != nil {
+			return bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+		}
+		if seg.blocklimits == nil {
+			seg.blocklimits = make(map[[16]byte]int64)
+		}
+		seg.blocklimits[key] = limit
+	}
+	if limit > 0 && int64(seg.sp.live.count(uuid)) >= limit {
+		return bte.Err(bte.ResourceDepleted, "stream has reached its block limit")
+	}
+	return nil
 }
 
 //Writes a slice to the segment, returns immediately
@@ -97,239 +810,1242 @@ func (seg *FileProviderSegment) Unlock() {
 //It is up to the implementer to work out how to report no space immediately
 //The uint64 rv is the address to be used for the next write
 func (seg *FileProviderSegment) Write(uuid []byte, address uint64, data []byte) (uint64, error) {
-	//TODO remove
-	if seg.ptr != int64(address&((1<<50)-1)) {
-		log.Panic("Pointer does not match address %x vs %x", seg.ptr, int64(address&((1<<50)-1)))
+	return seg.write(writeparams{UUID: uuid, Address: address, Data: seg.sp.preWrite(data)})
+}
+
+//Like Write, but gives up with ctx.Err() if the context is done before the
+//block is queued, including while waiting for room in the queue. Once queued
+//it is written regardless. A write that had to be split can't be abandoned
+//after the tail is written
+func (seg *FileProviderSegment) WriteCtx(ctx context.Context, uuid []byte, address uint64, data []byte) (uint64, error) {
+	return seg.writeCtx(ctx, writeparams{UUID: uuid, Address: address, Data: seg.sp.preWrite(data)})
+}
+
+//Like Write, but complete is called (from a writer goroutine, so it should not
+//block) once the block has been written. If OrderedCompletion is set, blocks
+//complete in the order they were written, otherwise in any order
+func (seg *FileProviderSegment) WriteNotify(uuid []byte, address uint64, data []byte, complete func(address uint64)) (uint64, error) {
+	return seg.write(writeparams{UUID: uuid, Address: address, Data: seg.sp.preWrite(data), Complete: complete})
+}
+
+//Like Write, but stores the given CRC32C with the block instead of computing
+//it. The database must have been created with checksums and without
+//FormatCodec, and there must be no PreWrite hook
+func (seg *FileProviderSegment) WriteChecked(uuid []byte, address uint64, data []byte, crc uint32) (uint64, error) {
+	if seg.sp.format&(FormatCRC|FormatCodec) != FormatCRC || seg.sp.PreWrite != nil {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	return seg.write(writeparams{UUID: uuid, Address: address, Data: data, CRC: crc, HasCRC: true})
+}
+
+func (seg *FileProviderSegment) write(wp writeparams) (uint64, error) {
+	return seg.writeCtx(context.Background(), wp)
+}
+
+func (seg *FileProviderSegment) writeCtx(ctx context.Context, wp writeparams) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	address := wp.Address
+	//Address zero is the file tag of file zero, and means "no block". This
+	//is refused whatever the assertion mode
+	if address == 0 {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	if atomic.LoadInt32(&seg.sp.readonly) != 0 {
+		return 0, bprovider.ErrReadOnly
+	}
+	if err := seg.failure(); err != nil {
+		return 0, err
+	}
+	if atomic.LoadInt32(&seg.sp.lowspace) != 0 {
+		return 0, bprovider.ErrNoSpace
+	}
+	if err := seg.checkBlockLimit(wp.UUID); err != nil {
+		return 0, err
+	}
+	//What a read of the address will return, even if the block is split
+	full := wp.Data
+	afidx, off := bprovider.DecodeAddress(address)
+	if afidx != seg.fidx {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	if err := seg.sp.invariant(seg.ptr == off, "Pointer does not match address %x vs %x", seg.ptr, off); err != nil {
+		return 0, err
+	}
+	if len(wp.Data) > seg.sp.maxDataSize() {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	if seg.sp.format&FormatSpan != 0 && len(wp.Data) == SPANMARK {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	if seg.resv != nil {
+		//Blocks are not split across ranges
+		if !seg.fitsReservation(seg.sp.recordLen(&wp)) {
+			return 0, bprovider.ErrNoSpace
+		}
+		wp.Resv = seg.resv
+	} else if seg.ptr+seg.sp.recordLen(&wp) > seg.sp.maxFileSize() {
+		if seg.sp.format&FormatSpan == 0 {
+			return 0, bprovider.ErrNoSpace
+		}
+		var err error
+		wp, err = seg.splitSpan(wp)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if seg.sp.format&FormatTimestamp != 0 {
+		//Keep timestamps monotonic within the segment even if the clock isn't
+		ts := time.Now().UnixNano()
+		if ts <= seg.lastts {
+			ts = seg.lastts + 1
+		}
+		seg.lastts = ts
+		wp.Timestamp = ts
+	}
+	wp.Seq = seg.seq
+	wp.Barrier = seg.barrier
+	seg.enqueued(time.Now().UnixNano())
+	if seg.batching {
+		seg.batch = append(seg.batch, wp)
+	} else if wp.Cont == 0 {
+		select {
+		case seg.wchan <- wp:
+		case <-ctx.Done():
+			seg.unqueued()
+			return 0, ctx.Err()
+		}
+	} else {
+		seg.wchan <- wp
+	}
+	seg.seq++
+	blen := seg.sp.recordLen(&wp)
+	seg.sp.live.add(wp.UUID, address, blen)
+	seg.sp.rcache.put(address, full)
+	if !wp.Tail {
+		seg.sp.io.write(len(full))
+	}
+	seg.queued = append(seg.queued, queuedblock{wp.UUID, address})
+	seg.ptr = off + blen
+	seg.sp.raiseFrontier(seg.fidx, seg.ptr)
+	if seg.resv != nil {
+		seg.nextReservation()
+	}
+	seg.cpwrites++
+	seg.cpbytes += blen
+	if (seg.sp.CheckpointWrites > 0 && seg.cpwrites >= seg.sp.CheckpointWrites) ||
+		(seg.sp.CheckpointBytes > 0 && seg.cpbytes >= seg.sp.CheckpointBytes) {
+		//Don't wait for it, the writer will get there
+		seg.enqueueCheckpoint()
 	}
-	wp := writeparams{Address: address, Data: data}
-	seg.wchan <- wp
-	seg.ptr = int64(address&((1<<50)-1)) + int64(len(data)) + 2
-	return uint64(seg.ptr) + (uint64(seg.fidx) << 50), nil
+	return bprovider.EncodeAddress(seg.fidx, seg.ptr), nil
 }
 
-//Block until all writes are complete, not
-func (seg *FileProviderSegment) Flush() {
+func (seg *FileProviderSegment) enqueueCheckpoint() chan struct{} {
+	seg.flushBatch()
+	done := make(chan struct{})
+	seg.enqueued(0)
+	seg.wchan <- writeparams{Done: done, Seq: seg.seq}
+	seg.seq++
+	seg.barrier = seg.seq
+	seg.cpwrites = 0
+	seg.cpbytes = 0
+	return done
+}
+
+//Block until all writes queued so far are on disk (and synced, if
+//SyncOnCheckpoint is set). The segment remains usable. Returns the first
+//error writing the segment
+func (seg *FileProviderSegment) Checkpoint() error {
+	<-seg.enqueueCheckpoint()
+	return seg.failure()
+}
+
+//Block until all writes queued so far are complete. If the configuration
+//asks for it, the file is also synced. The segment remains usable, and the
+//flush counts as a checkpoint. Returns the first error writing the segment
+func (seg *FileProviderSegment) Flush() error {
+	if err := seg.Checkpoint(); err != nil {
+		return err
+	}
+	return seg.flushSync()
+}
+
+//Stop the writers once everything queued is written, and sync the file if
+//the configuration asks for it. Nothing can be written to the segment
+//afterwards. Returns the first error writing the segment
+func (seg *FileProviderSegment) finish() error {
 	close(seg.wchan)
 	seg.wg.Wait()
+	seg.sp.removeSegment(seg)
+	return seg.flushSync()
 }
 
-//Provide file indices into fidx, does not return
-func (sp *FileStorageProvider) provideFiles() {
+//Sync the file if the configuration asks for it on flush, unless the
+//segment has failed. Returns the first error writing the segment
+func (seg *FileProviderSegment) flushSync() error {
+	if seg.sp.syncOnFlush && !seg.stopped() {
+		err := seg.sp.syncgroups[seg.fidx].sync(seg.w.Datasync)
+		if err != nil {
+			atomic.AddUint64(&seg.sp.errs.write[seg.fidx], 1)
+			seg.fail(err)
+		} else {
+			atomic.AddUint64(&seg.sp.syncs, 1)
+		}
+	}
+	return seg.failure()
+}
+
+//Provide the indices of the files belonging to the given allocator into its
+//fidx channel, until the provider is closed. Allocator k serves the files whose index is k
+//modulo the number of allocators, so no two allocators share a file. Sends on
+//ready once it is serving. A file can also be taken out of the pool with
+//detachFile, in which case it is not offered again until it is returned.
+//With WritersPerFile, a file stays on offer until that many segments hold it
+func (sp *FileStorageProvider) provideFiles(alloc int, ready chan<- struct{}) {
+	defer sp.bgwg.Done()
+	defer atomic.StoreInt32(&sp.allocstate[alloc], gsNotRunning)
+	fidx, retfidx, detachch := sp.fidx[alloc], sp.retfidx[alloc], sp.detachch[alloc]
+	avail := newFileHeap(sp)
+	for i := alloc; i < sp.numfiles; i += len(sp.fidx) {
+		if sp.favail[i] {
+			avail.add(i)
+		}
+	}
+	setAvail := func(fi int, ok bool) {
+		if ok {
+			avail.add(fi)
+		} else {
+			avail.remove(fi)
+		}
+		sp.setAvail(fi, ok)
+	}
+	maxholders := 1
+	if sp.shared() {
+		maxholders = sp.WritersPerFile
+	}
+	//The number of segments holding each file
+	holders := make(map[int]int)
+	//Detached files, and the detach requests for those still held, which are
+	//signalled once no segment holds them
+	detached := make(map[int]bool)
+	waiting := make(map[int]chan struct{})
+	returned := func(fi int) {
+		if detached[fi] && holders[fi] == 0 {
+			//Reattached
+			delete(detached, fi)
+			setAvail(fi, true)
+			return
+		}
+		holders[fi]--
+		if detached[fi] {
+			if holders[fi] == 0 {
+				close(waiting[fi])
+				delete(waiting, fi)
+			}
+			return
+		}
+		//The file has changed size since it was last keyed
+		avail.remove(fi)
+		setAvail(fi, true)
+	}
+	detach := func(req detachreq) {
+		setAvail(req.fidx, false)
+		detached[req.fidx] = true
+		if holders[req.fidx] == 0 {
+			close(req.done)
+			return
+		}
+		waiting[req.fidx] = req.done
+	}
+	ready <- struct{}{}
 	for {
 		//Read all returned files
 	ldretfi:
 		for {
 			select {
-			case fi := <-sp.retfidx:
-				sp.favail[fi] = true
+			case fi := <-retfidx:
+				returned(fi)
 			default:
 				break ldretfi
 			}
 		}
 
-		//Greedily select file
-		minidx := -1
-		var minv int64 = 0
-		for i := 0; i < NUMFILES; i++ {
-			if !sp.favail[i] {
-				continue
-			}
-			off, err := sp.dbf[i].Seek(0, os.SEEK_CUR)
-			if err != nil {
-				log.Panic(err)
-			}
-			if minidx == -1 || off < minv {
-				minidx = i
-				minv = off
+		//Take the least full file. Full files sort last, so if it is full
+		//they all are, and it is only offered if the locked files are full
+		//too, so that writes fail with ErrNoSpace rather than LockSegment
+		//blocking forever
+		minidx := avail.least()
+		if minidx != -1 && sp.fileFull(sp.fileSize(minidx)) {
+			for i := alloc; i < sp.numfiles; i += len(sp.fidx) {
+				if holders[i] > 0 && !sp.fileFull(sp.fileSize(i)) {
+					minidx = -1
+					break
+				}
 			}
 		}
 
 		//Return it, or do blocking read if not found
 		if minidx != -1 {
-			sp.favail[minidx] = false
-			sp.fidx <- minidx
+			setAvail(minidx, false)
+			atomic.StoreInt32(&sp.allocstate[alloc], gsOffering)
+			select {
+			case fidx <- minidx:
+				holders[minidx]++
+				if holders[minidx] < maxholders {
+					setAvail(minidx, true)
+				}
+			case req := <-detachch:
+				//Put the file on offer back before dealing with the request
+				setAvail(minidx, true)
+				detach(req)
+			case <-sp.done:
+				return
+			}
 		} else {
 			//Do a blocking read on retfidx to avoid fast spin on nonblocking
-			fi := <-sp.retfidx
-			sp.favail[fi] = true
+			atomic.StoreInt32(&sp.allocstate[alloc], gsWaiting)
+			select {
+			case fi := <-retfidx:
+				returned(fi)
+			case req := <-detachch:
+				detach(req)
+			case <-sp.done:
+				return
+			}
 		}
-
+		atomic.StoreInt32(&sp.allocstate[alloc], gsRunning)
 	}
 }
 
-//Called at startup
-func (sp *FileStorageProvider) Initialize(cfg configprovider.Configuration) {
+//Called at startup. Returns bprovider.ErrDatabaseNotInitialized if the
+//blockstore files are missing, leaving the caller to suggest -makedb, and
+//an error wrapping bprovider.ErrInvalidArgument if the configuration is not
+//usable
+func (sp *FileStorageProvider) Initialize(cfg configprovider.Configuration) error {
+	var err error
+	sp.numfiles, err = fileCount(cfg)
+	if err != nil {
+		return configError("blockstore file count %d", cfg.StorageFileCount())
+	}
 	//Initialize file indices thingy
-	sp.fidx = make(chan int)
-	sp.retfidx = make(chan int, NUMFILES+1)
-	sp.dbf = make([]*os.File, NUMFILES)
-	sp.dbrf = make([]*os.File, NUMFILES)
-	sp.dbrf_mtx = make([]sync.Mutex, NUMFILES)
-	sp.favail = make([]bool, NUMFILES)
-	for i := 0; i < NUMFILES; i++ {
+	nalloc := sp.Allocators
+	if nalloc <= 0 || sp.pooled() {
+		nalloc = 1
+	}
+	if nalloc > sp.numfiles {
+		nalloc = sp.numfiles
+	}
+	sp.fidx = make([]chan int, nalloc)
+	sp.retfidx = make([]chan int, nalloc)
+	sp.detachch = make([]chan detachreq, nalloc)
+	sp.allocstate = make([]int32, nalloc)
+	//Every segment holding a file, and a reattach, can return at once
+	holders := sp.numfiles
+	if sp.shared() {
+		holders *= sp.WritersPerFile
+	}
+	for i := range sp.fidx {
+		sp.fidx[i] = make(chan int)
+		sp.retfidx[i] = make(chan int, holders+1)
+		sp.detachch[i] = make(chan detachreq)
+	}
+	sp.dbf = make([]*os.File, sp.numfiles)
+	sp.dbrf = make([]*os.File, sp.numfiles)
+	sp.dbrf_mtx = newFileLocks(sp.numfiles)
+	sp.favail = make([]bool, sp.numfiles)
+	sp.done = make(chan struct{})
+	sp.dbpath = cfg.StorageFilepath()
+	sp.dbroots = blockRoots(cfg)
+	sp.syncOnFlush = cfg.StorageSyncOnFlush()
+	sp.fileMode, err = fileMode(cfg)
+	if err != nil {
+		return configError("file mode %o", cfg.StorageFileMode())
+	}
+	sp.verifyWrites = cfg.StorageVerifyWrites()
+	sp.queueDepth = cfg.StorageWriteQueueDepth()
+	if sp.queueDepth == 0 {
+		sp.queueDepth = WRITEQUEUEDEPTH
+	}
+	if sp.queueDepth < 0 {
+		return configError("write queue depth %d", sp.queueDepth)
+	}
+	sp.committed = make([]int64, sp.numfiles)
+	sp.frontier = make([]int64, sp.numfiles)
+	sp.tails = make([]filetail, sp.numfiles)
+	sp.preallocs = make([]preallocstate, sp.numfiles)
+	sp.scrubpos = make([]int64, sp.numfiles)
+	sp.errs.init(sp.numfiles)
+	sp.lastwrite = make([]int64, sp.numfiles)
+	sp.rcache.init(int64(cfg.StorageReadCacheBytes()))
+	codec, err := codecByName(cfg.StorageCompression())
+	if err != nil {
+		return configError("compression codec %q", cfg.StorageCompression())
+	}
+	sp.codec = codec
+	sp.useMmap = cfg.StorageUseMmap()
+	if sp.useMmap {
+		sp.maps = make([]filemap, sp.numfiles)
+	}
+	sp.firstread = cfg.StorageFirstReadBytes()
+	if sp.firstread < 0 || (sp.firstread > 0 && sp.firstread < SPANHEADERLEN) {
+		return configError("first read size %d, the minimum is %d", sp.firstread, SPANHEADERLEN)
+	}
+	sp.syncgroups = make([]syncgroup, sp.numfiles)
+	sp.compactBudget = newRateLimiter(sp.CompactBytesPerSec)
+	if sp.CompactConcurrency > 0 {
+		sp.compactSlots = make(chan struct{}, sp.CompactConcurrency)
+	}
+	if err := sp.registerMetrics(); err != nil {
+		return err
+	}
+	for i := 0; i < sp.numfiles; i++ {
 		//Open file
-		dbpath := cfg.StorageFilepath()
-		fname := fmt.Sprintf("%s/blockstore.%02x.db", dbpath, i)
-		//write file descriptor
+		fname := blockPath(sp.dbroots, i)
+		//Read file descriptor
 		{
-			f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+			f, err := os.OpenFile(fname, os.O_RDONLY, 0666)
 			if err != nil && os.IsNotExist(err) {
-				log.Critical("Aborting: seems database does not exist. Have you run `btrdbd -makedb`?")
-				os.Exit(1)
+				sp.logger().Error("Blockstore file does not exist", "path", fname)
+				sp.closeOpened()
+				sp.unregisterMetrics()
+				return bprovider.ErrDatabaseNotInitialized
 			}
 			if err != nil {
-				log.Panicf("Problem with blockstore DB: ", err)
+				sp.fatal("Problem with blockstore DB", "err", err)
+			}
+			sp.dbrf[i] = f
+		}
+		//write file descriptor
+		if !sp.ReadOnly {
+			f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+			if err != nil {
+				sp.fatal("Problem with blockstore DB", "err", err)
 			}
 			sp.dbf[i] = f
 		}
-		//Read file descriptor
-		{
-			f, err := os.OpenFile(fname, os.O_RDONLY, 0666)
+		if err := checkFileTag(sp.dbrf[i]); err != nil {
+			sp.fatal("Blockstore file is not part of a database", "path", fname, "err", err)
+		}
+		format, datastart, err := readFormatHeader(sp.dbrf[i])
+		if err != nil {
+			sp.fatal("Problem with blockstore DB", "err", err)
+		}
+		if i == 0 {
+			sp.format = format
+			sp.datastart = datastart
+		} else if format != sp.format {
+			sp.fatal("Blockstore file has a different format", "file", i, "format", fmt.Sprintf("%x", format), "expected", fmt.Sprintf("%x", sp.format))
+		}
+		if sp.ReadOnly {
+			fi, err := sp.dbrf[i].Stat()
 			if err != nil {
-				log.Panicf("Problem with blockstore DB: ", err)
+				sp.fatal("Problem with blockstore DB", "err", err)
 			}
-			sp.dbrf[i] = f
+			sp.committed[i], err = sp.recoverFile(i, fi.Size())
+			if err != nil {
+				sp.fatal("Could not check the end of blockstore file", "file", i, "err", err)
+			}
+		} else {
+			size, err := sp.dbf[i].Seek(0, os.SEEK_END)
+			if err != nil {
+				sp.fatal("Problem with blockstore DB", "err", err)
+			}
+			sp.committed[i] = sp.recoverTail(i, size)
 		}
+		sp.frontier[i] = sp.committed[i]
+		sp.tails[i].tail = sp.committed[i]
 		sp.favail[i] = true
 	}
-	go sp.provideFiles()
+	if sp.codec != CodecNone && sp.format&FormatCodec == 0 {
+		sp.closeOpened()
+		sp.unregisterMetrics()
+		return configError("compression %q, the database was created without it", cfg.StorageCompression())
+	}
+	if sp.format&FormatCodec != 0 {
+		if err := initZstd(); err != nil {
+			sp.logger().Error("Could not set up compression", "err", err)
+			sp.closeOpened()
+			sp.unregisterMetrics()
+			return err
+		}
+	}
+	//More files than configured would have their blocks ignored
+	extra := blockPath(sp.dbroots, sp.numfiles)
+	if _, err := os.Stat(extra); err == nil {
+		sp.closeOpened()
+		sp.unregisterMetrics()
+		return configError("blockstore file count %d, the database has more", sp.numfiles)
+	}
+	sp.openMetadata(cfg.StorageFilepath())
+	sp.openSuperblocks(cfg.StorageFilepath())
+	if sp.ReadOnly {
+		atomic.StoreInt32(&sp.readonly, 1)
+		return nil
+	}
+	sp.resetScratch()
+	if sp.pooled() {
+		sp.favailcond = sync.NewCond(&sp.favailmu)
+		sp.buildRing()
+		sp.checkSizeClasses()
+		sp.bgwg.Add(1)
+		go sp.returnFiles()
+	} else {
+		//Don't return until the allocators are serving, so the first
+		//LockSegment does not race their startup
+		ready := make(chan struct{}, len(sp.fidx))
+		sp.bgwg.Add(len(sp.fidx))
+		for i := range sp.fidx {
+			go sp.provideFiles(i, ready)
+		}
+		for range sp.fidx {
+			<-ready
+		}
+	}
+	if sp.MinFreeBytes > 0 {
+		sp.checkFreeSpace()
+		sp.bgwg.Add(1)
+		go sp.freeSpaceWatcher()
+	}
+	if sp.ScrubInterval > 0 {
+		sp.bgwg.Add(1)
+		go sp.scrubber()
+	}
+	if sp.VersionFlushInterval > 0 {
+		sp.bgwg.Add(1)
+		go sp.versionFlusher()
+	}
+	return nil
+}
+
+//Close the blockstore files Initialize opened before giving up
+func (sp *FileStorageProvider) closeOpened() {
+	for i := range sp.dbf {
+		if sp.dbf[i] != nil {
+			sp.dbf[i].Close()
+		}
+		if sp.dbrf[i] != nil {
+			sp.dbrf[i].Close()
+		}
+	}
+}
+
+//The errors of closing the provider's files, see Close
+type CloseErrors []error
+
+func (e CloseErrors) Error() string {
+	msg := fmt.Sprintf("%d errors closing the provider", len(e))
+	for _, err := range e {
+		msg += "; " + err.Error()
+	}
+	return msg
+}
+
+//Shut the provider down. The allocators and background workers are stopped,
+//segments still locked are waited for, batched version changes are written
+//out and every file is closed. Returns the errors closing files as
+//CloseErrors, or nil. Nothing else may be called once Close has been, except
+//Unlock or Abort on segments that were locked before. Closing again does
+//nothing
+func (sp *FileStorageProvider) Close() error {
+	if !atomic.CompareAndSwapInt32(&sp.closed, 0, 1) {
+		return nil
+	}
+	close(sp.done)
+	//Let a paused scrubber see that it should stop
+	sp.ResumeBackground()
+	sp.segwg.Wait()
+	sp.bgwg.Wait()
+	sp.metamu.Lock()
+	sp.flushVersions()
+	sp.metamu.Unlock()
+	sp.unregisterMetrics()
 
+	var errs CloseErrors
+	closeFile := func(f *os.File) {
+		if f == nil {
+			return
+		}
+		if err := f.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for i := range sp.dbf {
+		sp.unmapFile(i)
+		closeFile(sp.dbf[i])
+		sp.dbrf_mtx[i].Lock()
+		closeFile(sp.dbrf[i])
+		sp.dbrf_mtx[i].Unlock()
+	}
+	closeFile(sp.metaf)
+	if sp.metaidx != nil {
+		if sp.metaidx.data != nil {
+			closeFile(sp.metaidx.data.f)
+		}
+		if sp.metaidx.coll != nil {
+			closeFile(sp.metaidx.coll.f)
+		}
+	}
+	sp.sbmu.Lock()
+	closeFile(sp.sbf)
+	sp.sbmu.Unlock()
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+//Whether Close has been called
+func (sp *FileStorageProvider) closing() bool {
+	select {
+	case <-sp.done:
+		return true
+	default:
+		return false
+	}
+}
+
+//Sleep for the given duration, returning false early if the provider is
+//closed in the meantime
+func (sp *FileStorageProvider) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-sp.done:
+		return false
+	}
+}
+
+//Take a file from the allocators. Start at a different allocator each time and
+//take the first file on offer, only blocking if none has one. Also returns
+//whether it had to block. Gives up with -1 if timeout fires first, a nil
+//timeout never does
+func (sp *FileStorageProvider) allocate(timeout <-chan time.Time) (int, bool) {
+	start := int(atomic.AddUint32(&sp.nextalloc, 1))
+	for i := 0; i < len(sp.fidx); i++ {
+		select {
+		case fidx := <-sp.fidx[(start+i)%len(sp.fidx)]:
+			return fidx, false
+		default:
+		}
+	}
+	if len(sp.fidx) == 1 {
+		select {
+		case fidx := <-sp.fidx[0]:
+			return fidx, true
+		case <-timeout:
+			return -1, true
+		}
+	}
+	cases := make([]reflect.SelectCase, len(sp.fidx), len(sp.fidx)+1)
+	for i, ch := range sp.fidx {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+	}
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timeout)})
+	chosen, v, _ := reflect.Select(cases)
+	if chosen == len(sp.fidx) {
+		return -1, true
+	}
+	return int(v.Int()), true
 }
 
 // Lock a segment, or block until a segment can be locked
-// Returns a Segment struct
+// Returns a Segment struct. With SizeClasses set, its file is one for the
+// smallest class of blocks
 func (sp *FileStorageProvider) LockSegment(uuid []byte) bprovider.Segment {
+	return sp.LockSegmentSized(uuid, 0)
+}
+
+//Like LockSegment, but with SizeClasses set the file is one of the class of
+//blocks of the given size. Blocks of other sizes can still be written to the
+//segment, they just end up in a file of the wrong class
+func (sp *FileStorageProvider) LockSegmentSized(uuid []byte, size int) bprovider.Segment {
+	seg, _ := sp.lockSegment(uuid, size, 0)
+	return seg
+}
+
+//Returned by LockSegmentTimeout if no file became available in time
+var ErrLockTimeout = errors.New("no segment could be locked in time")
+
+//Like LockSegment, but gives up with ErrLockTimeout if no file becomes
+//available within d, so that callers can shed load rather than queue
+//behind every file being locked
+func (sp *FileStorageProvider) LockSegmentTimeout(uuid []byte, d time.Duration) (bprovider.Segment, error) {
+	return sp.lockSegment(uuid, 0, d)
+}
+
+//Lock a segment in a file for blocks of the given size, waiting at most d
+//for one if d is positive
+func (sp *FileStorageProvider) lockSegment(uuid []byte, size int, d time.Duration) (bprovider.Segment, error) {
+	if sp.ReadOnly {
+		return readonlySegment{}, nil
+	}
+	var timeout <-chan time.Time
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
 	//Grab a file index
-	fidx := <-sp.fidx
-	f := sp.dbf[fidx]
-	l, err := f.Seek(0, os.SEEK_END)
-	if err != nil {
-		log.Panicf("Error on lock segment: %v", err)
+	var fidx int
+	var blocked bool
+	then := time.Now()
+	if sp.pooled() {
+		fidx, blocked = sp.lockSubsetFile(sp.candidateFiles(uuid, size), timeout)
+	} else {
+		fidx, blocked = sp.allocate(timeout)
+	}
+	wait := time.Since(then)
+	sp.lockstats.observe(uuid, blocked, wait)
+	sp.observeLockWait(wait)
+	if fidx < 0 {
+		return nil, ErrLockTimeout
+	}
+	var resv *reservation
+	var l int64
+	if sp.shared() {
+		//This may be empty if the file is full, in which case writes fail
+		//with ErrNoSpace
+		resv = sp.reserve(fidx, 0)
+		l = resv.start
+	} else {
+		var err error
+		l, err = sp.dbf[fidx].Seek(0, os.SEEK_END)
+		if err != nil {
+			sp.fatal("Error on lock segment", "err", err)
+		}
 	}
 
 	//Construct segment
-	seg := &FileProviderSegment{sp: sp, fidx: fidx, f: sp.dbf[fidx], base: l, ptr: l}
+	seg := &FileProviderSegment{sp: sp, fidx: fidx, f: sp.dbf[fidx], base: l, ptr: l, resv: resv}
+	if resv != nil {
+		seg.resvfull = resv.end-resv.start < sp.reserveMin()
+	}
 	seg.init()
 
-	return seg
+	return seg, nil
 }
 
 //This is the size of a maximal size cblock + header
 const FIRSTREAD = 3459
 
-func (sp *FileStorageProvider) Read(uuid []byte, address uint64, buffer []byte) []byte {
-	fidx := address >> 50
-	off := int64(address & ((1 << 50) - 1))
-	if fidx > NUMFILES {
-		log.Panic("Encoded file idx too large")
+//This is the largest block the length prefix can describe, plus the prefix
+//and the largest trailer. A buffer of this size can hold any block, unless
+//the database has FormatWide
+const MAXBLOCKSIZE = 65535 + 2 + 8 + 4 + 1
+
+//What is stored alongside the data of a block, depending on the format
+type blockmeta struct {
+	crc       uint32
+	timestamp int64
+	//The bytes the record at the address takes on disk
+	reclen int64
+	//The address of the rest of a spanning block
+	cont uint64
+	//Set if the record lacks its sentinel, see FormatSentinel
+	torn bool
+}
+
+//Read the block at the given address into the buffer. Returns ErrCorrupt if
+//the block is truncated or fails its checksum (ErrIncompleteBlock if it was
+//not completely written and the format has sentinels), ErrNoBlock for
+//address zero, ErrInvalidArgument if the address is outside the files or
+//past the last block written to its file, and ErrBufferTooSmall if the
+//buffer can't hold the block (unless GrowSmallBuffers is set)
+func (sp *FileStorageProvider) Read(uuid []byte, address uint64, buffer []byte) ([]byte, error) {
+	return sp.ReadCtx(context.Background(), uuid, address, buffer)
+}
+
+//Like Read, but gives up with ctx.Err() if the context is done before the
+//block is read, including while waiting for the file
+func (sp *FileStorageProvider) ReadCtx(ctx context.Context, uuid []byte, address uint64, buffer []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	if err := sp.beforeRead(uuid, address); err != nil {
+		return nil, err
+	}
+	address = sp.forward(address)
+	if cached := sp.rcache.get(address); cached != nil {
+		rv, err := sp.fromCache(cached, buffer)
+		if err != nil {
+			return nil, err
+		}
+		sp.io.read(len(rv), start)
+		return sp.postRead(rv)
+	}
+	rv, meta, err := sp.readBlock(ctx, address, buffer)
+	if err != nil {
+		return nil, err
+	}
+	if !sp.checksumOK(address, rv, meta) {
+		return nil, bprovider.ErrCorrupt
+	}
+	sp.rcache.put(address, rv)
+	sp.io.read(len(rv), start)
+	return sp.postRead(rv)
+}
+
+//Like Read, but the block is given by its file index and the offset of its
+//record in that file, rather than by an address
+func (sp *FileStorageProvider) ReadAtOffset(fidx int, offset int64, buffer []byte) ([]byte, error) {
+	if fidx < 0 || fidx >= sp.numfiles || offset < 0 || offset > bprovider.ADDRESSOFFSETMASK {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	return sp.Read(nil, bprovider.EncodeAddress(fidx, offset), buffer)
+}
+
+//Like Read, but a corrupt block is not an error. Instead the returned data is
+//zero filled (to the stored length, if that could be read) and bad is true.
+//Other errors, such as invalid addresses, are still returned
+func (sp *FileStorageProvider) ReadLenient(uuid []byte, address uint64, buffer []byte) (data []byte, bad bool, err error) {
+	start := time.Now()
+	if err := sp.beforeRead(uuid, address); err != nil {
+		return nil, false, err
+	}
+	address = sp.forward(address)
+	rv, meta, err := sp.readBlock(context.Background(), address, buffer)
+	if err == nil && !sp.checksumOK(address, rv, meta) {
+		err = bprovider.ErrCorrupt
+	}
+	if err == nil {
+		data, err = sp.postRead(rv)
+	}
+	if err == bprovider.ErrCorrupt || err == bprovider.ErrIncompleteBlock {
+		for i := range rv {
+			rv[i] = 0
+		}
+		sp.io.read(len(rv), start)
+		return rv, true, nil
+	}
+	if err != nil {
+		return rv, false, err
+	}
+	sp.io.read(len(rv), start)
+	return data, false, nil
+}
+
+//Apply the BeforeRead hook, if any
+func (sp *FileStorageProvider) beforeRead(uuid []byte, address uint64) error {
+	if sp.BeforeRead == nil {
+		return nil
+	}
+	return sp.BeforeRead(uuid, address)
+}
+
+//Apply the PreWrite hook, if any, then with FormatCodec compress the data
+func (sp *FileStorageProvider) preWrite(data []byte) []byte {
+	if sp.PreWrite != nil {
+		data = sp.PreWrite(data)
+	}
+	if sp.format&FormatCodec != 0 {
+		data = sp.compress(data)
+	}
+	return data
+}
+
+//With FormatCodec decompress the data, then apply the PostRead hook, if any.
+//Decompressed data is in a new slice rather than the caller's buffer
+func (sp *FileStorageProvider) postRead(data []byte) ([]byte, error) {
+	if sp.format&FormatCodec != 0 {
+		var err error
+		data, err = decompress(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sp.PostRead == nil {
+		return data, nil
+	}
+	return sp.PostRead(data), nil
+}
+
+//Like Read, but also returns the CRC32C stored with the block, without
+//checking it against the data. The database must have been created with
+//checksums and without FormatCodec, and there must be no PostRead hook
+func (sp *FileStorageProvider) ReadChecked(uuid []byte, address uint64, buffer []byte) ([]byte, uint32, error) {
+	if sp.format&(FormatCRC|FormatCodec) != FormatCRC || sp.PostRead != nil {
+		return nil, 0, bprovider.ErrInvalidArgument
+	}
+	start := time.Now()
+	if err := sp.beforeRead(uuid, address); err != nil {
+		return nil, 0, err
+	}
+	rv, meta, err := sp.readBlock(context.Background(), sp.forward(address), buffer)
+	if err == nil {
+		sp.io.read(len(rv), start)
+	}
+	return rv, meta.crc, err
+}
+
+//Returns the time (in unix nanoseconds) at which the block at the given
+//address was written. The database must have been created with
+//FormatTimestamp
+func (sp *FileStorageProvider) BlockTimestamp(address uint64) (int64, error) {
+	if sp.format&FormatTimestamp == 0 {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	_, meta, err := sp.readBlock(context.Background(), sp.forward(address), make([]byte, sp.maxBlockSize()))
+	return meta.timestamp, err
+}
+
+//Check that each of the given addresses refers to a complete block with a
+//valid checksum, returning those that don't. The error is only set if
+//validation could not be completed
+func (sp *FileStorageProvider) ValidateReferences(addresses []uint64) ([]uint64, error) {
+	buf := make([]byte, sp.maxBlockSize())
+	bad := []uint64{}
+	for _, addr := range addresses {
+		_, err := sp.Read(nil, addr, buf)
+		if err == bprovider.ErrCorrupt || err == bprovider.ErrIncompleteBlock || err == bprovider.ErrInvalidArgument || err == bprovider.ErrNoBlock {
+			bad = append(bad, addr)
+			continue
+		}
+		if err != nil {
+			return bad, err
+		}
+	}
+	return bad, nil
+}
+
+//Read the record at the given address, returning its data and whatever is
+//stored alongside it. For the head of a spanning block, this is only the
+//part of the data in this file
+func (sp *FileStorageProvider) readRecord(ctx context.Context, address uint64, buffer []byte) ([]byte, blockmeta, error) {
+	meta := blockmeta{}
+	if address == 0 {
+		return nil, meta, bprovider.ErrNoBlock
+	}
+	fidx, off := bprovider.DecodeAddress(address)
+	if fidx >= sp.numfiles {
+		return nil, meta, bprovider.ErrInvalidArgument
 	}
-	sp.dbrf_mtx[fidx].Lock()
-	nread, err := sp.dbrf[fidx].ReadAt(buffer[:FIRSTREAD], off)
+	//Nothing was ever written there, say if a superblock is corrupt
+	if off < sp.datastart || off >= atomic.LoadInt64(&sp.frontier[fidx]) {
+		return nil, meta, bprovider.ErrInvalidArgument
+	}
+	//Always room for the header
+	if len(buffer) < SPANHEADERLEN {
+		if !sp.GrowSmallBuffers {
+			return nil, meta, bprovider.ErrBufferTooSmall{Need: SPANHEADERLEN}
+		}
+		buffer = make([]byte, FIRSTREAD)
+	}
+	if sp.useMmap {
+		rv, meta, err := sp.readMapped(uint64(fidx), off, buffer)
+		if err != errNotMapped {
+			return rv, meta, err
+		}
+	}
+	if err := sp.dbrf_mtx[fidx].rlockCtx(ctx); err != nil {
+		return nil, meta, err
+	}
+	defer sp.dbrf_mtx[fidx].RUnlock()
+	nread, err := sp.readAt(fidx, buffer[:sp.firstReadSize(len(buffer))], off)
 	if err != nil && err != io.EOF {
-		log.Panic("Non EOF read error: %v", err)
+		atomic.AddUint64(&sp.errs.read[fidx], 1)
+		return nil, meta, fmt.Errorf("Non EOF read error: %v", err)
 	}
-	if nread < 2 {
-		log.Panic("Unexpected (very) short read")
+	plen := sp.prefixLen()
+	if nread < plen {
+		return nil, meta, bprovider.ErrCorrupt
 	}
 	//Now we read the blob size
-	bsize := int(buffer[0]) + (int(buffer[1]) << 8)
-	if bsize > nread-2 {
-		_, err := sp.dbrf[fidx].ReadAt(buffer[nread:bsize+2], off+int64(nread))
+	bsize := sp.parseLength(buffer)
+	hdrlen := plen
+	if bsize == SPANMARK && sp.format&FormatSpan != 0 {
+		hdrlen = SPANHEADERLEN
+		if nread < hdrlen {
+			if _, err := sp.readAt(fidx, buffer[nread:hdrlen], off+int64(nread)); err != nil {
+				return nil, meta, bprovider.ErrCorrupt
+			}
+			nread = hdrlen
+		}
+		bsize, meta.cont = parseSpanHeader(buffer)
+	}
+	total := bsize + int(sp.blockOverhead()) + hdrlen - plen
+	meta.reclen = int64(total)
+	atomic.AddUint64(&sp.reads, 1)
+	if sp.AdaptiveFirstRead {
+		sp.observeBlockSize(total)
+	}
+	if total > len(buffer) {
+		if !sp.GrowSmallBuffers {
+			return nil, meta, bprovider.ErrBufferTooSmall{Need: total}
+		}
+		//The length came from the file. If it is corrupt, the record runs
+		//past what was ever written, and must not be allocated for
+		if off+int64(total) > atomic.LoadInt64(&sp.frontier[fidx]) {
+			return nil, meta, bprovider.ErrCorrupt
+		}
+		nb := make([]byte, total)
+		copy(nb, buffer[:nread])
+		buffer = nb
+	}
+	if total > nread {
+		atomic.AddUint64(&sp.secondreads, 1)
+		_, err := sp.readAt(fidx, buffer[nread:total], off+int64(nread))
+		if err == io.EOF {
+			//The block was never completely written. Return what there is
+			//so that the length is known
+			return buffer[hdrlen : bsize+hdrlen], meta, sp.errIncomplete()
+		}
 		if err != nil {
-			log.Panic("Read error: %v", err)
+			atomic.AddUint64(&sp.errs.read[fidx], 1)
+			return nil, meta, fmt.Errorf("Read error: %v", err)
+		}
+	}
+	sp.parseTrailer(buffer[bsize+hdrlen:total], &meta)
+	if meta.torn {
+		return buffer[hdrlen : bsize+hdrlen], meta, bprovider.ErrIncompleteBlock
+	}
+	return buffer[hdrlen : bsize+hdrlen], meta, nil
+}
+
+//The error for a record that runs past the end of its file. Without
+//sentinels it can't be told from any other corruption
+func (sp *FileStorageProvider) errIncomplete() error {
+	if sp.format&FormatSentinel != 0 {
+		return bprovider.ErrIncompleteBlock
+	}
+	return bprovider.ErrCorrupt
+}
+
+//Raise the write frontier of a file to at least off
+func (sp *FileStorageProvider) raiseFrontier(fidx int, off int64) {
+	for {
+		old := atomic.LoadInt64(&sp.frontier[fidx])
+		if off <= old || atomic.CompareAndSwapInt64(&sp.frontier[fidx], old, off) {
+			return
+		}
+	}
+}
+
+//Fill in the meta from what follows the data of a record
+func (sp *FileStorageProvider) parseTrailer(t []byte, meta *blockmeta) {
+	if sp.format&FormatTimestamp != 0 {
+		for i := uint(0); i < 8; i++ {
+			meta.timestamp += int64(t[i]) << (8 * i)
+		}
+		t = t[8:]
+	}
+	if sp.format&FormatCRC != 0 {
+		meta.crc = uint32(t[0]) + (uint32(t[1]) << 8) + (uint32(t[2]) << 16) + (uint32(t[3]) << 24)
+		t = t[4:]
+	}
+	if sp.format&FormatSentinel != 0 {
+		meta.torn = t[0] != SENTINEL
+	}
+}
+
+//Returns ErrInvalidArgument wrapped with a description of the configuration
+//Initialize refused
+func configError(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid configuration: %s: %w", fmt.Sprintf(format, args...), bprovider.ErrInvalidArgument)
+}
+
+//Returns the number of blockstore files configured, or ErrInvalidArgument if
+//the addresses can't describe that many
+func fileCount(cfg configprovider.Configuration) (int, error) {
+	n := cfg.StorageFileCount()
+	if n == 0 {
+		return NUMFILES, nil
+	}
+	if n < 0 || n > MAXNUMFILES {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	return n, nil
+}
+
+//The permissions files are created with if StorageFileMode is not set
+const FILEMODE os.FileMode = 0666
+
+//Returns the permissions to create files with, or ErrInvalidArgument if the
+//configured mode is more than permissions
+func fileMode(cfg configprovider.Configuration) (os.FileMode, error) {
+	mode := cfg.StorageFileMode()
+	if mode == 0 {
+		return FILEMODE, nil
+	}
+	if mode&^os.ModePerm != 0 {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	return mode, nil
+}
+
+//Returns the directories the blockstore files are spread over: those of
+//StorageFilepaths, or if it is empty, StorageFilepath
+func blockRoots(cfg configprovider.Configuration) []string {
+	if roots := cfg.StorageFilepaths(); len(roots) > 0 {
+		return roots
+	}
+	return []string{cfg.StorageFilepath()}
+}
+
+//Returns the path of blockstore file i. The files are dealt out over the
+//roots in turn, which spreads both the files and, as segments are locked
+//least full first, the writes
+func blockPath(roots []string, i int) string {
+	return fmt.Sprintf("%s/blockstore.%02x.db", roots[i%len(roots)], i)
+}
+
+//The format flags of a database created with the given configuration
+func (sp *FileStorageProvider) newFormat(cfg configprovider.Configuration) (uint16, error) {
+	if sp.FormatFlags&FormatWide != 0 && sp.FormatFlags&FormatSpan != 0 {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	flags := FormatCRC | sp.FormatFlags
+	if cfg.StorageCompression() != "" {
+		if _, err := codecByName(cfg.StorageCompression()); err != nil {
+			return 0, err
 		}
+		flags |= FormatCodec
 	}
-	sp.dbrf_mtx[fidx].Unlock()
-	return buffer[2 : bsize+2]
+	return flags, nil
 }
 
 //Called to create the database for the first time
 func (sp *FileStorageProvider) CreateDatabase(cfg configprovider.Configuration) error {
-	for i := 0; i < NUMFILES; i++ {
+	return sp.createDatabase(cfg, false)
+}
+
+//Create the database. With resume, files that already exist are checked and
+//completed rather than being an error, see CreateDatabaseIfMissing
+func (sp *FileStorageProvider) createDatabase(cfg configprovider.Configuration, resume bool) error {
+	flags, err := sp.newFormat(cfg)
+	if err != nil {
+		return err
+	}
+	sp.numfiles, err = fileCount(cfg)
+	if err != nil {
+		return err
+	}
+	sp.fileMode, err = fileMode(cfg)
+	if err != nil {
+		return err
+	}
+	roots := blockRoots(cfg)
+	for i := 0; i < sp.numfiles; i++ {
 		//Open file
-		dbpath := cfg.StorageFilepath()
-		fname := fmt.Sprintf("%s/blockstore.%02x.db", dbpath, i)
+		fname := blockPath(roots, i)
 		//write file descriptor
 		{
-			f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+			f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_EXCL, sp.fileMode)
 			if err != nil && !os.IsExist(err) {
-				log.Panicf("Problem with blockstore DB: ", err)
+				sp.fatal("Problem with blockstore DB", "err", err)
+			} else if os.IsExist(err) && resume {
+				if err := completeFile(fname, flags); err != nil {
+					return err
+				}
+				continue
 			} else if os.IsExist(err) {
 				return bprovider.ErrExists
 			}
 			//Add a file tag
 			//An exercise left for the reader: if you remove this, everything breaks :-)
 			//Hint: what is the physical address of the first byte of file zero?
-			_, err = f.Write([]byte("QUASARDB"))
+			//(It is zero, which is why no block may live there. See ErrNoBlock)
+			_, err = f.Write([]byte(FILETAG))
+			if err != nil {
+				sp.fatal("Could not write to blockstore", "err", err)
+			}
+			_, err = f.Write(encodeFormatHeader(flags))
 			if err != nil {
-				log.Panicf("Could not write to blockstore:", err)
+				sp.fatal("Could not write to blockstore", "err", err)
 			}
 
 			err = f.Close()
 			if err != nil {
-				log.Panicf("Error on close %v", err)
+				sp.fatal("Error on close", "err", err)
 			}
 		}
 	}
+	f, err := os.OpenFile(metadataPath(cfg.StorageFilepath()), os.O_RDWR|os.O_CREATE|os.O_EXCL, sp.fileMode)
+	if err != nil && !os.IsExist(err) {
+		sp.fatal("Problem with metadata log", "err", err)
+	} else if os.IsExist(err) && resume {
+		return nil
+	} else if os.IsExist(err) {
+		return bprovider.ErrExists
+	}
+	err = f.Close()
+	if err != nil {
+		sp.fatal("Error on close", "err", err)
+	}
 	return nil
 }
 
-// Read the given version of superblock into the buffer.
-func (sp *FileStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) []byte {
-	panic("yo not supported bro")
-}
-
-// Writes a superblock of the given version
-// TODO I think the storage will need to chunk this, because sb logs of gigabytes are possible
-func (sp *FileStorageProvider) WriteSuperBlock(uuid []byte, version uint64, buffer []byte) {
-	panic("yo not supported bro")
-}
-
-// Sets the version of a stream. If it is in the past, it is essentially a rollback,
-// and although no space is freed, the consecutive version numbers can be reused
-// note to self: you must make sure not to call ReadSuperBlock on versions higher
-// than you get from GetStreamVersion because they might succeed
-func (sp *FileStorageProvider) SetStreamVersion(uuid []byte, version uint64) {
-	panic("yo not supported bro")
-}
-
-// Gets the version of a stream. Returns 0 if none exists.
+// Gets the catalog entry and version of a stream. The entry has a nil UUID
+// if the stream does not exist, and the version is 0 if it has none
 func (sp *FileStorageProvider) GetStreamInfo(uuid []byte) (bprovider.Stream, uint64) {
-	panic("yo not supported bro")
-}
-
-// Gets the version of a stream. Returns 0 if none exists.
-func (sp *FileStorageProvider) GetStreamVersion(uuid []byte) uint64 {
-	panic("yo not supported bro")
-}
-
-// CreateStream makes a stream with the given uuid, collection and tags. Returns
-// an error if the uuid already exists.
-func (sp *FileStorageProvider) CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE {
-	panic("yo not supported bro")
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	key := uuidkey(uuid)
+	sm, err := sp.peekStream(key)
+	if err != nil {
+		sp.fatal("Could not read stream metadata", "err", err)
+	}
+	ver, err := sp.peekVersion(key)
+	if err != nil {
+		sp.fatal("Could not read stream metadata", "err", err)
+	}
+	if sm == nil {
+		return bprovider.Stream{}, ver
+	}
+	return bprovider.Stream{
+		UUID:       sm.uuid,
+		Collection: sm.collection,
+		Tags:       sm.tags,
+		Annotation: sm.annotation,
+	}, ver
 }
 
 // ListCollections returns a list of collections beginning with prefix (which may be "")
 // and starting from the given string. If number is > 0, only that many results
 // will be returned. More can be obtained by re-calling ListCollections with
 // a given startingFrom and number.
+//
+// The results are sorted, and startingFrom itself is included if it is a
+// collection. A collection exists once a stream has been created in it
 func (sp *FileStorageProvider) ListCollections(prefix string, startingFrom string, number int64) ([]string, bte.BTE) {
-	panic("yo not supported bro")
-}
-
-// ListStreams lists all the streams within a collection. If tags are specified
-// then streams are only returned if they have that tag, and the value equals
-// the value passed. If partial is false, zero or one streams will be returned.
-func (sp *FileStorageProvider) ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
-	panic("yo not supported bro")
-}
-
-// Sets the stream annotation
-func (sp *FileStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, content []byte) bte.BTE {
-	panic("yo not supported bro")
-}
-
-// Gets the stream annotation
-func (sp *FileStorageProvider) GetStreamAnnotation(uuid []byte) ([]byte, uint64, bte.BTE) {
-	panic("yo not supported bro")
+	if startingFrom < prefix {
+		startingFrom = prefix
+	}
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	found := make(map[string]struct{})
+	for c := range sp.collidx {
+		if c >= startingFrom && strings.HasPrefix(c, prefix) {
+			found[c] = struct{}{}
+		}
+	}
+	if sp.metaidx != nil {
+		//The first number of either source are enough for the first number
+		//of both
+		var ndisk int64
+		err := sp.metaidx.scanCollections(startingFrom, func(c string) bool {
+			if !strings.HasPrefix(c, prefix) {
+				return false
+			}
+			found[c] = struct{}{}
+			ndisk++
+			return number <= 0 || ndisk < number
+		})
+		if err != nil {
+			return nil, bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+		}
+	}
+	rv := make([]string, 0, len(found))
+	for c := range found {
+		rv = append(rv, c)
+	}
+	sort.Strings(rv)
+	if number > 0 && int64(len(rv)) > number {
+		rv = rv[:number]
+	}
+	return rv, nil
 }
@@ -0,0 +1,1439 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/BTrDB/btrdb-server/internal/bprovider/bprovidertest"
+	"github.com/BTrDB/btrdb-server/internal/configprovider"
+	"github.com/BTrDB/btrdb-server/internal/rez"
+	"github.com/pborman/uuid"
+	"go.uber.org/goleak"
+)
+
+type testConfig struct {
+	configprovider.Configuration
+	dir         string
+	files       int
+	syncOnFlush bool
+	readCache   int
+	dirs        []string
+	compression string
+	firstRead   int
+	mmap        bool
+	queueDepth  int
+	verify      bool
+	mode        os.FileMode
+}
+
+func (c *testConfig) StorageFilepath() string {
+	return c.dir
+}
+
+func (c *testConfig) StorageFilepaths() []string {
+	return c.dirs
+}
+
+func (c *testConfig) StorageCompression() string {
+	return c.compression
+}
+
+func (c *testConfig) StorageFirstReadBytes() int {
+	return c.firstRead
+}
+
+func (c *testConfig) StorageUseMmap() bool {
+	return c.mmap
+}
+
+func (c *testConfig) StorageWriteQueueDepth() int {
+	return c.queueDepth
+}
+
+func (c *testConfig) StorageVerifyWrites() bool {
+	return c.verify
+}
+
+func (c *testConfig) StorageFileMode() os.FileMode {
+	return c.mode
+}
+
+func (c *testConfig) StorageFileCount() int {
+	return c.files
+}
+
+func (c *testConfig) StorageSyncOnFlush() bool {
+	return c.syncOnFlush
+}
+
+func (c *testConfig) StorageReadCacheBytes() int {
+	return c.readCache
+}
+
+func mkDatabase(t testing.TB, setup func(sp *FileStorageProvider)) *testConfig {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	cfg := &testConfig{dir: dir}
+	sp := &FileStorageProvider{}
+	if setup != nil {
+		setup(sp)
+	}
+	if err := sp.CreateDatabase(cfg); err != nil {
+		t.Fatalf("could not create database: %v", err)
+	}
+	return cfg
+}
+
+//Create a fresh database and return a provider for it. The setup function,
+//if not nil, is called before CreateDatabase and Initialize
+func mkProvider(t testing.TB, setup func(sp *FileStorageProvider)) (*FileStorageProvider, *testConfig) {
+	cfg := mkDatabase(t, setup)
+	sp := &FileStorageProvider{}
+	if setup != nil {
+		setup(sp)
+	}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatalf("could not initialize: %v", err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	return sp, cfg
+}
+
+//Every provider a test makes is closed when it ends, so no goroutine may be
+//left running once the tests are done
+func TestMain(m *testing.M) {
+	goleak.VerifyTestMain(m)
+}
+
+func mkData(size int, seed byte) []byte {
+	rv := make([]byte, size)
+	for i := range rv {
+		rv[i] = byte(i) + seed
+	}
+	return rv
+}
+
+func TestCheckpointEveryNWrites(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.CheckpointWrites = 10
+		sp.SyncOnCheckpoint = true
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	addr := seg.BaseAddress()
+	var err error
+	for i := 0; i < 9; i++ {
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	if cp := atomic.LoadUint64(&sp.checkpoints); cp != 0 {
+		t.Fatalf("expected no checkpoint after 9 writes, got %d", cp)
+	}
+	_, err = seg.Write(id, addr, mkData(100, 9))
+	if err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	seg.Unlock()
+	if cp := atomic.LoadUint64(&sp.checkpoints); cp != 1 {
+		t.Fatalf("expected one checkpoint after 10 writes, got %d", cp)
+	}
+	if sy := atomic.LoadUint64(&sp.syncs); sy != 1 {
+		t.Fatalf("expected one sync after 10 writes, got %d", sy)
+	}
+}
+
+//A segfile whose syncs signal syncing, if nothing is waiting on it yet, and
+//then wait until release is closed
+type blockingSyncSegfile struct {
+	segfile
+	syncing chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingSyncSegfile) Datasync() error {
+	select {
+	case f.syncing <- struct{}{}:
+	default:
+	}
+	<-f.release
+	return f.segfile.Datasync()
+}
+
+func TestCheckpointSyncWithoutLock(t *testing.T) {
+	syncing := make(chan struct{}, 1)
+	release := make(chan struct{})
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.CheckpointWrites = 1
+		sp.SyncOnCheckpoint = true
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &blockingSyncSegfile{f, syncing, release}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 0)); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	<-syncing
+	//The sequence lock must be free while the checkpoint syncs
+	done := make(chan struct{})
+	go func() {
+		seg.oldestUnflushed()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		close(release)
+		t.Fatalf("the sequence lock was held during the checkpoint sync")
+	}
+	close(release)
+	seg.Unlock()
+	if sy := atomic.LoadUint64(&sp.syncs); sy == 0 {
+		t.Fatalf("expected the checkpoint to sync")
+	}
+}
+
+//Write a single block and return its address
+func writeOne(t *testing.T, sp *FileStorageProvider, id []byte, data []byte) uint64 {
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	if _, err := seg.Write(id, addr, data); err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	seg.Unlock()
+	return addr
+}
+
+//Flip a byte of the block at the given address, skip bytes into its data
+func corruptBlock(t *testing.T, cfg *testConfig, addr uint64, skip int64) {
+	fname := fmt.Sprintf("%s/blockstore.%02x.db", cfg.dir, addr>>50)
+	f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatalf("could not open blockstore file: %v", err)
+	}
+	defer f.Close()
+	off := int64(addr&((1<<50)-1)) + 2 + skip
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatalf("could not read blockstore file: %v", err)
+	}
+	b[0] ^= 0xFF
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatalf("could not write blockstore file: %v", err)
+	}
+}
+
+func TestReadLenient(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	good := writeOne(t, sp, id, mkData(100, 1))
+	bad := writeOne(t, sp, id, mkData(100, 2))
+	corruptBlock(t, cfg, bad, 10)
+
+	buf := make([]byte, MAXBLOCKSIZE)
+	if _, err := sp.Read(id, bad, buf); err != bprovider.ErrCorrupt {
+		t.Fatalf("expected strict read to fail with ErrCorrupt, got %v", err)
+	}
+	data, isbad, err := sp.ReadLenient(id, bad, buf)
+	if err != nil || !isbad {
+		t.Fatalf("expected lenient read to flag the block (%v, %v)", isbad, err)
+	}
+	if !bytes.Equal(data, make([]byte, 100)) {
+		t.Fatalf("expected lenient read to return zeros")
+	}
+	data, isbad, err = sp.ReadLenient(id, good, buf)
+	if err != nil || isbad || !bytes.Equal(data, mkData(100, 1)) {
+		t.Fatalf("lenient read of a good block failed (%v, %v)", isbad, err)
+	}
+}
+
+func TestValidateReferences(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	for i := 0; i < 10; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	seg.Unlock()
+	corruptBlock(t, cfg, addrs[3], 50)
+	//addr is now just past the last block, which is a hole
+	refs := append(append([]uint64{}, addrs...), addr)
+	bad, err := sp.ValidateReferences(refs)
+	if err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	if len(bad) != 2 || bad[0] != addrs[3] || bad[1] != addr {
+		t.Fatalf("expected %x and %x to fail validation, got %x", addrs[3], addr, bad)
+	}
+}
+
+func TestAddressZeroIsNoBlock(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	buf := make([]byte, MAXBLOCKSIZE)
+	if _, err := sp.Read(id, 0, buf); err != bprovider.ErrNoBlock {
+		t.Fatalf("expected ErrNoBlock reading address zero, got %v", err)
+	}
+	//Write until file zero has been used
+	for i := 0; i < 2*NUMFILES; i++ {
+		seg := sp.LockSegment(id)
+		if seg.BaseAddress() == 0 {
+			t.Fatalf("segment handed out at address zero")
+		}
+		addr, err := seg.Write(id, seg.BaseAddress(), mkData(10, byte(i)))
+		if err != nil || addr == 0 {
+			t.Fatalf("unexpected write result %x (%v)", addr, err)
+		}
+		seg.Unlock()
+	}
+	if _, _, err := sp.ReadLenient(id, 0, buf); err != bprovider.ErrNoBlock {
+		t.Fatalf("expected ErrNoBlock from ReadLenient, got %v", err)
+	}
+	bad, err := sp.ValidateReferences([]uint64{0})
+	if err != nil || len(bad) != 1 {
+		t.Fatalf("expected address zero to be an invalid reference, got %v (%v)", bad, err)
+	}
+}
+
+func TestWriteAddressZero(t *testing.T) {
+	defer SetAssertMode(AssertPanic)
+	SetAssertMode(AssertOff)
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	//Lock files until file zero is among them
+	var segs []bprovider.Segment
+	var zero bprovider.Segment
+	for zero == nil {
+		seg := sp.LockSegment(id)
+		if fidx, _ := bprovider.DecodeAddress(seg.BaseAddress()); fidx == 0 {
+			zero = seg
+		} else {
+			segs = append(segs, seg)
+		}
+	}
+	for _, seg := range segs {
+		seg.Unlock()
+	}
+	if _, err := zero.Write(id, 0, mkData(10, 0)); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument writing address zero, got %v", err)
+	}
+	zero.Unlock()
+	tag := make([]byte, len(FILETAG))
+	f, err := os.Open(blockPath([]string{cfg.dir}, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.ReadAt(tag, 0); err != nil || string(tag) != FILETAG {
+		t.Fatalf("expected the file tag to be intact, got %q (%v)", tag, err)
+	}
+}
+
+func TestOrderedCompletion(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.SegmentWriters = 4
+		sp.OrderedCompletion = true
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	var mu sync.Mutex
+	var completed []uint64
+	var written []uint64
+	addr := seg.BaseAddress()
+	for i := 0; i < 500; i++ {
+		written = append(written, addr)
+		var err error
+		//Vary the size so the writers take different times
+		addr, err = seg.WriteNotify(id, addr, mkData(10+(i%7)*3000, byte(i)), func(a uint64) {
+			mu.Lock()
+			completed = append(completed, a)
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 99 {
+			seg.Checkpoint()
+			mu.Lock()
+			n := len(completed)
+			mu.Unlock()
+			if n != i+1 {
+				t.Fatalf("checkpoint returned with %d of %d blocks complete", n, i+1)
+			}
+		}
+	}
+	seg.Unlock()
+	if fmt.Sprint(completed) != fmt.Sprint(written) {
+		t.Fatalf("blocks completed out of order")
+	}
+	buf := make([]byte, MAXBLOCKSIZE)
+	for i, a := range written {
+		d, err := sp.Read(id, a, buf)
+		if err != nil || !bytes.Equal(d, mkData(10+(i%7)*3000, byte(i))) {
+			t.Fatalf("block %d read back wrong (%v)", i, err)
+		}
+	}
+}
+
+func TestSegmentAbort(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.SegmentWriters = 2
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	kept := writeOne(t, sp, id, mkData(100, 1))
+	livebefore, _ := sp.TotalLiveSize()
+
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	st, err := seg.f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := st.Size()
+	if before != int64(seg.BaseAddress()&((1<<50)-1)) {
+		t.Fatalf("segment base %x does not match file length %d", seg.BaseAddress(), before)
+	}
+	addr := seg.BaseAddress()
+	for i := 0; i < 100; i++ {
+		addr, err = seg.Write(id, addr, mkData(1000, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 50 {
+			//Make sure some of it is on disk before the abort
+			seg.Checkpoint()
+		}
+	}
+	seg.Abort()
+	st, err = seg.f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Size() != before {
+		t.Fatalf("expected file length %d after abort, got %d", before, st.Size())
+	}
+	if live, _ := sp.TotalLiveSize(); live != livebefore {
+		t.Fatalf("expected aborted blocks to be released, live size %d vs %d", live, livebefore)
+	}
+	if _, err := sp.Read(id, kept, make([]byte, MAXBLOCKSIZE)); err != nil {
+		t.Fatalf("block written before the segment was lost: %v", err)
+	}
+	//The file is usable again from the same place
+	for i := 0; i < 2*NUMFILES; i++ {
+		seg2 := sp.LockSegment(id)
+		if seg2.BaseAddress()>>50 == seg.BaseAddress()>>50 {
+			if seg2.BaseAddress() != seg.BaseAddress() {
+				t.Fatalf("file reused at %x, expected %x", seg2.BaseAddress(), seg.BaseAddress())
+			}
+			seg2.Unlock()
+			return
+		}
+		defer seg2.Unlock()
+	}
+	t.Fatalf("aborted file was not returned")
+}
+
+//Records the order of writes and syncs
+type recordingSegfile struct {
+	segfile
+	mu     sync.Mutex
+	events []int64
+}
+
+const syncEvent = -1
+
+func (f *recordingSegfile) WriteAt(b []byte, off int64) (int, error) {
+	f.mu.Lock()
+	f.events = append(f.events, off)
+	f.mu.Unlock()
+	return f.segfile.WriteAt(b, off)
+}
+
+func (f *recordingSegfile) Datasync() error {
+	//Make the window for a later write to overtake the sync wide
+	time.Sleep(2 * time.Millisecond)
+	err := f.segfile.Datasync()
+	f.mu.Lock()
+	f.events = append(f.events, syncEvent)
+	f.mu.Unlock()
+	return err
+}
+
+//Writes bursts of 16 blocks, each taking 1ms to write, with 16ms between
+//bursts to prepare the next. With a shallow queue Write stalls in a burst,
+//with a deep one the writer catches up between bursts
+func benchmarkQueueDepth(b *testing.B, depth int) {
+	cfg := mkDatabase(b, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.queueDepth = depth
+	sp := &FileStorageProvider{}
+	sp.wrapSegfile = func(f segfile) segfile {
+		return &slowSegfile{f, time.Millisecond}
+	}
+	if err := sp.Initialize(cfg); err != nil {
+		b.Fatal(err)
+	}
+	defer sp.Close()
+	id := uuid.NewRandom()
+	data := mkData(200, 1)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 64 {
+		seg := sp.LockSegment(id)
+		addr := seg.BaseAddress()
+		for j := 0; j < 64; j++ {
+			if j%16 == 0 {
+				time.Sleep(16 * time.Millisecond)
+			}
+			var err error
+			if addr, err = seg.Write(id, addr, data); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := seg.Unlock(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkQueueDepth1(b *testing.B) {
+	benchmarkQueueDepth(b, 1)
+}
+
+func BenchmarkQueueDepth16(b *testing.B) {
+	benchmarkQueueDepth(b, 16)
+}
+
+func BenchmarkQueueDepth64(b *testing.B) {
+	benchmarkQueueDepth(b, 64)
+}
+
+func TestStrictBarriers(t *testing.T) {
+	rec := &recordingSegfile{}
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.SegmentWriters = 4
+		sp.StrictBarriers = true
+		sp.SyncOnCheckpoint = true
+		sp.wrapSegfile = func(f segfile) segfile {
+			rec.segfile = f
+			return rec
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	addr := seg.BaseAddress()
+	//The first offset written after each checkpoint
+	var boundaries []int64
+	for i := 0; i < 200; i++ {
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100+(i%5)*2000, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i%20 == 19 {
+			seg.enqueueCheckpoint()
+			boundaries = append(boundaries, int64(addr&((1<<50)-1)))
+		}
+	}
+	seg.Unlock()
+	syncs := 0
+	for _, ev := range rec.events {
+		if ev == syncEvent {
+			syncs++
+			continue
+		}
+		if syncs < len(boundaries) && ev >= boundaries[syncs] {
+			t.Fatalf("write at %d was issued before checkpoint %d was synced", ev, syncs)
+		}
+	}
+	if syncs != len(boundaries) {
+		t.Fatalf("expected %d syncs, got %d", len(boundaries), syncs)
+	}
+}
+
+func TestLockSegmentAfterInitialize(t *testing.T) {
+	for _, nalloc := range []int{1, 4} {
+		sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+			sp.Allocators = nalloc
+		})
+		//Every allocator must already be serving, so taking one file from
+		//each should not wait on a goroutine that has not started yet
+		for i := range sp.fidx {
+			select {
+			case fidx := <-sp.fidx[i]:
+				sp.retfidx[i] <- fidx
+			case <-time.After(time.Second):
+				t.Fatalf("allocator %d of %d was not serving when Initialize returned", i, nalloc)
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			seg := sp.LockSegment(uuid.NewRandom())
+			seg.Unlock()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("LockSegment blocked after Initialize with %d allocators", nalloc)
+		}
+		os.RemoveAll(cfg.dir)
+	}
+}
+
+func TestSerializationHooks(t *testing.T) {
+	//Prefix a frame and invert every byte
+	frame := []byte("FRM")
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.PreWrite = func(data []byte) []byte {
+			rv := append([]byte{}, frame...)
+			for _, b := range data {
+				rv = append(rv, ^b)
+			}
+			return rv
+		}
+		sp.PostRead = func(data []byte) []byte {
+			if !bytes.HasPrefix(data, frame) {
+				t.Fatalf("PostRead given data without the frame")
+			}
+			rv := data[len(frame):]
+			for i := range rv {
+				rv[i] = ^rv[i]
+			}
+			return rv
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	blocks := [][]byte{}
+	for i := 0; i < 10; i++ {
+		data := mkData(100+i, byte(i))
+		next, err := seg.Write(id, addr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//The stored length is that of the transformed data
+		if want := sp.recordLen(&writeparams{Data: make([]byte, len(data)+len(frame))}); int64(next-addr) != want {
+			t.Fatalf("block %d took %d bytes, expected %d", i, next-addr, want)
+		}
+		addrs = append(addrs, addr)
+		blocks = append(blocks, data)
+		addr = next
+	}
+	seg.Unlock()
+	for i, addr := range addrs {
+		buf := make([]byte, MAXBLOCKSIZE)
+		got, err := sp.Read(id, addr, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, blocks[i]) {
+			t.Fatalf("block %d did not round trip", i)
+		}
+		got, bad, err := sp.ReadLenient(id, addr, buf)
+		if err != nil || bad || !bytes.Equal(got, blocks[i]) {
+			t.Fatalf("block %d did not round trip through ReadLenient", i)
+		}
+	}
+	if _, _, err := sp.ReadChecked(id, addrs[0], make([]byte, MAXBLOCKSIZE)); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ReadChecked to be refused with hooks, got %v", err)
+	}
+}
+
+//A segfile whose writes wait until release is closed
+type stalledSegfile struct {
+	segfile
+	release chan struct{}
+}
+
+func (f *stalledSegfile) WriteAt(b []byte, off int64) (int, error) {
+	<-f.release
+	return f.segfile.WriteAt(b, off)
+}
+
+//A segfile whose writes each take at least delay
+type slowSegfile struct {
+	segfile
+	delay time.Duration
+}
+
+func (f *slowSegfile) WriteAt(b []byte, off int64) (int, error) {
+	time.Sleep(f.delay)
+	return f.segfile.WriteAt(b, off)
+}
+
+func TestWriteQueueDepth(t *testing.T) {
+	release := make(chan struct{})
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.queueDepth = 1
+	sp := &FileStorageProvider{}
+	sp.wrapSegfile = func(f segfile) segfile {
+		return &stalledSegfile{f, release}
+	}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	if n := cap(seg.wchan); n != 1 {
+		t.Fatalf("expected a queue of 1, got %d", n)
+	}
+	//The writer takes the first block and stalls on it, the second fills the
+	//queue and the third has to wait
+	addr := seg.BaseAddress()
+	for i := 0; i < 2; i++ {
+		var err error
+		if addr, err = seg.Write(id, addr, mkData(100, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := seg.WriteCtx(ctx, id, addr, mkData(100, 2)); err != context.DeadlineExceeded {
+		t.Fatalf("expected the third write to block, got %v", err)
+	}
+	close(release)
+	if _, err := seg.Write(id, addr, mkData(100, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	//Without the configuration, the default depth is used
+	sp2, cfg2 := mkProvider(t, nil)
+	defer os.RemoveAll(cfg2.dir)
+	seg = sp2.LockSegment(id).(*FileProviderSegment)
+	if n := cap(seg.wchan); n != WRITEQUEUEDEPTH {
+		t.Fatalf("expected a queue of %d by default, got %d", WRITEQUEUEDEPTH, n)
+	}
+	seg.Unlock()
+}
+
+func TestInvalidWriteQueueDepth(t *testing.T) {
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.queueDepth = -1
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); !errors.Is(err, bprovider.ErrInvalidArgument) {
+		t.Fatalf("expected a negative write queue depth to be rejected, got %v", err)
+	}
+}
+
+func TestInvalidConfiguration(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(cfg *testConfig)
+	}{
+		{"a file count past the address space", func(cfg *testConfig) { cfg.files = MAXNUMFILES + 1 }},
+		{"a file mode that is not permissions", func(cfg *testConfig) { cfg.mode = os.ModeDir | 0600 }},
+		{"an unknown codec", func(cfg *testConfig) { cfg.compression = "lzma" }},
+		{"a first read smaller than a span header", func(cfg *testConfig) { cfg.firstRead = SPANHEADERLEN - 1 }},
+		{"compression the database was created without", func(cfg *testConfig) { cfg.compression = "snappy" }},
+	} {
+		cfg := mkDatabase(t, nil)
+		tc.setup(cfg)
+		err := (&FileStorageProvider{}).Initialize(cfg)
+		if !errors.Is(err, bprovider.ErrInvalidArgument) {
+			t.Fatalf("expected %s to be rejected with ErrInvalidArgument, got %v", tc.name, err)
+		}
+		os.RemoveAll(cfg.dir)
+	}
+}
+
+func TestReadAtOffset(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	data := mkData(500, 3)
+	if _, err := seg.Write(id, addr, data); err != nil {
+		t.Fatal(err)
+	}
+	seg.Unlock()
+	byaddr, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byoff, err := sp.ReadAtOffset(int(addr>>50), int64(addr&((1<<50)-1)), make([]byte, MAXBLOCKSIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(byaddr, data) || !bytes.Equal(byoff, byaddr) {
+		t.Fatalf("ReadAtOffset did not return the same block as Read")
+	}
+	for _, bad := range []struct {
+		fidx   int
+		offset int64
+	}{{-1, 16}, {NUMFILES, 16}, {0, -1}, {0, 1 << 50}} {
+		if _, err := sp.ReadAtOffset(bad.fidx, bad.offset, make([]byte, MAXBLOCKSIZE)); err != bprovider.ErrInvalidArgument {
+			t.Fatalf("expected ErrInvalidArgument for file %d offset %d, got %v", bad.fidx, bad.offset, err)
+		}
+	}
+	if _, err := sp.ReadAtOffset(0, 0, make([]byte, MAXBLOCKSIZE)); err != bprovider.ErrNoBlock {
+		t.Fatalf("expected ErrNoBlock at the start of file zero, got %v", err)
+	}
+}
+
+func TestReadPastFrontier(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	addr := seg.BaseAddress()
+	next, err := seg.Write(id, addr, mkData(100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	//A block is readable once queued, but not the address after it
+	if _, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != nil {
+		t.Fatalf("expected a queued block to be readable, got %v", err)
+	}
+	fidx := addr >> 50
+	for _, bad := range []uint64{
+		next,
+		next + 1000,
+		fidx<<50 + 1<<40,
+		//Within the file tag and format header
+		fidx<<50 + 1,
+		uint64(sp.numfiles)<<50 + uint64(addr&(1<<50-1)),
+	} {
+		if _, err := sp.Read(id, bad, make([]byte, MAXBLOCKSIZE)); err != bprovider.ErrInvalidArgument {
+			t.Fatalf("expected ErrInvalidArgument reading %x, got %v", bad, err)
+		}
+	}
+	//What an aborted segment wrote is gone
+	seg.Abort()
+	if _, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument reading an aborted block, got %v", err)
+	}
+}
+
+func TestFileIndexBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 4}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	if _, err := seg.Write(id, addr, mkData(100, 1)); err != nil {
+		t.Fatal(err)
+	}
+	//The same offset in the file one past the last
+	off := addr & (1<<50 - 1)
+	bad := uint64(sp.numfiles)<<50 + off
+	if _, err := seg.Write(id, bad, mkData(100, 2)); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument writing to file %d, got %v", sp.numfiles, err)
+	}
+	seg.Unlock()
+	buf := make([]byte, MAXBLOCKSIZE)
+	if _, err := sp.Read(id, bad, buf); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument from Read, got %v", err)
+	}
+	if _, _, err := sp.ReadLenient(id, bad, buf); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument from ReadLenient, got %v", err)
+	}
+	if _, err := sp.ReadAtOffset(sp.numfiles, int64(off), buf); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument from ReadAtOffset, got %v", err)
+	}
+	if err := sp.IterateFile(sp.numfiles, func(*FileRecord) bool { return true }); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument from IterateFile, got %v", err)
+	}
+	if _, err := sp.CompactFile(sp.numfiles, nil); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument from CompactFile, got %v", err)
+	}
+	if invalid, err := sp.ValidateReferences([]uint64{addr, bad}); err != nil || len(invalid) != 1 || invalid[0] != bad {
+		t.Fatalf("expected only %x to fail validation, got %x (%v)", bad, invalid, err)
+	}
+}
+
+func TestReadIntoSmallBuffer(t *testing.T) {
+	for _, grow := range []bool{false, true} {
+		sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+			sp.GrowSmallBuffers = grow
+		})
+		id := uuid.NewRandom()
+		seg := sp.LockSegment(id)
+		addr := seg.BaseAddress()
+		data := mkData(2*FIRSTREAD, 9)
+		if _, err := seg.Write(id, addr, data); err != nil {
+			t.Fatal(err)
+		}
+		seg.Unlock()
+		got, err := sp.Read(id, addr, make([]byte, FIRSTREAD))
+		if grow {
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("expected the block to be read into a bigger buffer, got %v", err)
+			}
+		} else {
+			need := len(data) + int(sp.blockOverhead())
+			if e, ok := err.(bprovider.ErrBufferTooSmall); !ok || e.Need != need {
+				t.Fatalf("expected ErrBufferTooSmall needing %d bytes, got %v", need, err)
+			}
+			//A buffer of the size asked for is enough
+			got, err = sp.Read(id, addr, make([]byte, need))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("expected the block to fit the size reported, got %v", err)
+			}
+		}
+		os.RemoveAll(cfg.dir)
+	}
+}
+
+func TestGrowBufferCorruptLength(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatWide
+		sp.GrowSmallBuffers = true
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	addr := writeOne(t, sp, id, mkData(100, 1))
+	//A length prefix of 2GB, far past the end of the file
+	f, err := os.OpenFile(blockPath([]string{cfg.dir}, int(addr>>50)), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteAt([]byte{0xFF, 0xFF, 0xFF, 0x7F}, int64(addr&((1<<50)-1))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.Read(id, addr, make([]byte, FIRSTREAD)); err != bprovider.ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt for a length past the end of the file, got %v", err)
+	}
+}
+
+func TestBeforeReadHook(t *testing.T) {
+	denied := uuid.NewRandom()
+	errDenied := errors.New("denied")
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.BeforeRead = func(id []byte, address uint64) error {
+			if bytes.Equal(id, denied) {
+				return errDenied
+			}
+			return nil
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	allowed := uuid.NewRandom()
+	addrs := make(map[string]uint64)
+	for _, id := range []uuid.UUID{allowed, denied} {
+		seg := sp.LockSegment(id)
+		addrs[id.String()] = seg.BaseAddress()
+		if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 1)); err != nil {
+			t.Fatal(err)
+		}
+		seg.Unlock()
+	}
+	buf := make([]byte, MAXBLOCKSIZE)
+	before := atomic.LoadUint64(&sp.reads)
+	if _, err := sp.Read(denied, addrs[denied.String()], buf); err != errDenied {
+		t.Fatalf("expected the hook's error from Read, got %v", err)
+	}
+	if _, _, err := sp.ReadLenient(denied, addrs[denied.String()], buf); err != errDenied {
+		t.Fatalf("expected the hook's error from ReadLenient, got %v", err)
+	}
+	if _, _, err := sp.ReadChecked(denied, addrs[denied.String()], buf); err != errDenied {
+		t.Fatalf("expected the hook's error from ReadChecked, got %v", err)
+	}
+	if atomic.LoadUint64(&sp.reads) != before {
+		t.Fatalf("denied reads touched the disk")
+	}
+	if _, err := sp.Read(allowed, addrs[allowed.String()], buf); err != nil {
+		t.Fatalf("expected an allowed read to succeed, got %v", err)
+	}
+}
+
+//A segfile whose writes fail with EIO once fail is set
+type failingSegfile struct {
+	segfile
+	fail *int32
+}
+
+func (f *failingSegfile) WriteAt(b []byte, off int64) (int, error) {
+	if atomic.LoadInt32(f.fail) != 0 {
+		return 0, syscall.EIO
+	}
+	return f.segfile.WriteAt(b, off)
+}
+
+func TestSegmentWriteError(t *testing.T) {
+	var fail int32
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &failingSegfile{f, &fail}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	good := seg.BaseAddress()
+	addr, err := seg.Write(id, good, mkData(100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Checkpoint(); err != nil {
+		t.Fatalf("expected checkpoint before the failure to succeed: %v", err)
+	}
+	atomic.StoreInt32(&fail, 1)
+	bad := addr
+	if _, err := seg.Write(id, bad, mkData(100, 2)); err != nil {
+		t.Fatalf("expected the write to be queued before it fails: %v", err)
+	}
+	if err := seg.Checkpoint(); err != syscall.EIO {
+		t.Fatalf("expected the checkpoint to return EIO, got %v", err)
+	}
+	//The error is sticky
+	if _, err := seg.Write(id, bad+200, mkData(100, 3)); err != syscall.EIO {
+		t.Fatalf("expected later writes to return EIO, got %v", err)
+	}
+	if err := seg.Unlock(); err != syscall.EIO {
+		t.Fatalf("expected Unlock to return EIO, got %v", err)
+	}
+	if n := sp.Stats().Files[good>>50].WriteErrors; n != 1 {
+		t.Fatalf("expected 1 write error, got %d", n)
+	}
+	//The failed block is gone, the one before it is not
+	if got, err := sp.Read(id, good, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(got, mkData(100, 1)) {
+		t.Fatalf("expected the block before the failure to read back: %v", err)
+	}
+	if size, _ := sp.StreamPhysicalSize(id); size != uint64(addr-good) {
+		t.Fatalf("expected only the good block to be live, got %d bytes", size)
+	}
+	fi, err := os.Stat(fmt.Sprintf("%s/blockstore.%02x.db", cfg.dir, good>>50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(addr&((1<<50)-1)) {
+		t.Fatalf("expected the file to be truncated to %d, got %d", addr&((1<<50)-1), fi.Size())
+	}
+	//The provider carries on once the disk recovers
+	atomic.StoreInt32(&fail, 0)
+	addr = writeOne(t, sp, id, mkData(100, 4))
+	if got, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(got, mkData(100, 4)) {
+		t.Fatalf("expected a write after recovery to read back: %v", err)
+	}
+}
+
+//A segfile counting the syncs of every file it wraps
+type countingSegfile struct {
+	segfile
+	syncs *int32
+}
+
+func (f *countingSegfile) Datasync() error {
+	atomic.AddInt32(f.syncs, 1)
+	return f.segfile.Datasync()
+}
+
+func TestSyncOnFlush(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		cfg := mkDatabase(t, nil)
+		defer os.RemoveAll(cfg.dir)
+		cfg.syncOnFlush = enabled
+		var syncs int32
+		sp := &FileStorageProvider{}
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &countingSegfile{f, &syncs}
+		}
+		if err := sp.Initialize(cfg); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sp.Close() })
+		id := uuid.NewRandom()
+		for i := 0; i < 3; i++ {
+			seg := sp.LockSegment(id).(*FileProviderSegment)
+			addr := seg.BaseAddress()
+			for j := 0; j < 5; j++ {
+				var err error
+				addr, err = seg.Write(id, addr, mkData(100, byte(j)))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			//Checkpoints only sync with SyncOnCheckpoint
+			if err := seg.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+			if err := seg.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			expected := int32(0)
+			if enabled {
+				expected = int32(i + 1)
+			}
+			if n := atomic.LoadInt32(&syncs); n != expected {
+				t.Fatalf("expected %d syncs after %d flushes (sync on flush %v), got %d", expected, i+1, enabled, n)
+			}
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	setup := func(sp *FileStorageProvider) {
+		sp.ScrubInterval = time.Hour
+		sp.VersionFlushInterval = time.Hour
+		sp.MinFreeBytes = 1
+	}
+	cfg := mkDatabase(t, setup)
+	defer os.RemoveAll(cfg.dir)
+	sp := &FileStorageProvider{}
+	setup(sp)
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewRandom()
+	data := mkData(100, 3)
+	addr := writeOne(t, sp, id, data)
+	//Only in the batch until Close writes it out
+	sp.SetStreamVersion(id, 5)
+
+	//Close waits for a segment that is still locked
+	seg := sp.LockSegment(id)
+	closed := make(chan error)
+	go func() {
+		closed <- sp.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("close returned with a segment locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatalf("unexpected error closing again: %v", err)
+	}
+	goleak.VerifyNone(t)
+	if _, err := sp.dbrf[addr>>50].Stat(); err == nil {
+		t.Fatalf("expected blockstore file to be closed")
+	}
+
+	sp = &FileStorageProvider{}
+	setup(sp)
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	rv, err := sp.Read(id, addr, make([]byte, 200))
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if !bytes.Equal(rv, data) {
+		t.Fatalf("read returned the wrong data after reopening")
+	}
+	if v := sp.GetStreamVersion(id); v != 5 {
+		t.Fatalf("expected version 5 after reopening, got %d", v)
+	}
+}
+
+func TestCancelReadWrite(t *testing.T) {
+	release := make(chan struct{})
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &stalledSegfile{f, release}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	//Cancelled while waiting for room in the queue. The writer takes one
+	//block and stalls, so the queue fills up after one more than it holds
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i <= cap(seg.wchan); i++ {
+		addrs = append(addrs, addr)
+		var err error
+		if addr, err = seg.Write(id, addr, mkData(100, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := seg.WriteCtx(ctx, id, addr, mkData(100, 0xEE))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the write to wait for the queue, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("write did not return after being cancelled")
+	}
+	close(release)
+	//The abandoned write left nothing behind, so its address is still next
+	addrs = append(addrs, addr)
+	if _, err := seg.Write(id, addr, mkData(100, byte(len(addrs)-1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range addrs {
+		got, err := sp.Read(id, a, make([]byte, 200))
+		if err != nil || !bytes.Equal(got, mkData(100, byte(i))) {
+			t.Fatalf("unexpected block %d: %v", i, err)
+		}
+	}
+
+	//Cancelled while waiting for the file to be swapped
+	fidx := addrs[0] >> 50
+	sp.dbrf_mtx[fidx].Lock()
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := sp.ReadCtx(ctx, id, addrs[0], make([]byte, 200))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the read to wait for the file, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("read did not return after being cancelled")
+	}
+	sp.dbrf_mtx[fidx].Unlock()
+	if _, err := sp.ReadCtx(ctx, id, addrs[0], make([]byte, 200)); err != context.Canceled {
+		t.Fatalf("expected a read with a done context to fail, got %v", err)
+	}
+	if _, err := sp.ReadCtx(context.Background(), id, addrs[0], make([]byte, 200)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMultipleRoots(t *testing.T) {
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "fileprovider")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	//The metadata is in the first directory, the blockstore files in the
+	//other two
+	cfg := &testConfig{dir: dirs[0], files: 4, dirs: dirs[1:]}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		for d, dir := range dirs {
+			_, err := os.Stat(fmt.Sprintf("%s/blockstore.%02x.db", dir, i))
+			if want := d == 1+i%2; (err == nil) != want {
+				t.Fatalf("blockstore file %d in directory %d: %v, expected it there: %v", i, d, err, want)
+			}
+		}
+	}
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	//Lock every file, so that blocks go to both directories
+	data := make(map[uint64][]byte)
+	var segs []bprovider.Segment
+	for i := 0; i < 4; i++ {
+		segs = append(segs, sp.LockSegment(nil))
+	}
+	for i, seg := range segs {
+		d := mkData(100+i, byte(i))
+		if _, err := seg.Write(nil, seg.BaseAddress(), d); err != nil {
+			t.Fatal(err)
+		}
+		data[seg.BaseAddress()] = d
+	}
+	for _, seg := range segs {
+		if err := seg.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for addr, d := range data {
+		rv, err := sp.Read(nil, addr, make([]byte, 1000))
+		if err != nil || !bytes.Equal(rv, d) {
+			t.Fatalf("block at %x did not read back: %v", addr, err)
+		}
+	}
+}
+
+func TestInitializeMissingDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 2}
+	if err := (&FileStorageProvider{}).Initialize(cfg); err != bprovider.ErrDatabaseNotInitialized {
+		t.Fatalf("expected ErrDatabaseNotInitialized, got %v", err)
+	}
+	//A database missing only some of its files is not one either
+	if err := (&FileStorageProvider{}).CreateDatabase(&testConfig{dir: dir, files: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&FileStorageProvider{}).Initialize(cfg); err != bprovider.ErrDatabaseNotInitialized {
+		t.Fatalf("expected ErrDatabaseNotInitialized with a missing file, got %v", err)
+	}
+}
+
+//Presents the file provider as a bprovider.StorageProvider. It has nothing
+//like ObliterateStreamMetadata or BackgroundCleanup, so those panic, and it
+//doesn't opt in to the cases of the conformance suite that call them
+type storageProvider struct {
+	*FileStorageProvider
+}
+
+func (sp storageProvider) Initialize(cfg configprovider.Configuration, rm *rez.RezManager) {
+	if err := sp.FileStorageProvider.Initialize(cfg); err != nil {
+		panic(err)
+	}
+}
+
+func (sp storageProvider) CreateDatabase(cfg configprovider.Configuration, overwrite bool) error {
+	return sp.FileStorageProvider.CreateDatabase(cfg)
+}
+
+func (sp storageProvider) LockCoreSegment(uuid []byte) bprovider.Segment {
+	return sp.LockSegment(uuid)
+}
+
+func (sp storageProvider) LockVectorSegment(uuid []byte) bprovider.Segment {
+	return sp.LockSegment(uuid)
+}
+
+func (sp storageProvider) Read(ctx context.Context, uuid []byte, address uint64, buffer []byte) ([]byte, error) {
+	return sp.ReadCtx(ctx, uuid, address, buffer)
+}
+
+func (sp storageProvider) ReadSuperBlock(ctx context.Context, uuid []byte, version uint64, buffer []byte) ([]byte, error) {
+	return sp.FileStorageProvider.ReadSuperBlock(uuid, version, buffer)
+}
+
+func (sp storageProvider) GetStreamVersion(ctx context.Context, uuid []byte) (uint64, error) {
+	return sp.FileStorageProvider.GetStreamVersion(uuid), nil
+}
+
+func (sp storageProvider) ObliterateStreamMetadata(uuid []byte) {
+	panic("not implemented")
+}
+
+func (sp storageProvider) BackgroundCleanup(uuids [][]byte) error {
+	panic("not implemented")
+}
+
+func TestStorageProviderConformance(t *testing.T) {
+	//The cases run one after another, so the last case's provider can be
+	//closed when the next one is made, rather than all of them at the end
+	var last *FileStorageProvider
+	bprovidertest.RunConformance(t, func() bprovider.StorageProvider {
+		if last != nil {
+			last.Close()
+		}
+		last, _ = mkProvider(t, nil)
+		return storageProvider{last}
+	})
+}
+
+func TestFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 2, mode: 0600}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	names := []string{blockPath([]string{dir}, 0), blockPath([]string{dir}, 1), metadataPath(dir), superblockPath(dir)}
+	for _, fname := range names {
+		st, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Mode().Perm() != 0600 {
+			t.Fatalf("%s was created with mode %v, expected 0600", fname, st.Mode().Perm())
+		}
+	}
+	bad := &testConfig{dir: dir, files: 2, mode: os.ModeSetuid | 0600}
+	if err := (&FileStorageProvider{}).CreateDatabase(bad); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument for a mode that is not just permissions, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//The number of recent block sizes AdaptiveFirstRead looks at, and how often
+//(in blocks read) it recomputes the first read size from them
+const FIRSTREADSAMPLES = 1024
+const FIRSTREADUPDATE = 32
+
+//The on-disk sizes of the blocks most recently read, and the 99th percentile
+//of them
+type sizesampler struct {
+	mu    sync.Mutex
+	sizes [FIRSTREADSAMPLES]int
+	n     int
+	p99   int64
+}
+
+//How much Read should read before it knows the size of the block. Normally
+//this is StorageFirstReadBytes from the configuration (FIRSTREAD if not
+//given), but with AdaptiveFirstRead it is the 99th percentile of the sizes
+//of recently read blocks, so that nearly all reads need only one syscall
+//without reading far more than necessary
+func (sp *FileStorageProvider) firstReadSize(buflen int) int {
+	rv := sp.firstread
+	if rv <= 0 {
+		rv = FIRSTREAD
+	}
+	if sp.AdaptiveFirstRead {
+		if p99 := atomic.LoadInt64(&sp.blocksizes.p99); p99 > 0 {
+			rv = int(p99)
+		}
+		max := sp.MaxFirstRead
+		if max <= 0 {
+			max = sp.maxBlockSize()
+		}
+		if rv > max {
+			rv = max
+		}
+	}
+	if rv > buflen {
+		rv = buflen
+	}
+	return rv
+}
+
+//Record the on-disk size of a block that was just read
+func (sp *FileStorageProvider) observeBlockSize(size int) {
+	ss := &sp.blocksizes
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sizes[ss.n%FIRSTREADSAMPLES] = size
+	ss.n++
+	if ss.n%FIRSTREADUPDATE != 0 {
+		return
+	}
+	k := ss.n
+	if k > FIRSTREADSAMPLES {
+		k = FIRSTREADSAMPLES
+	}
+	sorted := make([]int, k)
+	copy(sorted, ss.sizes[:k])
+	sort.Ints(sorted)
+	//The nearest rank, so a block as big as the percentile fits
+	atomic.StoreInt64(&ss.p99, int64(sorted[(99*k+99)/100-1]))
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestAdaptiveFirstRead(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.AdaptiveFirstRead = true
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	//Bigger than FIRSTREAD, so every read would need two syscalls
+	for i := 0; i < 100; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(6000+i%50, byte(i)))
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	seg.Unlock()
+	buf := make([]byte, MAXBLOCKSIZE)
+	readAll := func() uint64 {
+		before := atomic.LoadUint64(&sp.secondreads)
+		for _, a := range addrs {
+			if _, err := sp.Read(id, a, buf); err != nil {
+				t.Fatalf("unexpected read error: %v", err)
+			}
+		}
+		return atomic.LoadUint64(&sp.secondreads) - before
+	}
+	first := readAll()
+	if first == 0 {
+		t.Fatalf("expected second reads before adapting")
+	}
+	if second := readAll(); second != 0 {
+		t.Fatalf("expected no second reads once adapted, got %d", second)
+	}
+	if fr := sp.firstReadSize(len(buf)); fr < 6050 || fr > 2*6050 {
+		t.Fatalf("first read size %d did not converge on the block size", fr)
+	}
+	sp.MaxFirstRead = 4000
+	if fr := sp.firstReadSize(len(buf)); fr != 4000 {
+		t.Fatalf("first read size %d is not bounded by the maximum", fr)
+	}
+}
+
+func TestConfiguredFirstRead(t *testing.T) {
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.firstRead = 100
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	id := uuid.NewRandom()
+	overhead := int(sp.blockOverhead())
+	//A block that just fits the first read, one a byte bigger, and one much
+	//bigger than it
+	sizes := []int{100 - overhead, 101 - overhead, 5000}
+	seconds := []uint64{0, 1, 1}
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	for i, size := range sizes {
+		addrs = append(addrs, addr)
+		var err error
+		if addr, err = seg.Write(id, addr, mkData(size, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg.Unlock()
+	for i, a := range addrs {
+		before := sp.Stats()
+		got, err := sp.Read(id, a, make([]byte, MAXBLOCKSIZE))
+		if err != nil || !bytes.Equal(got, mkData(sizes[i], byte(i))) {
+			t.Fatalf("block of %d bytes did not read back: %v", sizes[i], err)
+		}
+		after := sp.Stats()
+		if after.DiskReads-before.DiskReads != 1 || after.SecondReads-before.SecondReads != seconds[i] {
+			t.Fatalf("block of %d bytes took %d second reads, expected %d",
+				sizes[i], after.SecondReads-before.SecondReads, seconds[i])
+		}
+	}
+	st := sp.Stats()
+	if st.SecondReadRatio != float64(st.SecondReads)/float64(st.DiskReads) || st.SecondReads != 2 {
+		t.Fatalf("unexpected second read ratio %v of %d reads", st.SecondReadRatio, st.DiskReads)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+//Every blockstore file begins with this tag
+const FILETAG = "QUASARDB"
+
+//Files created by this version follow the tag with a format header. It starts
+//with a length prefix of 0xFFFF, which no block written by an older version
+//can have, so files without the header are recognised as the legacy format,
+//where a block is just a two byte length followed by the data
+const FORMATHEADERLEN = 8
+const FORMATVERSION = 1
+
+//Format flags. These are fixed when the database is created
+const (
+	//Each block is followed by a CRC32C of its data. Always set for new
+	//databases
+	FormatCRC uint16 = 1 << iota
+	//Each block stores the time it was written, before the CRC
+	FormatTimestamp
+	//Blocks may continue in another file, see span.go
+	FormatSpan
+	//Blocks have a four byte length prefix rather than two, so they can
+	//hold up to MAXWIDEDATA bytes. Can't be combined with FormatSpan
+	FormatWide
+	//The data of each block starts with the id of the codec it is
+	//compressed with, see codec.go. Set if the configuration names a codec
+	//when the database is created
+	FormatCodec
+	//Each record ends with SENTINEL, written after the rest of it, so a
+	//block torn by a crash is told apart from a complete one
+	FormatSentinel
+)
+
+//The format flags this version understands
+const formatKnown = FormatCRC | FormatTimestamp | FormatSpan | FormatWide | FormatCodec | FormatSentinel
+
+//The last byte of every record with FormatSentinel
+const SENTINEL = 0xA5
+
+//The largest block data in a database with FormatWide. The prefix could
+//describe more, but every reader would need a buffer this size
+const MAXWIDEDATA = 16 << 20
+
+var crctab = crc32.MakeTable(crc32.Castagnoli)
+
+func encodeFormatHeader(flags uint16) []byte {
+	return []byte{0xFF, 0xFF, 'F', 'M', 'T', FORMATVERSION, byte(flags), byte(flags >> 8)}
+}
+
+//Check that the file begins with FILETAG, so that a directory of something
+//else (or a truncated file) is not taken for a database
+func checkFileTag(f *os.File) error {
+	tag := make([]byte, len(FILETAG))
+	n, err := f.ReadAt(tag, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if n < len(tag) {
+		return fmt.Errorf("missing file tag, the file is only %d bytes", n)
+	}
+	if string(tag) != FILETAG {
+		return fmt.Errorf("bad file tag %q, expected %q", tag, FILETAG)
+	}
+	return nil
+}
+
+//Returns the format flags and the offset of the first block
+func readFormatHeader(f *os.File) (uint16, int64, error) {
+	hdr := make([]byte, FORMATHEADERLEN)
+	n, err := f.ReadAt(hdr, int64(len(FILETAG)))
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if n < FORMATHEADERLEN || hdr[0] != 0xFF || hdr[1] != 0xFF {
+		//Legacy file
+		return 0, int64(len(FILETAG)), nil
+	}
+	if string(hdr[2:5]) != "FMT" || hdr[5] != FORMATVERSION {
+		return 0, 0, fmt.Errorf("unknown blockstore format header %x", hdr)
+	}
+	flags := uint16(hdr[6]) + (uint16(hdr[7]) << 8)
+	if flags&^formatKnown != 0 {
+		return 0, 0, fmt.Errorf("unknown blockstore format flags %x", flags&^formatKnown)
+	}
+	return flags, int64(len(FILETAG) + FORMATHEADERLEN), nil
+}
+
+//The number of bytes a record occupies on disk
+func (sp *FileStorageProvider) recordLen(wp *writeparams) int64 {
+	rv := int64(len(wp.Data)) + sp.blockOverhead()
+	if wp.Cont != 0 {
+		rv += SPANHEADERLEN - 2
+	}
+	return rv
+}
+
+//The number of bytes a block occupies on disk in addition to its data
+func (sp *FileStorageProvider) blockOverhead() int64 {
+	rv := int64(sp.prefixLen())
+	if sp.format&FormatTimestamp != 0 {
+		rv += 8
+	}
+	if sp.format&FormatCRC != 0 {
+		rv += 4
+	}
+	if sp.format&FormatSentinel != 0 {
+		rv++
+	}
+	return rv
+}
+
+//The length of the prefix holding the size of a block
+func (sp *FileStorageProvider) prefixLen() int {
+	if sp.format&FormatWide != 0 {
+		return 4
+	}
+	return 2
+}
+
+func (sp *FileStorageProvider) lengthPrefix(n int) []byte {
+	if sp.format&FormatWide != 0 {
+		return []byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)}
+	}
+	return []byte{byte(n), byte(n >> 8)}
+}
+
+func (sp *FileStorageProvider) parseLength(b []byte) int {
+	rv := int(b[0]) + (int(b[1]) << 8)
+	if sp.format&FormatWide != 0 {
+		rv += (int(b[2]) << 16) + (int(b[3]) << 24)
+	}
+	return rv
+}
+
+//The most data a block can hold
+func (sp *FileStorageProvider) maxDataSize() int {
+	if sp.format&FormatWide != 0 {
+		return MAXWIDEDATA
+	}
+	return 65535
+}
+
+//The size of a buffer that can hold any block
+func (sp *FileStorageProvider) maxBlockSize() int {
+	return sp.maxDataSize() + int(sp.blockOverhead())
+}
@@ -0,0 +1,326 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestWriteReadChecked(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	good := mkData(300, 1)
+	bad := mkData(300, 2)
+	goodcrc := crc32.Checksum(good, crctab)
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	a1 := seg.BaseAddress()
+	a2, err := seg.WriteChecked(id, a1, good, goodcrc)
+	if err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	//Supply a CRC that does not match the data
+	_, err = seg.WriteChecked(id, a2, bad, goodcrc)
+	if err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	seg.Unlock()
+
+	buf := make([]byte, MAXBLOCKSIZE)
+	data, crc, err := sp.ReadChecked(id, a1, buf)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if !bytes.Equal(data, good) || crc != goodcrc {
+		t.Fatalf("block did not round trip with its CRC")
+	}
+	data, crc, err = sp.ReadChecked(id, a2, buf)
+	if err != nil {
+		t.Fatalf("unexpected read error: %v", err)
+	}
+	if !bytes.Equal(data, bad) {
+		t.Fatalf("block did not round trip")
+	}
+	if crc32.Checksum(data, crctab) == crc {
+		t.Fatalf("mismatched CRC was not detectable")
+	}
+}
+
+func TestBlockTimestamps(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatTimestamp
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	before := time.Now().UnixNano()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	addrs := []uint64{}
+	for i := 0; i < 20; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(64, byte(i)))
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	seg.Unlock()
+	after := time.Now().UnixNano()
+	var last int64
+	buf := make([]byte, MAXBLOCKSIZE)
+	for i, a := range addrs {
+		ts, err := sp.BlockTimestamp(a)
+		if err != nil {
+			t.Fatalf("unexpected timestamp error: %v", err)
+		}
+		if ts < before || ts > after+int64(len(addrs)) {
+			t.Fatalf("timestamp %d outside of write window", ts)
+		}
+		if ts <= last {
+			t.Fatalf("timestamps are not monotonic")
+		}
+		last = ts
+		data, _, err := sp.ReadChecked(id, a, buf)
+		if err != nil || !bytes.Equal(data, mkData(64, byte(i))) {
+			t.Fatalf("block did not round trip (%v)", err)
+		}
+	}
+}
+
+func TestBlockChecksums(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	data := mkData(300, 7)
+	addr := writeOne(t, sp, id, data)
+	buf := make([]byte, MAXBLOCKSIZE)
+	if got, err := sp.Read(id, addr, buf); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected the block to read back: %v", err)
+	}
+	corruptBlock(t, cfg, addr, 150)
+	if _, err := sp.Read(id, addr, buf); err != bprovider.ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt after flipping a payload byte, got %v", err)
+	}
+
+	//Files from before the format header have no checksums, and still read
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lcfg := &testConfig{dir: dir}
+	if err := (&FileStorageProvider{}).CreateDatabase(lcfg); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < NUMFILES; i++ {
+		if err := os.Truncate(fmt.Sprintf("%s/blockstore.%02x.db", dir, i), int64(len(FILETAG))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacy := &FileStorageProvider{}
+	if err := legacy.Initialize(lcfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { legacy.Close() })
+	if legacy.format != 0 {
+		t.Fatalf("expected the legacy format, got flags %x", legacy.format)
+	}
+	seg := legacy.LockSegment(id)
+	addr = seg.BaseAddress()
+	next, err := seg.Write(id, addr, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg.Unlock()
+	if next-addr != uint64(len(data)+2) {
+		t.Fatalf("expected legacy blocks to have no trailer, took %d bytes", next-addr)
+	}
+	if got, err := legacy.Read(id, addr, buf); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("expected the legacy block to read back: %v", err)
+	}
+}
+
+func TestWideBlocks(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatWide
+		sp.VerifySampleRate = 1
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	big := make([]byte, 200*1024)
+	rand.New(rand.NewSource(1)).Read(big)
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	next, err := seg.Write(id, addr, big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := mkData(100, 1)
+	if _, err := seg.Write(id, next, small); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.Write(id, next+100+4+4, make([]byte, MAXWIDEDATA+1)); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument above MAXWIDEDATA, got %v", err)
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if next-addr != uint64(len(big)+4+4) {
+		t.Fatalf("expected a four byte prefix and a CRC, the block took %d bytes", next-addr)
+	}
+	check := func(sp *FileStorageProvider) {
+		if got, err := sp.Read(id, addr, make([]byte, sp.maxBlockSize())); err != nil || !bytes.Equal(got, big) {
+			t.Fatalf("expected the 200KB block to read back: %v", err)
+		}
+		if got, err := sp.Read(id, next, make([]byte, FIRSTREAD)); err != nil || !bytes.Equal(got, small) {
+			t.Fatalf("expected the block after it to read back: %v", err)
+		}
+	}
+	check(sp)
+	if st := sp.Stats(); st.VerifiedBlocks != 2 || st.VerifyFailures != 0 {
+		t.Fatalf("expected both blocks to verify, got %+v", st)
+	}
+	var sizes []int
+	if err := sp.IterateFile(int(addr>>50), func(r *FileRecord) bool {
+		sizes = append(sizes, len(r.Data))
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[0] != len(big) || sizes[1] != len(small) {
+		t.Fatalf("expected to iterate over both blocks, got sizes %v", sizes)
+	}
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+
+	//Without FormatWide, blocks are limited to what two bytes can describe
+	nsp, ncfg := mkProvider(t, nil)
+	defer os.RemoveAll(ncfg.dir)
+	seg = nsp.LockSegment(id)
+	if _, err := seg.Write(id, seg.BaseAddress(), big); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument for a 200KB block, got %v", err)
+	}
+	seg.Unlock()
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	both := &FileStorageProvider{FormatFlags: FormatWide | FormatSpan}
+	if err := both.CreateDatabase(&testConfig{dir: dir}); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected FormatWide with FormatSpan to be rejected, got %v", err)
+	}
+}
+
+func TestFileTag(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		contents []byte
+	}{
+		{"empty", nil},
+		{"truncated", []byte(FILETAG[:5])},
+		{"wrong magic", append([]byte("NOTADBXX"), encodeFormatHeader(FormatCRC)...)},
+	} {
+		dir, err := ioutil.TempDir("", "fileprovider")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cfg := &testConfig{dir: dir, files: 2}
+		if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(dir+"/blockstore.01.db", tc.contents, 0666); err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("expected Initialize to refuse a file that is %s", tc.name)
+				}
+			}()
+			(&FileStorageProvider{}).Initialize(cfg)
+		}()
+	}
+}
+
+//A segfile that, while tear is set, drops the one byte writes that put
+//sentinels after their records
+type tearingSegfile struct {
+	segfile
+	tear *int32
+}
+
+func (f tearingSegfile) WriteAt(b []byte, off int64) (int, error) {
+	if len(b) == 1 && atomic.LoadInt32(f.tear) != 0 {
+		return 1, nil
+	}
+	return f.segfile.WriteAt(b, off)
+}
+
+func TestTornWrite(t *testing.T) {
+	var tear int32
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatSentinel
+		sp.wrapSegfile = func(f segfile) segfile {
+			return tearingSegfile{f, &tear}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	write := func(b byte) uint64 {
+		seg := sp.LockSegment(id)
+		addr := seg.BaseAddress()
+		if _, err := seg.Write(id, addr, mkData(100, b)); err != nil {
+			t.Fatal(err)
+		}
+		seg.Unlock()
+		return addr
+	}
+	good := write(1)
+	atomic.StoreInt32(&tear, 1)
+	torn := write(2)
+	buf := make([]byte, MAXBLOCKSIZE)
+	if data, err := sp.Read(id, good, buf); err != nil || !bytes.Equal(data, mkData(100, 1)) {
+		t.Fatalf("complete block read back wrong: %v", err)
+	}
+	if _, err := sp.Read(id, torn, buf); err != bprovider.ErrIncompleteBlock {
+		t.Fatalf("expected an incomplete block, got %v", err)
+	}
+	if bad, err := sp.ValidateReferences([]uint64{good, torn}); err != nil || len(bad) != 1 || bad[0] != torn {
+		t.Fatalf("expected only the torn block to be bad, got %v %v", bad, err)
+	}
+	fidx := int(torn >> 50)
+	st, err := sp.dbf[fidx].Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := sp.recoverFile(fidx, st.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != int64(torn&((1<<50)-1)) {
+		t.Fatalf("recovery kept the torn block: end %d, block at %d", end, torn&((1<<50)-1))
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/BTrDB/btrdb-server/internal/configprovider"
+)
+
+//What Fsck found in one blockstore file
+type FsckFile struct {
+	//The size of the file
+	Bytes int64
+	//Records that fit in the file and match their checksum
+	ValidBlocks int64
+	//Records that fit in the file but don't match their checksum, or lack
+	//their sentinel
+	BadChecksums int64
+	//The offset of the first record that doesn't fit in the file or doesn't
+	//match its checksum, or -1 if there is none
+	FirstBad int64
+	//Where the walk stopped. The file is only walked to its end if every
+	//length prefix is good, as a bad one leaves no way to find the next record
+	End int64
+}
+
+type FsckReport struct {
+	//Indexed by file number
+	Files       []FsckFile
+	ValidBlocks int64
+	Bytes       int64
+}
+
+//Whether every file was walked to its end without finding a bad record
+func (r FsckReport) OK() bool {
+	for _, f := range r.Files {
+		if f.FirstBad >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+//Check the blockstore files of the database without starting a provider or
+//changing them. Each file is walked record by record from the end of its
+//header, checking that every record fits in the file and, if the database
+//has them, matches its checksum. The error is only for files that can't be
+//read or are not part of a database; ErrDatabaseNotInitialized if one is
+//missing
+func Fsck(cfg configprovider.Configuration) (FsckReport, error) {
+	var rv FsckReport
+	numfiles, err := fileCount(cfg)
+	if err != nil {
+		return rv, err
+	}
+	roots := blockRoots(cfg)
+	for i := 0; i < numfiles; i++ {
+		ff, err := fsckFile(blockPath(roots, i))
+		if err != nil {
+			return rv, err
+		}
+		rv.Files = append(rv.Files, ff)
+		rv.ValidBlocks += ff.ValidBlocks
+		rv.Bytes += ff.Bytes
+	}
+	return rv, nil
+}
+
+func fsckFile(fname string) (FsckFile, error) {
+	rv := FsckFile{FirstBad: -1}
+	f, err := os.Open(fname)
+	if os.IsNotExist(err) {
+		return rv, bprovider.ErrDatabaseNotInitialized
+	}
+	if err != nil {
+		return rv, err
+	}
+	defer f.Close()
+	if err := checkFileTag(f); err != nil {
+		return rv, fmt.Errorf("blockstore file %s is not part of a database: %v", fname, err)
+	}
+	//Just enough of a provider to decode records
+	sp := &FileStorageProvider{}
+	sp.format, sp.datastart, err = readFormatHeader(f)
+	if err != nil {
+		return rv, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return rv, err
+	}
+	rv.Bytes = fi.Size()
+	off := sp.datastart
+	r := bufio.NewReaderSize(io.NewSectionReader(f, off, rv.Bytes-off), sp.maxBlockSize()+SPANHEADERLEN)
+	for off < rv.Bytes {
+		hdr, err := r.Peek(SPANHEADERLEN)
+		if err != nil && err != io.EOF {
+			return rv, err
+		}
+		_, meta, _ := sp.decodeRecord(hdr)
+		//The length is zero if the header itself runs past the end
+		if meta.reclen == 0 || off+meta.reclen > rv.Bytes {
+			rv.FirstBad = off
+			break
+		}
+		rec, err := r.Peek(int(meta.reclen))
+		if err != nil {
+			return rv, err
+		}
+		data, meta, _ := sp.decodeRecord(rec)
+		if meta.torn || sp.format&FormatCRC != 0 && crc32.Checksum(data, crctab) != meta.crc {
+			rv.BadChecksums++
+			if rv.FirstBad < 0 {
+				rv.FirstBad = off
+			}
+		} else {
+			rv.ValidBlocks++
+		}
+		r.Discard(int(meta.reclen))
+		off += meta.reclen
+	}
+	rv.End = off
+	return rv, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestFsck(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	fidx := seg.fidx
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i < 10; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100+i*10, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	sp.Close()
+	rep, err := Fsck(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.OK() || rep.ValidBlocks != 10 || rep.Files[fidx].ValidBlocks != 10 {
+		t.Fatalf("unexpected report of a clean database: %+v", rep)
+	}
+	fname := blockPath(sp.dbroots, fidx)
+	if ff := rep.Files[fidx]; ff.End != ff.Bytes || ff.Bytes != int64(addr&((1<<50)-1)) {
+		t.Fatalf("expected the walk of file %d to end at %d: %+v", fidx, addr&((1<<50)-1), ff)
+	}
+	f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	//A bad checksum is counted and the walk goes on
+	bad := int64(addrs[3] & ((1 << 50) - 1))
+	if _, err := f.WriteAt([]byte{0x55}, bad+10); err != nil {
+		t.Fatal(err)
+	}
+	rep, err = Fsck(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff := rep.Files[fidx]; rep.OK() || ff.FirstBad != bad || ff.BadChecksums != 1 || ff.ValidBlocks != 9 || ff.End != ff.Bytes {
+		t.Fatalf("unexpected report with a bad checksum at %d: %+v", bad, ff)
+	}
+	//A length prefix running past the end of the file stops the walk
+	bad = int64(addrs[2] & ((1 << 50) - 1))
+	if _, err := f.WriteAt([]byte{0xFF, 0xFE}, bad); err != nil {
+		t.Fatal(err)
+	}
+	rep, err = Fsck(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ff := rep.Files[fidx]; rep.OK() || ff.FirstBad != bad || ff.ValidBlocks != 2 || ff.BadChecksums != 0 || ff.End != bad {
+		t.Fatalf("unexpected report with a bad length prefix at %d: %+v", bad, ff)
+	}
+	os.Remove(fname)
+	if _, err := Fsck(cfg); err != bprovider.ErrDatabaseNotInitialized {
+		t.Fatalf("expected ErrDatabaseNotInitialized for a missing file, got %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//The default size of the chunks IterateFile reads
+const ITERATECHUNK = 1 << 20
+
+//A record found by IterateFile. Data is as stored (no PostRead hook is
+//applied) and is only valid until the callback returns
+type FileRecord struct {
+	Address   uint64
+	Data      []byte
+	Timestamp int64
+	CRC       uint32
+	//Whether the data matches its checksum
+	OK bool
+	//For the head of a spanning block, the address of the tail. The tail is
+	//visited as an ordinary record of its own file
+	Cont uint64
+}
+
+//Call cb with each record of the given file, in order, up to its committed
+//frontier, stopping early if cb returns false. The file is read in chunks of
+//IterateChunkSize bytes, so memory use does not depend on the file size
+func (sp *FileStorageProvider) IterateFile(fidx int, cb func(rec *FileRecord) bool) error {
+	if fidx < 0 || fidx >= sp.numfiles {
+		return bprovider.ErrInvalidArgument
+	}
+	return sp.walkFile(fidx, sp.datastart, func(addr uint64, data []byte, meta blockmeta) bool {
+		rec := FileRecord{
+			Address:   addr,
+			Data:      data,
+			Timestamp: meta.timestamp,
+			CRC:       meta.crc,
+			OK:        !meta.torn && sp.checksumOK(addr, data, meta),
+			Cont:      meta.cont,
+		}
+		return cb(&rec)
+	})
+}
+
+//Call cb with each of the count blocks that follow one another in a file
+//from the given address, as Read would return them, stopping early if cb
+//returns false or the committed frontier of the file is reached. Rather
+//than a read per block, the file is read IterateChunkSize bytes at a time,
+//so a sequential scan takes far fewer syscalls (and locks) than calling
+//Read for each block. The data is only valid until cb returns. The first
+//block that Read would fail on stops the scan with the same error
+func (sp *FileStorageProvider) ReadRange(uuid []byte, start uint64, count int, cb func(address uint64, data []byte) bool) error {
+	if start == 0 {
+		return bprovider.ErrNoBlock
+	}
+	start = sp.forward(start)
+	fidx, off := bprovider.DecodeAddress(start)
+	if count < 0 || fidx >= sp.numfiles || off < sp.datastart || off >= atomic.LoadInt64(&sp.committed[fidx]) {
+		return bprovider.ErrInvalidArgument
+	}
+	if count == 0 {
+		return nil
+	}
+	var rerr error
+	n := 0
+	err := sp.walkFile(fidx, off, func(addr uint64, data []byte, meta blockmeta) bool {
+		began := time.Now()
+		if rerr = sp.beforeRead(uuid, addr); rerr != nil {
+			return false
+		}
+		if meta.torn {
+			rerr = bprovider.ErrIncompleteBlock
+			return false
+		}
+		if meta.cont != 0 {
+			//The rest of a spanning block is in another file
+			data, _, rerr = sp.readBlock(context.Background(), addr, make([]byte, sp.maxBlockSize()))
+			if rerr != nil {
+				return false
+			}
+		} else if !sp.checksumOK(addr, data, meta) {
+			rerr = bprovider.ErrCorrupt
+			return false
+		}
+		data, rerr = sp.postRead(data)
+		if rerr != nil {
+			return false
+		}
+		sp.io.read(len(data), began)
+		n++
+		return cb(addr, data) && n < count
+	})
+	if rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+//Decode the records of the given file from the one at off up to the
+//committed frontier, calling cb with each until it returns false. The data
+//is in a buffer that is reused once cb returns
+func (sp *FileStorageProvider) walkFile(fidx int, off int64, cb func(addr uint64, data []byte, meta blockmeta) bool) error {
+	size := sp.IterateChunkSize
+	if size <= 0 {
+		size = ITERATECHUNK
+	}
+	buf := make([]byte, size)
+	end := atomic.LoadInt64(&sp.committed[fidx])
+	//buf[p:n] is what has been read but not yet decoded, and buf[0] is at
+	//file offset base
+	base := off
+	p, n := 0, 0
+	for base+int64(p) < end {
+		data, meta, need := sp.decodeRecord(buf[p:n])
+		if need == 0 {
+			if !cb(bprovider.EncodeAddress(fidx, base+int64(p)), data, meta) {
+				return nil
+			}
+			p += int(meta.reclen)
+			continue
+		}
+		//Carry the partial record over to the start of the buffer, growing
+		//it if the record is bigger than a chunk, and read the rest
+		if need > len(buf) {
+			nbuf := make([]byte, need)
+			copy(nbuf, buf[p:n])
+			buf = nbuf
+		} else {
+			copy(buf, buf[p:n])
+		}
+		base += int64(p)
+		n -= p
+		p = 0
+		limit := len(buf)
+		if int64(limit) > end-base {
+			limit = int(end - base)
+		}
+		if limit < need {
+			//The record runs past the committed frontier
+			return bprovider.ErrCorrupt
+		}
+		sp.dbrf_mtx[fidx].RLock()
+		nread, err := sp.readAt(fidx, buf[n:limit], base+int64(n))
+		sp.dbrf_mtx[fidx].RUnlock()
+		if err != nil && err != io.EOF {
+			atomic.AddUint64(&sp.errs.read[fidx], 1)
+			return err
+		}
+		if nread < limit-n {
+			return bprovider.ErrCorrupt
+		}
+		n = limit
+	}
+	return nil
+}
+
+//Decode the record at the start of b. If b does not hold all of it, instead
+//returns how many bytes are needed to decode it (or at least its length)
+func (sp *FileStorageProvider) decodeRecord(b []byte) (data []byte, meta blockmeta, need int) {
+	plen := sp.prefixLen()
+	if len(b) < plen {
+		return nil, meta, plen
+	}
+	bsize := sp.parseLength(b)
+	hdrlen := plen
+	if bsize == SPANMARK && sp.format&FormatSpan != 0 {
+		hdrlen = SPANHEADERLEN
+		if len(b) < hdrlen {
+			return nil, meta, hdrlen
+		}
+		bsize, meta.cont = parseSpanHeader(b)
+	}
+	total := bsize + int(sp.blockOverhead()) + hdrlen - plen
+	meta.reclen = int64(total)
+	if len(b) < total {
+		return nil, meta, total
+	}
+	sp.parseTrailer(b[bsize+hdrlen:total], &meta)
+	return b[hdrlen : bsize+hdrlen], meta, 0
+}
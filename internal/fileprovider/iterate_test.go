@@ -0,0 +1,132 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestIterateFileChunked(t *testing.T) {
+	const chunk = 4096
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.IterateChunkSize = chunk
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	fidx := int(addr >> 50)
+	overhead := int(sp.blockOverhead())
+	//The first block ends 10 bytes before the end of the first chunk, so the
+	//second straddles the boundary. There is also a block bigger than a chunk
+	sizes := []int{chunk - overhead - 10, 200, 3 * chunk}
+	for i := 0; i < 300; i++ {
+		sizes = append(sizes, 50+(i*37)%500)
+	}
+	addrs := []uint64{}
+	blocks := [][]byte{}
+	for i, size := range sizes {
+		data := mkData(size, byte(i))
+		next, err := seg.Write(id, addr, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+		blocks = append(blocks, data)
+		addr = next
+	}
+	seg.Unlock()
+	if boundary := uint64(fidx)<<50 + uint64(sp.datastart) + chunk; !(addrs[1] < boundary && addrs[2] > boundary) {
+		t.Fatalf("second block does not straddle the chunk boundary")
+	}
+	i := 0
+	err := sp.IterateFile(fidx, func(rec *FileRecord) bool {
+		if i >= len(addrs) {
+			t.Fatalf("too many records")
+		}
+		if rec.Address != addrs[i] || !bytes.Equal(rec.Data, blocks[i]) || !rec.OK {
+			t.Fatalf("record %d was not decoded correctly", i)
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != len(addrs) {
+		t.Fatalf("visited %d records, expected %d", i, len(addrs))
+	}
+	//Stopping early
+	i = 0
+	sp.IterateFile(fidx, func(rec *FileRecord) bool {
+		i++
+		return i < 5
+	})
+	if i != 5 {
+		t.Fatalf("iteration did not stop when asked")
+	}
+}
+
+func TestReadRange(t *testing.T) {
+	const chunk = 300
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.IterateChunkSize = chunk
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	//Most blocks straddle a chunk boundary, and some are bigger than a chunk
+	addrs := []uint64{}
+	for i := 0; i < 100; i++ {
+		next, err := seg.Write(id, addr, mkData(20+(i*97)%700, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, addr)
+		addr = next
+	}
+	seg.Unlock()
+	buf := make([]byte, 1000)
+	i := 3
+	err := sp.ReadRange(id, addrs[3], 90, func(address uint64, data []byte) bool {
+		want, err := sp.Read(id, addrs[i], buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != addrs[i] || !bytes.Equal(data, want) {
+			t.Fatalf("block %d does not match Read", i)
+		}
+		i++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i != 93 {
+		t.Fatalf("read %d blocks, expected 90", i-3)
+	}
+	//Past the last block, the range stops at the frontier
+	n := 0
+	err = sp.ReadRange(id, addrs[95], 10, func(address uint64, data []byte) bool {
+		n++
+		return true
+	})
+	if err != nil || n != 5 {
+		t.Fatalf("read %d blocks past the frontier (%v), expected 5", n, err)
+	}
+	if err := sp.ReadRange(id, addr, 1, func(uint64, []byte) bool { return true }); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected ErrInvalidArgument for an unwritten address, got %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//The provider can't tell garbage from live data on its own, the block store
+//above it knows which blocks are no longer reachable from any version. So
+//every block written is considered live until it is released with
+//ReleaseBlocks. The index is kept in memory and only covers blocks written
+//since the provider was initialized.
+type liveindex struct {
+	mu sync.Mutex
+	//The on-disk size of each live block, by stream then address
+	streams map[[16]byte]map[uint64]int64
+	//The sum of the above, by stream
+	sizes map[[16]byte]uint64
+}
+
+func (li *liveindex) add(uuid []byte, address uint64, size int64) {
+	key := uuidkey(uuid)
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if li.streams == nil {
+		li.streams = make(map[[16]byte]map[uint64]int64)
+		li.sizes = make(map[[16]byte]uint64)
+	}
+	blocks, ok := li.streams[key]
+	if !ok {
+		blocks = make(map[uint64]int64)
+		li.streams[key] = blocks
+	}
+	blocks[address] = size
+	li.sizes[key] += uint64(size)
+}
+
+//Release the given blocks, returning how many of them were live
+func (li *liveindex) release(uuid []byte, addresses []uint64) int {
+	key := uuidkey(uuid)
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	blocks := li.streams[key]
+	n := 0
+	for _, addr := range addresses {
+		size, ok := blocks[addr]
+		if !ok {
+			continue
+		}
+		delete(blocks, addr)
+		li.sizes[key] -= uint64(size)
+		n++
+	}
+	if len(blocks) == 0 {
+		delete(li.streams, key)
+		delete(li.sizes, key)
+	}
+	return n
+}
+
+//Update the index after the given file was compacted. The blocks in the
+//remap table moved, and any others in the file are gone
+func (li *liveindex) compacted(fidx int, remap map[uint64]uint64) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	for key, blocks := range li.streams {
+		//New addresses may equal old ones, so move them all at once
+		moved := make(map[uint64]int64)
+		for addr, size := range blocks {
+			if afidx, _ := bprovider.DecodeAddress(addr); afidx != fidx {
+				continue
+			}
+			delete(blocks, addr)
+			if nw, ok := remap[addr]; ok {
+				moved[nw] = size
+			} else {
+				li.sizes[key] -= uint64(size)
+			}
+		}
+		for addr, size := range moved {
+			blocks[addr] = size
+		}
+		if len(blocks) == 0 {
+			delete(li.streams, key)
+			delete(li.sizes, key)
+		}
+	}
+}
+
+//Returns the number of live blocks of a stream
+func (li *liveindex) count(uuid []byte) int {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	return len(li.streams[uuidkey(uuid)])
+}
+
+//Mark the given blocks of a stream as garbage, so they no longer count
+//towards its live size. Returns an error if any of them was not live
+func (sp *FileStorageProvider) ReleaseBlocks(uuid []byte, addresses []uint64) bte.BTE {
+	if n := sp.live.release(uuid, addresses); n != len(addresses) {
+		return bte.Err(bte.InvalidParameter, "released blocks that were not live")
+	}
+	return nil
+}
+
+//Returns the bytes on disk taken by the live blocks of a stream, including
+//their length prefixes and trailers
+func (sp *FileStorageProvider) StreamPhysicalSize(uuid []byte) (uint64, bte.BTE) {
+	sp.live.mu.Lock()
+	defer sp.live.mu.Unlock()
+	return sp.live.sizes[uuidkey(uuid)], nil
+}
+
+//Returns the bytes on disk taken by the live blocks of all streams. The
+//difference between this and TotalDiskSize is what compaction could reclaim
+func (sp *FileStorageProvider) TotalLiveSize() (uint64, bte.BTE) {
+	sp.live.mu.Lock()
+	defer sp.live.mu.Unlock()
+	var rv uint64
+	for _, size := range sp.live.sizes {
+		rv += size
+	}
+	return rv, nil
+}
+
+//Returns the bytes of block data in the files, live or not, excluding the
+//file headers
+func (sp *FileStorageProvider) TotalDiskSize() uint64 {
+	var rv uint64
+	for i := 0; i < sp.numfiles; i++ {
+		rv += uint64(atomic.LoadInt64(&sp.committed[i]) - sp.datastart)
+	}
+	return rv
+}
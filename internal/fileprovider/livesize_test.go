@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/pborman/uuid"
+)
+
+func TestTotalLiveSize(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	ids := []uuid.UUID{uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()}
+	addrs := make(map[string][]uint64)
+	var total uint64
+	for i, id := range ids {
+		for j := 0; j < 10; j++ {
+			d := mkData(100*(i+1), byte(j))
+			addrs[id.String()] = append(addrs[id.String()], writeOne(t, sp, id, d))
+			total += uint64(len(d)) + uint64(sp.blockOverhead())
+		}
+	}
+	live, err := sp.TotalLiveSize()
+	if err != nil || live != total || sp.TotalDiskSize() != total {
+		t.Fatalf("expected live and disk size %d, got %d and %d (%v)", total, live, sp.TotalDiskSize(), err)
+	}
+	//Trim half of the second stream
+	trimmed := addrs[ids[1].String()][:5]
+	if err := sp.ReleaseBlocks(ids[1], trimmed); err != nil {
+		t.Fatal(err)
+	}
+	garbage := 5 * (200 + uint64(sp.blockOverhead()))
+	live, _ = sp.TotalLiveSize()
+	if live != total-garbage {
+		t.Fatalf("expected live size %d after trim, got %d", total-garbage, live)
+	}
+	if sp.TotalDiskSize() != total {
+		t.Fatalf("expected disk size to still include garbage")
+	}
+	if ps, _ := sp.StreamPhysicalSize(ids[1]); ps != 5*(200+uint64(sp.blockOverhead())) {
+		t.Fatalf("unexpected physical size %d of trimmed stream", ps)
+	}
+	if err := sp.ReleaseBlocks(ids[1], trimmed); err == nil {
+		t.Fatalf("expected releasing garbage to fail")
+	}
+}
+
+func TestStreamBlockLimit(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.MaxStreamBlocks = 3
+	})
+	defer os.RemoveAll(cfg.dir)
+	isDepleted := func(err error) bool {
+		be, ok := err.(bte.BTE)
+		return ok && be.Code() == bte.ResourceDepleted
+	}
+	id := uuid.NewRandom()
+	if err := sp.CreateStream(id, "quota", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatalf("write %d within the limit failed: %v", i, err)
+		}
+	}
+	if _, err := seg.Write(id, addr, mkData(100, 3)); !isDepleted(err) {
+		t.Fatalf("expected ResourceDepleted over the limit, got %v", err)
+	}
+	//Released blocks no longer count
+	if err := sp.ReleaseBlocks(id, addrs[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.Write(id, addr, mkData(100, 4)); err != nil {
+		t.Fatalf("expected write after release to succeed: %v", err)
+	}
+	seg.Unlock()
+
+	//A stream can have its own limit, or none at all
+	id2 := uuid.NewRandom()
+	if err := sp.CreateStream(id2, "quota", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.SetStreamBlockLimit(id2, 1); err != nil {
+		t.Fatal(err)
+	}
+	id3 := uuid.NewRandom()
+	if err := sp.CreateStream(id3, "quota", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.SetStreamBlockLimit(id3, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.SetStreamBlockLimit(uuid.NewRandom(), 1); err == nil || err.Code() != bte.NoSuchStream {
+		t.Fatalf("expected NoSuchStream, got %v", err)
+	}
+	seg = sp.LockSegment(id2)
+	addr, err := seg.Write(id2, seg.BaseAddress(), mkData(100, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.Write(id2, addr, mkData(100, 1)); !isDepleted(err) {
+		t.Fatalf("expected override of 1 to be enforced, got %v", err)
+	}
+	seg.Unlock()
+	seg = sp.LockSegment(id3)
+	addr = seg.BaseAddress()
+	for i := 0; i < 5; i++ {
+		addr, err = seg.Write(id3, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatalf("expected unlimited stream to accept write %d: %v", i, err)
+		}
+	}
+	seg.Unlock()
+
+	//Overrides survive a restart
+	sp2 := &FileStorageProvider{MaxStreamBlocks: 3}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	for _, c := range []struct {
+		id    []byte
+		limit int64
+	}{{id, 3}, {id2, 1}, {id3, 0}} {
+		if got, err := sp2.streamBlockLimit(c.id); err != nil || got != c.limit {
+			t.Fatalf("expected limit %d after restart, got %d (%v)", c.limit, got, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync"
+	"time"
+)
+
+//How long LockSegment waited for files, overall and per stream. If Blocked
+//is a large fraction of Locks, the file pool (or FilesPerStream) is too small
+type LockStats struct {
+	Locks     uint64
+	Blocked   uint64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+	Streams   map[[16]byte]StreamLockStats
+	//The highest mean wait of any stream over the mean wait of all locks.
+	//Near one if streams wait alike, higher if some wait disproportionately
+	Unfairness float64
+}
+
+type StreamLockStats struct {
+	Locks     uint64
+	Blocked   uint64
+	TotalWait time.Duration
+}
+
+type lockcounters struct {
+	mu      sync.Mutex
+	all     StreamLockStats
+	maxwait time.Duration
+	streams map[[16]byte]*StreamLockStats
+}
+
+func (lc *lockcounters) observe(uuid []byte, blocked bool, wait time.Duration) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.streams == nil {
+		lc.streams = make(map[[16]byte]*StreamLockStats)
+	}
+	k := uuidkey(uuid)
+	s, ok := lc.streams[k]
+	if !ok {
+		s = &StreamLockStats{}
+		lc.streams[k] = s
+	}
+	for _, c := range []*StreamLockStats{&lc.all, s} {
+		c.Locks++
+		c.TotalWait += wait
+		if blocked {
+			c.Blocked++
+		}
+	}
+	if wait > lc.maxwait {
+		lc.maxwait = wait
+	}
+}
+
+//Returns a snapshot of how long LockSegment has waited
+func (sp *FileStorageProvider) LockStats() LockStats {
+	lc := &sp.lockstats
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	rv := LockStats{
+		Locks:     lc.all.Locks,
+		Blocked:   lc.all.Blocked,
+		TotalWait: lc.all.TotalWait,
+		MaxWait:   lc.maxwait,
+		Streams:   make(map[[16]byte]StreamLockStats, len(lc.streams)),
+	}
+	for k, s := range lc.streams {
+		rv.Streams[k] = *s
+	}
+	if lc.all.TotalWait > 0 {
+		mean := float64(lc.all.TotalWait) / float64(lc.all.Locks)
+		for _, s := range lc.streams {
+			if f := float64(s.TotalWait) / float64(s.Locks) / mean; f > rv.Unfairness {
+				rv.Unfairness = f
+			}
+		}
+	}
+	return rv
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestLockContentionStats(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	holder, waiter := uuid.NewRandom(), uuid.NewRandom()
+	//Take every file, so the next locks have to wait
+	held := []bprovider.Segment{}
+	for i := 0; i < NUMFILES; i++ {
+		held = append(held, sp.LockSegment(holder))
+	}
+	//These may briefly wait for the allocator to offer the next file, but no
+	//longer than that
+	before := sp.LockStats()
+	if before.Locks != NUMFILES || before.MaxWait > 50*time.Millisecond {
+		t.Fatalf("expected %d locks with little waiting, got %d (max wait %v)", NUMFILES, before.Locks, before.MaxWait)
+	}
+	const waiters = 3
+	var wg sync.WaitGroup
+	for i := 0; i < waiters; i++ {
+		wg.Add(1)
+		go func() {
+			sp.LockSegment(waiter).Unlock()
+			wg.Done()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, seg := range held {
+		seg.Unlock()
+	}
+	wg.Wait()
+	st := sp.LockStats()
+	if st.Locks != NUMFILES+waiters || st.Blocked != before.Blocked+waiters {
+		t.Fatalf("expected %d more blocked locks, got %d", waiters, st.Blocked-before.Blocked)
+	}
+	if st.MaxWait < 50*time.Millisecond {
+		t.Fatalf("expected a max wait of at least 50ms, got %v", st.MaxWait)
+	}
+	ws := st.Streams[uuidkey(waiter)]
+	if ws.Locks != waiters || ws.Blocked != waiters || ws.TotalWait < waiters*50*time.Millisecond {
+		t.Fatalf("unexpected stats for the waiting stream: %+v", ws)
+	}
+	//The waiting stream's mean wait is far above the overall mean
+	if st.Unfairness < 10 {
+		t.Fatalf("expected the waiting stream to show as treated unfairly, got %v", st.Unfairness)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/op/go-logging"
+)
+
+//Receives the events of a provider. Each event is a fixed message followed
+//by alternating keys and values, such as "file", 3, "err", err. Set the
+//Logger field before Initialize to route them elsewhere than go-logging.
+//
+//Conditions the provider can't go on from (a corrupt log, a file it can't
+//open) are reported with Error and then panic, as they always have
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+//Writes events to a go-logging logger as the message followed by key=value
+//pairs
+type goLogger struct {
+	l *logging.Logger
+}
+
+func (g goLogger) Debug(msg string, keyvals ...interface{}) {
+	g.l.Debug(formatKV(msg, keyvals))
+}
+
+func (g goLogger) Info(msg string, keyvals ...interface{}) {
+	g.l.Info(formatKV(msg, keyvals))
+}
+
+func (g goLogger) Warn(msg string, keyvals ...interface{}) {
+	g.l.Warning(formatKV(msg, keyvals))
+}
+
+func (g goLogger) Error(msg string, keyvals ...interface{}) {
+	g.l.Error(formatKV(msg, keyvals))
+}
+
+func formatKV(msg string, keyvals []interface{}) string {
+	var b bytes.Buffer
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 < len(keyvals) {
+			fmt.Fprintf(&b, " %v=%v", keyvals[i], keyvals[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", keyvals[i])
+		}
+	}
+	return b.String()
+}
+
+func (sp *FileStorageProvider) logger() Logger {
+	if sp.Logger != nil {
+		return sp.Logger
+	}
+	return goLogger{log}
+}
+
+//Report a condition the provider can't go on from and panic. Without a
+//Logger this is go-logging's Panic, as before
+func (sp *FileStorageProvider) fatal(msg string, keyvals ...interface{}) {
+	if sp.Logger == nil {
+		log.Panic(formatKV(msg, keyvals))
+	}
+	sp.Logger.Error(msg, keyvals...)
+	panic(formatKV(msg, keyvals))
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+type logEvent struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+//A Logger that keeps every event
+type capturingLogger struct {
+	mu     sync.Mutex
+	events []logEvent
+}
+
+func (l *capturingLogger) log(level, msg string, keyvals []interface{}) {
+	l.mu.Lock()
+	l.events = append(l.events, logEvent{level, msg, keyvals})
+	l.mu.Unlock()
+}
+
+func (l *capturingLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *capturingLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *capturingLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *capturingLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+//Returns the first event with the given message
+func (l *capturingLogger) find(msg string) (logEvent, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ev := range l.events {
+		if ev.msg == msg {
+			return ev, true
+		}
+	}
+	return logEvent{}, false
+}
+
+func TestLogger(t *testing.T) {
+	var fail int32
+	lg := &capturingLogger{}
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.Logger = lg
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &failingSegfile{f, &fail}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	atomic.StoreInt32(&fail, 1)
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Unlock(); err != syscall.EIO {
+		t.Fatalf("expected Unlock to return EIO, got %v", err)
+	}
+	ev, ok := lg.find("Writing file failed, failing the segment")
+	if !ok {
+		t.Fatalf("expected an event for the failed write, got %v", lg.events)
+	}
+	if ev.level != "error" {
+		t.Fatalf("expected the failed write at error level, got %s", ev.level)
+	}
+	want := []interface{}{"file", seg.fidx, "err", syscall.EIO}
+	if !reflect.DeepEqual(ev.keyvals, want) {
+		t.Fatalf("expected keyvals %v, got %v", want, ev.keyvals)
+	}
+	//A fatal condition is reported before the panic
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("expected fatal to panic")
+			}
+		}()
+		sp.fatal("Problem with blockstore DB", "err", syscall.EIO)
+	}()
+	if ev, ok := lg.find("Problem with blockstore DB"); !ok || ev.level != "error" {
+		t.Fatalf("expected the fatal condition to be logged as an error")
+	}
+}
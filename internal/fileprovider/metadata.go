@@ -0,0 +1,714 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//All stream metadata lives in an append-only log that is replayed into memory
+//at startup. Each record is a 4 byte little endian length followed by the
+//JSON encoded metarecord
+const METADATA_FILE = "metadata.log"
+
+//The largest metadata record that is written, or read back. A longer length
+//prefix can only be corrupt
+const MAXMETARECORD = 16 * 1024 * 1024
+
+const (
+	mrCreateStream = iota + 1
+	mrSetAnnotation
+	mrSetVersion
+	mrSetCollectionDefaults
+	mrSetBlockLimit
+)
+
+type metarecord struct {
+	Kind       int
+	UUID       []byte
+	Collection string            `json:",omitempty"`
+	Tags       map[string]string `json:",omitempty"`
+	Annotation []byte            `json:",omitempty"`
+	AVer       uint64            `json:",omitempty"`
+	Version    uint64            `json:",omitempty"`
+	BlockLimit int64             `json:",omitempty"`
+}
+
+type streammeta struct {
+	uuid       []byte
+	collection string
+	tags       map[string]string
+	annotation []byte
+	aver       uint64
+	//The metadata log offset of every retained annotation version, only
+	//populated if KeepAnnotationHistory is set
+	history map[uint64]int64
+	//Overrides MaxStreamBlocks if nonzero, see SetStreamBlockLimit
+	blocklimit int64
+}
+
+func uuidkey(uuid []byte) [16]byte {
+	var rv [16]byte
+	copy(rv[:], uuid)
+	return rv
+}
+
+func metadataPath(dbpath string) string {
+	return fmt.Sprintf("%s/%s", dbpath, METADATA_FILE)
+}
+
+//Open the metadata log and replay it. Databases created before the log
+//existed get an empty one
+func (sp *FileStorageProvider) openMetadata(dbpath string) {
+	f, err := os.OpenFile(metadataPath(dbpath), sp.openFlags(), sp.fileMode)
+	if err != nil {
+		sp.fatal("Problem with metadata log", "err", err)
+	}
+	sp.metaf = f
+	sp.metaw = f
+	if sp.wrapMetafile != nil {
+		sp.metaw = sp.wrapMetafile(f)
+	}
+	sp.meta = make(map[[16]byte]*streammeta)
+	sp.collidx = make(map[string]map[[16]byte]*streammeta)
+	sp.tagidx = make(map[string]map[string]map[[16]byte]*streammeta)
+	sp.versions = make(map[[16]byte]uint64)
+	sp.colldefaults = make(map[string]map[string]string)
+	if sp.MetadataOnDisk {
+		sp.metaidx = openMetaIndex(dbpath, sp.logger())
+		sp.metaend = sp.metaidx.watermark()
+		if sp.metaidx.coll != nil {
+			if err := json.Unmarshal(sp.metaidx.coll.ext, &sp.colldefaults); err != nil {
+				sp.fatal("Problem with metadata index", "err", err)
+			}
+		}
+	}
+	for {
+		rec, next, err := sp.readMetaRecord(sp.metaend)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			//A torn record at the end of the log is the result of a crash
+			//during an append, it was never acknowledged
+			sp.logger().Warn("Ignoring the end of the metadata log", "offset", sp.metaend, "err", err)
+			break
+		}
+		sp.applyMetaRecord(rec, sp.metaend)
+		sp.metaend = next
+		sp.maybeRebuildMetaIndex()
+	}
+}
+
+//Returns the stream, or nil if it does not exist. Must be called with metamu
+//held
+func (sp *FileStorageProvider) peekStream(key [16]byte) (*streammeta, error) {
+	if sm, ok := sp.meta[key]; ok || sp.metaidx == nil {
+		return sm, nil
+	}
+	ds, err := sp.metaidx.lookup(key)
+	if err != nil || ds == nil || !ds.Exists {
+		return nil, err
+	}
+	return ds.streammeta(append([]byte(nil), key[:]...)), nil
+}
+
+//Like peekStream, but the stream is brought into memory so that it can be
+//changed. Must be called with metamu held for writing
+func (sp *FileStorageProvider) loadStream(key [16]byte) (*streammeta, error) {
+	if sm, ok := sp.meta[key]; ok || sp.metaidx == nil {
+		return sm, nil
+	}
+	sm, err := sp.peekStream(key)
+	if sm != nil {
+		sp.meta[key] = sm
+		sp.indexStream(sm)
+	}
+	return sm, err
+}
+
+//Returns the version of the stream, or 0. Must be called with metamu held
+func (sp *FileStorageProvider) peekVersion(key [16]byte) (uint64, error) {
+	if v, ok := sp.versions[key]; ok || sp.metaidx == nil {
+		return v, nil
+	}
+	ds, err := sp.metaidx.lookup(key)
+	if err != nil || ds == nil {
+		return 0, err
+	}
+	return ds.Version, nil
+}
+
+//Read the record at the given offset, returning it and the offset of the
+//following record
+func (sp *FileStorageProvider) readMetaRecord(off int64) (*metarecord, int64, error) {
+	lenarr := make([]byte, 4)
+	n, err := sp.metaf.ReadAt(lenarr, off)
+	if n == 0 && err == io.EOF {
+		return nil, off, io.EOF
+	}
+	if n != 4 {
+		return nil, off, fmt.Errorf("short record header")
+	}
+	rlen := int(lenarr[0]) + (int(lenarr[1]) << 8) + (int(lenarr[2]) << 16) + (int(lenarr[3]) << 24)
+	//Check the length before allocating for it. A record that is too big, or
+	//that runs past the end of the log, is torn like a short one
+	if rlen < 0 || rlen > MAXMETARECORD {
+		return nil, off, fmt.Errorf("record length %d is too large", uint32(rlen))
+	}
+	fi, err := sp.metaf.Stat()
+	if err != nil {
+		return nil, off, err
+	}
+	if off+4+int64(rlen) > fi.Size() {
+		return nil, off, fmt.Errorf("short record body")
+	}
+	body := make([]byte, rlen)
+	n, err = sp.metaf.ReadAt(body, off+4)
+	if n != rlen {
+		return nil, off, fmt.Errorf("short record body")
+	}
+	rec := &metarecord{}
+	err = json.Unmarshal(body, rec)
+	if err != nil {
+		return nil, off, err
+	}
+	return rec, off + 4 + int64(rlen), nil
+}
+
+//Append a record to the metadata log. Must be called with metamu held. The
+//record is durable when this returns. Returns the offset of the record
+func (sp *FileStorageProvider) appendMetaRecord(rec *metarecord) (int64, bte.BTE) {
+	return sp.appendMetaRecords([]*metarecord{rec}, true)
+}
+
+//Append several records to the metadata log with a single write, followed by
+//a sync if sync is set. Must be called with metamu held. Returns the offset of
+//the first record
+func (sp *FileStorageProvider) appendMetaRecords(recs []*metarecord, sync bool) (int64, bte.BTE) {
+	buf := []byte{}
+	for _, rec := range recs {
+		body, err := json.Marshal(rec)
+		if err != nil {
+			return 0, bte.ErrW(bte.InvariantFailure, "could not encode metadata record", err)
+		}
+		if len(body) > MAXMETARECORD {
+			return 0, bte.Err(bte.InvalidParameter, "metadata record too big")
+		}
+		buf = append(buf, byte(len(body)), byte(len(body)>>8), byte(len(body)>>16), byte(len(body)>>24))
+		buf = append(buf, body...)
+	}
+	off := sp.metaend
+	//Rewriting the same bytes at the same offset is harmless, so a failed
+	//append can simply be tried again
+	err, attempts := retryTransient(sp.MetadataRetries, sp.MetadataRetryBackoff, func() error {
+		_, err := sp.metaw.WriteAt(buf, off)
+		if err == nil && sync {
+			err = sp.metaw.Sync()
+		}
+		return err
+	})
+	if err != nil {
+		return 0, bte.ErrW(bte.GenericError, fmt.Sprintf("could not append to metadata log after %d attempts", attempts), err)
+	}
+	atomic.AddUint64(&sp.metawrites, 1)
+	if sync {
+		atomic.AddUint64(&sp.metasyncs, 1)
+		//Anything written before is durable now too
+		sp.vunsynced = 0
+	}
+	sp.metaend += int64(len(buf))
+	return off, nil
+}
+
+//Apply a record to the in-memory state. Must be called with metamu held
+func (sp *FileStorageProvider) applyMetaRecord(rec *metarecord, off int64) {
+	key := uuidkey(rec.UUID)
+	switch rec.Kind {
+	case mrCreateStream:
+		sm := &streammeta{
+			uuid:       rec.UUID,
+			collection: rec.Collection,
+			tags:       rec.Tags,
+			annotation: rec.Annotation,
+			aver:       rec.AVer,
+		}
+		if sm.tags == nil {
+			sm.tags = make(map[string]string)
+		}
+		if sp.KeepAnnotationHistory {
+			sm.history = map[uint64]int64{rec.AVer: off}
+		}
+		sp.meta[key] = sm
+		sp.indexStream(sm)
+	case mrSetAnnotation:
+		sm, err := sp.loadStream(key)
+		if err != nil {
+			sp.fatal("Could not read stream metadata", "err", err)
+		}
+		if sm == nil {
+			sp.logger().Warn("Metadata log sets annotation on unknown stream", "uuid", fmt.Sprintf("%x", rec.UUID))
+			return
+		}
+		sm.annotation = rec.Annotation
+		sm.aver = rec.AVer
+		if sp.KeepAnnotationHistory {
+			//Streams loaded from the metadata index, or written without
+			//history, may not have one yet
+			if sm.history == nil {
+				sm.history = make(map[uint64]int64)
+			}
+			sm.history[rec.AVer] = off
+		}
+	case mrSetBlockLimit:
+		sm, err := sp.loadStream(key)
+		if err != nil {
+			sp.fatal("Could not read stream metadata", "err", err)
+		}
+		if sm == nil {
+			sp.logger().Warn("Metadata log sets block limit on unknown stream", "uuid", fmt.Sprintf("%x", rec.UUID))
+			return
+		}
+		sm.blocklimit = rec.BlockLimit
+	case mrSetVersion:
+		sp.versions[key] = rec.Version
+	case mrSetCollectionDefaults:
+		if len(rec.Tags) == 0 {
+			delete(sp.colldefaults, rec.Collection)
+		} else {
+			sp.colldefaults[rec.Collection] = rec.Tags
+		}
+	default:
+		sp.fatal("Unknown metadata record kind", "kind", rec.Kind)
+	}
+}
+
+func tagkey(k, v string) string {
+	return k + "\x00" + v
+}
+
+//Add a stream to the collection and tag indexes. Must be called with metamu
+//held
+func (sp *FileStorageProvider) indexStream(sm *streammeta) {
+	key := uuidkey(sm.uuid)
+	coll, ok := sp.collidx[sm.collection]
+	if !ok {
+		coll = make(map[[16]byte]*streammeta)
+		sp.collidx[sm.collection] = coll
+		sp.tagidx[sm.collection] = make(map[string]map[[16]byte]*streammeta)
+	}
+	coll[key] = sm
+	tags := sp.tagidx[sm.collection]
+	for k, v := range sm.tags {
+		tk := tagkey(k, v)
+		if tags[tk] == nil {
+			tags[tk] = make(map[[16]byte]*streammeta)
+		}
+		tags[tk][key] = sm
+	}
+}
+
+//Call fn for every stream in the collection that has all of the given tags.
+//If exact is true the stream must also have no other tags. Must be called
+//with metamu held
+func (sp *FileStorageProvider) matchStreams(collection string, tags map[string]string, exact bool, fn func(sm *streammeta)) error {
+	matches := func(sm *streammeta) bool {
+		if exact && len(sm.tags) != len(tags) {
+			return false
+		}
+		for k, v := range tags {
+			if sv, ok := sm.tags[k]; !ok || sv != v {
+				return false
+			}
+		}
+		return true
+	}
+	candidates := sp.collidx[collection]
+	//Walk the smallest posting list of the requested tags
+	for k, v := range tags {
+		posting := sp.tagidx[collection][tagkey(k, v)]
+		if len(posting) < len(candidates) {
+			candidates = posting
+		}
+	}
+	for _, sm := range candidates {
+		if matches(sm) {
+			fn(sm)
+		}
+	}
+	if sp.metaidx == nil {
+		return nil
+	}
+	//There is no tag index on disk, so the whole collection is scanned
+	var lerr error
+	err := sp.metaidx.scanCollection(collection, func(uuid []byte) bool {
+		key := uuidkey(uuid)
+		if _, ok := sp.meta[key]; ok {
+			//Already seen in memory
+			return true
+		}
+		var ds *diskstream
+		ds, lerr = sp.metaidx.lookup(key)
+		if lerr != nil {
+			return false
+		}
+		if ds != nil && ds.Exists {
+			if sm := ds.streammeta(append([]byte(nil), uuid...)); matches(sm) {
+				fn(sm)
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = lerr
+	}
+	return err
+}
+
+//Append a record and apply it. Must be called with metamu held
+func (sp *FileStorageProvider) commitMetaRecord(rec *metarecord) bte.BTE {
+	off, err := sp.appendMetaRecord(rec)
+	if err != nil {
+		return err
+	}
+	sp.applyMetaRecord(rec, off)
+	sp.maybeRebuildMetaIndex()
+	return nil
+}
+
+//Returns an error if the annotation is larger than MaxAnnotationSize allows
+func (sp *FileStorageProvider) checkAnnotationSize(annotation []byte) bte.BTE {
+	limit := bprovider.MaxAnnotationSize
+	if sp.MaxAnnotationSize > 0 && sp.MaxAnnotationSize < limit {
+		limit = sp.MaxAnnotationSize
+	}
+	if len(annotation) > limit {
+		return bte.Err(bte.AnnotationTooBig, "annotation too big")
+	}
+	return nil
+}
+
+//Returns an error if the tags are larger than MaxTagsSize allows. The size of
+//a set of tags is the total length of the keys and values
+func (sp *FileStorageProvider) checkTagsSize(tags map[string]string) bte.BTE {
+	if sp.MaxTagsSize <= 0 {
+		return nil
+	}
+	size := 0
+	for k, v := range tags {
+		size += len(k) + len(v)
+	}
+	if size > sp.MaxTagsSize {
+		return bte.Err(bte.InvalidParameter, "tags too big")
+	}
+	return nil
+}
+
+// CreateStream makes a stream with the given uuid, collection and tags. Returns
+// a StreamExists error if the uuid already exists. The check and the insert
+// happen under one lock, so of several concurrent creates of the same uuid
+// exactly one succeeds (whichever takes the lock first) and the rest get
+// StreamExists. The default tags of the collection are merged in, with the
+// given tags taking precedence
+func (sp *FileStorageProvider) CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE {
+	if err := sp.checkAnnotationSize(annotation); err != nil {
+		return err
+	}
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	if sm, err := sp.peekStream(uuidkey(uuid)); err != nil {
+		return bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	} else if sm != nil {
+		return bte.Err(bte.StreamExists, "stream already exists")
+	}
+	//The merged tags are what is logged, so later changes to the defaults
+	//do not affect existing streams
+	if defaults := sp.colldefaults[collection]; len(defaults) > 0 {
+		merged := make(map[string]string, len(defaults)+len(tags))
+		for k, v := range defaults {
+			merged[k] = v
+		}
+		for k, v := range tags {
+			merged[k] = v
+		}
+		tags = merged
+	}
+	if err := sp.checkTagsSize(tags); err != nil {
+		return err
+	}
+	return sp.commitMetaRecord(&metarecord{
+		Kind:       mrCreateStream,
+		UUID:       uuid,
+		Collection: collection,
+		Tags:       tags,
+		Annotation: annotation,
+		AVer:       1,
+	})
+}
+
+// Sets the tags merged into streams subsequently created in the collection.
+// Existing streams are not changed. Pass no tags to remove the defaults
+func (sp *FileStorageProvider) SetCollectionDefaultTags(collection string, tags map[string]string) bte.BTE {
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	if err := sp.checkTagsSize(tags); err != nil {
+		return err
+	}
+	cp := make(map[string]string, len(tags))
+	for k, v := range tags {
+		cp[k] = v
+	}
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	return sp.commitMetaRecord(&metarecord{
+		Kind:       mrSetCollectionDefaults,
+		Collection: collection,
+		Tags:       cp,
+	})
+}
+
+// Sets the stream annotation. The given aver must match the current annotation
+// version, which is then incremented
+func (sp *FileStorageProvider) SetStreamAnnotation(uuid []byte, aver uint64, content []byte) bte.BTE {
+	if err := sp.checkAnnotationSize(content); err != nil {
+		return err
+	}
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	sm, err := sp.loadStream(uuidkey(uuid))
+	if err != nil {
+		return bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	}
+	if sm == nil {
+		return bte.Err(bte.NoSuchStream, "stream does not exist")
+	}
+	if sm.aver != aver {
+		return bte.Err(bte.AnnotationVersionMismatch, "stream annotation version does not match")
+	}
+	return sp.commitMetaRecord(&metarecord{
+		Kind:       mrSetAnnotation,
+		UUID:       uuid,
+		Annotation: content,
+		AVer:       aver + 1,
+	})
+}
+
+// Sets how many blocks the stream may have, overriding MaxStreamBlocks. Zero
+// reverts to MaxStreamBlocks, and a negative limit means there is none
+func (sp *FileStorageProvider) SetStreamBlockLimit(uuid []byte, limit int64) bte.BTE {
+	if err := sp.checkWritable(); err != nil {
+		return err
+	}
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	sm, err := sp.peekStream(uuidkey(uuid))
+	if err != nil {
+		return bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	}
+	if sm == nil {
+		return bte.Err(bte.NoSuchStream, "stream does not exist")
+	}
+	return sp.commitMetaRecord(&metarecord{
+		Kind:       mrSetBlockLimit,
+		UUID:       uuid,
+		BlockLimit: limit,
+	})
+}
+
+//Returns how many blocks the stream may have, or zero for no limit
+func (sp *FileStorageProvider) streamBlockLimit(uuid []byte) (int64, error) {
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	sm, err := sp.peekStream(uuidkey(uuid))
+	if err != nil {
+		return 0, err
+	}
+	limit := sp.MaxStreamBlocks
+	if sm != nil && sm.blocklimit != 0 {
+		limit = sm.blocklimit
+	}
+	if limit < 0 {
+		return 0, nil
+	}
+	return limit, nil
+}
+
+// Gets the stream annotation
+func (sp *FileStorageProvider) GetStreamAnnotation(uuid []byte) ([]byte, uint64, bte.BTE) {
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	sm, err := sp.peekStream(uuidkey(uuid))
+	if err != nil {
+		return nil, 0, bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	}
+	if sm == nil {
+		return nil, 0, bte.Err(bte.NoSuchStream, "stream does not exist")
+	}
+	return sm.annotation, sm.aver, nil
+}
+
+// Gets a historical version of the stream annotation. Versions other than the
+// current one are only available if KeepAnnotationHistory was set when they
+// were written (and when the provider was initialized)
+func (sp *FileStorageProvider) GetStreamAnnotationVersion(uuid []byte, aver uint64) ([]byte, bte.BTE) {
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	sm, err := sp.peekStream(uuidkey(uuid))
+	if err != nil {
+		return nil, bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	}
+	if sm == nil {
+		return nil, bte.Err(bte.NoSuchStream, "stream does not exist")
+	}
+	if aver == sm.aver {
+		return sm.annotation, nil
+	}
+	off, ok := sm.history[aver]
+	if !ok {
+		return nil, bte.Err(bte.AnnotationVersionMismatch, "annotation version not retained")
+	}
+	rec, _, err := sp.readMetaRecord(off)
+	if err != nil {
+		return nil, bte.ErrW(bte.GenericError, "could not read metadata log", err)
+	}
+	return rec.Annotation, nil
+}
+
+// ListStreams lists all the streams within a collection. If tags are specified
+// then streams are only returned if they have that tag, and the value equals
+// the value passed. If partial is false, zero or one streams will be returned.
+func (sp *FileStorageProvider) ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	rv := []bprovider.Stream{}
+	err := sp.matchStreams(collection, tags, !partial, func(sm *streammeta) {
+		rv = append(rv, bprovider.Stream{
+			UUID:       sm.uuid,
+			Collection: sm.collection,
+			Tags:       sm.tags,
+			Annotation: sm.annotation,
+		})
+	})
+	if err != nil {
+		return nil, bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	}
+	if !partial && len(rv) > 1 {
+		return nil, bte.Err(bte.AmbiguousTags, "tags do not identify a single stream")
+	}
+	return rv, nil
+}
+
+// CountStreams returns the number of streams ListStreams would return with
+// partial set, without building them
+func (sp *FileStorageProvider) CountStreams(collection string, tags map[string]string) (int64, bte.BTE) {
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	if len(tags) == 0 && sp.metaidx == nil {
+		return int64(len(sp.collidx[collection])), nil
+	}
+	var rv int64
+	err := sp.matchStreams(collection, tags, false, func(sm *streammeta) {
+		rv++
+	})
+	if err != nil {
+		return 0, bte.ErrW(bte.GenericError, "could not read stream metadata", err)
+	}
+	return rv, nil
+}
+
+// Sets the version of a stream. If it is in the past, it is essentially a rollback,
+// and although no space is freed (until Compact), the consecutive version numbers can be reused
+// note to self: you must make sure not to call ReadSuperBlock on versions higher
+// than you get from GetStreamVersion because they might succeed (unless
+// StrictVersionReads is set, in which case they fail with ErrVersionRolledBack)
+//
+// If version batching is enabled, the change is written to the metadata log
+// immediately but only synced with the next batch, so it survives the process
+// crashing but not the machine
+func (sp *FileStorageProvider) SetStreamVersion(uuid []byte, version uint64) {
+	if err := sp.checkWritable(); err != nil {
+		sp.fatal("Could not set stream version", "err", err)
+	}
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	rec := &metarecord{Kind: mrSetVersion, UUID: uuid, Version: version}
+	if sp.VersionFlushBatch <= 0 && sp.VersionFlushInterval <= 0 {
+		if err := sp.commitMetaRecord(rec); err != nil {
+			sp.fatal("Could not set stream version", "err", err)
+		}
+		return
+	}
+	off, err := sp.appendMetaRecords([]*metarecord{rec}, false)
+	if err != nil {
+		sp.fatal("Could not set stream version", "err", err)
+	}
+	sp.applyMetaRecord(rec, off)
+	sp.maybeRebuildMetaIndex()
+	sp.vunsynced++
+	if sp.VersionFlushBatch > 0 && sp.vunsynced >= sp.VersionFlushBatch {
+		sp.flushVersions()
+	}
+}
+
+// Gets the version of a stream. Returns 0 if none exists.
+func (sp *FileStorageProvider) GetStreamVersion(uuid []byte) uint64 {
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	v, err := sp.peekVersion(uuidkey(uuid))
+	if err != nil {
+		sp.fatal("Could not read stream version", "err", err)
+	}
+	return v
+}
+
+//Sync batched version changes to the metadata log. Must be called with
+//metamu held
+func (sp *FileStorageProvider) flushVersions() {
+	if sp.vunsynced == 0 {
+		return
+	}
+	err, attempts := retryTransient(sp.MetadataRetries, sp.MetadataRetryBackoff, sp.metaw.Sync)
+	if err != nil {
+		sp.fatal("Could not flush stream versions", "attempts", attempts, "err", err)
+	}
+	atomic.AddUint64(&sp.metasyncs, 1)
+	sp.vunsynced = 0
+}
+
+//Sync batched version changes every VersionFlushInterval, until the
+//provider is closed
+func (sp *FileStorageProvider) versionFlusher() {
+	defer sp.bgwg.Done()
+	for {
+		atomic.StoreInt32(&sp.bgstate[bgVersionFlusher], gsSleeping)
+		if !sp.sleep(sp.VersionFlushInterval) {
+			atomic.StoreInt32(&sp.bgstate[bgVersionFlusher], gsNotRunning)
+			return
+		}
+		sp.bgpause.wait()
+		atomic.StoreInt32(&sp.bgstate[bgVersionFlusher], gsRunning)
+		sp.metamu.Lock()
+		sp.flushVersions()
+		sp.metamu.Unlock()
+	}
+}
@@ -0,0 +1,481 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/pborman/uuid"
+)
+
+func TestAnnotationHistory(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.KeepAnnotationHistory = true
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	if err := sp.CreateStream(id, "test/coll", map[string]string{"name": "a"}, []byte("v1")); err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	for aver := uint64(1); aver < 5; aver++ {
+		content := []byte(fmt.Sprintf("v%d", aver+1))
+		if err := sp.SetStreamAnnotation(id, aver, content); err != nil {
+			t.Fatalf("unexpected annotation error: %v", err)
+		}
+	}
+	ann, aver, err := sp.GetStreamAnnotation(id)
+	if err != nil || aver != 5 || string(ann) != "v5" {
+		t.Fatalf("unexpected current annotation %q@%d (%v)", ann, aver, err)
+	}
+	check := func(sp *FileStorageProvider) {
+		for aver := uint64(1); aver <= 5; aver++ {
+			ann, err := sp.GetStreamAnnotationVersion(id, aver)
+			if err != nil {
+				t.Fatalf("unexpected error reading annotation version %d: %v", aver, err)
+			}
+			if string(ann) != fmt.Sprintf("v%d", aver) {
+				t.Fatalf("annotation version %d was %q", aver, ann)
+			}
+		}
+	}
+	check(sp)
+	//The history must survive a replay of the metadata log
+	sp2 := &FileStorageProvider{KeepAnnotationHistory: true}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+}
+
+//Streams evicted to the metadata index before history was turned on come
+//back without one, and must still take new annotations
+func TestAnnotationHistoryOnDisk(t *testing.T) {
+	setup := func(sp *FileStorageProvider) {
+		sp.MetadataOnDisk = true
+		sp.MetadataMemtableSize = 10
+	}
+	sp, cfg := mkProvider(t, setup)
+	defer os.RemoveAll(cfg.dir)
+	ids := make([]uuid.UUID, 30)
+	for i := range ids {
+		ids[i] = uuid.NewRandom()
+		if err := sp.CreateStream(ids[i], "test/coll", nil, []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sp.Close()
+	sp2 := &FileStorageProvider{KeepAnnotationHistory: true}
+	setup(sp2)
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	for _, id := range ids {
+		if err := sp2.SetStreamAnnotation(id, 1, []byte("v2")); err != nil {
+			t.Fatalf("unexpected annotation error: %v", err)
+		}
+		if err := sp2.SetStreamAnnotation(id, 2, []byte("v3")); err != nil {
+			t.Fatalf("unexpected annotation error: %v", err)
+		}
+		ann, err := sp2.GetStreamAnnotationVersion(id, 2)
+		if err != nil || string(ann) != "v2" {
+			t.Fatalf("annotation version 2 was %q (%v)", ann, err)
+		}
+	}
+}
+
+func TestAnnotationVersions(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	if err := sp.SetStreamAnnotation(id, 1, []byte("x")); err == nil || err.Code() != bte.NoSuchStream {
+		t.Fatalf("expected NoSuchStream, got %v", err)
+	}
+	if err := sp.CreateStream(id, "test/coll", nil, []byte("v1")); err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	if err := sp.SetStreamAnnotation(id, 1, []byte("v2")); err != nil {
+		t.Fatalf("unexpected annotation error: %v", err)
+	}
+	//A writer that read version 1 must not overwrite version 2
+	if err := sp.SetStreamAnnotation(id, 1, []byte("stale")); err == nil || err.Code() != bte.AnnotationVersionMismatch {
+		t.Fatalf("expected AnnotationVersionMismatch, got %v", err)
+	}
+	if err := sp.SetStreamAnnotation(id, 3, []byte("ahead")); err == nil || err.Code() != bte.AnnotationVersionMismatch {
+		t.Fatalf("expected AnnotationVersionMismatch for a future version, got %v", err)
+	}
+	ann, aver, err := sp.GetStreamAnnotation(id)
+	if err != nil || aver != 2 || string(ann) != "v2" {
+		t.Fatalf("unexpected annotation %q@%d (%v)", ann, aver, err)
+	}
+	//The latest annotation is read back after a replay of the metadata log
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp2.Close()
+	ann, aver, err = sp2.GetStreamAnnotation(id)
+	if err != nil || aver != 2 || string(ann) != "v2" {
+		t.Fatalf("unexpected annotation after reopening %q@%d (%v)", ann, aver, err)
+	}
+}
+
+func TestCountStreams(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	for i := 0; i < 20; i++ {
+		tags := map[string]string{"name": fmt.Sprintf("s%d", i), "parity": fmt.Sprintf("%d", i%2)}
+		if i%5 == 0 {
+			tags["unit"] = "volts"
+		}
+		if err := sp.CreateStream(uuid.NewRandom(), "a/b", tags, nil); err != nil {
+			t.Fatalf("unexpected create error: %v", err)
+		}
+	}
+	if err := sp.CreateStream(uuid.NewRandom(), "a/c", map[string]string{"parity": "0"}, nil); err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	filters := []map[string]string{
+		nil,
+		{"parity": "0"},
+		{"parity": "1", "unit": "volts"},
+		{"unit": "volts"},
+		{"name": "s3"},
+		{"name": "nope"},
+	}
+	for _, coll := range []string{"a/b", "a/c", "a/d"} {
+		for _, f := range filters {
+			l, err := sp.ListStreams(coll, true, f)
+			if err != nil {
+				t.Fatalf("unexpected list error: %v", err)
+			}
+			c, err := sp.CountStreams(coll, f)
+			if err != nil {
+				t.Fatalf("unexpected count error: %v", err)
+			}
+			if int64(len(l)) != c {
+				t.Fatalf("count %d for %s %v does not match list length %d", c, coll, f, len(l))
+			}
+		}
+	}
+	if c, _ := sp.CountStreams("a/b", map[string]string{"parity": "1", "unit": "volts"}); c != 2 {
+		t.Fatalf("expected 2 streams, got %d", c)
+	}
+}
+
+func TestBatchedVersionFlush(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.VersionFlushBatch = 10
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	writes, syncs := atomic.LoadUint64(&sp.metawrites), atomic.LoadUint64(&sp.metasyncs)
+	for v := uint64(1); v <= 95; v++ {
+		sp.SetStreamVersion(id, v)
+		if got := sp.GetStreamVersion(id); got != v {
+			t.Fatalf("expected version %d, got %d", v, got)
+		}
+	}
+	if w := atomic.LoadUint64(&sp.metawrites) - writes; w != 95 {
+		t.Fatalf("expected every update to be written to the log, got %d writes", w)
+	}
+	if s := atomic.LoadUint64(&sp.metasyncs) - syncs; s != 9 {
+		t.Fatalf("expected 9 batched syncs for 95 updates, got %d", s)
+	}
+	//Only the sync is batched, so a crash of the process loses nothing
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	if got := sp2.GetStreamVersion(id); got != 95 {
+		t.Fatalf("expected recovered version 95, got %d", got)
+	}
+}
+
+func TestPauseVersionFlusher(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.VersionFlushInterval = time.Millisecond
+	})
+	defer os.RemoveAll(cfg.dir)
+	sp.PauseBackground()
+	//Let a flush in flight finish
+	time.Sleep(10 * time.Millisecond)
+	syncs := atomic.LoadUint64(&sp.metasyncs)
+	sp.SetStreamVersion(uuid.NewRandom(), 1)
+	time.Sleep(50 * time.Millisecond)
+	if s := atomic.LoadUint64(&sp.metasyncs); s != syncs {
+		t.Fatalf("version flusher synced while background I/O was paused")
+	}
+	sp.ResumeBackground()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&sp.metasyncs) == syncs {
+		if time.Now().After(deadline) {
+			t.Fatalf("version flusher made no progress once resumed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCollectionDefaultTags(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	defaults := map[string]string{"unit": "volts", "site": "a"}
+	if err := sp.SetCollectionDefaultTags("defaults/test", defaults); err != nil {
+		t.Fatal(err)
+	}
+	plain, override := uuid.NewRandom(), uuid.NewRandom()
+	if err := sp.CreateStream(plain, "defaults/test", map[string]string{"name": "p"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.CreateStream(override, "defaults/test", map[string]string{"name": "o", "site": "b"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.CreateStream(uuid.NewRandom(), "other", map[string]string{"name": "x"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rv, err := sp.ListStreams("defaults/test", false, map[string]string{"name": "p", "unit": "volts", "site": "a"})
+	if err != nil || len(rv) != 1 || !bytes.Equal(rv[0].UUID, plain) {
+		t.Fatalf("expected defaults in effective tags, got %v (%v)", rv, err)
+	}
+	rv, err = sp.ListStreams("defaults/test", false, map[string]string{"name": "o", "unit": "volts", "site": "b"})
+	if err != nil || len(rv) != 1 || !bytes.Equal(rv[0].UUID, override) {
+		t.Fatalf("expected explicit tag to override default, got %v (%v)", rv, err)
+	}
+	rv, _ = sp.ListStreams("other", true, map[string]string{"unit": "volts"})
+	if len(rv) != 0 {
+		t.Fatalf("defaults leaked into another collection")
+	}
+	//The defaults must not alias the caller's map
+	defaults["unit"] = "amps"
+	if err := sp.CreateStream(uuid.NewRandom(), "defaults/test", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := sp.CountStreams("defaults/test", map[string]string{"unit": "volts"}); n != 3 {
+		t.Fatalf("expected 3 streams with default unit, got %d", n)
+	}
+}
+
+func TestMetadataSizeLimits(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.MaxAnnotationSize = 100
+		sp.MaxTagsSize = 20
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	//Exactly at the limits
+	if err := sp.CreateStream(id, "limits", map[string]string{"0123456789": "abcdefghij"}, make([]byte, 100)); err != nil {
+		t.Fatalf("expected metadata within limits to be accepted: %v", err)
+	}
+	if err := sp.CreateStream(uuid.NewRandom(), "limits", nil, make([]byte, 101)); err == nil || err.Code() != bte.AnnotationTooBig {
+		t.Fatalf("expected AnnotationTooBig, got %v", err)
+	}
+	if err := sp.CreateStream(uuid.NewRandom(), "limits", map[string]string{"0123456789": "abcdefghijk"}, nil); err == nil || err.Code() != bte.InvalidParameter {
+		t.Fatalf("expected InvalidParameter for oversized tags, got %v", err)
+	}
+	if err := sp.SetStreamAnnotation(id, 1, make([]byte, 101)); err == nil || err.Code() != bte.AnnotationTooBig {
+		t.Fatalf("expected AnnotationTooBig, got %v", err)
+	}
+	if err := sp.SetStreamAnnotation(id, 1, make([]byte, 50)); err != nil {
+		t.Fatalf("expected annotation within limit to be accepted: %v", err)
+	}
+	//Defaults count towards the limit once merged
+	if err := sp.SetCollectionDefaultTags("limits", map[string]string{"unit": "volts"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.CreateStream(uuid.NewRandom(), "limits", map[string]string{"name": "abcdefghijk"}, nil); err == nil || err.Code() != bte.InvalidParameter {
+		t.Fatalf("expected merged tags to be limited, got %v", err)
+	}
+	if err := sp.SetCollectionDefaultTags("limits", map[string]string{"unit": "abcdefghijklmnopq"}); err == nil || err.Code() != bte.InvalidParameter {
+		t.Fatalf("expected oversized defaults to be rejected, got %v", err)
+	}
+}
+
+func TestConcurrentCreateStream(t *testing.T) {
+	for _, ondisk := range []bool{false, true} {
+		sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+			sp.MetadataOnDisk = ondisk
+		})
+		id := uuid.NewRandom()
+		const n = 50
+		errs := make(chan bte.BTE, n)
+		start := make(chan struct{})
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				<-start
+				errs <- sp.CreateStream(id, "race", map[string]string{"creator": fmt.Sprint(i)}, nil)
+			}(i)
+		}
+		close(start)
+		ok := 0
+		for i := 0; i < n; i++ {
+			err := <-errs
+			if err == nil {
+				ok++
+			} else if err.Code() != bte.StreamExists {
+				t.Fatalf("expected StreamExists, got %v", err)
+			}
+		}
+		if ok != 1 {
+			t.Fatalf("expected exactly one create to succeed (on disk %v), %d did", ondisk, ok)
+		}
+		os.RemoveAll(cfg.dir)
+	}
+}
+
+//A metafile whose appends fail with err the first failures times
+type failingMetafile struct {
+	metafile
+	failures int32
+	err      error
+}
+
+func (f *failingMetafile) WriteAt(b []byte, off int64) (int, error) {
+	if atomic.AddInt32(&f.failures, -1) >= 0 {
+		return 0, f.err
+	}
+	return f.metafile.WriteAt(b, off)
+}
+
+func TestMetadataRetries(t *testing.T) {
+	var mf *failingMetafile
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.MetadataRetries = 3
+		sp.MetadataRetryBackoff = time.Millisecond
+		sp.wrapMetafile = func(f metafile) metafile {
+			mf = &failingMetafile{metafile: f}
+			return mf
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	//Two transient failures are retried, and the create commits
+	mf.failures, mf.err = 2, &os.PathError{Op: "write", Path: "metadata", Err: syscall.EIO}
+	id := uuid.NewRandom()
+	if err := sp.CreateStream(id, "retries", nil, nil); err != nil {
+		t.Fatalf("expected the create to commit after retries, got %v", err)
+	}
+	//More failures than retries
+	mf.failures = 10
+	if err := sp.CreateStream(uuid.NewRandom(), "retries", nil, nil); err == nil {
+		t.Fatalf("expected the create to fail once retries are exhausted")
+	}
+	//A failure that is not transient is not retried
+	mf.failures, mf.err = 1, &os.PathError{Op: "write", Path: "metadata", Err: syscall.EBADF}
+	if err := sp.CreateStream(uuid.NewRandom(), "retries", nil, nil); err == nil {
+		t.Fatalf("expected a permanent failure not to be retried")
+	}
+	if mf.failures != 0 {
+		t.Fatalf("expected a single attempt for a permanent failure")
+	}
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	if info, _ := sp2.GetStreamInfo(id); info.UUID == nil {
+		t.Fatalf("the retried create was not in the metadata log")
+	}
+}
+
+func TestStreamVersionRollback(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	if v := sp.GetStreamVersion(id); v != 0 {
+		t.Fatalf("expected version 0 for a missing stream, got %d", v)
+	}
+	if err := sp.CreateStream(id, "rollback", map[string]string{"unit": "V"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for v := uint64(1); v <= 8; v++ {
+		sp.WriteSuperBlock(id, v, mkData(50, byte(v)))
+	}
+	sp.SetStreamVersion(id, 8)
+	//Roll back, then reuse the version numbers after it
+	sp.SetStreamVersion(id, 5)
+	if v := sp.GetStreamVersion(id); v != 5 {
+		t.Fatalf("expected version 5 after rolling back, got %d", v)
+	}
+	for v := uint64(6); v <= 7; v++ {
+		sp.WriteSuperBlock(id, v, mkData(50, byte(v+100)))
+	}
+	sp.SetStreamVersion(id, 7)
+
+	check := func(sp *FileStorageProvider) {
+		stream, ver := sp.GetStreamInfo(id)
+		if ver != 7 || !bytes.Equal(stream.UUID, id) || stream.Collection != "rollback" || stream.Tags["unit"] != "V" {
+			t.Fatalf("unexpected stream info %+v at version %d", stream, ver)
+		}
+		//Every version up to the current one reads as last written
+		for v := uint64(1); v <= ver; v++ {
+			expected := mkData(50, byte(v))
+			if v > 5 {
+				expected = mkData(50, byte(v+100))
+			}
+			got, err := sp.ReadSuperBlock(id, v, make([]byte, 100))
+			if err != nil || !bytes.Equal(got, expected) {
+				t.Fatalf("unexpected superblock for version %d: %v", v, err)
+			}
+		}
+	}
+	check(sp)
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+}
+
+func TestCorruptMetadataRecordLength(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	if err := sp.CreateStream(id, "test/coll", nil, nil); err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	//A length prefix of almost 4GB, followed by a little junk
+	f, err := os.OpenFile(metadataPath(cfg.dir), os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0xF0, 0xFF, 0xFF, 0xFF, '{', '}'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	//The record is ignored as a torn tail, and the next append replaces it
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	if info, _ := sp2.GetStreamInfo(id); info.UUID == nil {
+		t.Fatalf("the stream before the corrupt record was lost")
+	}
+	id2 := uuid.NewRandom()
+	if err := sp2.CreateStream(id2, "test/coll", nil, nil); err != nil {
+		t.Fatalf("unexpected create error: %v", err)
+	}
+	sp3 := &FileStorageProvider{}
+	if err := sp3.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp3.Close() })
+	if info, _ := sp3.GetStreamInfo(id2); info.UUID == nil {
+		t.Fatalf("the stream created after the corrupt record was lost")
+	}
+}
@@ -0,0 +1,521 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+//With MetadataOnDisk set, the metadata log is still the source of truth, but
+//only the records after a watermark are replayed into memory. Everything
+//before it is in two sorted index files, written by merging the previous
+//index files with the in-memory state whenever that gets too large:
+//  metadata.idx  : every stream and version, sorted by uuid
+//  metadata.cidx : the uuid of every stream, sorted by collection then uuid
+//Only every METAINDEX_SPARSE'th key of each file is held in memory.
+const (
+	METAINDEX_DATA = "metadata.idx"
+	METAINDEX_COLL = "metadata.cidx"
+)
+
+const METAINDEX_SPARSE = 32
+
+//The number of streams and versions held in memory before they are merged
+//into the index files, if MetadataMemtableSize is not set
+const DEFAULT_METADATA_MEMTABLE = 10000
+
+//Each index file is this tag, the watermark, a 4 byte length and that many
+//bytes of extra header, then records of a 4 byte length and a body. Bodies
+//start with the 16 byte uuid. The extra header of metadata.cidx holds the
+//collection default tags
+var metaIndexTag = []byte("QMETAIDX")
+
+const METAINDEX_HEADERLEN = 20
+
+//A stream as stored in metadata.idx. Exists is false for uuids that only have
+//a version
+type diskstream struct {
+	Exists     bool              `json:",omitempty"`
+	Collection string            `json:",omitempty"`
+	Tags       map[string]string `json:",omitempty"`
+	Annotation []byte            `json:",omitempty"`
+	AVer       uint64            `json:",omitempty"`
+	Version    uint64            `json:",omitempty"`
+	History    map[uint64]int64  `json:",omitempty"`
+	BlockLimit int64             `json:",omitempty"`
+}
+
+func (ds *diskstream) streammeta(uuid []byte) *streammeta {
+	sm := &streammeta{
+		uuid:       uuid,
+		collection: ds.Collection,
+		tags:       ds.Tags,
+		annotation: ds.Annotation,
+		aver:       ds.AVer,
+		history:    ds.History,
+		blocklimit: ds.BlockLimit,
+	}
+	if sm.tags == nil {
+		sm.tags = make(map[string]string)
+	}
+	return sm
+}
+
+type sparsekey struct {
+	key string
+	off int64
+}
+
+//A read only file of records sorted by key
+type sortedfile struct {
+	f         *os.File
+	watermark int64
+	ext       []byte
+	//The offset of the first record, and the end of the last
+	first  int64
+	end    int64
+	sparse []sparsekey
+}
+
+func dataKey(body []byte) string {
+	return string(body[:16])
+}
+
+func collKey(body []byte) string {
+	return string(body[16:]) + "\x00" + string(body[:16])
+}
+
+//Open a sorted file, building its sparse index. Returns nil if it does not
+//exist
+func openSortedFile(path string, keyOf func(body []byte) string) (*sortedfile, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, METAINDEX_HEADERLEN)
+	if _, err := f.ReadAt(hdr, 0); err != nil || !bytes.Equal(hdr[:8], metaIndexTag) {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a metadata index", path)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	sf := &sortedfile{f: f, watermark: int64(binary.LittleEndian.Uint64(hdr[8:])), end: st.Size()}
+	sf.ext = make([]byte, binary.LittleEndian.Uint32(hdr[16:]))
+	if _, err := f.ReadAt(sf.ext, METAINDEX_HEADERLEN); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+	sf.first = METAINDEX_HEADERLEN + int64(len(sf.ext))
+	n := 0
+	err = sf.iter(sf.first, func(body []byte, off int64) bool {
+		if n%METAINDEX_SPARSE == 0 {
+			sf.sparse = append(sf.sparse, sparsekey{keyOf(body), off})
+		}
+		n++
+		return true
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+//Returns the offset to start scanning from to find the given key
+func (sf *sortedfile) start(key string) int64 {
+	i := sort.Search(len(sf.sparse), func(i int) bool {
+		return sf.sparse[i].key > key
+	})
+	if i == 0 {
+		return sf.first
+	}
+	return sf.sparse[i-1].off
+}
+
+//Call fn with each record from the given offset, until it returns false
+func (sf *sortedfile) iter(from int64, fn func(body []byte, off int64) bool) error {
+	r := bufio.NewReader(io.NewSectionReader(sf.f, from, sf.end-from))
+	lenarr := make([]byte, 4)
+	off := from
+	for off < sf.end {
+		if _, err := io.ReadFull(r, lenarr); err != nil {
+			return err
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(lenarr))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if !fn(body, off) {
+			return nil
+		}
+		off += 4 + int64(len(body))
+	}
+	return nil
+}
+
+//Writes a sorted file to a temporary name, which replaces the real one once
+//it is complete
+type sortedwriter struct {
+	path   string
+	f      *os.File
+	w      *bufio.Writer
+	sf     *sortedfile
+	n      int
+	lenarr []byte
+}
+
+func newSortedWriter(path string, mode os.FileMode, watermark int64, ext []byte) (*sortedwriter, error) {
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return nil, err
+	}
+	sw := &sortedwriter{path: path, f: f, w: bufio.NewWriter(f), lenarr: make([]byte, 4)}
+	first := METAINDEX_HEADERLEN + int64(len(ext))
+	sw.sf = &sortedfile{watermark: watermark, ext: ext, first: first, end: first}
+	hdr := make([]byte, METAINDEX_HEADERLEN)
+	copy(hdr, metaIndexTag)
+	binary.LittleEndian.PutUint64(hdr[8:], uint64(watermark))
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(len(ext)))
+	if _, err := sw.w.Write(append(hdr, ext...)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *sortedwriter) add(key string, body []byte) error {
+	if sw.n%METAINDEX_SPARSE == 0 {
+		sw.sf.sparse = append(sw.sf.sparse, sparsekey{key, sw.sf.end})
+	}
+	sw.n++
+	binary.LittleEndian.PutUint32(sw.lenarr, uint32(len(body)))
+	if _, err := sw.w.Write(sw.lenarr); err != nil {
+		return err
+	}
+	if _, err := sw.w.Write(body); err != nil {
+		return err
+	}
+	sw.sf.end += 4 + int64(len(body))
+	return nil
+}
+
+func (sw *sortedwriter) abort() {
+	sw.f.Close()
+	os.Remove(sw.path + ".tmp")
+}
+
+//Make the file durable and move it into place
+func (sw *sortedwriter) finish() (*sortedfile, error) {
+	err := sw.w.Flush()
+	if err == nil {
+		err = sw.f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(sw.path+".tmp", sw.path)
+	}
+	if err != nil {
+		sw.abort()
+		return nil, err
+	}
+	sw.sf.f = sw.f
+	return sw.sf, nil
+}
+
+type metaindex struct {
+	//Either may be nil if there is no index yet
+	data *sortedfile
+	coll *sortedfile
+}
+
+//Open the index files in the given directory. If they are missing or do not
+//go together, an empty index is returned and the log is replayed in full
+func openMetaIndex(dbpath string, lg Logger) *metaindex {
+	data, err := openSortedFile(fmt.Sprintf("%s/%s", dbpath, METAINDEX_DATA), dataKey)
+	if err != nil {
+		lg.Warn("Ignoring metadata index", "err", err)
+		return &metaindex{}
+	}
+	coll, err := openSortedFile(fmt.Sprintf("%s/%s", dbpath, METAINDEX_COLL), collKey)
+	if err != nil {
+		lg.Warn("Ignoring metadata index", "err", err)
+		return &metaindex{}
+	}
+	//The collection index is replaced first, and only ever gains streams, so
+	//it may be newer than the data index but never older
+	if data == nil || coll == nil || coll.watermark < data.watermark {
+		if data != nil || coll != nil {
+			lg.Warn("Ignoring incomplete metadata index")
+		}
+		return &metaindex{}
+	}
+	return &metaindex{data: data, coll: coll}
+}
+
+//Returns the log offset the index is current to
+func (mi *metaindex) watermark() int64 {
+	if mi.data == nil {
+		return 0
+	}
+	return mi.data.watermark
+}
+
+//Returns the stored entry for the uuid, or nil if there is none
+func (mi *metaindex) lookup(key [16]byte) (*diskstream, error) {
+	if mi.data == nil {
+		return nil, nil
+	}
+	k := string(key[:])
+	var rv *diskstream
+	var derr error
+	err := mi.data.iter(mi.data.start(k), func(body []byte, off int64) bool {
+		bk := dataKey(body)
+		if bk < k {
+			return true
+		}
+		if bk == k {
+			rv = &diskstream{}
+			derr = json.Unmarshal(body[16:], rv)
+		}
+		return false
+	})
+	if err == nil {
+		err = derr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+//Call fn with the uuid of each stream in the collection, until it returns false
+func (mi *metaindex) scanCollection(collection string, fn func(uuid []byte) bool) error {
+	if mi.coll == nil {
+		return nil
+	}
+	return mi.coll.iter(mi.coll.start(collection+"\x00"), func(body []byte, off int64) bool {
+		c := string(body[16:])
+		if c < collection {
+			return true
+		}
+		if c > collection {
+			return false
+		}
+		return fn(body[:16])
+	})
+}
+
+//Call fn with each collection that has a stream, in order, starting from the
+//given one, until it returns false
+func (mi *metaindex) scanCollections(from string, fn func(collection string) bool) error {
+	if mi.coll == nil {
+		return nil
+	}
+	last, seen := "", false
+	return mi.coll.iter(mi.coll.start(from), func(body []byte, off int64) bool {
+		c := string(body[16:])
+		if c < from || (seen && c == last) {
+			return true
+		}
+		last, seen = c, true
+		return fn(c)
+	})
+}
+
+//The number of streams and versions held in memory
+func (sp *FileStorageProvider) memtableSize() int {
+	return len(sp.meta) + len(sp.versions)
+}
+
+//Merge the in-memory state into new index files, then drop it from memory.
+//Must be called with metamu held, and only with MetadataOnDisk set
+func (sp *FileStorageProvider) rebuildMetaIndex() error {
+	mi := sp.metaidx
+	//Everything in memory overrides what is on disk
+	overlay := make(map[string]*diskstream, sp.memtableSize())
+	get := func(key [16]byte) (*diskstream, error) {
+		ds, ok := overlay[string(key[:])]
+		if ok {
+			return ds, nil
+		}
+		ds, err := mi.lookup(key)
+		if err != nil {
+			return nil, err
+		}
+		if ds == nil {
+			ds = &diskstream{}
+		}
+		overlay[string(key[:])] = ds
+		return ds, nil
+	}
+	newstreams := []string{}
+	for key, sm := range sp.meta {
+		ds, err := get(key)
+		if err != nil {
+			return err
+		}
+		if !ds.Exists {
+			newstreams = append(newstreams, collKey(append(key[:], sm.collection...)))
+		}
+		ds.Exists = true
+		ds.Collection = sm.collection
+		ds.Tags = sm.tags
+		ds.Annotation = sm.annotation
+		ds.AVer = sm.aver
+		ds.History = sm.history
+		ds.BlockLimit = sm.blocklimit
+	}
+	for key, v := range sp.versions {
+		ds, err := get(key)
+		if err != nil {
+			return err
+		}
+		ds.Version = v
+	}
+	keys := make([]string, 0, len(overlay))
+	for k := range overlay {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	sort.Strings(newstreams)
+
+	//The collection index first, see openMetaIndex
+	defaults, err := json.Marshal(sp.colldefaults)
+	if err != nil {
+		return err
+	}
+	cw, err := newSortedWriter(fmt.Sprintf("%s/%s", sp.dbpath, METAINDEX_COLL), sp.fileMode, sp.metaend, defaults)
+	if err != nil {
+		return err
+	}
+	var werr error
+	addcoll := func(k string) {
+		if werr == nil {
+			body := append([]byte(k[len(k)-16:]), k[:len(k)-17]...)
+			werr = cw.add(k, body)
+		}
+	}
+	if mi.coll != nil {
+		err = mi.coll.iter(mi.coll.first, func(body []byte, off int64) bool {
+			k := collKey(body)
+			for len(newstreams) > 0 && newstreams[0] < k {
+				addcoll(newstreams[0])
+				newstreams = newstreams[1:]
+			}
+			if werr == nil {
+				werr = cw.add(k, body)
+			}
+			return werr == nil
+		})
+	}
+	for _, k := range newstreams {
+		addcoll(k)
+	}
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		cw.abort()
+		return err
+	}
+	coll, err := cw.finish()
+	if err != nil {
+		return err
+	}
+
+	dw, err := newSortedWriter(fmt.Sprintf("%s/%s", sp.dbpath, METAINDEX_DATA), sp.fileMode, sp.metaend, nil)
+	if err != nil {
+		coll.f.Close()
+		return err
+	}
+	adddata := func(k string) {
+		if werr == nil {
+			body, err := json.Marshal(overlay[k])
+			if err != nil {
+				werr = err
+				return
+			}
+			werr = dw.add(k, append([]byte(k), body...))
+		}
+	}
+	if mi.data != nil {
+		err = mi.data.iter(mi.data.first, func(body []byte, off int64) bool {
+			k := dataKey(body)
+			for len(keys) > 0 && keys[0] < k {
+				adddata(keys[0])
+				keys = keys[1:]
+			}
+			if len(keys) > 0 && keys[0] == k {
+				adddata(keys[0])
+				keys = keys[1:]
+			} else if werr == nil {
+				werr = dw.add(k, body)
+			}
+			return werr == nil
+		})
+	}
+	for _, k := range keys {
+		adddata(k)
+	}
+	if err == nil {
+		err = werr
+	}
+	if err != nil {
+		dw.abort()
+		coll.f.Close()
+		return err
+	}
+	data, err := dw.finish()
+	if err != nil {
+		coll.f.Close()
+		return err
+	}
+
+	if mi.data != nil {
+		mi.data.f.Close()
+		mi.coll.f.Close()
+	}
+	sp.metaidx = &metaindex{data: data, coll: coll}
+	sp.meta = make(map[[16]byte]*streammeta)
+	sp.collidx = make(map[string]map[[16]byte]*streammeta)
+	sp.tagidx = make(map[string]map[string]map[[16]byte]*streammeta)
+	sp.versions = make(map[[16]byte]uint64)
+	return nil
+}
+
+//Rebuild the index if the in-memory state has grown too large. Must be
+//called with metamu held
+func (sp *FileStorageProvider) maybeRebuildMetaIndex() {
+	if sp.metaidx == nil || sp.ReadOnly {
+		return
+	}
+	limit := sp.MetadataMemtableSize
+	if limit <= 0 {
+		limit = DEFAULT_METADATA_MEMTABLE
+	}
+	if sp.memtableSize() < limit {
+		return
+	}
+	if err := sp.rebuildMetaIndex(); err != nil {
+		//Everything is still in memory and in the log, so this can wait
+		sp.logger().Error("Could not rebuild metadata index", "err", err)
+	}
+}
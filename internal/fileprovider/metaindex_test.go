@@ -0,0 +1,150 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/pborman/uuid"
+)
+
+func TestMetadataOnDisk(t *testing.T) {
+	setup := func(sp *FileStorageProvider) {
+		sp.MetadataOnDisk = true
+		sp.MetadataMemtableSize = 100
+	}
+	sp, cfg := mkProvider(t, setup)
+	defer os.RemoveAll(cfg.dir)
+	if err := sp.SetCollectionDefaultTags("disk/odd", map[string]string{"parity": "odd"}); err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]uuid.UUID, 1000)
+	for i := range ids {
+		ids[i] = uuid.NewRandom()
+		coll := "disk/even"
+		if i%2 == 1 {
+			coll = "disk/odd"
+		}
+		tags := map[string]string{"name": fmt.Sprint(i), "mod3": fmt.Sprint(i % 3)}
+		if err := sp.CreateStream(ids[i], coll, tags, []byte("a")); err != nil {
+			t.Fatal(err)
+		}
+		sp.SetStreamVersion(ids[i], uint64(i+10))
+	}
+	//Update some streams that are only on disk by now
+	for i := 0; i < 50; i++ {
+		if err := sp.SetStreamAnnotation(ids[i], 1, []byte("b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sp.CreateStream(ids[0], "disk/even", nil, nil); err == nil || err.Code() != bte.StreamExists {
+		t.Fatalf("expected StreamExists for a stream on disk, got %v", err)
+	}
+
+	check := func(sp *FileStorageProvider) {
+		if sp.memtableSize() >= 100 {
+			t.Fatalf("expected at most 100 streams in memory, have %d", sp.memtableSize())
+		}
+		for i, id := range ids {
+			st, ver := sp.GetStreamInfo(id)
+			ann := "a"
+			if i < 50 {
+				ann = "b"
+			}
+			if !bytes.Equal(st.UUID, id) || st.Tags["name"] != fmt.Sprint(i) || string(st.Annotation) != ann || ver != uint64(i+10) {
+				t.Fatalf("stream %d wrong: %+v at version %d", i, st, ver)
+			}
+		}
+		if st, ver := sp.GetStreamInfo(uuid.NewRandom()); st.UUID != nil || ver != 0 {
+			t.Fatalf("expected nothing for an unknown stream")
+		}
+		rv, err := sp.ListStreams("disk/odd", true, map[string]string{"mod3": "0"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		//Odd multiples of 3 below 1000
+		if len(rv) != 167 {
+			t.Fatalf("expected 167 streams, got %d", len(rv))
+		}
+		for _, s := range rv {
+			if s.Tags["parity"] != "odd" || s.Collection != "disk/odd" {
+				t.Fatalf("unexpected stream in listing %+v", s)
+			}
+		}
+		rv, err = sp.ListStreams("disk/even", false, map[string]string{"name": "500", "mod3": "2"})
+		if err != nil || len(rv) != 1 || !bytes.Equal(rv[0].UUID, ids[500]) {
+			t.Fatalf("exact lookup failed: %v (%v)", rv, err)
+		}
+		if n, _ := sp.CountStreams("disk/even", nil); n != 500 {
+			t.Fatalf("expected 500 even streams, got %d", n)
+		}
+	}
+	check(sp)
+	//Only the log tail after the index is replayed on restart
+	sp2 := &FileStorageProvider{}
+	setup(sp2)
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+	if err := sp2.CreateStream(uuid.NewRandom(), "disk/odd", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := sp2.CountStreams("disk/odd", map[string]string{"parity": "odd"}); n != 501 {
+		t.Fatalf("expected defaults to survive restart, got %d matching streams", n)
+	}
+}
+
+func TestListCollections(t *testing.T) {
+	for _, ondisk := range []bool{false, true} {
+		sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+			sp.MetadataOnDisk = ondisk
+			sp.MetadataMemtableSize = 4
+		})
+		defer os.RemoveAll(cfg.dir)
+		colls := []string{"a", "sensors/c", "sensors/a", "sensorsx", "sensors/b", "zeta", "sensors/b"}
+		for _, c := range colls {
+			if err := sp.CreateStream(uuid.NewRandom(), c, map[string]string{"name": c}, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ondisk && sp.metaidx.coll == nil {
+			t.Fatalf("expected some collections to be in the index on disk")
+		}
+		for _, tc := range []struct {
+			prefix, from string
+			number       int64
+			expected     []string
+		}{
+			{"", "", 0, []string{"a", "sensors/a", "sensors/b", "sensors/c", "sensorsx", "zeta"}},
+			{"sensors/", "", 0, []string{"sensors/a", "sensors/b", "sensors/c"}},
+			{"sensors/", "", 2, []string{"sensors/a", "sensors/b"}},
+			//The next page starts from the last collection returned
+			{"sensors/", "sensors/b", 2, []string{"sensors/b", "sensors/c"}},
+			{"sensors/", "sensors/b\x00", 2, []string{"sensors/c"}},
+			{"sensors", "sensors/c", 0, []string{"sensors/c", "sensorsx"}},
+			{"sensors/", "sensors/d", 0, []string{}},
+			{"zz", "", 0, []string{}},
+		} {
+			got, err := sp.ListCollections(tc.prefix, tc.from, tc.number)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tc.expected) {
+				t.Fatalf("on disk %v: collections with prefix %q from %q (%d) were %q, expected %q",
+					ondisk, tc.prefix, tc.from, tc.number, got, tc.expected)
+			}
+		}
+	}
+}
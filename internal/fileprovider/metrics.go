@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//The Prometheus metrics of a provider, registered on Registerer at
+//Initialize and unregistered by Close. The counts the provider keeps anyway
+//(see Stats) are read when the metrics are collected, so only the two
+//histograms are updated as the provider runs, and nothing is if Registerer
+//is nil
+type metrics struct {
+	sp           *FileStorageProvider
+	reads        *prometheus.Desc
+	writes       *prometheus.Desc
+	bytesRead    *prometheus.Desc
+	bytesWritten *prometheus.Desc
+	fileBytes    *prometheus.Desc
+	//Observed by every read, see iocounters
+	readLatency prometheus.Histogram
+	//Observed by every LockSegment, including the time blocked waiting for
+	//a file to be free
+	lockWait prometheus.Histogram
+}
+
+//From 10us to about 2.6s
+var metricBuckets = prometheus.ExponentialBuckets(10e-6, 4, 10)
+
+func newMetrics(sp *FileStorageProvider) *metrics {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("btrdb", "fileprovider", name), help, labels, nil)
+	}
+	return &metrics{
+		sp:           sp,
+		reads:        desc("reads_total", "The number of blocks read"),
+		writes:       desc("writes_total", "The number of blocks written"),
+		bytesRead:    desc("read_bytes_total", "The bytes of block data read"),
+		bytesWritten: desc("written_bytes_total", "The bytes of block data written"),
+		fileBytes:    desc("file_bytes", "The committed size of each blockstore file", "file"),
+		readLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "btrdb",
+			Subsystem: "fileprovider",
+			Name:      "read_seconds",
+			Help:      "How long block reads take",
+			Buckets:   metricBuckets,
+		}),
+		lockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "btrdb",
+			Subsystem: "fileprovider",
+			Name:      "lock_wait_seconds",
+			Help:      "How long LockSegment waits for a file",
+			Buckets:   metricBuckets,
+		}),
+	}
+}
+
+func (m *metrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.reads
+	ch <- m.writes
+	ch <- m.bytesRead
+	ch <- m.bytesWritten
+	ch <- m.fileBytes
+	m.readLatency.Describe(ch)
+	m.lockWait.Describe(ch)
+}
+
+func (m *metrics) Collect(ch chan<- prometheus.Metric) {
+	c := &m.sp.io
+	counter := func(d *prometheus.Desc, v *uint64) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, float64(atomic.LoadUint64(v)))
+	}
+	counter(m.reads, &c.reads)
+	counter(m.writes, &c.writes)
+	counter(m.bytesRead, &c.bytesRead)
+	counter(m.bytesWritten, &c.bytesWrite)
+	for i := range m.sp.committed {
+		size := atomic.LoadInt64(&m.sp.committed[i])
+		ch <- prometheus.MustNewConstMetric(m.fileBytes, prometheus.GaugeValue, float64(size), strconv.Itoa(i))
+	}
+	m.readLatency.Collect(ch)
+	m.lockWait.Collect(ch)
+}
+
+//Register the metrics on Registerer, if it is set
+func (sp *FileStorageProvider) registerMetrics() error {
+	if sp.Registerer == nil {
+		return nil
+	}
+	m := newMetrics(sp)
+	if err := sp.Registerer.Register(m); err != nil {
+		return err
+	}
+	sp.metrics = m
+	sp.io.latency = m.readLatency
+	return nil
+}
+
+func (sp *FileStorageProvider) unregisterMetrics() {
+	if sp.metrics != nil {
+		sp.Registerer.Unregister(sp.metrics)
+	}
+}
+
+func (sp *FileStorageProvider) observeLockWait(wait time.Duration) {
+	if sp.metrics != nil {
+		sp.metrics.lockWait.Observe(wait.Seconds())
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/pborman/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+//Returns the metrics gathered from the registry by name, each keyed by its
+//labels
+func gatherMetrics(t *testing.T, reg *prometheus.Registry) map[string]map[string]*dto.Metric {
+	fams, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rv := make(map[string]map[string]*dto.Metric)
+	for _, fam := range fams {
+		rv[fam.GetName()] = make(map[string]*dto.Metric)
+		for _, m := range fam.GetMetric() {
+			key := ""
+			for _, l := range m.GetLabel() {
+				key += l.GetName() + "=" + l.GetValue()
+			}
+			rv[fam.GetName()][key] = m
+		}
+	}
+	return rv
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	sp := &FileStorageProvider{Registerer: reg}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewRandom()
+	var addrs []uint64
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, writeOne(t, sp, id, mkData(100, byte(i))))
+	}
+	for _, a := range addrs {
+		if _, err := sp.Read(id, a, make([]byte, MAXBLOCKSIZE)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := gatherMetrics(t, reg)
+	for name, want := range map[string]float64{
+		"btrdb_fileprovider_reads_total":         3,
+		"btrdb_fileprovider_writes_total":        3,
+		"btrdb_fileprovider_read_bytes_total":    300,
+		"btrdb_fileprovider_written_bytes_total": 300,
+	} {
+		if v := got[name][""].GetCounter().GetValue(); v != want {
+			t.Fatalf("expected %s to be %v, got %v", name, want, v)
+		}
+	}
+	if n := got["btrdb_fileprovider_read_seconds"][""].GetHistogram().GetSampleCount(); n != 3 {
+		t.Fatalf("expected 3 read latencies, got %d", n)
+	}
+	if n := got["btrdb_fileprovider_lock_wait_seconds"][""].GetHistogram().GetSampleCount(); n != 3 {
+		t.Fatalf("expected 3 lock waits, got %d", n)
+	}
+	if n := len(got["btrdb_fileprovider_file_bytes"]); n != sp.numfiles {
+		t.Fatalf("expected a size for each of %d files, got %d", sp.numfiles, n)
+	}
+	fidx := int(addrs[0] >> 50)
+	size := got["btrdb_fileprovider_file_bytes"][fmt.Sprintf("file=%d", fidx)].GetGauge().GetValue()
+	if size != float64(sp.Stats().Offsets[fidx]) {
+		t.Fatalf("expected file %d to be %d bytes, got %v", fidx, sp.Stats().Offsets[fidx], size)
+	}
+	//Close unregisters the metrics, so the database can be opened again
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := gatherMetrics(t, reg); len(got) != 0 {
+		t.Fatalf("expected no metrics after Close, got %d", len(got))
+	}
+	sp = &FileStorageProvider{Registerer: reg}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatalf("expected the metrics to register again: %v", err)
+	}
+	defer sp.Close()
+	//A second provider on the same registry is refused
+	if err := (&FileStorageProvider{Registerer: reg}).Initialize(cfg); err == nil {
+		t.Fatalf("expected registering the metrics twice to fail")
+	}
+}
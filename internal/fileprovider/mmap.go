@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//With StorageUseMmap in the configuration, each blockstore file is mapped
+//read-only and Read copies blocks out of the mapping, so reads of warm files
+//need neither a syscall nor the file's read lock. A file is mapped on its
+//first read and remapped when a block is read past the end of the mapping.
+//The mapping is never longer than the file, as touching a page past its end
+//faults, so anything that shortens or replaces a file unmaps it first.
+//Where a file can't be mapped, or a block is not within it even after a
+//remap, the read falls back to ReadAt
+
+//Returned by readMapped when the read has to use ReadAt instead
+var errNotMapped = errors.New("block is not mapped")
+
+type filemap struct {
+	mu   sync.RWMutex
+	data []byte
+	//Set if mapping the file failed, so it is not tried again
+	failed bool
+}
+
+//Read the record at the given offset from the file's mapping, as readRecord
+//does. Returns errNotMapped if the record is not in the mapping
+func (sp *FileStorageProvider) readMapped(fidx uint64, off int64, buffer []byte) ([]byte, blockmeta, error) {
+	fm := &sp.maps[fidx]
+	for remapped := false; ; remapped = true {
+		fm.mu.RLock()
+		if int64(len(fm.data)) > off {
+			data, meta, need := sp.decodeRecord(fm.data[off:])
+			if need == 0 {
+				rv, err := sp.copyMapped(data, buffer)
+				fm.mu.RUnlock()
+				if err == nil && meta.torn {
+					err = bprovider.ErrIncompleteBlock
+				}
+				if err == nil {
+					atomic.AddUint64(&sp.reads, 1)
+				}
+				return rv, meta, err
+			}
+		}
+		fm.mu.RUnlock()
+		if remapped || !sp.remap(fidx) {
+			return nil, blockmeta{}, errNotMapped
+		}
+	}
+}
+
+//Copy a block's data out of a mapping into the caller's buffer, which must
+//be as big as the record, as for a read from the file
+func (sp *FileStorageProvider) copyMapped(data []byte, buffer []byte) ([]byte, error) {
+	need := len(data) + int(sp.blockOverhead())
+	if need > len(buffer) {
+		if !sp.GrowSmallBuffers {
+			return nil, bprovider.ErrBufferTooSmall{Need: need}
+		}
+		buffer = make([]byte, need)
+	}
+	return buffer[:copy(buffer, data)], nil
+}
+
+//Map the whole of the file as it is now, if that is longer than the current
+//mapping. Returns whether the mapping grew
+func (sp *FileStorageProvider) remap(fidx uint64) bool {
+	fm := &sp.maps[fidx]
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if fm.failed {
+		return false
+	}
+	fi, err := sp.dbrf[fidx].Stat()
+	if err != nil || fi.Size() <= int64(len(fm.data)) {
+		return false
+	}
+	data, err := mmapFile(sp.dbrf[fidx], fi.Size())
+	if err != nil {
+		sp.logger().Warn("Could not map blockstore file, reading it with ReadAt", "file", fidx, "err", err)
+		fm.failed = true
+		return false
+	}
+	fm.unmap(sp.logger())
+	fm.data = data
+	atomic.AddUint64(&sp.remaps, 1)
+	return true
+}
+
+//Drop the mapping of a file, before it is replaced. It is mapped again by
+//the next read
+func (sp *FileStorageProvider) unmapFile(fidx int) {
+	if sp.maps == nil {
+		return
+	}
+	fm := &sp.maps[fidx]
+	fm.mu.Lock()
+	fm.unmap(sp.logger())
+	fm.mu.Unlock()
+}
+
+//Shorten a file to the given size, with no read mapping it in the meantime
+func (sp *FileStorageProvider) truncateFile(fidx int, size int64) error {
+	sp.resetPrealloc(fidx)
+	if sp.maps == nil {
+		return sp.dbf[fidx].Truncate(size)
+	}
+	fm := &sp.maps[fidx]
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	fm.unmap(sp.logger())
+	return sp.dbf[fidx].Truncate(size)
+}
+
+//Must be called with the write lock held
+func (fm *filemap) unmap(lg Logger) {
+	if fm.data != nil {
+		if err := munmapFile(fm.data); err != nil {
+			lg.Error("Could not unmap blockstore file", "err", err)
+		}
+		fm.data = nil
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+//Map the first size bytes of the file read-only. Blocks are written with
+//pwrite through the page cache, which a shared mapping sees at once
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	if int64(int(size)) != size {
+		return nil, unix.EFBIG
+	}
+	return unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+}
+
+func munmapFile(b []byte) error {
+	return unix.Munmap(b)
+}
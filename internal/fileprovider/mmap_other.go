@@ -0,0 +1,24 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+// +build !linux
+
+package fileprovider
+
+import (
+	"errors"
+	"os"
+)
+
+//Files are only mapped on Linux, elsewhere every read uses ReadAt
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestMmapReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 1, mmap: true}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	id := uuid.NewRandom()
+	written := make(map[uint64][]byte)
+	write := func(n int, seed byte) bprovider.Segment {
+		seg := sp.LockSegment(id)
+		addr := seg.BaseAddress()
+		for i := 0; i < n; i++ {
+			d := mkData(100+1000*i, seed+byte(i))
+			next, err := seg.Write(id, addr, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			written[addr] = d
+			addr = next
+		}
+		return seg
+	}
+	readAll := func() {
+		for addr, d := range written {
+			got, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE))
+			if err != nil || !bytes.Equal(got, d) {
+				t.Fatalf("block at %x did not read back: %v", addr, err)
+			}
+		}
+	}
+	mapped := func() int {
+		sp.maps[0].mu.RLock()
+		defer sp.maps[0].mu.RUnlock()
+		return len(sp.maps[0].data)
+	}
+	size := func() int {
+		fi, err := sp.dbrf[0].Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(fi.Size())
+	}
+	write(5, 0).Unlock()
+	readAll()
+	if atomic.LoadUint64(&sp.remaps) != 1 || mapped() != size() {
+		t.Fatalf("expected the file to be mapped once, whole")
+	}
+	//Blocks written after the file was mapped are read through a new mapping
+	//of the longer file, and the old blocks still read
+	write(5, 50).Unlock()
+	readAll()
+	if atomic.LoadUint64(&sp.remaps) != 2 || mapped() != size() {
+		t.Fatalf("expected the file to be remapped whole once it grew")
+	}
+	//Nothing new reads without a remap
+	reads := sp.Stats().DiskReads
+	readAll()
+	if atomic.LoadUint64(&sp.remaps) != 2 || sp.Stats().DiskReads != reads+uint64(len(written)) {
+		t.Fatalf("expected reads from the existing mapping")
+	}
+	//An aborted segment truncates the file, which must not be mapped past
+	//its new end
+	before := written
+	written = make(map[uint64][]byte)
+	seg := write(3, 100)
+	if err := seg.(*FileProviderSegment).Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	readAll()
+	seg.(*FileProviderSegment).Abort()
+	if mapped() > size() {
+		t.Fatalf("file of %d bytes is mapped to %d", size(), mapped())
+	}
+	written = before
+	readAll()
+	if mapped() != size() {
+		t.Fatalf("expected the truncated file to be mapped again")
+	}
+}
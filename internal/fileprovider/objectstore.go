@@ -0,0 +1,100 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+//Where TieredStorageProvider keeps the parts of the blockstore files it has
+//moved off the local disk. Objects are written once and then only read, a
+//range at a time
+type ObjectStore interface {
+	//Store size bytes read from data under key, replacing any object
+	//already there
+	Put(key string, data io.Reader, size int64) error
+	//Read len(b) bytes of the object from off, like io.ReaderAt
+	GetRange(key string, b []byte, off int64) (int, error)
+}
+
+//An ObjectStore speaking the S3 protocol, or anything else that takes
+//objects with PUT and serves ranges of them with a Range GET
+type HTTPObjectStore struct {
+	//The URL of the bucket, objects are under it by key
+	URL    string
+	Client *http.Client
+	//If set, called on every request before it is sent, to add credentials
+	Sign func(req *http.Request) error
+}
+
+func (s *HTTPObjectStore) url(key string) string {
+	return strings.TrimSuffix(s.URL, "/") + "/" + key
+}
+
+func (s *HTTPObjectStore) do(req *http.Request) (*http.Response, error) {
+	if s.Sign != nil {
+		if err := s.Sign(req); err != nil {
+			return nil, err
+		}
+	}
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+func (s *HTTPObjectStore) Put(key string, data io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", s.url(key), data)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("could not put object %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+func (s *HTTPObjectStore) GetRange(key string, b []byte, off int64) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest("GET", s.url(key), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(b))-1))
+	resp, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, fmt.Errorf("could not get object %s: %s", key, resp.Status)
+	}
+	n, err := io.ReadFull(resp.Body, b)
+	if err == io.ErrUnexpectedEOF {
+		//The object ends before the range does
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHTTPObjectStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PUT":
+			b, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = b
+		case "GET":
+			b, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(b))
+		}
+	}))
+	defer srv.Close()
+	signed := 0
+	store := &HTTPObjectStore{URL: srv.URL + "/bucket/", Sign: func(req *http.Request) error {
+		signed++
+		return nil
+	}}
+	data := mkData(1000, 3)
+	if err := store.Put("obj", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/bucket/obj"]; !ok {
+		t.Fatalf("expected the object to be stored under the bucket")
+	}
+	b := make([]byte, 100)
+	if n, err := store.GetRange("obj", b, 200); n != 100 || err != nil || !bytes.Equal(b, data[200:300]) {
+		t.Fatalf("expected bytes 200 to 300 of the object, got %d bytes: %v", n, err)
+	}
+	if n, err := store.GetRange("obj", b, 950); n != 50 || err != io.EOF || !bytes.Equal(b[:50], data[950:]) {
+		t.Fatalf("expected the last 50 bytes and EOF, got %d bytes: %v", n, err)
+	}
+	if _, err := store.GetRange("missing", b, 0); err == nil {
+		t.Fatalf("expected reading a missing object to fail")
+	}
+	if signed != 4 {
+		t.Fatalf("expected every request to be signed, got %d", signed)
+	}
+}
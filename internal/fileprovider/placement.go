@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+//The number of points each file has on the placement ring. More points give
+//a more even spread of streams over the files
+const RINGPOINTS = 16
+
+type ringpoint struct {
+	hash uint64
+	fidx int
+}
+
+func ringhash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+//Build the consistent hashing ring used when FilesPerStream is set
+func (sp *FileStorageProvider) buildRing() {
+	sp.ring = make([]ringpoint, 0, sp.numfiles*RINGPOINTS)
+	key := make([]byte, 4)
+	for i := 0; i < sp.numfiles; i++ {
+		for v := 0; v < RINGPOINTS; v++ {
+			binary.LittleEndian.PutUint16(key[0:], uint16(i))
+			binary.LittleEndian.PutUint16(key[2:], uint16(v))
+			sp.ring = append(sp.ring, ringpoint{hash: ringhash(key), fidx: i})
+		}
+	}
+	sort.Slice(sp.ring, func(i, j int) bool {
+		return sp.ring[i].hash < sp.ring[j].hash
+	})
+}
+
+//Returns the files a stream's blocks are placed in: the first FilesPerStream
+//distinct files found walking the ring clockwise from the hash of the uuid.
+//This only depends on the uuid and the number of files, so it is stable
+//across restarts
+func (sp *FileStorageProvider) fileSubset(uuid []byte) []int {
+	n := sp.FilesPerStream
+	if n > sp.numfiles {
+		n = sp.numfiles
+	}
+	h := ringhash(uuid)
+	start := sort.Search(len(sp.ring), func(i int) bool {
+		return sp.ring[i].hash >= h
+	})
+	rv := make([]int, 0, n)
+	for i := 0; len(rv) < n; i++ {
+		fidx := sp.ring[(start+i)%len(sp.ring)].fidx
+		dup := false
+		for _, e := range rv {
+			if e == fidx {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			rv = append(rv, fidx)
+		}
+	}
+	return rv
+}
+
+//Whether files are locked from the pool directly with lockSubsetFile, rather
+//than being handed out by the allocators
+func (sp *FileStorageProvider) pooled() bool {
+	return sp.FilesPerStream > 0 || len(sp.SizeClasses) > 0
+}
+
+func (sp *FileStorageProvider) checkSizeClasses() {
+	if len(sp.SizeClasses) >= sp.numfiles {
+		sp.fatal("SizeClasses must have fewer boundaries than there are files", "files", sp.numfiles)
+	}
+	if !sort.IntsAreSorted(sp.SizeClasses) {
+		sp.fatal("SizeClasses must be ascending")
+	}
+}
+
+//Returns the size class of a block, the files of class c are those with
+//fidx % (len(SizeClasses)+1) == c
+func (sp *FileStorageProvider) sizeClass(size int) int {
+	return sort.Search(len(sp.SizeClasses), func(i int) bool {
+		return size < sp.SizeClasses[i]
+	})
+}
+
+//Returns the files a segment for blocks of the given size may lock. If
+//the stream's FilesPerStream subset has no files of the class, the whole
+//subset is used
+func (sp *FileStorageProvider) candidateFiles(uuid []byte, size int) []int {
+	var files []int
+	if sp.FilesPerStream > 0 {
+		files = sp.fileSubset(uuid)
+	} else {
+		files = make([]int, sp.numfiles)
+		for i := range files {
+			files[i] = i
+		}
+	}
+	if len(sp.SizeClasses) == 0 {
+		return files
+	}
+	nclasses := len(sp.SizeClasses) + 1
+	class := sp.sizeClass(size)
+	rv := make([]int, 0, len(files)/nclasses+1)
+	for _, fidx := range files {
+		if fidx%nclasses == class {
+			rv = append(rv, fidx)
+		}
+	}
+	if len(rv) == 0 {
+		return files
+	}
+	return rv
+}
+
+//Used instead of provideFiles when files are pooled. Returned files are
+//marked available and any LockSegment waiting on its subset is woken
+func (sp *FileStorageProvider) returnFiles() {
+	defer sp.bgwg.Done()
+	defer atomic.StoreInt32(&sp.allocstate[0], gsNotRunning)
+	atomic.StoreInt32(&sp.allocstate[0], gsWaiting)
+	for {
+		select {
+		case fi := <-sp.retfidx[0]:
+			sp.favailmu.Lock()
+			sp.favail[fi] = true
+			sp.favailcond.Broadcast()
+			sp.favailmu.Unlock()
+		case <-sp.done:
+			return
+		}
+	}
+}
+
+//Lock the least full available file in the subset, blocking until one is
+//available. Also returns whether it had to block. Gives up with -1 if timeout
+//fires first, as allocate does
+func (sp *FileStorageProvider) lockSubsetFile(subset []int, timeout <-chan time.Time) (int, bool) {
+	sp.favailmu.Lock()
+	defer sp.favailmu.Unlock()
+	blocked := false
+	//Set by the goroutine waiting on the timeout, which wakes the wait
+	expired := false
+	for {
+		minidx, fullidx := -1, -1
+		nfull := 0
+		var minv int64 = 0
+		for _, i := range subset {
+			if !sp.favail[i] {
+				continue
+			}
+			off := atomic.LoadInt64(&sp.committed[i])
+			if sp.fileFull(off) {
+				nfull++
+				fullidx = i
+				continue
+			}
+			if minidx == -1 || off < minv {
+				minidx = i
+				minv = off
+			}
+		}
+		//As in provideFiles, full files are used once there is nothing else
+		if minidx == -1 && nfull == len(subset) {
+			minidx = fullidx
+		}
+		if minidx != -1 {
+			sp.favail[minidx] = false
+			return minidx, blocked
+		}
+		if expired {
+			return -1, true
+		}
+		if !blocked && timeout != nil {
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				select {
+				case <-timeout:
+					sp.favailmu.Lock()
+					expired = true
+					sp.favailcond.Broadcast()
+					sp.favailmu.Unlock()
+				case <-stop:
+				}
+			}()
+		}
+		blocked = true
+		sp.favailcond.Wait()
+	}
+}
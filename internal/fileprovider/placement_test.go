@@ -0,0 +1,399 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestFilesPerStream(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FilesPerStream = 4
+	})
+	defer os.RemoveAll(cfg.dir)
+	ida := uuid.Parse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	idb := uuid.Parse("6ba7b811-9dad-11d1-80b4-00c04fd430c8")
+	subset := sp.fileSubset(ida)
+	if len(subset) != 4 {
+		t.Fatalf("expected a subset of 4 files, got %v", subset)
+	}
+	if fmt.Sprint(subset) == fmt.Sprint(sp.fileSubset(idb)) {
+		t.Fatalf("different uuids mapped to the same subset %v", subset)
+	}
+	insubset := make(map[uint64]bool)
+	for _, fidx := range subset {
+		insubset[uint64(fidx)] = true
+	}
+	used := make(map[uint64]bool)
+	for i := 0; i < 100; i++ {
+		addr := writeOne(t, sp, ida, mkData(100, byte(i)))
+		if !insubset[addr>>50] {
+			t.Fatalf("block %d written to file %d, outside subset %v", i, addr>>50, subset)
+		}
+		used[addr>>50] = true
+	}
+	if len(used) != len(subset) {
+		t.Fatalf("expected writes to spread over the subset, used %d files", len(used))
+	}
+}
+
+func TestShardedAllocators(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.Allocators = 4
+	})
+	defer os.RemoveAll(cfg.dir)
+	var mu sync.Mutex
+	held := make(map[uint64]bool)
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	errs := make(chan string, 1)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := uuid.NewRandom()
+			for i := 0; i < 50; i++ {
+				seg := sp.LockSegment(id)
+				fidx := seg.BaseAddress() >> 50
+				mu.Lock()
+				if held[fidx] {
+					select {
+					case errs <- fmt.Sprintf("file %d handed out twice", fidx):
+					default:
+					}
+				}
+				held[fidx] = true
+				seen[fidx] = true
+				mu.Unlock()
+				seg.Write(id, seg.BaseAddress(), mkData(10, byte(i)))
+				mu.Lock()
+				held[fidx] = false
+				mu.Unlock()
+				seg.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	select {
+	case e := <-errs:
+		t.Fatal(e)
+	default:
+	}
+	shards := make(map[uint64]bool)
+	for fidx := range seen {
+		shards[fidx%4] = true
+	}
+	if len(shards) != 4 {
+		t.Fatalf("expected files from all 4 allocators, got %v", shards)
+	}
+}
+
+func benchmarkLockSegment(b *testing.B, allocators int) {
+	sp, cfg := mkProvider(b, func(sp *FileStorageProvider) {
+		sp.Allocators = allocators
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sp.LockSegment(id).Unlock()
+		}
+	})
+}
+
+func BenchmarkLockSegment1Allocator(b *testing.B) {
+	benchmarkLockSegment(b, 1)
+}
+
+func BenchmarkLockSegment4Allocators(b *testing.B) {
+	benchmarkLockSegment(b, 4)
+}
+
+func TestLeastFullFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 6}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	rnd := rand.New(rand.NewSource(1))
+	//The allocator picks the next file as soon as one is taken, which may be
+	//before or after the last file locked is unlocked, so either may be next
+	least := func(except int) int {
+		rv := -1
+		for f := 0; f < sp.numfiles; f++ {
+			if f != except && (rv == -1 || sp.committed[f] < sp.committed[rv]) {
+				rv = f
+			}
+		}
+		return rv
+	}
+	prev := -1
+	for i := 0; i < 50; i++ {
+		seg := sp.LockSegment(nil)
+		got := int(seg.BaseAddress() >> 50)
+		if got != least(-1) && got != least(prev) {
+			t.Fatalf("lock %d got file %d at %d, expected the least full of %v", i, got, sp.committed[got], sp.committed)
+		}
+		if _, err := seg.Write(nil, seg.BaseAddress(), mkData(1+rnd.Intn(20000), byte(i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := seg.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		prev = got
+	}
+}
+
+func TestSizeClasses(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.SizeClasses = []int{1000, 10000}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	sizes := []int{10, 20000, 999, 1000, 5000, 65000, 100, 9999}
+	classes := []int{0, 2, 0, 1, 1, 2, 0, 1}
+	used := make(map[int]map[uint64]bool)
+	for round := 0; round < 10; round++ {
+		for i, size := range sizes {
+			seg := sp.LockSegmentSized(id, size)
+			data := mkData(size, byte(i+round))
+			addr := seg.BaseAddress()
+			if _, err := seg.Write(id, addr, data); err != nil {
+				t.Fatal(err)
+			}
+			seg.Unlock()
+			if class := int(addr>>50) % 3; class != classes[i] {
+				t.Fatalf("block of %d bytes written to file %d of class %d, expected class %d", size, addr>>50, class, classes[i])
+			}
+			if used[classes[i]] == nil {
+				used[classes[i]] = make(map[uint64]bool)
+			}
+			used[classes[i]][addr>>50] = true
+			got, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE))
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("block of %d bytes did not read back: %v", size, err)
+			}
+		}
+	}
+	for class, files := range used {
+		if len(files) < 2 {
+			t.Fatalf("expected class %d to spread over its files, used %v", class, files)
+		}
+	}
+	//Without a hint, segments are for the smallest blocks
+	addr := writeOne(t, sp, id, mkData(100, 1))
+	if addr>>50%3 != 0 {
+		t.Fatalf("expected an unhinted segment in class 0, got file %d", addr>>50)
+	}
+}
+
+func TestConfiguredFileCount(t *testing.T) {
+	for _, n := range []int{16, 1024} {
+		//Each count in a subtest, so its providers are closed before the next
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "fileprovider")
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(dir) })
+			cfg := &testConfig{dir: dir, files: n}
+			if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+				t.Fatal(err)
+			}
+			sp := &FileStorageProvider{}
+			if err := sp.Initialize(cfg); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { sp.Close() })
+			if len(sp.Stats().Files) != n {
+				t.Fatalf("expected %d files, got %d", n, len(sp.Stats().Files))
+			}
+			//Lock every file, so that one of them is the last
+			id := uuid.NewRandom()
+			var last bprovider.Segment
+			var segs []bprovider.Segment
+			for i := 0; i < n; i++ {
+				seg := sp.LockSegment(id)
+				if seg.BaseAddress()>>50 == uint64(n-1) {
+					last = seg
+				}
+				segs = append(segs, seg)
+			}
+			data := mkData(1000, byte(n))
+			addr := last.BaseAddress()
+			if _, err := last.Write(id, addr, data); err != nil {
+				t.Fatal(err)
+			}
+			for _, seg := range segs {
+				seg.Unlock()
+			}
+			if err := sp.Close(); err != nil {
+				t.Fatal(err)
+			}
+			sp2 := &FileStorageProvider{}
+			if err := sp2.Initialize(cfg); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { sp2.Close() })
+			if got, err := sp2.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("block in file %d of %d did not read back: %v", n-1, n, err)
+			}
+			if _, err := sp2.Read(id, uint64(n)<<50|100, make([]byte, MAXBLOCKSIZE)); err != bprovider.ErrInvalidArgument {
+				t.Fatalf("expected ErrInvalidArgument past the last file, got %v", err)
+			}
+		})
+	}
+	for _, n := range []int{-1, MAXNUMFILES + 1} {
+		dir, err := ioutil.TempDir("", "fileprovider")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		if err := (&FileStorageProvider{}).CreateDatabase(&testConfig{dir: dir, files: n}); err != bprovider.ErrInvalidArgument {
+			t.Fatalf("expected a file count of %d to be rejected, got %v", n, err)
+		}
+	}
+}
+
+func TestAddressSpaceLimit(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	base := seg.ptr
+	data := mkData(100, 1)
+	//Pretend the segment is at the end of the address space. The block would
+	//end exactly at 1<<50, leaving no valid address after it
+	seg.ptr = 1<<50 - seg.sp.recordLen(&writeparams{Data: data})
+	addr := uint64(seg.fidx)<<50 + uint64(seg.ptr)
+	if _, err := seg.Write(id, addr, data); err != bprovider.ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace at the end of the address space, got %v", err)
+	}
+	if seg.ptr+seg.sp.recordLen(&writeparams{Data: data}) != 1<<50 || !sp.fileFull(1<<50-1) {
+		t.Fatalf("expected a full file at the end of the address space")
+	}
+	seg.ptr = base
+	seg.Unlock()
+
+	//Full files are not handed out while others have room
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg2 := &testConfig{dir: dir, files: 2}
+	setup := func(sp *FileStorageProvider) {
+		sp.MaxFileSize = 1000
+	}
+	sp2 := &FileStorageProvider{}
+	setup(sp2)
+	if err := sp2.CreateDatabase(cfg2); err != nil {
+		t.Fatal(err)
+	}
+	sp2 = &FileStorageProvider{}
+	setup(sp2)
+	if err := sp2.Initialize(cfg2); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	seg = sp2.LockSegment(id).(*FileProviderSegment)
+	full := seg.fidx
+	addr = seg.BaseAddress()
+	for {
+		next, err := seg.Write(id, addr, mkData(100, 2))
+		if err == bprovider.ErrNoSpace {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr = next
+	}
+	//Fill the rest with an empty block if there is room for one
+	for !sp2.fileFull(seg.ptr) {
+		if addr, err = seg.Write(id, addr, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg.Unlock()
+	for i := 0; i < 5; i++ {
+		seg := sp2.LockSegment(id).(*FileProviderSegment)
+		if seg.fidx == full {
+			t.Fatalf("full file %d was handed out", full)
+		}
+		seg.Unlock()
+	}
+}
+
+func TestLockSegmentTimeout(t *testing.T) {
+	for _, pooled := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "fileprovider")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		cfg := &testConfig{dir: dir, files: 2}
+		if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+			t.Fatal(err)
+		}
+		sp := &FileStorageProvider{}
+		if pooled {
+			sp.FilesPerStream = 2
+		}
+		if err := sp.Initialize(cfg); err != nil {
+			t.Fatal(err)
+		}
+		id := uuid.NewRandom()
+		held := []bprovider.Segment{sp.LockSegment(id), sp.LockSegment(id)}
+		start := time.Now()
+		seg, err := sp.LockSegmentTimeout(id, 50*time.Millisecond)
+		if err != ErrLockTimeout || seg != nil {
+			t.Fatalf("pooled %v: expected ErrLockTimeout with every file locked, got %v", pooled, err)
+		}
+		if waited := time.Since(start); waited > 5*time.Second {
+			t.Fatalf("pooled %v: timing out took %v", pooled, waited)
+		}
+		//A file unlocked while waiting is taken
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			held[0].Unlock()
+		}()
+		seg, err = sp.LockSegmentTimeout(id, 10*time.Second)
+		if err != nil {
+			t.Fatalf("pooled %v: expected to lock the released file, got %v", pooled, err)
+		}
+		if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 1)); err != nil {
+			t.Fatal(err)
+		}
+		seg.Unlock()
+		held[1].Unlock()
+		sp.Close()
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/BTrDB/btrdb-server/internal/configprovider"
+)
+
+//What creating a database would take, see PlanDatabase
+type DatabasePlan struct {
+	//The files of the database: the blockstore files, in order, then the
+	//metadata log and the superblock log. The superblock log is created when
+	//the provider is first initialized rather than by CreateDatabase
+	Files []string
+	//The inodes the files take
+	Inodes int
+	//The free space needed to create the database and start writing to it:
+	//the headers of the blockstore files, a chunk of PreallocateBytes for
+	//each and MinFreeBytes. With several storage volumes MinFreeBytes is
+	//needed on each of them, so this is only the total
+	Bytes int64
+}
+
+//Check the configuration as CreateDatabase would and return what it would
+//create, without creating anything. Returns an error if a storage directory
+//can't be used, or ErrExists if any of the files already exist
+func (sp *FileStorageProvider) PlanDatabase(cfg configprovider.Configuration) (DatabasePlan, error) {
+	plan := DatabasePlan{}
+	if _, err := sp.newFormat(cfg); err != nil {
+		return plan, err
+	}
+	numfiles, err := fileCount(cfg)
+	if err != nil {
+		return plan, err
+	}
+	dirs := blockRoots(cfg)
+	if len(cfg.StorageFilepaths()) > 0 {
+		dirs = append(dirs, cfg.StorageFilepath())
+	}
+	for _, dir := range dirs {
+		st, err := os.Stat(dir)
+		if err != nil {
+			return plan, err
+		}
+		if !st.IsDir() {
+			return plan, fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	roots := blockRoots(cfg)
+	for i := 0; i < numfiles; i++ {
+		plan.Files = append(plan.Files, blockPath(roots, i))
+	}
+	plan.Files = append(plan.Files, metadataPath(cfg.StorageFilepath()), superblockPath(cfg.StorageFilepath()))
+	for _, fname := range plan.Files {
+		if _, err := os.Stat(fname); err == nil {
+			return plan, bprovider.ErrExists
+		} else if !os.IsNotExist(err) {
+			return plan, err
+		}
+	}
+	plan.Inodes = len(plan.Files)
+	headers := int64(len(FILETAG) + FORMATHEADERLEN)
+	if sp.PreallocateBytes > 0 {
+		headers += sp.PreallocateBytes
+	}
+	plan.Bytes = int64(numfiles)*headers + int64(sp.MinFreeBytes)
+	return plan, nil
+}
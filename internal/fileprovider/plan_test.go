@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+func TestPlanDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 4}
+	sp := &FileStorageProvider{PreallocateBytes: 1 << 20}
+	plan, err := sp.PlanDatabase(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		dir + "/blockstore.00.db",
+		dir + "/blockstore.01.db",
+		dir + "/blockstore.02.db",
+		dir + "/blockstore.03.db",
+		dir + "/metadata.log",
+		dir + "/superblocks.log",
+	}
+	if !reflect.DeepEqual(plan.Files, expected) {
+		t.Fatalf("planned files %v, expected %v", plan.Files, expected)
+	}
+	if plan.Inodes != len(expected) {
+		t.Fatalf("planned %d inodes, expected %d", plan.Inodes, len(expected))
+	}
+	if want := int64(4 * (len(FILETAG) + FORMATHEADERLEN + 1<<20)); plan.Bytes != want {
+		t.Fatalf("planned %d bytes, expected %d", plan.Bytes, want)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Fatalf("planning created %d files", len(names))
+	}
+	if err := sp.CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sp.PlanDatabase(cfg); err != bprovider.ErrExists {
+		t.Fatalf("expected ErrExists for an existing database, got %v", err)
+	}
+	if _, err := sp.PlanDatabase(&testConfig{dir: dir + "/missing"}); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing directory to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import "sync"
+
+//With PreallocateBytes, disk space is reserved for each file a chunk of that
+//many bytes at a time, ahead of the blocks written to it, so that the file
+//is laid out in large extents rather than a fragment per append and most
+//writes don't extend it. Space is reserved without changing the size of the
+//file, which is still the end of the last block. Reservations are not
+//remembered across restarts, reserving space that is already reserved just
+//costs a syscall. Where space can't be reserved (see fallocate), writes go
+//ahead without it
+
+//How far space has been reserved in a file
+type preallocstate struct {
+	mu  sync.Mutex
+	end int64
+	//Set once reserving space has failed, so it is not tried again
+	failed bool
+}
+
+//Make sure space is reserved for a write ending at end, reserving up to the
+//end of the next chunk if it is not
+func (sp *FileStorageProvider) preallocate(fidx int, end int64) {
+	chunk := sp.PreallocateBytes
+	if chunk <= 0 {
+		return
+	}
+	pa := &sp.preallocs[fidx]
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.failed || end <= pa.end {
+		return
+	}
+	target := (end/chunk + 1) * chunk
+	if target > sp.maxFileSize() {
+		target = sp.maxFileSize()
+	}
+	if target <= pa.end {
+		return
+	}
+	if err := fallocate(sp.dbf[fidx], pa.end, target-pa.end); err != nil {
+		sp.logger().Warn("Could not preallocate space for blockstore file", "file", fidx, "err", err)
+		pa.failed = true
+		return
+	}
+	pa.end = target
+}
+
+//Forget the space reserved for a file, which truncating it frees
+func (sp *FileStorageProvider) resetPrealloc(fidx int) {
+	pa := &sp.preallocs[fidx]
+	pa.mu.Lock()
+	pa.end = 0
+	pa.mu.Unlock()
+}
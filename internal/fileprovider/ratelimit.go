@@ -0,0 +1,47 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync"
+	"time"
+)
+
+//A byte budget shared between any number of goroutines. Each caller reserves
+//its bytes and sleeps until the budget allows them, so the aggregate rate
+//stays under the limit however many workers there are
+type ratelimiter struct {
+	mu sync.Mutex
+	//Bytes per second, zero means unlimited
+	rate int64
+	//When the budget next has room
+	next time.Time
+}
+
+func newRateLimiter(rate int64) *ratelimiter {
+	return &ratelimiter{rate: rate}
+}
+
+//Block until n more bytes fit within the budget
+func (r *ratelimiter) take(n int64) {
+	if r == nil || r.rate <= 0 {
+		return
+	}
+	r.mu.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now)
+	r.next = r.next.Add(time.Duration(n * int64(time.Second) / r.rate))
+	r.mu.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+//Returns a buffer that Read can read any block of this database into, from a
+//pool so that callers need not allocate one per read. Give it back with
+//PutReadBuffer once the data read into it is no longer used
+func (sp *FileStorageProvider) GetReadBuffer() []byte {
+	if b, ok := sp.readbufs.Get().([]byte); ok {
+		return b
+	}
+	return make([]byte, sp.maxBlockSize())
+}
+
+//Return a buffer from GetReadBuffer to the pool. This must be the buffer
+//itself, not the data Read returned in it. Buffers too small for any block
+//are dropped
+func (sp *FileStorageProvider) PutReadBuffer(b []byte) {
+	if cap(b) < sp.maxBlockSize() {
+		return
+	}
+	sp.readbufs.Put(b[:cap(b)])
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestReadBufferPool(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	data := mkData(65535, 3)
+	if _, err := seg.Write(id, addr, data); err != nil {
+		t.Fatal(err)
+	}
+	seg.Unlock()
+	//A buffer too small for even the header is refused, not sliced past
+	if _, err := sp.Read(id, addr, make([]byte, 1)); err == nil {
+		t.Fatalf("expected a read into a 1 byte buffer to fail")
+	} else if e, ok := err.(bprovider.ErrBufferTooSmall); !ok || e.Need != SPANHEADERLEN {
+		t.Fatalf("expected ErrBufferTooSmall needing %d bytes, got %v", SPANHEADERLEN, err)
+	}
+	//Pool buffers hold the largest block
+	buf := sp.GetReadBuffer()
+	got, err := sp.Read(id, addr, buf)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("could not read into a pool buffer: %v", err)
+	}
+	//Buffers are reused, whatever they were resliced to. The pool may drop
+	//any of them, so only some reuse is expected
+	reused := false
+	for i := 0; i < 20 && !reused; i++ {
+		sp.PutReadBuffer(buf[:10])
+		next := sp.GetReadBuffer()
+		if len(next) != sp.maxBlockSize() {
+			t.Fatalf("expected a buffer of %d bytes, got %d", sp.maxBlockSize(), len(next))
+		}
+		reused = &next[0] == &buf[0]
+		buf = next
+	}
+	if !reused {
+		t.Fatalf("no buffer was reused")
+	}
+	//Small buffers are not pooled
+	sp.PutReadBuffer(make([]byte, FIRSTREAD))
+	if b := sp.GetReadBuffer(); len(b) != sp.maxBlockSize() {
+		t.Fatalf("expected a buffer of %d bytes, got %d", sp.maxBlockSize(), len(b))
+	}
+}
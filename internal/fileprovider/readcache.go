@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//An LRU cache of block data by address, in front of Read. It is bounded by
+//the bytes of data it holds, as StorageReadCacheBytes in the configuration.
+//The data is as stored, before the PostRead hook, and has been checked
+//against its checksum. Blocks are also put in the cache as they are written
+type readcache struct {
+	mu      sync.Mutex
+	items   map[uint64]*rcitem
+	oldest  *rcitem
+	newest  *rcitem
+	size    int64
+	maxsize int64
+	hits    uint64
+	misses  uint64
+}
+
+type rcitem struct {
+	val   []byte
+	addr  uint64
+	newer *rcitem
+	older *rcitem
+}
+
+func (rc *readcache) init(maxsize int64) {
+	rc.maxsize = maxsize
+	rc.items = make(map[uint64]*rcitem)
+}
+
+//Must be called with the mutex held
+func (rc *readcache) unlink(i *rcitem) {
+	if i.newer != nil {
+		i.newer.older = i.older
+	} else {
+		rc.newest = i.older
+	}
+	if i.older != nil {
+		i.older.newer = i.newer
+	} else {
+		rc.oldest = i.newer
+	}
+	i.newer, i.older = nil, nil
+}
+
+//Must be called with the mutex held
+func (rc *readcache) pushNewest(i *rcitem) {
+	i.older = rc.newest
+	if rc.newest != nil {
+		rc.newest.newer = i
+	}
+	rc.newest = i
+	if rc.oldest == nil {
+		rc.oldest = i
+	}
+}
+
+//Cache a copy of the data of the block at the given address
+func (rc *readcache) put(addr uint64, data []byte) {
+	if rc.maxsize <= 0 || int64(len(data)) > rc.maxsize {
+		return
+	}
+	val := make([]byte, len(data))
+	copy(val, data)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if i, ok := rc.items[addr]; ok {
+		rc.unlink(i)
+		rc.size -= int64(len(i.val))
+		delete(rc.items, addr)
+	}
+	i := &rcitem{val: val, addr: addr}
+	rc.items[addr] = i
+	rc.pushNewest(i)
+	rc.size += int64(len(val))
+	for rc.size > rc.maxsize {
+		old := rc.oldest
+		rc.unlink(old)
+		rc.size -= int64(len(old.val))
+		delete(rc.items, old.addr)
+	}
+}
+
+//Returns the cached data of the block at the given address, or nil. The
+//returned slice must not be modified
+func (rc *readcache) get(addr uint64) []byte {
+	if rc.maxsize <= 0 {
+		return nil
+	}
+	rc.mu.Lock()
+	i, ok := rc.items[addr]
+	if ok {
+		rc.unlink(i)
+		rc.pushNewest(i)
+	}
+	rc.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&rc.misses, 1)
+		return nil
+	}
+	atomic.AddUint64(&rc.hits, 1)
+	return i.val
+}
+
+//Drop the blocks at the given addresses, or every block of the given file
+//if addrs is nil
+func (rc *readcache) invalidate(fidx int, addrs []uint64) {
+	if rc.maxsize <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	drop := func(i *rcitem) {
+		rc.unlink(i)
+		rc.size -= int64(len(i.val))
+		delete(rc.items, i.addr)
+	}
+	if addrs != nil {
+		for _, addr := range addrs {
+			if i, ok := rc.items[addr]; ok {
+				drop(i)
+			}
+		}
+		return
+	}
+	for addr, i := range rc.items {
+		if afidx, _ := bprovider.DecodeAddress(addr); afidx == fidx {
+			drop(i)
+		}
+	}
+}
+
+//Copy cached data into the buffer the caller gave Read, which must be large
+//enough for the block as it would be read from disk
+func (sp *FileStorageProvider) fromCache(data []byte, buffer []byte) ([]byte, error) {
+	if len(data) > len(buffer) {
+		if !sp.GrowSmallBuffers {
+			return nil, bprovider.ErrBufferTooSmall{Need: len(data) + int(sp.blockOverhead())}
+		}
+		buffer = make([]byte, len(data))
+	}
+	return buffer[:copy(buffer, data)], nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestReadCache(t *testing.T) {
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.readCache = 1000
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	id := uuid.NewRandom()
+	data := mkData(100, 1)
+	addr := writeOne(t, sp, id, data)
+
+	//The written block is served from the cache, even once the copy on disk
+	//is corrupted
+	corruptBlock(t, cfg, addr, 10)
+	for i := 0; i < 2; i++ {
+		rv, err := sp.Read(id, addr, make([]byte, 200))
+		if err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+		if !bytes.Equal(rv, data) {
+			t.Fatalf("read returned the wrong data")
+		}
+	}
+	if st := sp.Stats(); st.CacheHits != 2 || st.CacheMisses != 0 {
+		t.Fatalf("expected 2 hits and no misses, got %d and %d", st.CacheHits, st.CacheMisses)
+	}
+
+	//Older blocks are evicted to keep the cache within its size
+	seg := sp.LockSegment(id)
+	next := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i < 20; i++ {
+		addrs = append(addrs, next)
+		var err error
+		next, err = seg.Write(id, next, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sp.rcache.size > sp.rcache.maxsize {
+			t.Fatalf("cache holds %d bytes, more than %d", sp.rcache.size, sp.rcache.maxsize)
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if sp.rcache.get(addr) != nil || sp.rcache.get(addrs[0]) != nil {
+		t.Fatalf("expected the oldest blocks to be evicted")
+	}
+	for i, a := range addrs {
+		rv, err := sp.Read(id, a, make([]byte, 200))
+		if err != nil {
+			t.Fatalf("unexpected read error: %v", err)
+		}
+		if !bytes.Equal(rv, mkData(100, byte(i))) {
+			t.Fatalf("read of block %d returned the wrong data", i)
+		}
+	}
+	if sp.rcache.size > sp.rcache.maxsize {
+		t.Fatalf("cache holds %d bytes, more than %d", sp.rcache.size, sp.rcache.maxsize)
+	}
+
+	//Blocks of an aborted segment are dropped
+	fseg := sp.LockSegment(id).(*FileProviderSegment)
+	aborted := fseg.BaseAddress()
+	if _, err := fseg.Write(id, aborted, mkData(100, 7)); err != nil {
+		t.Fatal(err)
+	}
+	fseg.Abort()
+	if sp.rcache.get(aborted) != nil {
+		t.Fatalf("expected aborted block to be dropped from the cache")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//How the metadata and superblock logs are opened. A read-only provider
+//neither writes them nor creates them if they are missing
+func (sp *FileStorageProvider) openFlags() int {
+	if sp.ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR | os.O_CREATE
+}
+
+//What LockSegment returns on a read-only provider, see ReadOnly. There are
+//no files to hand out, so it holds none and every write to it fails
+type readonlySegment struct{}
+
+//Always zero, which no block can have
+func (readonlySegment) BaseAddress() uint64 {
+	return 0
+}
+
+func (readonlySegment) Unlock() error {
+	return nil
+}
+
+func (readonlySegment) Write(uuid []byte, address uint64, data []byte) (uint64, error) {
+	return 0, bprovider.ErrReadOnly
+}
+
+func (readonlySegment) Flush() error {
+	return nil
+}
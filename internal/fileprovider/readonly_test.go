@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestReadOnly(t *testing.T) {
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewRandom()
+	if err := sp.CreateStream(id, "test/coll", nil, []byte("ann")); err != nil {
+		t.Fatal(err)
+	}
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	fidx := seg.fidx
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	for i := 0; i < 5; i++ {
+		addrs = append(addrs, addr)
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//A torn block at the end is left for a writer to deal with
+	fname := blockPath(sp.dbroots, fidx)
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0xFF, 0x00, 1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Several read-only providers can share the database
+	var ros []*FileStorageProvider
+	for i := 0; i < 2; i++ {
+		ro := &FileStorageProvider{ReadOnly: true}
+		if err := ro.Initialize(cfg); err != nil {
+			t.Fatal(err)
+		}
+		defer ro.Close()
+		ros = append(ros, ro)
+	}
+	for _, ro := range ros {
+		for i, a := range addrs {
+			d, err := ro.Read(id, a, make([]byte, 200))
+			if err != nil || !bytes.Equal(d, mkData(100, byte(i))) {
+				t.Fatalf("block %d did not read back: %v", i, err)
+			}
+		}
+		if ann, _, err := ro.GetStreamAnnotation(id); err != nil || string(ann) != "ann" {
+			t.Fatalf("unexpected annotation %q (%v)", ann, err)
+		}
+		seg := ro.LockSegment(id)
+		if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 9)); err != bprovider.ErrReadOnly {
+			t.Fatalf("expected ErrReadOnly, got %v", err)
+		}
+		if err := seg.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if err := ro.CreateStream(uuid.NewRandom(), "test/coll", nil, nil); err == nil {
+			t.Fatalf("expected creating a stream to fail")
+		}
+		if _, err := ro.CompactFile(fidx, nil); err != bprovider.ErrReadOnly {
+			t.Fatalf("expected compaction to fail with ErrReadOnly, got %v", err)
+		}
+	}
+	after, err := os.Stat(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Size() != before.Size() || !after.ModTime().Equal(before.ModTime()) {
+		t.Fatalf("read-only providers changed the file")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+//A crash can leave a file ending in part of a block: a length prefix with
+//only some (or none) of its data after it, or data that never fully reached
+//the disk. Nothing ever refers to such a block, as its segment was never
+//unlocked, but the next block written to the file would follow it.
+//Initialize finds the end of the last complete block in each file and
+//truncates what is after it
+
+//Returns the end of the last complete block in the given file, which is size
+//bytes long. The whole file is walked, reading only the header of each
+//block, and the last block is checked against its checksum and, if the
+//format has them, for its sentinel
+func (sp *FileStorageProvider) recoverFile(fidx int, size int64) (int64, error) {
+	f := sp.dbrf[fidx]
+	hdr := make([]byte, SPANHEADERLEN)
+	off := sp.datastart
+	//Migrated ranges are not on the local disk, see tiered.go
+	if sp.tier != nil {
+		if end := sp.tier.migratedEnd(fidx); end > off {
+			off = end
+		}
+	}
+	for off < size {
+		n, err := f.ReadAt(hdr, off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		_, meta, _ := sp.decodeRecord(hdr[:n])
+		//The length is zero if the header itself is incomplete
+		if meta.reclen == 0 || off+meta.reclen > size {
+			return off, nil
+		}
+		if off+meta.reclen == size && sp.format&(FormatCRC|FormatSentinel) != 0 {
+			rec := make([]byte, meta.reclen)
+			if _, err := f.ReadAt(rec, off); err != nil {
+				return 0, err
+			}
+			//A missing sentinel means the block was torn, whatever its data
+			data, meta, _ := sp.decodeRecord(rec)
+			if meta.torn || sp.format&FormatCRC != 0 && crc32.Checksum(data, crctab) != meta.crc {
+				return off, nil
+			}
+		}
+		off += meta.reclen
+	}
+	return off, nil
+}
+
+//Truncate the given file after its last complete block, see recoverFile.
+//Returns the new size
+func (sp *FileStorageProvider) recoverTail(fidx int, size int64) int64 {
+	end, err := sp.recoverFile(fidx, size)
+	if err != nil {
+		sp.fatal("Could not check the end of blockstore file", "file", fidx, "err", err)
+	}
+	if end == size {
+		return size
+	}
+	sp.logger().Warn("Blockstore file ends in an incomplete block, truncating it", "file", fidx, "size", size, "end", end)
+	if err := sp.dbf[fidx].Truncate(end); err != nil {
+		sp.fatal("Could not truncate blockstore file", "file", fidx, "err", err)
+	}
+	if _, err := sp.dbf[fidx].Seek(end, os.SEEK_SET); err != nil {
+		sp.fatal("Problem with blockstore DB", "err", err)
+	}
+	return end
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestRecoverTornWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//A single file, so that every segment is in it
+	cfg := &testConfig{dir: dir, files: 1}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	fname := dir + "/blockstore.00.db"
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewRandom()
+	var addrs []uint64
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, writeOne(t, sp, id, mkData(100, byte(i))))
+	}
+	sp.Close()
+	good, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := int64(addrs[2] & ((1 << 50) - 1))
+	record := good[last:]
+	for _, tc := range []struct {
+		name     string
+		contents []byte
+		end      int64
+	}{
+		{"complete", good, int64(len(good))},
+		{"ending in a length prefix", append(append([]byte{}, good...), record[:2]...), int64(len(good))},
+		{"ending in part of a block", append(append([]byte{}, good...), record[:50]...), int64(len(good))},
+		{"missing the end of its last block", good[:len(good)-10], last},
+		{"ending in a block with a bad checksum", append(append([]byte{}, good[:len(good)-1]...), good[len(good)-1]^0xFF), last},
+	} {
+		if err := ioutil.WriteFile(fname, tc.contents, 0666); err != nil {
+			t.Fatal(err)
+		}
+		sp := &FileStorageProvider{}
+		if err := sp.Initialize(cfg); err != nil {
+			t.Fatal(err)
+		}
+		if off := sp.Stats().Offsets[0]; off != tc.end {
+			t.Fatalf("file %s: expected recovery to %d bytes, got %d", tc.name, tc.end, off)
+		}
+		if fi, err := os.Stat(fname); err != nil || fi.Size() != tc.end {
+			t.Fatalf("file %s: expected it to be truncated to %d bytes", tc.name, tc.end)
+		}
+		//Blocks before the end still read, and the next segment starts there
+		for i, a := range addrs {
+			if int64(a&((1<<50)-1)) >= tc.end {
+				break
+			}
+			if got, err := sp.Read(id, a, make([]byte, 200)); err != nil || !bytes.Equal(got, mkData(100, byte(i))) {
+				t.Fatalf("file %s: unexpected block %d: %v", tc.name, i, err)
+			}
+		}
+		seg := sp.LockSegment(id)
+		if seg.BaseAddress() != uint64(tc.end) {
+			t.Fatalf("file %s: expected the next segment at %d, got %d", tc.name, tc.end, seg.BaseAddress())
+		}
+		seg.Unlock()
+		sp.Close()
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//A dump is a sequence of frames, each a header of
+//  [1 byte kind][2 byte file index][8 byte offset][4 byte length]
+//followed by length bytes of data and a 4 byte CRC32C of the data. All
+//integers are little endian. Block frames carry raw byte ranges of the
+//blockstore files and metadata frames carry whole records of the metadata
+//log, so the replica ends up with identical files and every address stays
+//valid. Because each frame says where its data goes, a restore that was
+//interrupted can be resumed by dumping from the replica's Watermark.
+const (
+	frHeader = iota + 1
+	frMeta
+	frBlocks
+	frEnd
+)
+
+const FRAMEHEADERLEN = 15
+
+//The amount of data put in a frame, a metadata frame may be larger if a
+//single record is
+const DUMPCHUNK = 1 << 20
+
+//How much of the database a replica holds. The zero value holds nothing
+type Watermark struct {
+	//The end of the data in each file
+	Files []int64
+	//The end of the metadata log
+	Meta int64
+}
+
+//Returns the watermark of everything written so far. Version changes that are
+//batched and not yet flushed are not included
+func (sp *FileStorageProvider) Watermark() Watermark {
+	rv := Watermark{Files: make([]int64, sp.numfiles)}
+	for i := range rv.Files {
+		rv.Files[i] = atomic.LoadInt64(&sp.committed[i])
+	}
+	sp.metamu.RLock()
+	rv.Meta = sp.metaend
+	sp.metamu.RUnlock()
+	return rv
+}
+
+func writeFrame(w io.Writer, kind int, fidx int, off int64, data []byte) error {
+	hdr := make([]byte, FRAMEHEADERLEN)
+	hdr[0] = byte(kind)
+	binary.LittleEndian.PutUint16(hdr[1:], uint16(fidx))
+	binary.LittleEndian.PutUint64(hdr[3:], uint64(off))
+	binary.LittleEndian.PutUint32(hdr[11:], uint32(len(data)))
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.Checksum(data, crctab))
+	for _, b := range [][]byte{hdr, data, crc} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readFrame(r io.Reader) (kind int, fidx int, off int64, data []byte, err error) {
+	hdr := make([]byte, FRAMEHEADERLEN)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	kind = int(hdr[0])
+	fidx = int(binary.LittleEndian.Uint16(hdr[1:]))
+	off = int64(binary.LittleEndian.Uint64(hdr[3:]))
+	dlen := binary.LittleEndian.Uint32(hdr[11:])
+	if dlen > 64*DUMPCHUNK {
+		err = fmt.Errorf("dump frame of %d bytes is too large", dlen)
+		return
+	}
+	data = make([]byte, dlen+4)
+	if _, err = io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	crc := binary.LittleEndian.Uint32(data[dlen:])
+	data = data[:dlen]
+	if crc32.Checksum(data, crctab) != crc {
+		err = fmt.Errorf("dump frame at file %d offset %d fails its checksum", fidx, off)
+	}
+	return
+}
+
+//Write everything after the given watermark to w, in a form StreamRestore
+//can apply to a replica. Pass the zero Watermark for a full dump
+func (sp *FileStorageProvider) StreamDump(w io.Writer, since Watermark) error {
+	_, err := sp.dump(w, since)
+	return err
+}
+
+//Like StreamDump, but returns the watermark the dump goes up to
+func (sp *FileStorageProvider) dump(w io.Writer, since Watermark) (Watermark, error) {
+	upto := sp.Watermark()
+	hdr := make([]byte, 10)
+	binary.LittleEndian.PutUint16(hdr, sp.format)
+	binary.LittleEndian.PutUint64(hdr[2:], uint64(sp.datastart))
+	if err := writeFrame(w, frHeader, 0, 0, hdr); err != nil {
+		return upto, err
+	}
+
+	//The log is append only, so the records before upto.Meta can be read
+	//without holding metamu
+	off := since.Meta
+	for off < upto.Meta {
+		end := off
+		for end < upto.Meta && end-off < DUMPCHUNK {
+			_, next, err := sp.readMetaRecord(end)
+			if err != nil {
+				return upto, fmt.Errorf("could not read metadata log at %d: %v", end, err)
+			}
+			end = next
+		}
+		buf := make([]byte, end-off)
+		if _, err := sp.metaf.ReadAt(buf, off); err != nil {
+			return upto, err
+		}
+		if err := writeFrame(w, frMeta, 0, off, buf); err != nil {
+			return upto, err
+		}
+		off = end
+	}
+
+	buf := make([]byte, DUMPCHUNK)
+	for fidx := 0; fidx < sp.numfiles; fidx++ {
+		off := sp.datastart
+		if fidx < len(since.Files) && since.Files[fidx] > off {
+			off = since.Files[fidx]
+		}
+		for off < upto.Files[fidx] {
+			n := upto.Files[fidx] - off
+			if n > DUMPCHUNK {
+				n = DUMPCHUNK
+			}
+			sp.dbrf_mtx[fidx].RLock()
+			_, err := sp.readAt(fidx, buf[:n], off)
+			sp.dbrf_mtx[fidx].RUnlock()
+			if err != nil {
+				atomic.AddUint64(&sp.errs.read[fidx], 1)
+				return upto, err
+			}
+			if err := writeFrame(w, frBlocks, fidx, off, buf[:n]); err != nil {
+				return upto, err
+			}
+			off += n
+		}
+	}
+	return upto, writeFrame(w, frEnd, 0, 0, nil)
+}
+
+//Apply a dump produced by StreamDump. The replica must have been created
+//with the same format as the source and must not be written to while this
+//runs. Anything the replica already holds is skipped, so if this returns an
+//error the restore can be resumed with a dump from the replica's Watermark
+func (sp *FileStorageProvider) StreamRestore(r io.Reader) error {
+	if sp.ReadOnly {
+		return bprovider.ErrReadOnly
+	}
+	kind, _, _, data, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if kind != frHeader || len(data) != 10 {
+		return fmt.Errorf("dump does not start with a header")
+	}
+	format := binary.LittleEndian.Uint16(data)
+	datastart := int64(binary.LittleEndian.Uint64(data[2:]))
+	if format != sp.format || datastart != sp.datastart {
+		return fmt.Errorf("dump has format %x, expected %x", format, sp.format)
+	}
+	touched := make(map[int]bool)
+	for {
+		kind, fidx, off, data, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		switch kind {
+		case frMeta:
+			if err := sp.restoreMeta(off, data); err != nil {
+				return err
+			}
+		case frBlocks:
+			if fidx >= sp.numfiles {
+				return fmt.Errorf("dump refers to file %d", fidx)
+			}
+			if err := sp.restoreBlocks(fidx, off, data); err != nil {
+				return err
+			}
+			touched[fidx] = true
+		case frEnd:
+			for fidx := range touched {
+				if err := datasync(sp.dbf[fidx]); err != nil {
+					atomic.AddUint64(&sp.errs.write[fidx], 1)
+					return err
+				}
+			}
+			return nil
+		default:
+			return fmt.Errorf("unknown dump frame kind %d", kind)
+		}
+	}
+}
+
+func (sp *FileStorageProvider) restoreMeta(off int64, data []byte) error {
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	end := off + int64(len(data))
+	if off > sp.metaend {
+		return fmt.Errorf("dump skips metadata log from %d to %d", sp.metaend, off)
+	}
+	if end <= sp.metaend {
+		return nil
+	}
+	start := sp.metaend
+	_, err := sp.metaf.WriteAt(data[start-off:], start)
+	if err == nil {
+		err = sp.metaf.Sync()
+	}
+	if err != nil {
+		return err
+	}
+	for sp.metaend < end {
+		rec, next, err := sp.readMetaRecord(sp.metaend)
+		if err != nil {
+			return fmt.Errorf("restored metadata log is invalid at %d: %v", sp.metaend, err)
+		}
+		sp.applyMetaRecord(rec, sp.metaend)
+		sp.metaend = next
+		sp.maybeRebuildMetaIndex()
+	}
+	return nil
+}
+
+func (sp *FileStorageProvider) restoreBlocks(fidx int, off int64, data []byte) error {
+	have := atomic.LoadInt64(&sp.committed[fidx])
+	end := off + int64(len(data))
+	if off > have {
+		return fmt.Errorf("dump skips file %d from %d to %d", fidx, have, off)
+	}
+	if end <= have {
+		return nil
+	}
+	_, err := sp.dbf[fidx].WriteAt(data[have-off:], have)
+	if err != nil {
+		atomic.AddUint64(&sp.errs.write[fidx], 1)
+		return err
+	}
+	sp.setCommitted(fidx, end)
+	return nil
+}
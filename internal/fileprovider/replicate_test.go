@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestStreamDumpRestore(t *testing.T) {
+	src, srccfg := mkProvider(t, nil)
+	defer os.RemoveAll(srccfg.dir)
+	dst, dstcfg := mkProvider(t, nil)
+	defer os.RemoveAll(dstcfg.dir)
+
+	ids := []uuid.UUID{uuid.NewRandom(), uuid.NewRandom()}
+	addrs := make(map[uint64][]byte)
+	populate := func(round int) {
+		for i, id := range ids {
+			if round == 0 {
+				tags := map[string]string{"name": fmt.Sprint(i)}
+				if err := src.CreateStream(id, "dump/test", tags, []byte("a")); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := src.SetStreamAnnotation(id, uint64(round), []byte(fmt.Sprint("a", round))); err != nil {
+				t.Fatal(err)
+			}
+			src.SetStreamVersion(id, uint64(round+10))
+			for j := 0; j < 20; j++ {
+				d := mkData(50+j*100, byte(round*40+j))
+				addrs[writeOne(t, src, id, d)] = d
+			}
+		}
+	}
+	checkParity := func() {
+		buf := make([]byte, MAXBLOCKSIZE)
+		for addr, d := range addrs {
+			got, err := dst.Read(nil, addr, buf)
+			if err != nil || !bytes.Equal(got, d) {
+				t.Fatalf("block %x differs on replica (%v)", addr, err)
+			}
+		}
+		for _, id := range ids {
+			sa, sav, _ := src.GetStreamAnnotation(id)
+			da, dav, err := dst.GetStreamAnnotation(id)
+			if err != nil || !bytes.Equal(sa, da) || sav != dav {
+				t.Fatalf("annotation differs on replica (%v)", err)
+			}
+			if src.GetStreamVersion(id) != dst.GetStreamVersion(id) {
+				t.Fatalf("version differs on replica")
+			}
+		}
+		sl, _ := src.ListStreams("dump/test", true, nil)
+		dl, _ := dst.ListStreams("dump/test", true, nil)
+		if len(sl) != len(dl) {
+			t.Fatalf("replica has %d streams, expected %d", len(dl), len(sl))
+		}
+	}
+
+	populate(0)
+	var full bytes.Buffer
+	if err := src.StreamDump(&full, Watermark{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dst.StreamRestore(&full); err != nil {
+		t.Fatal(err)
+	}
+	checkParity()
+
+	//An incremental dump that is cut off part way can be resumed
+	populate(1)
+	var incr bytes.Buffer
+	if err := src.StreamDump(&incr, dst.Watermark()); err != nil {
+		t.Fatal(err)
+	}
+	cut := bytes.NewReader(incr.Bytes()[:incr.Len()/2])
+	if err := dst.StreamRestore(cut); err == nil {
+		t.Fatalf("expected truncated dump to fail")
+	}
+	var rest bytes.Buffer
+	if err := src.StreamDump(&rest, dst.Watermark()); err != nil {
+		t.Fatal(err)
+	}
+	if rest.Len() >= incr.Len() {
+		t.Fatalf("resumed dump should not repeat restored data")
+	}
+	if err := dst.StreamRestore(&rest); err != nil {
+		t.Fatal(err)
+	}
+	checkParity()
+	if fmt.Sprint(src.Watermark()) != fmt.Sprint(dst.Watermark()) {
+		t.Fatalf("watermarks differ after restore")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/BTrDB/btrdb-server/internal/configprovider"
+)
+
+//Like CreateDatabase, but files that already exist are kept, so that it can
+//be run again to finish creating a database after it was interrupted, or on
+//a database that is already complete. An existing blockstore file must begin
+//with the tag and format header CreateDatabase would give it, or only part
+//of them, in which case the rest is written. Any other file is an error
+func (sp *FileStorageProvider) CreateDatabaseIfMissing(cfg configprovider.Configuration) error {
+	return sp.createDatabase(cfg, true)
+}
+
+//Check that an existing blockstore file begins as one created with the given
+//format flags would, completing the header of a file that was cut short
+func completeFile(fname string, flags uint16) error {
+	hdr := append([]byte(FILETAG), encodeFormatHeader(flags)...)
+	f, err := os.OpenFile(fname, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	have := make([]byte, len(hdr))
+	n, err := f.ReadAt(have, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return err
+	}
+	if !bytes.Equal(have[:n], hdr[:n]) {
+		f.Close()
+		return fmt.Errorf("%s exists but is not a blockstore file of this database", fname)
+	}
+	if n < len(hdr) {
+		if _, err := f.WriteAt(hdr[n:], int64(n)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
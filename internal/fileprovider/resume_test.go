@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestCreateDatabaseIfMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 4}
+	hdr := append([]byte(FILETAG), encodeFormatHeader(FormatCRC)...)
+	//As an interrupted CreateDatabase would leave it: one file complete, one
+	//with only its tag and the rest missing
+	if err := ioutil.WriteFile(blockPath([]string{dir}, 0), hdr, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blockPath([]string{dir}, 1), []byte(FILETAG), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != bprovider.ErrExists {
+		t.Fatalf("expected ErrExists, got %v", err)
+	}
+	for pass := 0; pass < 2; pass++ {
+		if err := (&FileStorageProvider{}).CreateDatabaseIfMissing(cfg); err != nil {
+			t.Fatalf("pass %d: %v", pass, err)
+		}
+		for i := 0; i < 4; i++ {
+			body, err := ioutil.ReadFile(blockPath([]string{dir}, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, hdr) {
+				t.Fatalf("pass %d: file %d begins %x, expected %x", pass, i, body, hdr)
+			}
+		}
+	}
+	sp := &FileStorageProvider{}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Close()
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	if _, err := seg.Write(id, addr, mkData(100, 1)); err != nil {
+		t.Fatal(err)
+	}
+	seg.Unlock()
+	if data, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(data, mkData(100, 1)) {
+		t.Fatalf("could not read back a block: %v", err)
+	}
+
+	//A file that is not a blockstore file of this database is not touched
+	bad, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bad)
+	junk := []byte("not a blockstore file")
+	if err := ioutil.WriteFile(blockPath([]string{bad}, 2), junk, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&FileStorageProvider{}).CreateDatabaseIfMissing(&testConfig{dir: bad, files: 4}); err == nil {
+		t.Fatalf("a corrupt file was accepted")
+	}
+	if body, _ := ioutil.ReadFile(blockPath([]string{bad}, 2)); !bytes.Equal(body, junk) {
+		t.Fatalf("the corrupt file was changed")
+	}
+}
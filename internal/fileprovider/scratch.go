@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//Temporary space for things like external sorts. Each allocation is its own
+//file in a scratch directory, away from the blockstore files and the free
+//pool, and is deleted when freed. Anything left over from a previous run is
+//deleted at startup
+type ScratchHandle struct {
+	sp   *FileStorageProvider
+	f    *os.File
+	size int64
+	mu   sync.Mutex
+	//Set once freed
+	freed bool
+}
+
+type scratchstate struct {
+	mu   sync.Mutex
+	next uint64
+	used int64
+}
+
+func scratchPath(dbpath string) string {
+	return fmt.Sprintf("%s/scratch", dbpath)
+}
+
+//Delete whatever scratch space was left over and start afresh
+func (sp *FileStorageProvider) resetScratch() {
+	dir := scratchPath(sp.dbpath)
+	if err := os.RemoveAll(dir); err != nil {
+		sp.fatal("Could not clear scratch space", "err", err)
+	}
+	if err := os.Mkdir(dir, 0777); err != nil {
+		sp.fatal("Could not create scratch space", "err", err)
+	}
+}
+
+//Allocate size bytes of scratch space. Fails with ErrNoSpace if that would
+//take more than ScratchLimit bytes (if set) of scratch space in total
+func (sp *FileStorageProvider) AllocScratch(size int64) (*ScratchHandle, error) {
+	if size <= 0 {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	if sp.ReadOnly {
+		return nil, bprovider.ErrReadOnly
+	}
+	sp.scratch.mu.Lock()
+	if sp.ScratchLimit > 0 && sp.scratch.used+size > sp.ScratchLimit {
+		sp.scratch.mu.Unlock()
+		return nil, bprovider.ErrNoSpace
+	}
+	sp.scratch.used += size
+	n := sp.scratch.next
+	sp.scratch.next++
+	sp.scratch.mu.Unlock()
+	fname := fmt.Sprintf("%s/scratch.%d", scratchPath(sp.dbpath), n)
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE|os.O_EXCL, sp.fileMode)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err != nil {
+		sp.releaseScratch(size)
+		if f != nil {
+			f.Close()
+			os.Remove(fname)
+		}
+		return nil, err
+	}
+	return &ScratchHandle{sp: sp, f: f, size: size}, nil
+}
+
+func (sp *FileStorageProvider) releaseScratch(size int64) {
+	sp.scratch.mu.Lock()
+	sp.scratch.used -= size
+	sp.scratch.mu.Unlock()
+}
+
+//Returns the size the scratch space was allocated with
+func (h *ScratchHandle) Size() int64 {
+	return h.size
+}
+
+//Write to the scratch space at the given offset. The write must fit in the
+//allocated size
+func (h *ScratchHandle) WriteAt(data []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.freed || off < 0 || off+int64(len(data)) > h.size {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	return h.f.WriteAt(data, off)
+}
+
+//Read from the scratch space at the given offset
+func (h *ScratchHandle) ReadAt(buffer []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.freed || off < 0 || off+int64(len(buffer)) > h.size {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	return h.f.ReadAt(buffer, off)
+}
+
+//Delete the scratch space. The handle may not be used afterwards
+func (h *ScratchHandle) Free() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.freed {
+		return nil
+	}
+	h.freed = true
+	h.sp.releaseScratch(h.size)
+	name := h.f.Name()
+	h.f.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+func TestScratchSpace(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.ScratchLimit = 1 << 20
+	})
+	defer os.RemoveAll(cfg.dir)
+	disk := sp.TotalDiskSize()
+	h, err := sp.AllocScratch(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := mkData(1000, 4)
+	if _, err := h.WriteAt(data, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.WriteAt(data, (1<<20)-10); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected a write past the end to fail, got %v", err)
+	}
+	got := make([]byte, len(data))
+	if _, err := h.ReadAt(got, 5000); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("scratch data did not read back: %v", err)
+	}
+	if _, err := sp.AllocScratch(1); err != bprovider.ErrNoSpace {
+		t.Fatalf("expected the scratch limit to be enforced, got %v", err)
+	}
+	//Scratch space is not block data
+	if sp.TotalDiskSize() != disk {
+		t.Fatalf("scratch space was counted as block data")
+	}
+	if err := h.Free(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.ReadAt(got, 5000); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected a freed handle to be unusable, got %v", err)
+	}
+	h2, err := sp.AllocScratch(1 << 20)
+	if err != nil {
+		t.Fatalf("expected freed scratch space to be reusable, got %v", err)
+	}
+	//Whatever is left over is cleared at startup
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	if left, _ := ioutil.ReadDir(scratchPath(cfg.dir)); len(left) != 0 {
+		t.Fatalf("expected scratch space to be cleared at startup, found %d files", len(left))
+	}
+	h2.Free()
+}
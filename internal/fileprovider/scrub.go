@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//Background work (scrubbing, compaction) waits on this at safe points, so
+//that it can be paused without affecting foreground reads and writes
+type pausegate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+//Block while the gate is paused
+func (g *pausegate) wait() {
+	g.mu.Lock()
+	for g.paused {
+		if g.cond == nil {
+			g.cond = sync.NewCond(&g.mu)
+		}
+		g.cond.Wait()
+	}
+	g.mu.Unlock()
+}
+
+func (g *pausegate) set(paused bool) {
+	g.mu.Lock()
+	g.paused = paused
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+	g.mu.Unlock()
+}
+
+//Suspend background I/O (the scrubber, relocations, compaction and the
+//version flusher) at its next safe point until ResumeBackground is called.
+//Foreground reads and writes are unaffected
+func (sp *FileStorageProvider) PauseBackground() {
+	sp.bgpause.set(true)
+}
+
+//Resume background I/O suspended by PauseBackground
+func (sp *FileStorageProvider) ResumeBackground() {
+	sp.bgpause.set(false)
+}
+
+//Scrub every file until the provider is closed, sleeping ScrubInterval
+//between passes
+func (sp *FileStorageProvider) scrubber() {
+	defer sp.bgwg.Done()
+	for {
+		atomic.StoreInt32(&sp.bgstate[bgScrubber], gsRunning)
+		sp.scrubPass()
+		atomic.StoreInt32(&sp.bgstate[bgScrubber], gsSleeping)
+		if !sp.sleep(sp.ScrubInterval) {
+			atomic.StoreInt32(&sp.bgstate[bgScrubber], gsNotRunning)
+			return
+		}
+	}
+}
+
+//Which scrub worker is responsible for the given file. Files in different
+//groups are scrubbed in parallel. Every file of a root is in the same group,
+//so that no two workers compete for a disk, and the roots are dealt out over
+//the workers as the files are over the roots (see blockPath)
+func (sp *FileStorageProvider) scrubGroup(fidx int) int {
+	if sp.ScrubWorkers <= 1 {
+		return 0
+	}
+	return fidx % len(sp.dbroots) % sp.ScrubWorkers
+}
+
+//Walk every file up to its committed frontier, verifying each block. There
+//is one worker per file group, all sharing the ScrubBytesPerSec budget
+func (sp *FileStorageProvider) scrubPass() {
+	workers := sp.ScrubWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	groups := make([][]int, workers)
+	for fidx := 0; fidx < sp.numfiles; fidx++ {
+		g := sp.scrubGroup(fidx)
+		groups[g] = append(groups[g], fidx)
+	}
+	budget := newRateLimiter(sp.ScrubBytesPerSec)
+	var wg sync.WaitGroup
+	for _, files := range groups {
+		wg.Add(1)
+		go func(files []int) {
+			defer wg.Done()
+			buf := make([]byte, sp.maxBlockSize())
+			for _, fidx := range files {
+				sp.scrubFile(fidx, buf, budget)
+			}
+		}(files)
+	}
+	wg.Wait()
+}
+
+func (sp *FileStorageProvider) scrubFile(fidx int, buf []byte, budget *ratelimiter) {
+	off := sp.datastart
+	end := atomic.LoadInt64(&sp.committed[fidx])
+	for off < end {
+		sp.bgpause.wait()
+		if sp.closing() {
+			return
+		}
+		addr := bprovider.EncodeAddress(fidx, off)
+		data, meta, err := sp.readBlock(context.Background(), addr, buf)
+		if err == bprovider.ErrIncompleteBlock && meta.reclen != 0 {
+			sp.logger().Error("Scrub found an incomplete block", "file", fidx, "offset", off)
+			atomic.AddUint64(&sp.scrubErrors, 1)
+		} else if err != nil {
+			//We can't find the next block without this one's length
+			sp.logger().Error("Scrub of file stopped", "file", fidx, "offset", off, "err", err)
+			atomic.AddUint64(&sp.scrubErrors, 1)
+			return
+		} else if !sp.checksumOK(addr, data, meta) {
+			sp.logger().Error("Scrub found a checksum mismatch", "file", fidx, "offset", off)
+			atomic.AddUint64(&sp.scrubErrors, 1)
+		}
+		blen := meta.reclen
+		off += blen
+		atomic.StoreInt64(&sp.scrubpos[fidx], off)
+		atomic.AddUint64(&sp.scrubbed, 1)
+		budget.take(blen)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+func TestPauseBackground(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.ScrubInterval = time.Millisecond
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	for i := 0; i < 100; i++ {
+		var err error
+		addr, err = seg.Write(id, addr, mkData(200, byte(i)))
+		if err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	seg.Unlock()
+	waitForScrub := func(than uint64) uint64 {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if v := atomic.LoadUint64(&sp.scrubbed); v > than {
+				return v
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("scrubber made no progress")
+		return 0
+	}
+	waitForScrub(0)
+	sp.PauseBackground()
+	//Let any block in flight finish
+	time.Sleep(10 * time.Millisecond)
+	paused := atomic.LoadUint64(&sp.scrubbed)
+	time.Sleep(50 * time.Millisecond)
+	if v := atomic.LoadUint64(&sp.scrubbed); v != paused {
+		t.Fatalf("scrubber made progress while paused (%d -> %d)", paused, v)
+	}
+	sp.ResumeBackground()
+	waitForScrub(paused)
+	if e := atomic.LoadUint64(&sp.scrubErrors); e != 0 {
+		t.Fatalf("scrubber found %d errors in a clean database", e)
+	}
+}
+
+func TestParallelScrub(t *testing.T) {
+	//Two roots stand for two disks, and the metadata is in a third
+	var dirs []string
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "fileprovider")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+	cfg := &testConfig{dir: dirs[0], files: 4, dirs: dirs[1:]}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	//More workers than roots, which must not put two on a disk
+	sp := &FileStorageProvider{ScrubWorkers: 4, ScrubBytesPerSec: 100 * 1024}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	//The files of a root are scrubbed by the same worker
+	for fidx := 0; fidx < 4; fidx++ {
+		if g := sp.scrubGroup(fidx); g != sp.scrubGroup(fidx%2) {
+			t.Fatalf("file %d is not scrubbed with the other files of its root", fidx)
+		}
+	}
+	//Hold both segments at once so they are in different files, and so on
+	//different disks
+	id := uuid.NewRandom()
+	segs := []*FileProviderSegment{
+		sp.LockSegment(id).(*FileProviderSegment),
+		sp.LockSegment(id).(*FileProviderSegment),
+	}
+	if sp.scrubGroup(segs[0].fidx) == sp.scrubGroup(segs[1].fidx) {
+		t.Fatalf("expected segments in different scrub groups")
+	}
+	var total int64
+	for _, seg := range segs {
+		addr := seg.BaseAddress()
+		for i := 0; i < 20; i++ {
+			var err error
+			addr, err = seg.Write(id, addr, mkData(1000, byte(i)))
+			if err != nil {
+				t.Fatalf("unexpected write error: %v", err)
+			}
+			total += 1000 + sp.blockOverhead()
+		}
+		seg.Unlock()
+	}
+	done := make(chan struct{})
+	then := time.Now()
+	go func() {
+		sp.scrubPass()
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	for _, seg := range segs {
+		if atomic.LoadInt64(&sp.scrubpos[seg.fidx]) == 0 {
+			t.Fatalf("file %d was not being scrubbed in parallel", seg.fidx)
+		}
+	}
+	<-done
+	elapsed := time.Since(then)
+	//The budget is shared, so the pass takes at least total/rate (less the
+	//first block each worker reads before it waits)
+	if min := time.Duration((total - 2*1000) * int64(time.Second) / sp.ScrubBytesPerSec); elapsed < min {
+		t.Fatalf("scrub took %s, faster than the budget allows (%s)", elapsed, min)
+	}
+	if atomic.LoadUint64(&sp.scrubbed) != 40 || atomic.LoadUint64(&sp.scrubErrors) != 0 {
+		t.Fatalf("expected 40 clean blocks, got %d (%d errors)", sp.scrubbed, sp.scrubErrors)
+	}
+}
+
+//A block whose end was lost, as it might be in a crash, is counted as one
+//error
+func TestScrubIncompleteBlock(t *testing.T) {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatSentinel
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	for i := 0; i < 2; i++ {
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	seg.Unlock()
+	fidx := int(addr >> 50)
+	if err := sp.dbf[fidx].Truncate(atomic.LoadInt64(&sp.committed[fidx]) - 10); err != nil {
+		t.Fatal(err)
+	}
+	sp.scrubPass()
+	if s, e := atomic.LoadUint64(&sp.scrubbed), atomic.LoadUint64(&sp.scrubErrors); s != 2 || e != 1 {
+		t.Fatalf("expected 2 blocks scrubbed with one error, got %d with %d errors", s, e)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//With WritersPerFile, several segments can hold a file at once. Rather than
+//writing from the end of the file, each segment reserves a range of it and
+//writes there, reserving another range when the next block might not fit.
+//The address returned by Write must be good for a block of any size, so a
+//range is given up once less than the largest record (and room to pad) is
+//left in it. What is left is filled with padding records: ordinary records
+//of zeros that no stream refers to, so the file can still be walked record
+//by record and compaction drops them. On Unlock, a range at the end of the
+//file is given back instead of padded.
+//
+//The committed frontier of a shared file is the end of the blocks written
+//in order from the start of the file, which is as far as the first range
+//not yet completely written has got.
+//
+//A segment on a shared file can't take back what it wrote, so Abort
+//releases the blocks but leaves them in the file, and a failed segment is
+//not truncated. Its range is never completed, so the committed frontier of
+//the file stops there until the provider is restarted. Blocks never span
+//files, as a range always fits in its file
+
+//The size of the ranges segments reserve, if ReserveBytes is not set
+const DEFAULT_RESERVE = 1 << 20
+
+//The largest padding record. Smaller than any block limit, and never
+//SPANMARK
+const MAXPADDATA = 32 << 10
+
+//A range of a shared file reserved by a segment
+type reservation struct {
+	start int64
+	end   int64
+	//The end of the blocks written to it in order. The range is complete
+	//once this reaches end
+	written int64
+}
+
+//The ranges of a shared file
+type filetail struct {
+	mu sync.Mutex
+	//Where the next range starts
+	tail int64
+	//The ranges not yet complete, in order
+	open []*reservation
+}
+
+func (sp *FileStorageProvider) shared() bool {
+	return sp.WritersPerFile > 1 && !sp.pooled()
+}
+
+//How full a file is for choosing between files: the end of its last range
+//if it is shared, otherwise its committed frontier
+func (sp *FileStorageProvider) fileSize(fidx int) int64 {
+	if sp.shared() {
+		ft := &sp.tails[fidx]
+		ft.mu.Lock()
+		defer ft.mu.Unlock()
+		return ft.tail
+	}
+	return atomic.LoadInt64(&sp.committed[fidx])
+}
+
+//Set the committed frontier of a file that no segment holds, such as after
+//compaction
+func (sp *FileStorageProvider) setCommitted(fidx int, off int64) {
+	atomic.StoreInt64(&sp.committed[fidx], off)
+	atomic.StoreInt64(&sp.frontier[fidx], off)
+	if sp.shared() {
+		ft := &sp.tails[fidx]
+		ft.mu.Lock()
+		ft.tail = off
+		ft.mu.Unlock()
+	}
+}
+
+//The largest record a block can need, plus the smallest padding record.
+//The rest of a range must be at least this for its next address to be
+//handed out
+func (sp *FileStorageProvider) reserveMin() int64 {
+	return int64(sp.maxBlockSize()) + SPANHEADERLEN + sp.blockOverhead()
+}
+
+func (sp *FileStorageProvider) reserveSize() int64 {
+	size := sp.ReserveBytes
+	if size <= 0 {
+		size = DEFAULT_RESERVE
+	}
+	if min := 2 * sp.reserveMin(); size < min {
+		size = min
+	}
+	return size
+}
+
+//Reserve the next range of a file, or return nil if the file does not have
+//min bytes left. Near the end of the file the range is cut short, and it is
+//empty if what is left could not even be padded
+func (sp *FileStorageProvider) reserve(fidx int, min int64) *reservation {
+	ft := &sp.tails[fidx]
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	end := ft.tail + sp.reserveSize()
+	if end > sp.maxFileSize() {
+		end = sp.maxFileSize()
+	}
+	if end-ft.tail < sp.blockOverhead() {
+		end = ft.tail
+	}
+	if end-ft.tail < min {
+		return nil
+	}
+	r := &reservation{start: ft.tail, end: end, written: ft.tail}
+	ft.tail = end
+	ft.open = append(ft.open, r)
+	sp.settle(fidx)
+	return r
+}
+
+//Record that the blocks of a range have been written up to the given
+//offset
+func (sp *FileStorageProvider) advance(fidx int, r *reservation, written int64) {
+	ft := &sp.tails[fidx]
+	ft.mu.Lock()
+	r.written = written
+	sp.settle(fidx)
+	ft.mu.Unlock()
+}
+
+//Drop the complete ranges from the front of the file's list and update its
+//committed frontier. Must be called with the file's tail mutex held
+func (sp *FileStorageProvider) settle(fidx int) {
+	ft := &sp.tails[fidx]
+	for len(ft.open) > 0 && ft.open[0].written >= ft.open[0].end {
+		ft.open = ft.open[1:]
+	}
+	committed := ft.tail
+	if len(ft.open) > 0 {
+		committed = ft.open[0].written
+	}
+	atomic.StoreInt64(&sp.committed[fidx], committed)
+}
+
+//Called by Write after a block is queued to a shared file. If the rest of
+//the range might not hold the next block, it is padded and the segment moves
+//to a new range. If the file has no room for one, the segment stays where
+//it is and the rest of the range is all it can write
+func (seg *FileProviderSegment) nextReservation() {
+	if seg.resvfull || seg.resv.end-seg.ptr >= seg.sp.reserveMin() {
+		return
+	}
+	r := seg.sp.reserve(seg.fidx, seg.sp.reserveMin())
+	if r == nil {
+		seg.resvfull = true
+		return
+	}
+	seg.pad(seg.ptr, seg.resv.end)
+	seg.resv = r
+	seg.ptr = r.start
+}
+
+//Whether a record of the given length fits at the segment's pointer, leaving
+//either nothing or enough to pad
+func (seg *FileProviderSegment) fitsReservation(reclen int64) bool {
+	rest := seg.resv.end - seg.ptr - reclen
+	return rest == 0 || rest >= seg.sp.blockOverhead()
+}
+
+//Give up the rest of the segment's range, when it is unlocked. If nothing
+//has been reserved after it, the file is shortened instead of padded
+func (seg *FileProviderSegment) releaseReservation() {
+	ft := &seg.sp.tails[seg.fidx]
+	ft.mu.Lock()
+	if ft.tail == seg.resv.end {
+		ft.tail = seg.ptr
+		seg.resv.end = seg.ptr
+		seg.sp.settle(seg.fidx)
+		ft.mu.Unlock()
+		return
+	}
+	ft.mu.Unlock()
+	seg.pad(seg.ptr, seg.resv.end)
+}
+
+//Queue padding records to fill the file from start to end, which must be
+//nothing or at least blockOverhead bytes
+func (seg *FileProviderSegment) pad(start, end int64) {
+	seg.flushBatch()
+	overhead := seg.sp.blockOverhead()
+	for start < end {
+		n := end - start
+		if n > MAXPADDATA+overhead {
+			n = MAXPADDATA + overhead
+			if rest := end - start - n; rest > 0 && rest < overhead {
+				n -= overhead
+			}
+		}
+		wp := writeparams{
+			Address: bprovider.EncodeAddress(seg.fidx, start),
+			Data:    make([]byte, n-overhead),
+			Resv:    seg.resv,
+			Seq:     seg.seq,
+			Barrier: seg.barrier,
+			Pad:     true,
+		}
+		seg.enqueued(0)
+		seg.wchan <- wp
+		seg.seq++
+		start += n
+	}
+}
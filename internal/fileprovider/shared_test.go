@@ -0,0 +1,179 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestSharedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &testConfig{dir: dir, files: 2}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	setup := func(sp *FileStorageProvider) {
+		sp.WritersPerFile = 4
+		sp.SegmentWriters = 2
+		//The smallest ranges, so that segments use up several
+		sp.ReserveBytes = 1
+	}
+	sp := &FileStorageProvider{}
+	setup(sp)
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	type block struct {
+		addr uint64
+		data []byte
+	}
+	//More writers than files, each locking several segments of blocks that
+	//fill a few ranges. All of them hold their first segment at once, so each
+	//file is held by WritersPerFile of them
+	const writers = 8
+	var mu sync.Mutex
+	var blocks []block
+	var wg, locked sync.WaitGroup
+	wg.Add(writers)
+	locked.Add(writers)
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for s := 0; s < 5; s++ {
+				seg := sp.LockSegment(nil)
+				if s == 0 {
+					locked.Done()
+					locked.Wait()
+				}
+				addr := seg.BaseAddress()
+				for i := 0; i < 20; i++ {
+					d := mkData(1+rnd.Intn(20000), byte(w*100+s*20+i))
+					next, err := seg.Write(nil, addr, d)
+					if err != nil {
+						t.Error(err)
+						break
+					}
+					mu.Lock()
+					blocks = append(blocks, block{addr, d})
+					mu.Unlock()
+					addr = next
+				}
+				if err := seg.Unlock(); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if t.Failed() {
+		sp.Close()
+		return
+	}
+	//No two blocks overlap
+	ends := make(map[uint64]uint64)
+	for _, b := range blocks {
+		ends[b.addr] = b.addr + uint64(len(b.data)) + uint64(sp.blockOverhead())
+	}
+	for _, b := range blocks {
+		for _, o := range blocks {
+			if b.addr < o.addr && ends[b.addr] > o.addr {
+				t.Fatalf("block at %x overlaps block at %x", b.addr, o.addr)
+			}
+		}
+	}
+	check := func(sp *FileStorageProvider) {
+		for _, b := range blocks {
+			got, err := sp.Read(nil, b.addr, make([]byte, MAXBLOCKSIZE))
+			if err != nil || !bytes.Equal(got, b.data) {
+				t.Fatalf("block at %x did not read back: %v", b.addr, err)
+			}
+		}
+		//Every file is committed to its end, and walks cleanly with the blocks
+		//among its records
+		found := make(map[uint64]bool)
+		for fidx := 0; fidx < sp.numfiles; fidx++ {
+			size, err := sp.dbf[fidx].Seek(0, os.SEEK_END)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := atomic.LoadInt64(&sp.committed[fidx]); c != size {
+				t.Fatalf("file %d committed to %d, but is %d bytes", fidx, c, size)
+			}
+			err = sp.IterateFile(fidx, func(rec *FileRecord) bool {
+				if !rec.OK {
+					t.Errorf("bad record at %x", rec.Address)
+				}
+				found[rec.Address] = true
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, b := range blocks {
+			if !found[b.addr] {
+				t.Fatalf("block at %x not found iterating its file", b.addr)
+			}
+		}
+	}
+	check(sp)
+	sp.Close()
+	reopened := &FileStorageProvider{}
+	setup(reopened)
+	if err := reopened.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	check(reopened)
+}
+
+//On a shared file, Abort writes what was queued anyway, so a failure to do
+//so is logged
+func TestSharedAbortError(t *testing.T) {
+	var fail int32
+	lg := &capturingLogger{}
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.WritersPerFile = 2
+		sp.Logger = lg
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &failingSegfile{f, &fail}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	atomic.StoreInt32(&fail, 1)
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(100, 1)); err != nil {
+		t.Fatal(err)
+	}
+	seg.Abort()
+	ev, ok := lg.find("Could not write aborted segment")
+	if !ok {
+		t.Fatalf("expected an event for the failed abort, got %v", lg.events)
+	}
+	want := []interface{}{"file", seg.fidx, "err", syscall.EIO}
+	if ev.level != "error" || !reflect.DeepEqual(ev.keyvals, want) {
+		t.Fatalf("expected an error with keyvals %v, got %s %v", want, ev.level, ev.keyvals)
+	}
+}
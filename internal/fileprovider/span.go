@@ -0,0 +1,119 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"context"
+	"hash/crc32"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//In a database with FormatSpan, a block that does not fit in the rest of its
+//file is split. The tail is written as an ordinary block in another file, and
+//the head fills the rest of this one as a record with the length SPANMARK:
+//  [0xFE 0xFF][2 byte head length][8 byte address of the tail][head][trailer]
+//The trailer covers only the head, the tail has its own. A block of exactly
+//SPANMARK bytes can't be written to such a database
+const SPANMARK = 0xFFFE
+const SPANHEADERLEN = 12
+
+func spanHeader(headlen int, cont uint64) []byte {
+	rv := []byte{0xFE, 0xFF, byte(headlen), byte(headlen >> 8)}
+	for i := uint(0); i < 64; i += 8 {
+		rv = append(rv, byte(cont>>i))
+	}
+	return rv
+}
+
+//Returns the head length and tail address from a span header
+func parseSpanHeader(b []byte) (int, uint64) {
+	headlen := int(b[2]) + (int(b[3]) << 8)
+	var cont uint64
+	for i := uint(0); i < 8; i++ {
+		cont += uint64(b[4+i]) << (8 * i)
+	}
+	return headlen, cont
+}
+
+//A file must end before the offset in an address overflows for the address
+//after its last block to be valid
+const MAXFILESIZE = bprovider.ADDRESSOFFSETMASK
+
+func (sp *FileStorageProvider) maxFileSize() int64 {
+	if sp.MaxFileSize <= 0 || sp.MaxFileSize > MAXFILESIZE {
+		return MAXFILESIZE
+	}
+	return sp.MaxFileSize
+}
+
+//Whether a file of the given size has no room for even an empty block
+func (sp *FileStorageProvider) fileFull(size int64) bool {
+	return size+int64(sp.prefixLen())+sp.blockOverhead() > sp.maxFileSize()
+}
+
+//Write the tail of a block that does not fit in the segment to another file,
+//returning the head to write in its place. This locks a second segment, so
+//it can block like LockSegment does
+func (seg *FileProviderSegment) splitSpan(wp writeparams) (writeparams, error) {
+	room := seg.sp.maxFileSize() - seg.ptr - seg.sp.blockOverhead() - (SPANHEADERLEN - 2)
+	if room <= 0 {
+		return wp, bprovider.ErrNoSpace
+	}
+	tseg := seg.sp.LockSegment(wp.UUID).(*FileProviderSegment)
+	cont := tseg.BaseAddress()
+	//The given CRC is of the whole block, the parts get their own
+	_, err := tseg.write(writeparams{UUID: wp.UUID, Address: cont, Data: wp.Data[room:], Tail: true})
+	//The tail must be on disk before anything refers to it
+	if uerr := tseg.Unlock(); err == nil {
+		err = uerr
+	}
+	if err != nil {
+		return wp, err
+	}
+	wp.Data = wp.Data[:room]
+	wp.Cont = cont
+	wp.HasCRC = false
+	return wp, nil
+}
+
+//Read the block at the given address, returning its data and whatever is
+//stored alongside it. The parts of a spanning block are checked against
+//their checksums here, and the returned crc is that of the whole block
+func (sp *FileStorageProvider) readBlock(ctx context.Context, address uint64, buffer []byte) ([]byte, blockmeta, error) {
+	head, meta, err := sp.readRecord(ctx, address, buffer)
+	if err != nil || meta.cont == 0 {
+		return head, meta, err
+	}
+	if !sp.checksumOK(address, head, meta) {
+		return nil, meta, bprovider.ErrCorrupt
+	}
+	//This is read after the lock on the head's file is released, so that
+	//spans in opposite directions can't deadlock. The tail gets a buffer of
+	//its own, big enough for any record
+	tail, tmeta, err := sp.readBlock(ctx, meta.cont, make([]byte, MAXBLOCKSIZE))
+	if err != nil {
+		return nil, meta, err
+	}
+	if !sp.checksumOK(meta.cont, tail, tmeta) {
+		return nil, meta, bprovider.ErrCorrupt
+	}
+	if len(head)+len(tail) > len(buffer) {
+		if !sp.GrowSmallBuffers {
+			return nil, meta, bprovider.ErrBufferTooSmall{Need: len(head) + len(tail)}
+		}
+		buffer = make([]byte, len(head)+len(tail))
+	}
+	n := copy(buffer, head)
+	n += copy(buffer[n:], tail)
+	if sp.format&FormatCRC != 0 {
+		meta.crc = crc32.Checksum(buffer[:n], crctab)
+	}
+	return buffer[:n], meta, nil
+}
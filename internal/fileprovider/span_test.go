@@ -0,0 +1,74 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestSpanningBlock(t *testing.T) {
+	const maxsize = 4096
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.FormatFlags = FormatSpan | FormatTimestamp
+		sp.MaxFileSize = maxsize
+		sp.ScrubWorkers = 1
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	first := seg.BaseAddress()
+	second, err := seg.Write(id, first, mkData(2000, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := seg.Write(id, second, mkData(3000, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.Write(id, next, mkData(10, 3)); err != bprovider.ErrNoSpace {
+		t.Fatalf("expected the file to be full, got %v", err)
+	}
+	seg.Unlock()
+	if next&((1<<50)-1) != maxsize {
+		t.Fatalf("expected the head to fill the file, next address is %x", next)
+	}
+	buf := make([]byte, MAXBLOCKSIZE)
+	data, err := sp.Read(id, second, buf)
+	if err != nil || !bytes.Equal(data, mkData(3000, 2)) {
+		t.Fatalf("spanning block did not read back intact (%v)", err)
+	}
+	data, err = sp.Read(id, first, buf)
+	if err != nil || !bytes.Equal(data, mkData(2000, 1)) {
+		t.Fatalf("block before the span did not read back intact (%v)", err)
+	}
+	sp.scrubPass()
+	if atomic.LoadUint64(&sp.scrubErrors) != 0 {
+		t.Fatalf("scrub failed on a spanning block")
+	}
+	//Without FormatSpan, the block is refused
+	sp2, cfg2 := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.MaxFileSize = maxsize
+	})
+	defer os.RemoveAll(cfg2.dir)
+	seg = sp2.LockSegment(id)
+	addr, err := seg.Write(id, seg.BaseAddress(), mkData(2000, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := seg.Write(id, addr, mkData(3000, 2)); err != bprovider.ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace without FormatSpan, got %v", err)
+	}
+	seg.Unlock()
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/bte"
+)
+
+//Like StreamDump, but does not stop at the end of the data. Once a dump is
+//written, it waits for interval and then writes a dump of whatever was written
+//in the meantime, until stop is closed or writing to w fails. A standby reads
+//this as a sequence of dumps
+func (sp *FileStorageProvider) StreamTail(w io.Writer, since Watermark, interval time.Duration, stop <-chan struct{}) error {
+	for {
+		upto, err := sp.dump(w, since)
+		if err != nil {
+			return err
+		}
+		since = upto
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+//A provider that follows a primary, see StartStandby
+type Standby struct {
+	sp    *FileStorageProvider
+	dial  func(since Watermark) (io.ReadCloser, error)
+	retry time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+
+	mu   sync.Mutex
+	conn io.ReadCloser
+}
+
+//Make this provider a warm standby for a primary. dial must return a
+//StreamTail of the primary starting from the given watermark. Dumps are
+//applied as they arrive, and if the stream fails, dial is called again after
+//retry to resume from what has been applied. Reads are served as usual, but
+//writes fail until the standby is promoted
+func (sp *FileStorageProvider) StartStandby(dial func(since Watermark) (io.ReadCloser, error), retry time.Duration) *Standby {
+	atomic.StoreInt32(&sp.readonly, 1)
+	s := &Standby{
+		sp:    sp,
+		dial:  dial,
+		retry: retry,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Standby) run() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		conn, err := s.dial(s.sp.Watermark())
+		if err != nil {
+			s.sp.logger().Warn("Standby could not connect to primary", "err", err)
+		} else {
+			s.mu.Lock()
+			s.conn = conn
+			s.mu.Unlock()
+			for {
+				if err = s.sp.StreamRestore(conn); err != nil {
+					break
+				}
+			}
+			//Promote may have closed it already
+			s.mu.Lock()
+			if s.conn != nil {
+				s.conn.Close()
+				s.conn = nil
+			}
+			s.mu.Unlock()
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			s.sp.logger().Warn("Standby lost stream from primary", "err", err)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(s.retry):
+		}
+	}
+}
+
+//Stop following the primary and start accepting writes. Whatever was applied
+//up to this point is kept
+func (s *Standby) Promote() {
+	close(s.stop)
+	s.mu.Lock()
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.mu.Unlock()
+	<-s.done
+	atomic.StoreInt32(&s.sp.readonly, 0)
+}
+
+//Returns an error if the provider is not accepting metadata changes
+func (sp *FileStorageProvider) checkWritable() bte.BTE {
+	if atomic.LoadInt32(&sp.readonly) != 0 {
+		return bte.Err(bte.WrongEndpoint, "provider is read only")
+	}
+	return nil
+}
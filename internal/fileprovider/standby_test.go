@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+//Fails reads after limit bytes, to simulate a dropped connection
+type flakyConn struct {
+	io.ReadCloser
+	left int
+}
+
+func (c *flakyConn) Read(p []byte) (int, error) {
+	if c.left <= 0 {
+		return 0, fmt.Errorf("connection dropped")
+	}
+	if len(p) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.left -= n
+	return n, err
+}
+
+func TestWarmStandby(t *testing.T) {
+	primary, pcfg := mkProvider(t, nil)
+	defer os.RemoveAll(pcfg.dir)
+	standby, scfg := mkProvider(t, nil)
+	defer os.RemoveAll(scfg.dir)
+
+	var dials int32
+	dial := func(since Watermark) (io.ReadCloser, error) {
+		pr, pw := io.Pipe()
+		stop := make(chan struct{})
+		go func() {
+			err := primary.StreamTail(pw, since, 5*time.Millisecond, stop)
+			pw.CloseWithError(err)
+		}()
+		conn := struct {
+			io.Reader
+			io.Closer
+		}{pr, closerFunc(func() error {
+			close(stop)
+			return pr.Close()
+		})}
+		//The first connection drops part way
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return &flakyConn{ReadCloser: conn, left: 20000}, nil
+		}
+		return conn, nil
+	}
+	s := standby.StartStandby(dial, 10*time.Millisecond)
+
+	id := uuid.NewRandom()
+	if err := primary.CreateStream(id, "standby", nil, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	addrs := make(map[uint64][]byte)
+	buf := make([]byte, MAXBLOCKSIZE)
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 20; i++ {
+			d := mkData(500, byte(round*20+i))
+			addrs[writeOne(t, primary, id, d)] = d
+		}
+		primary.SetStreamVersion(id, uint64(round+10))
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			caughtup := standby.GetStreamVersion(id) == uint64(round+10)
+			for addr, d := range addrs {
+				got, err := standby.Read(id, addr, buf)
+				if err != nil || !bytes.Equal(got, d) {
+					caughtup = false
+					break
+				}
+			}
+			if caughtup {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("standby did not catch up in round %d", round)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	if atomic.LoadInt32(&dials) < 2 {
+		t.Fatalf("expected the standby to reconnect")
+	}
+	seg := standby.LockSegment(id)
+	if _, err := seg.Write(id, seg.BaseAddress(), mkData(10, 0)); err != bprovider.ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly on standby, got %v", err)
+	}
+	seg.Unlock()
+	if err := standby.CreateStream(uuid.NewRandom(), "standby", nil, nil); err == nil || err.Code() != bte.WrongEndpoint {
+		t.Fatalf("expected metadata changes to be refused on standby, got %v", err)
+	}
+
+	s.Promote()
+	if ann, _, err := standby.GetStreamAnnotation(id); err != nil || string(ann) != "x" {
+		t.Fatalf("promoted standby lost metadata (%v)", err)
+	}
+	writeOne(t, standby, id, mkData(10, 0))
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
@@ -0,0 +1,283 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"hash/crc32"
+	"sync/atomic"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+//Error counts for a single blockstore file. A count that keeps rising on one
+//file is a good sign that the disk under it is failing
+type FileStats struct {
+	ReadErrors     uint64
+	WriteErrors    uint64
+	ChecksumErrors uint64
+}
+
+type Stats struct {
+	//Indexed by file number
+	Files []FileStats
+	//The committed end of each file, where the next segment in it starts.
+	//Indexed by file number
+	Offsets []int64
+	//How long the oldest block queued in any segment has been waiting to be
+	//written. Zero if nothing is waiting. If this keeps growing, a writer
+	//is stalled
+	OldestUnflushed time.Duration
+	//How many blocks were read back after being written (see
+	//VerifySampleRate), and how many of those did not match
+	VerifiedBlocks uint64
+	VerifyFailures uint64
+	//Reads served from the read cache, and reads that missed it
+	CacheHits   uint64
+	CacheMisses uint64
+	//Blocks returned by Read, ReadRange, ReadLenient and ReadChecked, the
+	//bytes of data in them and the total time those reads took
+	Reads     uint64
+	BytesRead uint64
+	ReadTime  time.Duration
+	//Blocks queued by the Write methods and the bytes of data in them. A
+	//block split across files counts once. WriteTime is the total time
+	//writers spent writing blocks to the files
+	Writes       uint64
+	BytesWritten uint64
+	WriteTime    time.Duration
+	//Records read from the files, how many of those were bigger than the
+	//first read (see firstread.go) and so needed a second, and the fraction
+	//that did
+	DiskReads       uint64
+	SecondReads     uint64
+	SecondReadRatio float64
+	//Block reads and writes retried after a transient error, see IORetries
+	IORetries uint64
+	//Files that LockSegment can hand out, and files locked by a segment
+	AvailableSegments int
+	LockedSegments    int
+}
+
+//Updated atomically on every read and write, see Stats
+type iocounters struct {
+	reads      uint64
+	bytesRead  uint64
+	readTime   int64
+	writes     uint64
+	bytesWrite uint64
+	writeTime  int64
+	//If metrics are registered, every read is observed here too
+	latency prometheus.Histogram
+}
+
+func (c *iocounters) read(n int, start time.Time) {
+	d := time.Since(start)
+	atomic.AddUint64(&c.reads, 1)
+	atomic.AddUint64(&c.bytesRead, uint64(n))
+	atomic.AddInt64(&c.readTime, int64(d))
+	if c.latency != nil {
+		c.latency.Observe(d.Seconds())
+	}
+}
+
+func (c *iocounters) write(n int) {
+	atomic.AddUint64(&c.writes, 1)
+	atomic.AddUint64(&c.bytesWrite, uint64(n))
+}
+
+type errcounters struct {
+	read     []uint64
+	write    []uint64
+	checksum []uint64
+}
+
+func (ec *errcounters) init(n int) {
+	ec.read = make([]uint64, n)
+	ec.write = make([]uint64, n)
+	ec.checksum = make([]uint64, n)
+}
+
+//Returns a snapshot of the provider's counters
+func (sp *FileStorageProvider) Stats() Stats {
+	rv := Stats{Files: make([]FileStats, sp.numfiles), Offsets: make([]int64, sp.numfiles)}
+	for i := range rv.Files {
+		rv.Offsets[i] = atomic.LoadInt64(&sp.committed[i])
+		rv.Files[i] = FileStats{
+			ReadErrors:     atomic.LoadUint64(&sp.errs.read[i]),
+			WriteErrors:    atomic.LoadUint64(&sp.errs.write[i]),
+			ChecksumErrors: atomic.LoadUint64(&sp.errs.checksum[i]),
+		}
+	}
+	rv.VerifiedBlocks = atomic.LoadUint64(&sp.verified)
+	rv.VerifyFailures = atomic.LoadUint64(&sp.verifyFails)
+	rv.CacheHits = atomic.LoadUint64(&sp.rcache.hits)
+	rv.CacheMisses = atomic.LoadUint64(&sp.rcache.misses)
+	rv.Reads = atomic.LoadUint64(&sp.io.reads)
+	rv.BytesRead = atomic.LoadUint64(&sp.io.bytesRead)
+	rv.ReadTime = time.Duration(atomic.LoadInt64(&sp.io.readTime))
+	rv.Writes = atomic.LoadUint64(&sp.io.writes)
+	rv.BytesWritten = atomic.LoadUint64(&sp.io.bytesWrite)
+	rv.WriteTime = time.Duration(atomic.LoadInt64(&sp.io.writeTime))
+	rv.DiskReads = atomic.LoadUint64(&sp.reads)
+	rv.SecondReads = atomic.LoadUint64(&sp.secondreads)
+	rv.IORetries = atomic.LoadUint64(&sp.ioretries)
+	if rv.DiskReads > 0 {
+		rv.SecondReadRatio = float64(rv.SecondReads) / float64(rv.DiskReads)
+	}
+	sp.segsmu.Lock()
+	rv.LockedSegments = len(sp.segs)
+	sp.segsmu.Unlock()
+	rv.AvailableSegments = sp.numfiles - rv.LockedSegments
+	if oldest := sp.oldestUnflushed(); oldest != 0 {
+		rv.OldestUnflushed = time.Duration(time.Now().UnixNano() - oldest)
+	}
+	return rv
+}
+
+//When a blockstore file was last written to, see FileActivity
+type FileStat struct {
+	//Zero if no block has been written to the file since the provider was
+	//initialized
+	LastWrite time.Time
+}
+
+//Returns when each file was last written to, indexed by file number. Files
+//written to long ago (or not at all) are cold, and candidates for
+//migration or compaction
+func (sp *FileStorageProvider) FileActivity() []FileStat {
+	rv := make([]FileStat, sp.numfiles)
+	for i := range rv {
+		if t := atomic.LoadInt64(&sp.lastwrite[i]); t != 0 {
+			rv[i].LastWrite = time.Unix(0, t)
+		}
+	}
+	return rv
+}
+
+func (sp *FileStorageProvider) addSegment(seg *FileProviderSegment) {
+	sp.segsmu.Lock()
+	if sp.segs == nil {
+		sp.segs = make(map[*FileProviderSegment]struct{})
+	}
+	sp.segs[seg] = struct{}{}
+	sp.segsmu.Unlock()
+	sp.segwg.Add(1)
+}
+
+func (sp *FileStorageProvider) removeSegment(seg *FileProviderSegment) {
+	sp.segsmu.Lock()
+	delete(sp.segs, seg)
+	sp.segsmu.Unlock()
+	sp.segwg.Done()
+}
+
+//Returns when (in unix nanoseconds) the oldest block still queued in any
+//segment was queued, or zero if there is none
+func (sp *FileStorageProvider) oldestUnflushed() int64 {
+	sp.segsmu.Lock()
+	defer sp.segsmu.Unlock()
+	var rv int64
+	for seg := range sp.segs {
+		if t := seg.oldestUnflushed(); t != 0 && (rv == 0 || t < rv) {
+			rv = t
+		}
+	}
+	return rv
+}
+
+//Record that an item was queued at the given time (zero for checkpoints).
+//Must be called in sequence order, before the item is on the queue
+func (seg *FileProviderSegment) enqueued(t int64) {
+	seg.seqmu.Lock()
+	seg.enqtimes = append(seg.enqtimes, t)
+	seg.seqmu.Unlock()
+}
+
+//Undo enqueued, for a write given up on before it was queued
+func (seg *FileProviderSegment) unqueued() {
+	seg.seqmu.Lock()
+	seg.enqtimes = seg.enqtimes[:len(seg.enqtimes)-1]
+	seg.seqmu.Unlock()
+}
+
+func (seg *FileProviderSegment) oldestUnflushed() int64 {
+	seg.seqmu.Lock()
+	defer seg.seqmu.Unlock()
+	for _, t := range seg.enqtimes {
+		if t != 0 {
+			return t
+		}
+	}
+	return 0
+}
+
+//Zero the per file error counts
+func (sp *FileStorageProvider) ResetErrorCounters() {
+	for i := 0; i < sp.numfiles; i++ {
+		atomic.StoreUint64(&sp.errs.read[i], 0)
+		atomic.StoreUint64(&sp.errs.write[i], 0)
+		atomic.StoreUint64(&sp.errs.checksum[i], 0)
+	}
+}
+
+//Check the data of the block read from the given address against its stored
+//checksum, counting a mismatch. Always true if the format has no checksums
+func (sp *FileStorageProvider) checksumOK(address uint64, data []byte, meta blockmeta) bool {
+	if sp.format&FormatCRC == 0 || crc32.Checksum(data, crctab) == meta.crc {
+		return true
+	}
+	fidx, _ := bprovider.DecodeAddress(address)
+	atomic.AddUint64(&sp.errs.checksum[fidx], 1)
+	return false
+}
+
+//A snapshot of the files available to LockSegment, see FreePoolState
+type PoolState struct {
+	//The files that can be locked right away
+	Available []int
+	//The files locked by a segment, and for how long they have been
+	Locked map[int]time.Duration
+	//The number of files unlocked but not yet back in the pool
+	Backlog int
+}
+
+//Returns which files are available, which are locked and for how long, and
+//how many are waiting to be returned to the pool. If LockSegment blocks
+//while nothing is available, look for a segment that is held too long
+func (sp *FileStorageProvider) FreePoolState() PoolState {
+	rv := PoolState{Locked: make(map[int]time.Duration)}
+	sp.favailmu.Lock()
+	for i, avail := range sp.favail {
+		if avail {
+			rv.Available = append(rv.Available, i)
+		}
+	}
+	sp.favailmu.Unlock()
+	now := time.Now()
+	sp.segsmu.Lock()
+	for seg := range sp.segs {
+		if held := now.Sub(seg.locked); held > rv.Locked[seg.fidx] {
+			rv.Locked[seg.fidx] = held
+		}
+	}
+	sp.segsmu.Unlock()
+	for _, ch := range sp.retfidx {
+		rv.Backlog += len(ch)
+	}
+	return rv
+}
+
+//Mark a file as available to the allocators or not
+func (sp *FileStorageProvider) setAvail(fidx int, avail bool) {
+	sp.favailmu.Lock()
+	sp.favail[fidx] = avail
+	sp.favailmu.Unlock()
+}
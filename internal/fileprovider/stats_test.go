@@ -0,0 +1,233 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestErrorCounters(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	good := writeOne(t, sp, id, mkData(100, 1))
+	bad := writeOne(t, sp, id, mkData(100, 2))
+	corruptBlock(t, cfg, bad, 10)
+	buf := make([]byte, MAXBLOCKSIZE)
+
+	if _, err := sp.Read(id, bad, buf); err != bprovider.ErrCorrupt {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+	//Make reads of the good block's file fail
+	gfidx := good >> 50
+	rf := sp.dbrf[gfidx]
+	closed, err := os.Open(rf.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	sp.dbrf[gfidx] = closed
+	for i := 0; i < 3; i++ {
+		if _, err := sp.Read(id, good, buf); err == nil {
+			t.Fatalf("expected read of closed file to fail")
+		}
+	}
+	sp.dbrf[gfidx] = rf
+
+	st := sp.Stats()
+	if st.Files[bad>>50].ChecksumErrors != 1 {
+		t.Fatalf("expected 1 checksum error on file %d, got %+v", bad>>50, st.Files[bad>>50])
+	}
+	if st.Files[gfidx].ReadErrors != 3 {
+		t.Fatalf("expected 3 read errors on file %d, got %+v", gfidx, st.Files[gfidx])
+	}
+	for i, fs := range st.Files {
+		if uint64(i) != gfidx && fs.ReadErrors != 0 {
+			t.Fatalf("unexpected read errors on file %d: %+v", i, fs)
+		}
+	}
+
+	sp.ResetErrorCounters()
+	for i, fs := range sp.Stats().Files {
+		if fs != (FileStats{}) {
+			t.Fatalf("counters of file %d not reset: %+v", i, fs)
+		}
+	}
+	if _, err := sp.Read(id, good, buf); err != nil {
+		t.Fatalf("read after restoring file failed: %v", err)
+	}
+}
+
+func TestOldestUnflushed(t *testing.T) {
+	release := make(chan struct{})
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &stalledSegfile{f, release}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	if age := sp.Stats().OldestUnflushed; age != 0 {
+		t.Fatalf("expected no unflushed age before any writes, got %v", age)
+	}
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	for i := 0; i < 5; i++ {
+		var err error
+		addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	first := sp.Stats().OldestUnflushed
+	if first < 20*time.Millisecond {
+		t.Fatalf("expected the oldest unflushed age to be at least 20ms, got %v", first)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if second := sp.Stats().OldestUnflushed; second < first+20*time.Millisecond {
+		t.Fatalf("expected the oldest unflushed age to grow, got %v then %v", first, second)
+	}
+	close(release)
+	seg.Unlock()
+	if age := sp.Stats().OldestUnflushed; age != 0 {
+		t.Fatalf("expected no unflushed age after the writes completed, got %v", age)
+	}
+}
+
+func TestFreePoolState(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	segs := []*FileProviderSegment{}
+	for i := 0; i < 3; i++ {
+		segs = append(segs, sp.LockSegment(id).(*FileProviderSegment))
+	}
+	time.Sleep(10 * time.Millisecond)
+	state := sp.FreePoolState()
+	if len(state.Locked) != 3 {
+		t.Fatalf("expected 3 locked files, got %d", len(state.Locked))
+	}
+	for _, seg := range segs {
+		held, ok := state.Locked[seg.fidx]
+		if !ok || held < 10*time.Millisecond {
+			t.Fatalf("file %d should be locked for at least 10ms, got %v", seg.fidx, held)
+		}
+		for _, fidx := range state.Available {
+			if fidx == seg.fidx {
+				t.Fatalf("locked file %d reported as available", fidx)
+			}
+		}
+	}
+	//The allocator may be holding one more file ready to hand out
+	if n := len(state.Available); n < NUMFILES-4 || n > NUMFILES-3 {
+		t.Fatalf("expected %d or %d available files, got %d", NUMFILES-4, NUMFILES-3, n)
+	}
+	for _, seg := range segs {
+		seg.Unlock()
+	}
+	//Returned files wait in the backlog until the allocator next looks
+	state = sp.FreePoolState()
+	if len(state.Locked) != 0 || len(state.Available)+state.Backlog < NUMFILES-1 {
+		t.Fatalf("files were not returned: %d available, %d locked, backlog %d",
+			len(state.Available), len(state.Locked), state.Backlog)
+	}
+}
+
+func TestIOStats(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	fidx := seg.fidx
+	addr := seg.BaseAddress()
+	var addrs []uint64
+	var size, ondisk int64
+	for i := 0; i < 7; i++ {
+		data := mkData(100*(i+1), byte(i))
+		addrs = append(addrs, addr)
+		size += int64(len(data))
+		ondisk += sp.recordLen(&writeparams{Data: data})
+		var err error
+		if addr, err = seg.Write(id, addr, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st := sp.Stats()
+	if st.LockedSegments != 1 || st.AvailableSegments != sp.numfiles-1 {
+		t.Fatalf("expected one locked segment, got %d locked and %d available", st.LockedSegments, st.AvailableSegments)
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	for pass := 0; pass < 2; pass++ {
+		for _, a := range addrs {
+			if _, err := sp.Read(id, a, make([]byte, 1000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	//Failed reads are not counted
+	if _, err := sp.Read(id, addrs[0]+1, make([]byte, 1000)); err == nil {
+		t.Fatalf("expected a read of a bad address to fail")
+	}
+	st = sp.Stats()
+	if st.Writes != 7 || st.BytesWritten != uint64(size) {
+		t.Fatalf("expected 7 writes of %d bytes, got %d of %d", size, st.Writes, st.BytesWritten)
+	}
+	if st.Reads != 14 || st.BytesRead != 2*uint64(size) {
+		t.Fatalf("expected 14 reads of %d bytes, got %d of %d", 2*size, st.Reads, st.BytesRead)
+	}
+	if st.ReadTime <= 0 || st.WriteTime <= 0 {
+		t.Fatalf("expected read and write time, got %v and %v", st.ReadTime, st.WriteTime)
+	}
+	if off := st.Offsets[fidx]; off != sp.datastart+ondisk {
+		t.Fatalf("expected file %d to end at %d, got %d", fidx, sp.datastart+ondisk, off)
+	}
+	if st.LockedSegments != 0 || st.AvailableSegments != sp.numfiles {
+		t.Fatalf("expected no locked segments, got %d", st.LockedSegments)
+	}
+}
+
+func TestFileLastWrite(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	before := time.Now()
+	segs := []bprovider.Segment{sp.LockSegment(id), sp.LockSegment(id)}
+	written := make(map[int]bool)
+	for _, seg := range segs {
+		addr := seg.BaseAddress()
+		if _, err := seg.Write(id, addr, mkData(100, 1)); err != nil {
+			t.Fatal(err)
+		}
+		fidx, _ := bprovider.DecodeAddress(addr)
+		written[fidx] = true
+	}
+	for _, seg := range segs {
+		seg.Unlock()
+	}
+	after := time.Now()
+	for fidx, fs := range sp.FileActivity() {
+		if !written[fidx] {
+			if !fs.LastWrite.IsZero() {
+				t.Fatalf("file %d was not written but reports a write at %v", fidx, fs.LastWrite)
+			}
+			continue
+		}
+		if fs.LastWrite.Before(before) || fs.LastWrite.After(after) {
+			t.Fatalf("file %d reports a write at %v, outside %v to %v", fidx, fs.LastWrite, before, after)
+		}
+	}
+}
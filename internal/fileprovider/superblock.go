@@ -0,0 +1,326 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//Superblocks are appended to a log next to the metadata log, as records of
+//  [16 byte uuid][8 byte version][4 byte length][data][4 byte CRC32C]
+//where the CRC covers everything before it. Superblocks larger than
+//SBCHUNKSIZE are split over consecutive records, all but the last of which
+//have SBMORE set in their length. An index of where the latest record of
+//each version of each stream is, is rebuilt from the log at startup. Writing
+//a version again (after a rollback) appends a new record that replaces the
+//old one in the index
+const SBHEADERLEN = 28
+const SBCHUNKSIZE = 65535
+const SBMORE = 1 << 31
+
+//Records of one stream less than this far apart are read together by
+//ReadSuperBlockRange, rather than one at a time
+const SBMAXGAP = 4096
+
+//A version of a superblock, as returned by ReadSuperBlockRange
+type SuperBlockEntry struct {
+	Version uint64
+	Data    []byte
+}
+
+//Where a superblock record is in the log, and the length of its data.
+//Size covers all its chunks
+type sbloc struct {
+	off    int64
+	size   int64
+	length int
+}
+
+func superblockPath(dbpath string) string {
+	return fmt.Sprintf("%s/superblocks.log", dbpath)
+}
+
+func (sp *FileStorageProvider) openSuperblocks(dbpath string) {
+	f, err := os.OpenFile(superblockPath(dbpath), sp.openFlags(), sp.fileMode)
+	if err != nil {
+		sp.fatal("Problem with superblock log", "err", err)
+	}
+	sp.sbf = f
+	sp.sbidx = make(map[[16]byte]map[uint64]sbloc)
+	r := bufio.NewReaderSize(io.NewSectionReader(f, 0, 1<<62), 1<<20)
+	//The chunks read so far of a superblock split over several records
+	var loc sbloc
+	var key [16]byte
+	var cversion uint64
+	for {
+		rec := make([]byte, SBHEADERLEN)
+		if _, err := io.ReadFull(r, rec); err == io.EOF {
+			break
+		} else if err != nil {
+			sp.logger().Warn("Ignoring the end of the superblock log", "offset", sp.sbend, "err", err)
+			break
+		}
+		length := int(binary.LittleEndian.Uint32(rec[24:]) &^ SBMORE)
+		rest := make([]byte, length+4)
+		if _, err := io.ReadFull(r, rest); err != nil {
+			sp.logger().Warn("Ignoring the end of the superblock log", "offset", sp.sbend, "err", err)
+			break
+		}
+		rec = append(rec, rest...)
+		uuid, version, _, more, err := decodeSuperblock(rec)
+		if err == nil && loc.size != 0 && (uuidkey(uuid) != key || version != cversion) {
+			err = bprovider.ErrCorrupt
+		}
+		if err != nil {
+			//A torn record at the end of the log is the result of a crash
+			//during an append, it was never acknowledged
+			sp.logger().Warn("Ignoring the end of the superblock log", "offset", sp.sbend, "err", err)
+			break
+		}
+		if loc.size == 0 {
+			loc.off = sp.sbend
+			key, cversion = uuidkey(uuid), version
+		}
+		loc.size += int64(len(rec))
+		loc.length += length
+		sp.sbend += int64(len(rec))
+		if !more {
+			sp.indexSuperblock(key, version, loc)
+			loc = sbloc{}
+		}
+	}
+	if loc.size != 0 {
+		sp.logger().Warn("Ignoring incomplete superblock", "offset", loc.off)
+		sp.sbend = loc.off
+	}
+}
+
+func (sp *FileStorageProvider) indexSuperblock(key [16]byte, version uint64, loc sbloc) {
+	vers, ok := sp.sbidx[key]
+	if !ok {
+		vers = make(map[uint64]sbloc)
+		sp.sbidx[key] = vers
+	}
+	vers[version] = loc
+}
+
+//Encode one chunk of a superblock, more is set for all but the last
+func encodeSuperblock(uuid []byte, version uint64, data []byte, more bool) []byte {
+	rv := make([]byte, SBHEADERLEN, SBHEADERLEN+len(data)+4)
+	copy(rv, uuid)
+	binary.LittleEndian.PutUint64(rv[16:], version)
+	length := uint32(len(data))
+	if more {
+		length |= SBMORE
+	}
+	binary.LittleEndian.PutUint32(rv[24:], length)
+	rv = append(rv, data...)
+	crc := make([]byte, 4)
+	binary.LittleEndian.PutUint32(crc, crc32.Checksum(rv, crctab))
+	return append(rv, crc...)
+}
+
+//Returns the uuid, version and data of a whole record, and whether more
+//chunks follow it, checking its CRC
+func decodeSuperblock(rec []byte) ([]byte, uint64, []byte, bool, error) {
+	if len(rec) < SBHEADERLEN+4 {
+		return nil, 0, nil, false, bprovider.ErrCorrupt
+	}
+	length := binary.LittleEndian.Uint32(rec[24:])
+	more := length&SBMORE != 0
+	length &^= SBMORE
+	if len(rec) != SBHEADERLEN+int(length)+4 {
+		return nil, 0, nil, false, bprovider.ErrCorrupt
+	}
+	body := rec[:SBHEADERLEN+int(length)]
+	if crc32.Checksum(body, crctab) != binary.LittleEndian.Uint32(rec[len(body):]) {
+		return nil, 0, nil, false, bprovider.ErrCorrupt
+	}
+	return rec[:16], binary.LittleEndian.Uint64(rec[16:]), rec[SBHEADERLEN:len(body)], more, nil
+}
+
+//Decode all the chunks of a superblock, returning its version and data
+func decodeSuperblockChunks(rec []byte) (uint64, []byte, error) {
+	var data []byte
+	var uuid []byte
+	var version uint64
+	for first := true; ; first = false {
+		if len(rec) < SBHEADERLEN+4 {
+			return 0, nil, bprovider.ErrCorrupt
+		}
+		n := SBHEADERLEN + int(binary.LittleEndian.Uint32(rec[24:])&^SBMORE) + 4
+		if n > len(rec) {
+			return 0, nil, bprovider.ErrCorrupt
+		}
+		cuuid, cversion, chunk, more, err := decodeSuperblock(rec[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		if first {
+			uuid, version = cuuid, cversion
+		} else if !bytes.Equal(cuuid, uuid) || cversion != version {
+			return 0, nil, bprovider.ErrCorrupt
+		}
+		rec = rec[n:]
+		if first && !more {
+			data = chunk
+		} else {
+			data = append(data, chunk...)
+		}
+		if !more {
+			if len(rec) != 0 {
+				return 0, nil, bprovider.ErrCorrupt
+			}
+			return version, data, nil
+		}
+	}
+}
+
+// Read the given version of superblock into the buffer. Returns nil if the
+// stream has no superblock of that version. With StrictVersionReads, versions
+// above the stream's current version fail with ErrVersionRolledBack. A buffer
+// too small for the superblock gives ErrBufferTooSmall, unless
+// GrowSmallBuffers is set
+func (sp *FileStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) ([]byte, error) {
+	if err := sp.checkVersionRead(uuid, version); err != nil {
+		return nil, err
+	}
+	sp.sbmu.RLock()
+	loc, ok := sp.sbidx[uuidkey(uuid)][version]
+	sp.sbmu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if loc.length > len(buffer) {
+		if !sp.GrowSmallBuffers {
+			return nil, bprovider.ErrBufferTooSmall{Need: loc.length}
+		}
+		buffer = make([]byte, loc.length)
+	}
+	rec := make([]byte, loc.size)
+	if _, err := sp.sbf.ReadAt(rec, loc.off); err != nil {
+		sp.fatal("Problem with superblock log", "err", err)
+	}
+	_, data, err := decodeSuperblockChunks(rec)
+	if err != nil {
+		sp.fatal("Superblock is corrupt", "version", version, "offset", loc.off)
+	}
+	return buffer[:copy(buffer, data)], nil
+}
+
+//With StrictVersionReads, fail reads of versions above the current one
+func (sp *FileStorageProvider) checkVersionRead(uuid []byte, version uint64) error {
+	if sp.StrictVersionReads && version > sp.GetStreamVersion(uuid) {
+		return bprovider.ErrVersionRolledBack
+	}
+	return nil
+}
+
+// Writes a superblock of the given version, in chunks of at most SBCHUNKSIZE
+func (sp *FileStorageProvider) WriteSuperBlock(uuid []byte, version uint64, buffer []byte) {
+	if err := sp.checkWritable(); err != nil {
+		sp.fatal("Could not write superblock", "err", err)
+	}
+	sp.sbmu.Lock()
+	defer sp.sbmu.Unlock()
+	loc := sbloc{off: sp.sbend, length: len(buffer)}
+	data := buffer
+	var err error
+	for first := true; err == nil && (first || len(data) > 0); first = false {
+		n := len(data)
+		if n > SBCHUNKSIZE {
+			n = SBCHUNKSIZE
+		}
+		rec := encodeSuperblock(uuid, version, data[:n], n < len(data))
+		_, err = sp.sbf.WriteAt(rec, loc.off+loc.size)
+		loc.size += int64(len(rec))
+		data = data[n:]
+	}
+	if err == nil {
+		err = sp.sbf.Sync()
+	}
+	if err != nil {
+		sp.fatal("Could not append to superblock log", "err", err)
+	}
+	sp.indexSuperblock(uuidkey(uuid), version, loc)
+	sp.sbend += loc.size
+}
+
+//Returns the superblocks of the stream from version from to version to
+//inclusive, in version order. Versions with no superblock (for example those
+//never written again after a rollback) are skipped. Records close together in
+//the log are read with one read, rather than one read per version. With
+//StrictVersionReads, a range extending above the current version fails with
+//ErrVersionRolledBack
+func (sp *FileStorageProvider) ReadSuperBlockRange(uuid []byte, from uint64, to uint64) ([]SuperBlockEntry, error) {
+	if from > to {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	if err := sp.checkVersionRead(uuid, to); err != nil {
+		return nil, err
+	}
+	sp.sbmu.RLock()
+	vers := sp.sbidx[uuidkey(uuid)]
+	type want struct {
+		version uint64
+		loc     sbloc
+	}
+	wants := []want{}
+	if to-from < uint64(len(vers)) {
+		for v := from; v <= to; v++ {
+			if loc, ok := vers[v]; ok {
+				wants = append(wants, want{v, loc})
+			}
+		}
+	} else {
+		for v, loc := range vers {
+			if v >= from && v <= to {
+				wants = append(wants, want{v, loc})
+			}
+		}
+	}
+	sp.sbmu.RUnlock()
+	sort.Slice(wants, func(i, j int) bool { return wants[i].loc.off < wants[j].loc.off })
+	rv := make([]SuperBlockEntry, 0, len(wants))
+	for i := 0; i < len(wants); {
+		//Extend the run while the next record is close enough
+		start := wants[i].loc.off
+		end := start + wants[i].loc.size
+		j := i + 1
+		for ; j < len(wants) && wants[j].loc.off-end <= SBMAXGAP; j++ {
+			end = wants[j].loc.off + wants[j].loc.size
+		}
+		buf := make([]byte, end-start)
+		if _, err := sp.sbf.ReadAt(buf, start); err != nil {
+			return nil, err
+		}
+		for ; i < j; i++ {
+			off := wants[i].loc.off - start
+			version, data, err := decodeSuperblockChunks(buf[off : off+wants[i].loc.size])
+			if err != nil {
+				return nil, err
+			}
+			if version != wants[i].version {
+				return nil, bprovider.ErrCorrupt
+			}
+			rv = append(rv, SuperBlockEntry{Version: version, Data: data})
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool { return rv[i].Version < rv[j].Version })
+	return rv, nil
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+func TestReadSuperBlockRange(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id, other := uuid.NewRandom(), uuid.NewRandom()
+	sbdata := func(version uint64, gen byte) []byte {
+		return mkData(200, byte(version)+gen)
+	}
+	for v := uint64(1); v <= 10; v++ {
+		if v == 5 {
+			//Never written, so a gap
+			continue
+		}
+		sp.WriteSuperBlock(id, v, sbdata(v, 0))
+		sp.WriteSuperBlock(other, v, sbdata(v, 100))
+	}
+	//Roll back to 5 and write 6 and 7 again
+	sp.SetStreamVersion(id, 5)
+	sp.WriteSuperBlock(id, 6, sbdata(6, 50))
+	sp.WriteSuperBlock(id, 7, sbdata(7, 50))
+	check := func(sp *FileStorageProvider) {
+		entries, err := sp.ReadSuperBlockRange(id, 3, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []SuperBlockEntry{{3, sbdata(3, 0)}, {4, sbdata(4, 0)}, {6, sbdata(6, 50)}, {7, sbdata(7, 50)}}
+		if len(entries) != len(expected) {
+			t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+		}
+		for i, e := range entries {
+			if e.Version != expected[i].Version || !bytes.Equal(e.Data, expected[i].Data) {
+				t.Fatalf("entry %d: expected version %d, got %d", i, expected[i].Version, e.Version)
+			}
+		}
+		if got, err := sp.ReadSuperBlock(other, 6, make([]byte, 1000)); err != nil || !bytes.Equal(got, sbdata(6, 100)) {
+			t.Fatalf("the other stream's superblock was not kept")
+		}
+		if got, err := sp.ReadSuperBlock(id, 5, make([]byte, 1000)); err != nil || got != nil {
+			t.Fatalf("expected no superblock for a version never written")
+		}
+	}
+	check(sp)
+	//The index is rebuilt from the log
+	sp2 := &FileStorageProvider{}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+}
+
+func TestStrictVersionReads(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+			sp.StrictVersionReads = strict
+		})
+		id := uuid.NewRandom()
+		if err := sp.CreateStream(id, "versions", nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		for v := uint64(1); v <= 10; v++ {
+			sp.WriteSuperBlock(id, v, mkData(100, byte(v)))
+		}
+		sp.SetStreamVersion(id, 10)
+		sp.SetStreamVersion(id, 5)
+		buf := make([]byte, 1000)
+		if got, err := sp.ReadSuperBlock(id, 5, buf); err != nil || !bytes.Equal(got, mkData(100, 5)) {
+			t.Fatalf("expected the current version to be readable, got %v", err)
+		}
+		got, err := sp.ReadSuperBlock(id, 7, buf)
+		_, rerr := sp.ReadSuperBlockRange(id, 3, 7)
+		if strict {
+			if err != bprovider.ErrVersionRolledBack || rerr != bprovider.ErrVersionRolledBack {
+				t.Fatalf("expected ErrVersionRolledBack, got %v and %v", err, rerr)
+			}
+			if entries, err := sp.ReadSuperBlockRange(id, 3, 5); err != nil || len(entries) != 3 {
+				t.Fatalf("expected versions up to the current one to be readable, got %v", err)
+			}
+		} else if err != nil || rerr != nil || !bytes.Equal(got, mkData(100, 7)) {
+			//Without the policy, the stale superblock is returned
+			t.Fatalf("expected the rolled back version to be returned, got %v and %v", err, rerr)
+		}
+		os.RemoveAll(cfg.dir)
+	}
+}
+
+func TestChunkedSuperBlocks(t *testing.T) {
+	sp, cfg := mkProvider(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	rnd := rand.New(rand.NewSource(1))
+	sizes := []int{0, 100, SBCHUNKSIZE, SBCHUNKSIZE + 1, 2 * SBCHUNKSIZE, 5*SBCHUNKSIZE + 1234}
+	written := make(map[uint64][]byte)
+	for i, size := range sizes {
+		data := make([]byte, size)
+		rnd.Read(data)
+		written[uint64(i+1)] = data
+		sp.WriteSuperBlock(id, uint64(i+1), data)
+	}
+	check := func(sp *FileStorageProvider) {
+		buf := make([]byte, 6*SBCHUNKSIZE)
+		for v, data := range written {
+			got, err := sp.ReadSuperBlock(id, v, buf)
+			if err != nil || !bytes.Equal(got, data) {
+				t.Fatalf("version %d of %d bytes did not read back: %v", v, len(data), err)
+			}
+		}
+		entries, err := sp.ReadSuperBlockRange(id, 1, uint64(len(sizes)))
+		if err != nil || len(entries) != len(sizes) {
+			t.Fatalf("expected %d entries from the range, got %d (%v)", len(sizes), len(entries), err)
+		}
+		for _, e := range entries {
+			if !bytes.Equal(e.Data, written[e.Version]) {
+				t.Fatalf("version %d from the range did not match", e.Version)
+			}
+		}
+	}
+	check(sp)
+	_, err := sp.ReadSuperBlock(id, 6, make([]byte, 100))
+	if tooSmall, ok := err.(bprovider.ErrBufferTooSmall); !ok || tooSmall.Need != len(written[6]) {
+		t.Fatalf("expected ErrBufferTooSmall, got %v", err)
+	}
+	//A crash part way through a chunked write loses only that write
+	sp.WriteSuperBlock(id, 7, make([]byte, 3*SBCHUNKSIZE))
+	fi, err := os.Stat(superblockPath(cfg.dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(superblockPath(cfg.dir), fi.Size()-SBCHUNKSIZE); err != nil {
+		t.Fatal(err)
+	}
+	sp2 := &FileStorageProvider{GrowSmallBuffers: true}
+	if err := sp2.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp2.Close() })
+	check(sp2)
+	if got, err := sp2.ReadSuperBlock(id, 7, nil); err != nil || got != nil {
+		t.Fatalf("expected the torn version to be missing, got %d bytes (%v)", len(got), err)
+	}
+	sp2.WriteSuperBlock(id, 7, written[6])
+	if got, err := sp2.ReadSuperBlock(id, 7, nil); err != nil || !bytes.Equal(got, written[6]) {
+		t.Fatalf("expected the rewrite after the torn version to read back: %v", err)
+	}
+}
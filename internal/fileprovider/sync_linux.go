@@ -0,0 +1,55 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+var fdatasync = unix.Fdatasync
+
+//Blockstore files are only ever appended to, so there is no need to flush
+//their metadata (mtime) along with the data. fdatasync still flushes the
+//file size, which is all a subsequent read depends on
+func datasync(f *os.File) error {
+	return fdatasync(int(f.Fd()))
+}
+
+//Write the buffers one after another at off with pwritev, so that the
+//length prefix, data and trailer of a block go out in one call and a crash
+//is unlikely to leave a prefix without its data. A short write is continued
+//from where it stopped
+func (f osSegfile) WriteVecAt(bufs [][]byte, off int64) (int, error) {
+	total := 0
+	for _, b := range bufs {
+		total += len(b)
+	}
+	n := 0
+	for n < total {
+		m, err := unix.Pwritev(int(f.Fd()), bufs, off+int64(n))
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return n, err
+		}
+		n += m
+		for m > 0 && len(bufs) > 0 {
+			if m < len(bufs[0]) {
+				bufs[0] = bufs[0][m:]
+				break
+			}
+			m -= len(bufs[0])
+			bufs = bufs[1:]
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pborman/uuid"
+)
+
+func TestCheckpointUsesFdatasync(t *testing.T) {
+	calls := 0
+	realfdatasync := fdatasync
+	fdatasync = func(fd int) error {
+		calls++
+		return realfdatasync(fd)
+	}
+	defer func() { fdatasync = realfdatasync }()
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.SyncOnCheckpoint = true
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	_, err := seg.Write(id, seg.BaseAddress(), mkData(100, 0))
+	if err != nil {
+		t.Fatalf("unexpected write error: %v", err)
+	}
+	seg.Checkpoint()
+	seg.Unlock()
+	if calls != 1 {
+		t.Fatalf("expected one fdatasync, got %d", calls)
+	}
+}
+
+func benchmarkSync(b *testing.B, sync func(f *os.File) error) {
+	f, err := ioutil.TempFile("", "fileprovider")
+	if err != nil {
+		b.Fatalf("could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	data := mkData(4096, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := f.WriteAt(data, int64(i)*int64(len(data)))
+		if err != nil {
+			b.Fatalf("unexpected write error: %v", err)
+		}
+		if err := sync(f); err != nil {
+			b.Fatalf("unexpected sync error: %v", err)
+		}
+	}
+}
+
+func BenchmarkFsync(b *testing.B) {
+	benchmarkSync(b, func(f *os.File) error { return f.Sync() })
+}
+
+func BenchmarkFdatasync(b *testing.B) {
+	benchmarkSync(b, datasync)
+}
+
+//Hides WriteVecAt, so that each part of a block is written separately
+type plainSegfile struct {
+	segfile
+}
+
+//Write the same blocks with and without pwritev, returning the contents of
+//the file they went to
+func writeBlocks(t *testing.T, vectored bool) []byte {
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		if !vectored {
+			sp.wrapSegfile = func(f segfile) segfile {
+				return plainSegfile{f}
+			}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	if _, ok := seg.w.(vectorWriter); ok != vectored {
+		t.Fatalf("expected vectored writes to be %v", vectored)
+	}
+	addr := seg.BaseAddress()
+	for i := 0; i < 20; i++ {
+		var err error
+		if addr, err = seg.Write(id, addr, mkData(i*50, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	rv, err := ioutil.ReadFile(fmt.Sprintf("%s/blockstore.%02x.db", cfg.dir, seg.fidx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rv
+}
+
+func TestVectoredWrites(t *testing.T) {
+	if !bytes.Equal(writeBlocks(t, true), writeBlocks(t, false)) {
+		t.Fatalf("blocks written with pwritev differ from those written in parts")
+	}
+}
+
+func benchmarkWriteBlock(b *testing.B, vectored bool) {
+	f, err := ioutil.TempFile("", "fileprovider")
+	if err != nil {
+		b.Fatalf("could not create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	seg := &FileProviderSegment{sp: &FileStorageProvider{format: FormatCRC}, w: osSegfile{f}}
+	if !vectored {
+		seg.w = plainSegfile{seg.w}
+	}
+	args := writeparams{Data: mkData(1000, 0)}
+	reclen := seg.sp.recordLen(&args)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		args.Address = uint64(i) * uint64(reclen)
+		if err := seg.writeBlock(&args); err != nil {
+			b.Fatalf("unexpected write error: %v", err)
+		}
+	}
+}
+
+func BenchmarkWriteBlockPwritev(b *testing.B) {
+	benchmarkWriteBlock(b, true)
+}
+
+func BenchmarkWriteBlockWriteAt(b *testing.B) {
+	benchmarkWriteBlock(b, false)
+}
+
+func TestPreallocate(t *testing.T) {
+	const chunk = 64 << 10
+	type call struct{ off, n int64 }
+	var calls []call
+	realfallocate := fallocate
+	fallocate = func(f *os.File, off int64, n int64) error {
+		calls = append(calls, call{off, n})
+		return realfallocate(f, off, n)
+	}
+	defer func() { fallocate = realfallocate }()
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.PreallocateBytes = chunk
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id).(*FileProviderSegment)
+	allocated := func() int64 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(int(seg.f.Fd()), &st); err != nil {
+			t.Fatal(err)
+		}
+		return st.Blocks * 512
+	}
+	addr := seg.BaseAddress()
+	steps := 0
+	for i := 0; i < 200; i++ {
+		var err error
+		if addr, err = seg.Write(id, addr, mkData(1000, byte(i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := seg.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		//Space is reserved up to the chunk after the one written to
+		end := int64(addr & (1<<50 - 1))
+		if len(calls) != steps {
+			steps = len(calls)
+			if got := allocated(); got < (end/chunk+1)*chunk {
+				t.Fatalf("%d bytes allocated for a file written to %d", got, end)
+			}
+		}
+	}
+	if err := seg.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	//One chunk at a time, each following on from the last, and the file is
+	//still as long as what was written
+	end := int64(addr & (1<<50 - 1))
+	if len(calls) != int(end/chunk)+1 {
+		t.Fatalf("expected %d preallocations for a file written to %d, got %v", end/chunk+1, end, calls)
+	}
+	for i, c := range calls {
+		if c.off+c.n != int64(i+1)*chunk || (i > 0 && c.off != calls[i-1].off+calls[i-1].n) {
+			t.Fatalf("preallocation %d of %v is not the next chunk", i, calls)
+		}
+	}
+	if fi, err := seg.f.Stat(); err != nil || fi.Size() != end {
+		t.Fatalf("expected the file to be %d bytes, got %v (%v)", end, fi.Size(), err)
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+// +build !linux
+
+package fileprovider
+
+import "os"
+
+func datasync(f *os.File) error {
+	return f.Sync()
+}
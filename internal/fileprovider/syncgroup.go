@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+//Coalesces syncs of one file. A caller needs a sync that starts after it
+//asks, so while one is running, everyone who asks waits for the next, and
+//then a single sync serves all of them. With WritersPerFile several segments
+//share a file (see shared.go), and their checkpoints and flushes, as well as
+//SyncAll, come here, so syncs don't multiply with the writers
+type syncgroup struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running bool
+	//The number of syncs started and the last one finished
+	started uint64
+	done    uint64
+	err     error
+}
+
+//Run do, or wait for a run of it that started after this was called
+func (g *syncgroup) sync(do func() error) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mu)
+	}
+	want := g.started + 1
+	for g.done < want {
+		if g.running {
+			g.cond.Wait()
+			continue
+		}
+		g.running = true
+		g.started++
+		gen := g.started
+		g.mu.Unlock()
+		err := do()
+		g.mu.Lock()
+		g.running = false
+		g.done = gen
+		g.err = err
+		g.cond.Broadcast()
+	}
+	return g.err
+}
+
+//The errors from SyncAll, by file number
+type SyncErrors map[int]error
+
+func (e SyncErrors) Error() string {
+	fidxs := make([]int, 0, len(e))
+	for fidx := range e {
+		fidxs = append(fidxs, fidx)
+	}
+	sort.Ints(fidxs)
+	msg := fmt.Sprintf("could not sync %d blockstore files", len(e))
+	for _, fidx := range fidxs {
+		msg += fmt.Sprintf("; file %d: %v", fidx, e[fidx])
+	}
+	return msg
+}
+
+//Sync every blockstore file, including those no segment holds, whose blocks
+//may have been unlocked without a sync. Every file is tried even if one
+//fails. Returns nil or a SyncErrors
+func (sp *FileStorageProvider) SyncAll() error {
+	errs := make(SyncErrors)
+	for fidx := 0; fidx < sp.numfiles; fidx++ {
+		//Keep compaction from swapping the file while it is synced
+		sp.dbrf_mtx[fidx].RLock()
+		if sp.dbf[fidx] != nil {
+			err := sp.syncgroups[fidx].sync(sp.segfile(sp.dbf[fidx]).Datasync)
+			if err != nil {
+				atomic.AddUint64(&sp.errs.write[fidx], 1)
+				errs[fidx] = err
+			} else {
+				atomic.AddUint64(&sp.syncs, 1)
+			}
+		}
+		sp.dbrf_mtx[fidx].RUnlock()
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
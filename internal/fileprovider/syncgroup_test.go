@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+func TestSyncCoalescing(t *testing.T) {
+	var g syncgroup
+	var calls int32
+	release := make(chan struct{})
+	started := make(chan struct{})
+	do := func() error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		g.sync(do)
+		wg.Done()
+	}()
+	<-started
+	//These two ask while the first sync is running, so they can't rely on it,
+	//but one more sync serves them both
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			g.sync(do)
+			wg.Done()
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 syncs for 3 concurrent requests, got %d", n)
+	}
+	//Once nothing is running, a request syncs again
+	g.sync(do)
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Fatalf("expected a new sync after the others finished, got %d", n)
+	}
+}
+
+//Counts the syncs of each file by name, and fails those of the file named
+//fail
+type syncCountingSegfile struct {
+	segfile
+	mu    *sync.Mutex
+	syncs map[string]int
+	fail  *string
+}
+
+func (f *syncCountingSegfile) Datasync() error {
+	name := f.segfile.(osSegfile).Name()
+	f.mu.Lock()
+	f.syncs[name]++
+	fail := *f.fail == name
+	f.mu.Unlock()
+	if fail {
+		return syscall.EIO
+	}
+	return f.segfile.Datasync()
+}
+
+func TestSyncAll(t *testing.T) {
+	var mu sync.Mutex
+	var fail string
+	syncs := make(map[string]int)
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.wrapSegfile = func(f segfile) segfile {
+			return &syncCountingSegfile{f, &mu, syncs, &fail}
+		}
+	})
+	defer os.RemoveAll(cfg.dir)
+	id := uuid.NewRandom()
+	var addrs []uint64
+	for i := 0; i < 4; i++ {
+		addrs = append(addrs, writeOne(t, sp, id, mkData(100, byte(i))))
+	}
+	//Nothing syncs on unlock without StorageSyncOnFlush
+	if len(syncs) != 0 {
+		t.Fatalf("expected no syncs before SyncAll, got %v", syncs)
+	}
+	if err := sp.SyncAll(); err != nil {
+		t.Fatal(err)
+	}
+	if len(syncs) != sp.numfiles {
+		t.Fatalf("expected all %d files to be synced, got %d", sp.numfiles, len(syncs))
+	}
+	for i := 0; i < sp.numfiles; i++ {
+		if n := syncs[sp.dbf[i].Name()]; n != 1 {
+			t.Fatalf("expected file %d to be synced once, got %d", i, n)
+		}
+	}
+	//A failure on one file is reported, and the others are still synced
+	bad := int(addrs[2] >> 50)
+	fail = sp.dbf[bad].Name()
+	err := sp.SyncAll()
+	serr, ok := err.(SyncErrors)
+	if !ok || len(serr) != 1 || serr[bad] != syscall.EIO {
+		t.Fatalf("expected a sync error for file %d only, got %v", bad, err)
+	}
+	for i := 0; i < sp.numfiles; i++ {
+		if n := syncs[sp.dbf[i].Name()]; n != 2 {
+			t.Fatalf("expected file %d to be synced twice, got %d", i, n)
+		}
+	}
+	if n := sp.Stats().Files[bad].WriteErrors; n != 1 {
+		t.Fatalf("expected 1 write error on file %d, got %d", bad, n)
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/BTrDB/btrdb-server/internal/configprovider"
+)
+
+//A TieredStorageProvider keeps recent blocks in the blockstore files of the
+//provider it wraps and moves older ones to an ObjectStore. Migrating a file
+//uploads it, from where its last migration stopped up to its committed end,
+//as one object, and then punches that range out of the local file so it no
+//longer takes up space. Addresses don't change: reads of a migrated range
+//fetch it from the object store with a range read, and segments carry on
+//appending to the local file after it.
+//
+//The migrated ranges are listed in a manifest next to the metadata log, so
+//they are known when the provider is next initialized. Files can't be read
+//through memory mappings, a file with migrated ranges can't be compacted
+//(BeginRelocation still moves its live blocks), and Fsck, which reads the
+//files directly, does not know about migrated ranges
+type TieredStorageProvider struct {
+	*FileStorageProvider
+	Store ObjectStore
+	//If nonzero, a file whose committed end has not moved for this long is
+	//migrated in the background. Files are checked every MigrateInterval, a
+	//minute if not set
+	MigrateAfter    time.Duration
+	MigrateInterval time.Duration
+
+	manifest string
+	//Guards objects. Also held while the manifest is written, so migrations
+	//are one at a time
+	mu sync.RWMutex
+	//The migrated ranges of each file, in order, by file number
+	objects map[int][]remoteobj
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+//A migrated range of a file, and the object it is in
+type remoteobj struct {
+	File  int
+	Start int64
+	End   int64
+	Key   string
+}
+
+//What the wrapped provider needs to know about migrated ranges, see readAt
+//and recoverFile
+type remoteTier interface {
+	//Returns what to read the given file through
+	reader(fidx int, local io.ReaderAt) io.ReaderAt
+	//The end of the last migrated range of the file, or zero if none
+	migratedEnd(fidx int) int64
+}
+
+var ErrTieredMmap = errors.New("tiered storage can't read files through memory mappings")
+
+//The manifest of migrated ranges, in the metadata directory
+const TIERMANIFEST = "tiered.manifest"
+
+func (tp *TieredStorageProvider) Initialize(cfg configprovider.Configuration) error {
+	if tp.Store == nil {
+		return bprovider.ErrInvalidArgument
+	}
+	if cfg.StorageUseMmap() {
+		return ErrTieredMmap
+	}
+	tp.manifest = filepath.Join(cfg.StorageFilepath(), TIERMANIFEST)
+	if err := tp.loadManifest(); err != nil {
+		return err
+	}
+	tp.FileStorageProvider.tier = tp
+	if err := tp.FileStorageProvider.Initialize(cfg); err != nil {
+		return err
+	}
+	if tp.MigrateAfter > 0 && !tp.ReadOnly {
+		tp.stop = make(chan struct{})
+		tp.wg.Add(1)
+		go tp.migrator()
+	}
+	return nil
+}
+
+//Stop migrating in the background and close the wrapped provider
+func (tp *TieredStorageProvider) Close() error {
+	if tp.stop != nil {
+		close(tp.stop)
+		tp.wg.Wait()
+		tp.stop = nil
+	}
+	return tp.FileStorageProvider.Close()
+}
+
+func (tp *TieredStorageProvider) loadManifest() error {
+	tp.objects = make(map[int][]remoteobj)
+	body, err := ioutil.ReadFile(tp.manifest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var objs []remoteobj
+	if err := json.Unmarshal(body, &objs); err != nil {
+		return fmt.Errorf("could not read %s: %v", tp.manifest, err)
+	}
+	for _, obj := range objs {
+		tp.objects[obj.File] = append(tp.objects[obj.File], obj)
+	}
+	return nil
+}
+
+//Replace the manifest with one listing objs. Must be called with mu held
+func (tp *TieredStorageProvider) writeManifest(objs []remoteobj) error {
+	body, err := json.Marshal(objs)
+	if err != nil {
+		return err
+	}
+	tmp := tp.manifest + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, tp.fileMode)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, tp.manifest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func (tp *TieredStorageProvider) migratedEnd(fidx int) int64 {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	objs := tp.objects[fidx]
+	if len(objs) == 0 {
+		return 0
+	}
+	return objs[len(objs)-1].End
+}
+
+func (tp *TieredStorageProvider) reader(fidx int, local io.ReaderAt) io.ReaderAt {
+	tp.mu.RLock()
+	objs := tp.objects[fidx]
+	tp.mu.RUnlock()
+	if len(objs) == 0 {
+		return local
+	}
+	return &tieredFile{store: tp.Store, objs: objs, local: local}
+}
+
+//Move the blocks of the given file, from the end of its last migrated range
+//to its committed end, to the object store. The file is taken out of the
+//pool meanwhile, so this waits for any segment holding it to be unlocked
+func (tp *TieredStorageProvider) Migrate(fidx int) error {
+	sp := tp.FileStorageProvider
+	if fidx < 0 || fidx >= sp.numfiles {
+		return bprovider.ErrInvalidArgument
+	}
+	if sp.ReadOnly {
+		return bprovider.ErrReadOnly
+	}
+	sp.detachFile(fidx)
+	defer sp.reattachFile(fidx)
+	start := tp.migratedEnd(fidx)
+	if start < sp.datastart {
+		start = sp.datastart
+	}
+	end := atomic.LoadInt64(&sp.committed[fidx])
+	if end <= start {
+		return nil
+	}
+	obj := remoteobj{
+		File:  fidx,
+		Start: start,
+		End:   end,
+		Key:   fmt.Sprintf("blockstore.%02x.%x-%x", fidx, start, end),
+	}
+	//Detached, the file is neither written nor replaced while it uploads
+	if err := tp.Store.Put(obj.Key, io.NewSectionReader(sp.dbrf[fidx], start, end-start), end-start); err != nil {
+		return err
+	}
+	//Reads hold the read lock of the file, so none sees the range between
+	//it being listed and it being punched out
+	sp.dbrf_mtx[fidx].Lock()
+	defer sp.dbrf_mtx[fidx].Unlock()
+	tp.mu.Lock()
+	objs := []remoteobj{}
+	for _, fobjs := range tp.objects {
+		objs = append(objs, fobjs...)
+	}
+	if err := tp.writeManifest(append(objs, obj)); err != nil {
+		tp.mu.Unlock()
+		return err
+	}
+	tp.objects[fidx] = append(tp.objects[fidx], obj)
+	tp.mu.Unlock()
+	if err := punchHole(sp.dbf[fidx], start, end-start); err != nil {
+		sp.logger().Warn("Could not free the space of a migrated range", "file", fidx, "err", err)
+	}
+	return nil
+}
+
+//Migrate files whose committed end has not moved for MigrateAfter
+func (tp *TieredStorageProvider) migrator() {
+	defer tp.wg.Done()
+	interval := tp.MigrateInterval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	type lastwrite struct {
+		end  int64
+		when time.Time
+	}
+	last := make([]lastwrite, tp.numfiles)
+	now := time.Now()
+	for fidx := range last {
+		last[fidx] = lastwrite{atomic.LoadInt64(&tp.committed[fidx]), now}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tp.stop:
+			return
+		case now = <-ticker.C:
+		}
+		for fidx := range last {
+			end := atomic.LoadInt64(&tp.committed[fidx])
+			if end != last[fidx].end {
+				last[fidx] = lastwrite{end, now}
+				continue
+			}
+			if now.Sub(last[fidx].when) < tp.MigrateAfter || end <= tp.migratedEnd(fidx) || end <= tp.datastart {
+				continue
+			}
+			if err := tp.Migrate(fidx); err != nil {
+				tp.logger().Warn("Could not migrate blockstore file", "file", fidx, "err", err)
+			}
+		}
+	}
+}
+
+//Reads a file from the object store where it has been migrated, and from
+//the local file elsewhere
+type tieredFile struct {
+	store ObjectStore
+	objs  []remoteobj
+	local io.ReaderAt
+}
+
+func (f *tieredFile) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for n < len(b) {
+		pos := off + int64(n)
+		i := sort.Search(len(f.objs), func(i int) bool { return f.objs[i].End > pos })
+		if i == len(f.objs) || f.objs[i].Start > pos {
+			m, err := f.local.ReadAt(b[n:], pos)
+			return n + m, err
+		}
+		obj := f.objs[i]
+		chunk := b[n:]
+		if rest := obj.End - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		m, err := f.store.GetRange(obj.Key, chunk, pos-obj.Start)
+		n += m
+		if m == len(chunk) {
+			continue
+		}
+		if err == nil || err == io.EOF {
+			//The object is shorter than the range it was uploaded for
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	return n, nil
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+//An ObjectStore in memory, counting range reads
+type memObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (s *memObjectStore) Put(key string, data io.Reader, size int64) error {
+	b, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return fmt.Errorf("expected %d bytes, got %d", size, len(b))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.objects == nil {
+		s.objects = make(map[string][]byte)
+	}
+	s.objects[key] = b
+	return nil
+}
+
+func (s *memObjectStore) GetRange(key string, b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	obj, ok := s.objects[key]
+	if !ok {
+		return 0, os.ErrNotExist
+	}
+	if off >= int64(len(obj)) {
+		return 0, io.EOF
+	}
+	n := copy(b, obj[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (s *memObjectStore) getCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gets
+}
+
+func TestTieredStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileprovider")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	//A single file, so that every segment is in the migrated one
+	cfg := &testConfig{dir: dir, files: 1}
+	if err := (&FileStorageProvider{}).CreateDatabase(cfg); err != nil {
+		t.Fatal(err)
+	}
+	store := &memObjectStore{}
+	tp := &TieredStorageProvider{FileStorageProvider: &FileStorageProvider{}, Store: store}
+	if err := tp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	id := uuid.NewRandom()
+	var addrs []uint64
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, writeOne(t, tp.FileStorageProvider, id, mkData(100, byte(i))))
+	}
+	if err := tp.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.objects) != 1 {
+		t.Fatalf("expected 1 object, got %d", len(store.objects))
+	}
+	//The local copies are gone, or spoiled here in case holes can't be
+	//punched, so the blocks can only come from the object store
+	for _, a := range addrs {
+		corruptBlock(t, cfg, a, 10)
+	}
+	check := func(tp *TieredStorageProvider, addrs []uint64) {
+		for i, a := range addrs {
+			gets := store.getCount()
+			got, err := tp.Read(id, a, make([]byte, MAXBLOCKSIZE))
+			if err != nil || !bytes.Equal(got, mkData(100, byte(i))) {
+				t.Fatalf("expected block %d to read back from the object store: %v", i, err)
+			}
+			if store.getCount() == gets {
+				t.Fatalf("expected block %d to be fetched from the object store", i)
+			}
+		}
+	}
+	check(tp, addrs)
+	//Writes carry on after the migrated range, and are read locally
+	local := writeOne(t, tp.FileStorageProvider, id, mkData(100, 3))
+	if local != addrs[2]+uint64(tp.recordLen(&writeparams{Data: mkData(100, 2)})) {
+		t.Fatalf("expected the next block to follow the migrated range, got %x", local)
+	}
+	gets := store.getCount()
+	if got, err := tp.Read(id, local, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(got, mkData(100, 3)) {
+		t.Fatalf("expected the block after the migrated range to read back: %v", err)
+	}
+	if store.getCount() != gets {
+		t.Fatalf("expected the block after the migrated range to be read locally")
+	}
+	live := map[uint64]bool{local: true}
+	for _, a := range addrs {
+		live[a] = true
+	}
+	if _, err := tp.CompactFile(0, live); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("expected compacting a migrated file to be refused, got %v", err)
+	}
+	//A second migration of the file picks up where the first stopped
+	if err := tp.Migrate(0); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.objects) != 2 {
+		t.Fatalf("expected 2 objects, got %d", len(store.objects))
+	}
+	corruptBlock(t, cfg, local, 10)
+	addrs = append(addrs, local)
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	//The manifest lists the migrated ranges when the database is reopened
+	tp = &TieredStorageProvider{FileStorageProvider: &FileStorageProvider{}, Store: store}
+	if err := tp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	check(tp, addrs)
+	if err := tp.Close(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.mmap = true
+	tp = &TieredStorageProvider{FileStorageProvider: &FileStorageProvider{}, Store: store}
+	if err := tp.Initialize(cfg); err != ErrTieredMmap {
+		t.Fatalf("expected memory mapped reads to be refused, got %v", err)
+	}
+}
+
+func TestTieredMigrateAfter(t *testing.T) {
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	store := &memObjectStore{}
+	tp := &TieredStorageProvider{
+		FileStorageProvider: &FileStorageProvider{},
+		Store:               store,
+		MigrateAfter:        10 * time.Millisecond,
+		MigrateInterval:     time.Millisecond,
+	}
+	if err := tp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	defer tp.Close()
+	id := uuid.NewRandom()
+	addr := writeOne(t, tp.FileStorageProvider, id, mkData(100, 1))
+	deadline := time.Now().Add(5 * time.Second)
+	for tp.migratedEnd(int(addr>>50)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the file to be migrated once it was idle")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, err := tp.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(got, mkData(100, 1)) {
+		t.Fatalf("expected the migrated block to read back: %v", err)
+	}
+}
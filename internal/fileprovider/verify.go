@@ -0,0 +1,64 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+//Returned from the writes of a segment when a block read back with
+//StorageVerifyWrites set differs from what was written
+var ErrVerifyFailed = errors.New("block read back differs from what was written")
+
+//Whether the next block written should be read back, so that a fraction
+//VerifySampleRate of all blocks are. The choice is by count rather than at
+//random, so the fraction is exact
+func (sp *FileStorageProvider) sampleVerify() bool {
+	if sp.VerifySampleRate <= 0 {
+		return false
+	}
+	n := atomic.AddUint64(&sp.verifyseq, 1)
+	return uint64(float64(n)*sp.VerifySampleRate) != uint64(float64(n-1)*sp.VerifySampleRate)
+}
+
+//Read back a block just written by a segment and compare it to what was
+//written. A mismatch is logged and counted, and returned as ErrVerifyFailed
+//(or the error reading it back). Only with verifyWrites does it fail the
+//write, sampled blocks are written regardless
+func (seg *FileProviderSegment) verifyBlock(args *writeparams) error {
+	atomic.AddUint64(&seg.sp.verified, 1)
+	data, _, err := seg.sp.readRecord(context.Background(), args.Address, make([]byte, seg.sp.recordLen(args)+SPANHEADERLEN))
+	if err == nil && bytes.Equal(data, args.Data) {
+		return nil
+	}
+	atomic.AddUint64(&seg.sp.verifyFails, 1)
+	if err != nil {
+		seg.sp.logger().Error("Could not read back block for verification", "address", fmt.Sprintf("%x", args.Address), "err", err)
+		return err
+	}
+	seg.sp.logger().Error("Block read back differs from what was written", "address", fmt.Sprintf("%x", args.Address))
+	return ErrVerifyFailed
+}
+
+//With verifyWrites, read back a block a writer just wrote, returning the
+//error that fails the segment if it is not as written
+func (seg *FileProviderSegment) verifyWrite(args *writeparams) error {
+	if !seg.sp.verifyWrites || args.Pad {
+		return nil
+	}
+	err := seg.verifyBlock(args)
+	if err != nil {
+		atomic.AddUint64(&seg.sp.errs.write[seg.fidx], 1)
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+// +build ignore
+
+package fileprovider
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/pborman/uuid"
+)
+
+//A segfile that flips a byte of every data write longer than the length
+//prefix and trailer
+type corruptingSegfile struct {
+	segfile
+}
+
+func (f corruptingSegfile) WriteAt(b []byte, off int64) (int, error) {
+	if len(b) > 16 {
+		b = append([]byte(nil), b...)
+		b[0] ^= 0xFF
+	}
+	return f.segfile.WriteAt(b, off)
+}
+
+func TestSampledVerification(t *testing.T) {
+	write := func(sp *FileStorageProvider, n int) {
+		id := uuid.NewRandom()
+		seg := sp.LockSegment(id)
+		addr := seg.BaseAddress()
+		for i := 0; i < n; i++ {
+			var err error
+			addr, err = seg.Write(id, addr, mkData(100, byte(i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		seg.Unlock()
+	}
+	sp, cfg := mkProvider(t, func(sp *FileStorageProvider) {
+		sp.VerifySampleRate = 1
+		sp.wrapSegfile = func(f segfile) segfile {
+			return corruptingSegfile{f}
+		}
+	})
+	write(sp, 20)
+	if st := sp.Stats(); st.VerifiedBlocks != 20 || st.VerifyFailures != 20 {
+		t.Fatalf("expected all 20 corrupt blocks to be detected, got %d of %d", st.VerifyFailures, st.VerifiedBlocks)
+	}
+	os.RemoveAll(cfg.dir)
+
+	sp, cfg = mkProvider(t, func(sp *FileStorageProvider) {
+		sp.VerifySampleRate = 0.1
+	})
+	defer os.RemoveAll(cfg.dir)
+	write(sp, 200)
+	if st := sp.Stats(); st.VerifiedBlocks != 20 || st.VerifyFailures != 0 {
+		t.Fatalf("expected 20 of 200 blocks verified without failures, got %d (%d failed)", st.VerifiedBlocks, st.VerifyFailures)
+	}
+}
+
+//A reader that, while flip is set, returns the first byte of the data of a
+//record read from its start changed
+type flippingReadfile struct {
+	io.ReaderAt
+	flip *int32
+}
+
+func (f flippingReadfile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.ReaderAt.ReadAt(b, off)
+	if n > 2 && atomic.LoadInt32(f.flip) != 0 {
+		b[2] ^= 0xFF
+	}
+	return n, err
+}
+
+func TestVerifyWrites(t *testing.T) {
+	var flip int32
+	cfg := mkDatabase(t, nil)
+	defer os.RemoveAll(cfg.dir)
+	cfg.verify = true
+	sp := &FileStorageProvider{}
+	sp.wrapReadfile = func(f io.ReaderAt) io.ReaderAt {
+		return flippingReadfile{f, &flip}
+	}
+	if err := sp.Initialize(cfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sp.Close() })
+	id := uuid.NewRandom()
+	seg := sp.LockSegment(id)
+	addr := seg.BaseAddress()
+	next, err := seg.Write(id, addr, mkData(100, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.(*FileProviderSegment).Checkpoint(); err != nil {
+		t.Fatalf("a block read back as written failed verification: %v", err)
+	}
+	atomic.StoreInt32(&flip, 1)
+	if _, err := seg.Write(id, next, mkData(100, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := seg.Unlock(); err != ErrVerifyFailed {
+		t.Fatalf("expected ErrVerifyFailed for a block read back differently, got %v", err)
+	}
+	atomic.StoreInt32(&flip, 0)
+	fidx, _ := bprovider.DecodeAddress(addr)
+	st := sp.Stats()
+	if st.VerifiedBlocks != 2 || st.VerifyFailures != 1 || st.Files[fidx].WriteErrors != 1 {
+		t.Fatalf("expected 1 of 2 blocks to fail verification as a write error, got %d of %d, %+v", st.VerifyFailures, st.VerifiedBlocks, st.Files[fidx])
+	}
+	if data, err := sp.Read(id, addr, make([]byte, MAXBLOCKSIZE)); err != nil || !bytes.Equal(data, mkData(100, 1)) {
+		t.Fatalf("the verified block was lost: %v", err)
+	}
+}
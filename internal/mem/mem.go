@@ -0,0 +1,309 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+//Package mem is a storage provider that keeps everything in memory, for
+//tests that need a backend but not a database directory. It has the same
+//methods as the file provider and the same address layout: the top bits
+//are a file index and the low bits an offset in that file, see
+//bprovider.EncodeAddress
+package mem
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+)
+
+//The number of files if NumFiles is not set
+const NUMFILES = 16
+
+//Each file starts with this many unused bytes, so that no block is at
+//address zero
+const DATASTART = 8
+
+//Blocks are stored with a four byte length prefix
+const PREFIXLEN = 4
+
+//A file must end before the offset runs into the file index
+const MAXFILESIZE = bprovider.ADDRESSOFFSETMASK
+
+//A storage provider backed by byte slices. The zero value is ready to use
+type MemStorageProvider struct {
+	//The number of files, and so the number of segments that can be locked
+	//at once. NUMFILES if zero. Must be set before first use
+	NumFiles int
+
+	once sync.Once
+	mu   sync.Mutex
+	//Signalled when a segment is unlocked
+	cond   *sync.Cond
+	files  [][]byte
+	locked []bool
+
+	metamu   sync.RWMutex
+	streams  map[[16]byte]*bprovider.Stream
+	versions map[[16]byte]uint64
+	sbs      map[[16]byte]map[uint64][]byte
+}
+
+type MemSegment struct {
+	sp   *MemStorageProvider
+	fidx int
+	base uint64
+	ptr  uint64
+	//Set once unlocked, after which writes fail
+	unlocked bool
+}
+
+func (sp *MemStorageProvider) init() {
+	sp.once.Do(func() {
+		n := sp.NumFiles
+		if n <= 0 {
+			n = NUMFILES
+		}
+		sp.cond = sync.NewCond(&sp.mu)
+		sp.files = make([][]byte, n)
+		for i := range sp.files {
+			sp.files[i] = make([]byte, DATASTART)
+		}
+		sp.locked = make([]bool, n)
+		sp.streams = make(map[[16]byte]*bprovider.Stream)
+		sp.versions = make(map[[16]byte]uint64)
+		sp.sbs = make(map[[16]byte]map[uint64][]byte)
+	})
+}
+
+func uuidkey(uuid []byte) [16]byte {
+	var rv [16]byte
+	copy(rv[:], uuid)
+	return rv
+}
+
+//Lock the least full file that is not locked, blocking until there is one
+func (sp *MemStorageProvider) LockSegment(uuid []byte) bprovider.Segment {
+	sp.init()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for {
+		minidx := -1
+		for i, f := range sp.files {
+			if !sp.locked[i] && (minidx == -1 || len(f) < len(sp.files[minidx])) {
+				minidx = i
+			}
+		}
+		if minidx != -1 {
+			sp.locked[minidx] = true
+			base := bprovider.EncodeAddress(minidx, int64(len(sp.files[minidx])))
+			return &MemSegment{sp: sp, fidx: minidx, base: base, ptr: base}
+		}
+		sp.cond.Wait()
+	}
+}
+
+//Returns the address of the first block written to the segment
+func (seg *MemSegment) BaseAddress() uint64 {
+	return seg.base
+}
+
+//Writes the block at the given address, which must be the one returned by
+//the previous write (or BaseAddress). Returns the address of the next block.
+//Fails with ErrNoSpace if the block would take the file past MAXFILESIZE
+func (seg *MemSegment) Write(uuid []byte, address uint64, data []byte) (uint64, error) {
+	if seg.unlocked || address != seg.ptr || uint64(len(data)) > 0xFFFFFFFF {
+		return 0, bprovider.ErrInvalidArgument
+	}
+	_, off := bprovider.DecodeAddress(address)
+	end := off + PREFIXLEN + int64(len(data))
+	if end > MAXFILESIZE {
+		return 0, bprovider.ErrNoSpace
+	}
+	n := len(data)
+	seg.sp.mu.Lock()
+	seg.sp.files[seg.fidx] = append(seg.sp.files[seg.fidx], byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	seg.sp.files[seg.fidx] = append(seg.sp.files[seg.fidx], data...)
+	seg.sp.mu.Unlock()
+	seg.ptr = bprovider.EncodeAddress(seg.fidx, end)
+	return seg.ptr, nil
+}
+
+//Writes are done as they are made, so there is nothing to wait for
+func (seg *MemSegment) Flush() error {
+	return nil
+}
+
+//Makes the file available to LockSegment again
+func (seg *MemSegment) Unlock() error {
+	if seg.unlocked {
+		return bprovider.ErrInvalidArgument
+	}
+	seg.unlocked = true
+	seg.sp.mu.Lock()
+	seg.sp.locked[seg.fidx] = false
+	seg.sp.cond.Signal()
+	seg.sp.mu.Unlock()
+	return nil
+}
+
+//Read the block at the given address into the buffer. Returns ErrNoBlock for
+//address zero, ErrInvalidArgument for an address no block was written to
+//and ErrBufferTooSmall if the buffer can't hold the block
+func (sp *MemStorageProvider) Read(uuid []byte, address uint64, buffer []byte) ([]byte, error) {
+	sp.init()
+	if address == 0 {
+		return nil, bprovider.ErrNoBlock
+	}
+	fidx, off := bprovider.DecodeAddress(address)
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if fidx >= len(sp.files) || off < DATASTART || off+PREFIXLEN > int64(len(sp.files[fidx])) {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	f := sp.files[fidx][off:]
+	n := int(f[0]) | int(f[1])<<8 | int(f[2])<<16 | int(f[3])<<24
+	if PREFIXLEN+n > len(f) {
+		return nil, bprovider.ErrInvalidArgument
+	}
+	if n > len(buffer) {
+		return nil, bprovider.ErrBufferTooSmall{Need: n}
+	}
+	return buffer[:copy(buffer, f[PREFIXLEN:PREFIXLEN+n])], nil
+}
+
+//Read the given version of superblock into the buffer. Returns nil if the
+//stream has no superblock of that version
+func (sp *MemStorageProvider) ReadSuperBlock(uuid []byte, version uint64, buffer []byte) ([]byte, error) {
+	sp.init()
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	sb, ok := sp.sbs[uuidkey(uuid)][version]
+	if !ok {
+		return nil, nil
+	}
+	if len(sb) > len(buffer) {
+		return nil, bprovider.ErrBufferTooSmall{Need: len(sb)}
+	}
+	return buffer[:copy(buffer, sb)], nil
+}
+
+//Writes a superblock of the given version, replacing any there was
+func (sp *MemStorageProvider) WriteSuperBlock(uuid []byte, version uint64, buffer []byte) {
+	sp.init()
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	key := uuidkey(uuid)
+	if sp.sbs[key] == nil {
+		sp.sbs[key] = make(map[uint64][]byte)
+	}
+	sp.sbs[key][version] = append([]byte(nil), buffer...)
+}
+
+//Sets the version of a stream. As with the file provider, it may go back,
+//and the versions after it can then be written again
+func (sp *MemStorageProvider) SetStreamVersion(uuid []byte, version uint64) {
+	sp.init()
+	sp.metamu.Lock()
+	sp.versions[uuidkey(uuid)] = version
+	sp.metamu.Unlock()
+}
+
+//Gets the version of a stream. Returns 0 if none exists
+func (sp *MemStorageProvider) GetStreamVersion(uuid []byte) uint64 {
+	sp.init()
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	return sp.versions[uuidkey(uuid)]
+}
+
+//Makes a stream with the given uuid, collection and tags. Returns a
+//StreamExists error if the uuid already exists
+func (sp *MemStorageProvider) CreateStream(uuid []byte, collection string, tags map[string]string, annotation []byte) bte.BTE {
+	sp.init()
+	if len(annotation) > bprovider.MaxAnnotationSize {
+		return bte.Err(bte.AnnotationTooBig, "annotation too big")
+	}
+	sp.metamu.Lock()
+	defer sp.metamu.Unlock()
+	key := uuidkey(uuid)
+	if _, ok := sp.streams[key]; ok {
+		return bte.Err(bte.StreamExists, "stream already exists")
+	}
+	s := &bprovider.Stream{
+		UUID:       append([]byte(nil), uuid...),
+		Collection: collection,
+		Tags:       make(map[string]string, len(tags)),
+		Annotation: append([]byte(nil), annotation...),
+	}
+	for k, v := range tags {
+		s.Tags[k] = v
+	}
+	sp.streams[key] = s
+	return nil
+}
+
+//Gets the catalog entry and version of a stream. The entry has a nil UUID
+//if the stream does not exist, and the version is 0 if it has none
+func (sp *MemStorageProvider) GetStreamInfo(uuid []byte) (bprovider.Stream, uint64) {
+	sp.init()
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	key := uuidkey(uuid)
+	if s, ok := sp.streams[key]; ok {
+		return *s, sp.versions[key]
+	}
+	return bprovider.Stream{}, sp.versions[key]
+}
+
+//Lists the streams in a collection that have all of the given tags. If
+//partial is false, the streams must have no other tags and at most one may
+//match, otherwise the result is an AmbiguousTags error
+func (sp *MemStorageProvider) ListStreams(collection string, partial bool, tags map[string]string) ([]bprovider.Stream, bte.BTE) {
+	sp.init()
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	rv := []bprovider.Stream{}
+outer:
+	for _, s := range sp.streams {
+		if s.Collection != collection || (!partial && len(s.Tags) != len(tags)) {
+			continue
+		}
+		for k, v := range tags {
+			if sv, ok := s.Tags[k]; !ok || sv != v {
+				continue outer
+			}
+		}
+		rv = append(rv, *s)
+	}
+	if !partial && len(rv) > 1 {
+		return nil, bte.Err(bte.AmbiguousTags, "tags do not identify a single stream")
+	}
+	return rv, nil
+}
+
+//Returns the collections beginning with prefix, in order, from startingFrom
+//inclusive. If number is > 0, only that many are returned
+func (sp *MemStorageProvider) ListCollections(prefix string, startingFrom string, number int64) ([]string, bte.BTE) {
+	sp.init()
+	sp.metamu.RLock()
+	defer sp.metamu.RUnlock()
+	found := make(map[string]struct{})
+	for _, s := range sp.streams {
+		if s.Collection >= startingFrom && strings.HasPrefix(s.Collection, prefix) {
+			found[s.Collection] = struct{}{}
+		}
+	}
+	rv := make([]string, 0, len(found))
+	for c := range found {
+		rv = append(rv, c)
+	}
+	sort.Strings(rv)
+	if number > 0 && int64(len(rv)) > number {
+		rv = rv[:number]
+	}
+	return rv, nil
+}
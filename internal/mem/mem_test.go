@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Michael Andersen
+// Copyright (c) 2021 Regents of the University Of California
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file or at
+// https://opensource.org/licenses/MIT.
+
+package mem
+
+import (
+	"context"
+	"testing"
+
+	"github.com/BTrDB/btrdb-server/bte"
+	"github.com/BTrDB/btrdb-server/internal/bprovider"
+	"github.com/BTrDB/btrdb-server/internal/bprovider/bprovidertest"
+	"github.com/BTrDB/btrdb-server/internal/configprovider"
+	"github.com/BTrDB/btrdb-server/internal/rez"
+)
+
+//Presents the memory provider as a bprovider.StorageProvider. It has nothing
+//like ObliterateStreamMetadata or BackgroundCleanup, so those panic, and it
+//doesn't opt in to the cases of the conformance suite that call them
+type storageProvider struct {
+	*MemStorageProvider
+}
+
+func (sp storageProvider) Initialize(cfg configprovider.Configuration, rm *rez.RezManager) {
+}
+
+func (sp storageProvider) CreateDatabase(cfg configprovider.Configuration, overwrite bool) error {
+	return nil
+}
+
+func (sp storageProvider) LockCoreSegment(uuid []byte) bprovider.Segment {
+	return sp.LockSegment(uuid)
+}
+
+func (sp storageProvider) LockVectorSegment(uuid []byte) bprovider.Segment {
+	return sp.LockSegment(uuid)
+}
+
+func (sp storageProvider) Read(ctx context.Context, uuid []byte, address uint64, buffer []byte) ([]byte, error) {
+	return sp.MemStorageProvider.Read(uuid, address, buffer)
+}
+
+func (sp storageProvider) ReadSuperBlock(ctx context.Context, uuid []byte, version uint64, buffer []byte) ([]byte, error) {
+	return sp.MemStorageProvider.ReadSuperBlock(uuid, version, buffer)
+}
+
+func (sp storageProvider) GetStreamVersion(ctx context.Context, uuid []byte) (uint64, error) {
+	return sp.MemStorageProvider.GetStreamVersion(uuid), nil
+}
+
+func (sp storageProvider) ObliterateStreamMetadata(uuid []byte) {
+	panic("not implemented")
+}
+
+func (sp storageProvider) BackgroundCleanup(uuids [][]byte) error {
+	panic("not implemented")
+}
+
+func TestConformance(t *testing.T) {
+	bprovidertest.RunConformance(t, func() bprovider.StorageProvider {
+		return storageProvider{&MemStorageProvider{}}
+	})
+}
+
+func TestAddressLayout(t *testing.T) {
+	sp := &MemStorageProvider{NumFiles: 3}
+	var segs []bprovider.Segment
+	seen := make(map[int]bool)
+	for i := 0; i < 3; i++ {
+		seg := sp.LockSegment(nil)
+		fidx, off := bprovider.DecodeAddress(seg.BaseAddress())
+		if fidx >= 3 || seen[fidx] || off != DATASTART {
+			t.Fatalf("segment %d has base address %x", i, seg.BaseAddress())
+		}
+		seen[fidx] = true
+		segs = append(segs, seg)
+	}
+	next, err := segs[0].Write(nil, segs[0].BaseAddress(), make([]byte, 10))
+	if err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if next != segs[0].BaseAddress()+PREFIXLEN+10 {
+		t.Fatalf("next address is %x", next)
+	}
+	if _, err := segs[0].Write(nil, segs[0].BaseAddress(), nil); err != bprovider.ErrInvalidArgument {
+		t.Fatalf("write at a used address gave %v", err)
+	}
+	//All files are locked, so this waits for an unlock
+	got := make(chan bprovider.Segment)
+	go func() { got <- sp.LockSegment(nil) }()
+	segs[1].Unlock()
+	if seg := <-got; seg.BaseAddress() != segs[1].BaseAddress() {
+		t.Fatalf("got base address %x after unlocking %x", seg.BaseAddress(), segs[1].BaseAddress())
+	}
+}
+
+//Annotation limits are not part of the conformance suite
+func TestAnnotationTooBig(t *testing.T) {
+	sp := &MemStorageProvider{}
+	big := make([]byte, bprovider.MaxAnnotationSize+1)
+	if err := sp.CreateStream([]byte("cccccccccccccccc"), "x/q", nil, big); err == nil || err.Code() != bte.AnnotationTooBig {
+		t.Fatalf("creating a stream with a big annotation gave %v", err)
+	}
+	if s, _ := sp.GetStreamInfo([]byte("cccccccccccccccc")); s.UUID != nil {
+		t.Fatalf("stream with a big annotation was created: %v", s)
+	}
+}